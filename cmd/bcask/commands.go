@@ -0,0 +1,349 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sayuyere/bcask/internal/consts"
+	"github.com/sayuyere/bcask/internal/db"
+	"github.com/sayuyere/bcask/internal/dump"
+	"github.com/sayuyere/bcask/internal/index"
+	"github.com/sayuyere/bcask/internal/item"
+	"github.com/sayuyere/bcask/internal/redisimport"
+	"github.com/sayuyere/bcask/internal/segment"
+	"github.com/sayuyere/bcask/internal/uuid"
+)
+
+// open loads the existing database in dir, failing with
+// consts.ErrorDatabaseNotFound if there is none. Commands that only read
+// open it read-only, so they work next to other readers and never create
+// files.
+func open(dir string, readOnly bool) (*db.Bcask, error) {
+	dir = filepath.Clean(dir)
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	var opts []db.Option
+	if readOnly {
+		opts = append(opts, db.WithReadOnly())
+	}
+	return db.Load(filepath.Dir(dir), filepath.Base(dir), opts...)
+}
+
+func openReadOnly(dir string) (*db.Bcask, error) { return open(dir, true) }
+
+func openWritable(dir string) (*db.Bcask, error) { return open(dir, false) }
+
+// openOrCreate is openWritable for commands asked to create the database
+// in dir if it holds none.
+func openOrCreate(dir string) (*db.Bcask, error) {
+	dir = filepath.Clean(dir)
+	return db.Open(filepath.Dir(dir), filepath.Base(dir))
+}
+
+// withDB parses flags, opens the database named by the first argument with
+// openDB and runs fn with the remaining arguments, which must number exactly
+// nargs.
+func withDB(name string, fs *flag.FlagSet, args []string, nargs int, openDB func(dir string) (*db.Bcask, error), stderr io.Writer, fn func(b *db.Bcask, args []string) error) int {
+	if fs == nil {
+		fs = flag.NewFlagSet(name, flag.ContinueOnError)
+	}
+	fs.SetOutput(stderr)
+	if err := fs.Parse(args); err != nil || fs.NArg() != nargs+1 {
+		return badUsage(stderr, name)
+	}
+	b, err := openDB(fs.Arg(0))
+	if err != nil {
+		return fail(stderr, name, err)
+	}
+	err = fn(b, fs.Args()[1:])
+	if closeErr := b.Close(); err == nil {
+		err = closeErr
+	}
+	if errors.Is(err, consts.ErrorKeyNotFound) {
+		fmt.Fprintf(stderr, "bcask %s: %v\n", name, err)
+		return 1
+	}
+	if err != nil {
+		return fail(stderr, name, err)
+	}
+	return 0
+}
+
+func runGet(args []string, stdout, stderr io.Writer) int {
+	return withDB("get", nil, args, 1, openReadOnly, stderr, func(b *db.Bcask, args []string) error {
+		value, err := b.Get(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, value)
+		return nil
+	})
+}
+
+func runPut(args []string, stdout, stderr io.Writer) int {
+	return withDB("put", nil, args, 2, openWritable, stderr, func(b *db.Bcask, args []string) error {
+		return b.Put(args[0], args[1])
+	})
+}
+
+func runDelete(args []string, stdout, stderr io.Writer) int {
+	return withDB("delete", nil, args, 1, openWritable, stderr, func(b *db.Bcask, args []string) error {
+		if _, err := b.Get(args[0]); err != nil {
+			return err
+		}
+		return b.Delete(args[0])
+	})
+}
+
+func runKeys(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("keys", flag.ContinueOnError)
+	prefix := fs.String("prefix", "", "only list keys starting with `P`")
+	return withDB("keys", fs, args, 0, openReadOnly, stderr, func(b *db.Bcask, args []string) error {
+		keys, err := b.ListKeysWithPrefix(*prefix)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			fmt.Fprintln(stdout, key)
+		}
+		return nil
+	})
+}
+
+func runScan(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("scan", flag.ContinueOnError)
+	prefix := fs.String("prefix", "", "only scan keys starting with `P`")
+	return withDB("scan", fs, args, 0, openReadOnly, stderr, func(b *db.Bcask, args []string) error {
+		return b.Scan(*prefix, func(key, value string) error {
+			_, err := fmt.Fprintf(stdout, "%s\t%s\n", key, value)
+			return err
+		})
+	})
+}
+
+// runExport writes the live keys and values to stdout.
+func runExport(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fs.String("format", string(dump.FormatJSONL), "write `F`: jsonl, csv or native")
+	prefix := fs.String("prefix", "", "only export keys starting with `P`")
+	return withDB("export", fs, args, 0, openReadOnly, stderr, func(b *db.Bcask, args []string) error {
+		f, err := dump.ParseFormat(*format)
+		if err != nil {
+			return err
+		}
+		_, err = dump.Export(b, stdout, f, *prefix)
+		return err
+	})
+}
+
+// runImport puts the pairs of an export into the database; "-" reads them
+// from stdin. With --create a new database is made if DIR holds none.
+func runImport(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := fs.String("format", string(dump.FormatJSONL), "read `F`: jsonl, csv or native")
+	create := fs.Bool("create", false, "create the database if DIR holds none")
+	openDB := func(dir string) (*db.Bcask, error) {
+		if *create {
+			return openOrCreate(dir)
+		}
+		return openWritable(dir)
+	}
+	return withDB("import", fs, args, 1, openDB, stderr, func(b *db.Bcask, args []string) error {
+		f, err := dump.ParseFormat(*format)
+		if err != nil {
+			return err
+		}
+		in := stdin
+		if args[0] != "-" {
+			file, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			in = file
+		}
+		n, err := dump.Import(b, in, f)
+		fmt.Fprintf(stdout, "imported %d keys\n", n)
+		return err
+	})
+}
+
+// runImportRedis loads a Redis RDB snapshot, or with --aof an append-only
+// file or directory, into a new database.
+func runImportRedis(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("import-redis", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	aof := fs.Bool("aof", false, "read an append-only file or directory instead of an RDB file")
+	database := fs.Int("db", 0, "import Redis database `N`, or -1 for all of them")
+	prefix := fs.String("prefix", "", "prepend `P` to every key")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 2 {
+		return badUsage(stderr, "import-redis")
+	}
+	dir := filepath.Clean(fs.Arg(1))
+	l, err := db.NewBulkLoader(filepath.Dir(dir), filepath.Base(dir))
+	if err != nil {
+		return fail(stderr, "import-redis", err)
+	}
+	opts := redisimport.Options{Database: *database, Prefix: *prefix}
+	var stats redisimport.Stats
+	if *aof {
+		stats, err = redisimport.ImportAOF(l, fs.Arg(0), opts)
+	} else {
+		var f *os.File
+		if f, err = os.Open(fs.Arg(0)); err == nil {
+			stats, err = redisimport.ImportRDB(l, f, opts)
+			f.Close()
+		}
+	}
+	if closeErr := l.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fail(stderr, "import-redis", err)
+	}
+	fmt.Fprintf(stdout, "imported %d keys: %d strings, %d hashes, %d lists, %d sets\n",
+		stats.Imported(), stats.Strings, stats.Hashes, stats.Lists, stats.Sets)
+	if stats.Expired+stats.Skipped > 0 {
+		fmt.Fprintf(stdout, "left out %d expired keys and %d keys of other types or with binary names\n", stats.Expired, stats.Skipped)
+	}
+	if stats.Lossy > 0 {
+		fmt.Fprintf(stdout, "%d keys held bytes that are not UTF-8, replaced in their JSON\n", stats.Lossy)
+	}
+	if stats.Truncated {
+		fmt.Fprintln(stdout, "the AOF ends inside a command, which was dropped")
+	}
+	return 0
+}
+
+func runStats(args []string, stdout, stderr io.Writer) int {
+	return withDB("stats", nil, args, 0, openReadOnly, stderr, func(b *db.Bcask, args []string) error {
+		s := b.Stats()
+		fmt.Fprintf(stdout, "keys:          %d\n", s.Keys)
+		fmt.Fprintf(stdout, "segments:      %d\n", len(s.Segments))
+		fmt.Fprintf(stdout, "live bytes:    %d\n", s.LiveBytes)
+		fmt.Fprintf(stdout, "dead bytes:    %d (%.1f%%)\n", s.DeadBytes, 100*s.DeadRatio())
+		fmt.Fprintf(stdout, "index memory:  %d\n\n", s.IndexMemoryBytes)
+		w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(w, "segment\tused\tlive\tdead\tdead %\t")
+		for _, seg := range s.Segments {
+			id := strconv.FormatInt(seg.ID, 10)
+			if seg.Active {
+				id += "*"
+			}
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%.1f\t\n", id, seg.BytesUsed, seg.LiveBytes, seg.DeadBytes, 100*seg.DeadRatio())
+		}
+		return w.Flush()
+	})
+}
+
+func runMerge(args []string, stdout, stderr io.Writer) int {
+	return withDB("merge", nil, args, 0, openWritable, stderr, func(b *db.Bcask, args []string) error {
+		if err := b.Merge(); err != nil {
+			return err
+		}
+		merges := b.Stats().Merges
+		if len(merges) == 0 {
+			fmt.Fprintln(stdout, "nothing to merge")
+			return nil
+		}
+		m := merges[len(merges)-1]
+		fmt.Fprintf(stdout, "merged segments %v into %d, moved %d records, reclaimed %d bytes in %v\n",
+			m.SegmentsIn, m.SegmentsOut, m.RecordsMoved, m.BytesReclaimed, m.Duration.Round(time.Millisecond))
+		return nil
+	})
+}
+
+// runDumpSegment prints the header and every record of one segment file.
+// The file is mapped read-only and the database is not opened.
+func runDumpSegment(args []string, stdout, stderr io.Writer) int {
+	if len(args) != 2 {
+		return badUsage(stderr, "dump-segment")
+	}
+	id, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return badUsage(stderr, "dump-segment")
+	}
+	seg, err := segment.OpenFileSegment(args[0], id, uuid.Nil, segment.Options{ReadOnly: true})
+	if err != nil {
+		return fail(stderr, "dump-segment", err)
+	}
+	defer seg.OSFile.Close()
+	defer seg.Close()
+
+	h := seg.Header
+	fmt.Fprintf(stdout, "segment %d version %d database %s created %s\n",
+		h.SegmentID, h.Version, h.DatabaseID, time.Unix(0, h.CreatedAt).UTC().Format(time.RFC3339))
+	w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "offset\ttimestamp\tsize\tkey\tvalue size\texpires\t")
+	end, err := seg.Scan(seg.DataStart(), func(offset int64, kv item.DiskKV) error {
+		stamp := "deleted"
+		if kv.Timestamp != 0 {
+			stamp = strconv.FormatInt(kv.Timestamp, 10)
+		}
+		valueSize := strconv.FormatInt(kv.ValueSize, 10)
+		if kv.Tombstone {
+			valueSize = "tombstone"
+		}
+		_, err := fmt.Fprintf(w, "%d\t%s\t%d\t%q\t%s\t%s\t\n", offset, stamp, kv.EncodedSize(), kv.Key, valueSize, expiry(kv.ExpiresAt))
+		return err
+	})
+	w.Flush()
+	if err != nil {
+		return fail(stderr, "dump-segment", err)
+	}
+	fmt.Fprintf(stdout, "end offset %d\n", end)
+	return 0
+}
+
+// runDumpIndex prints the header and entries of index_file.
+func runDumpIndex(args []string, stdout, stderr io.Writer) int {
+	if len(args) != 1 {
+		return badUsage(stderr, "dump-index")
+	}
+	f, err := os.Open(filepath.Join(args[0], consts.IndexFileName))
+	if err != nil {
+		return fail(stderr, "dump-index", err)
+	}
+	defer f.Close()
+	r, err := index.NewReader(f)
+	if err != nil {
+		return fail(stderr, "dump-index", err)
+	}
+	h := r.Header()
+	fmt.Fprintf(stdout, "index version %d flags %#x checkpoint segment %d offset %d\n",
+		h.Version, h.Flags, h.CheckpointSegment, h.CheckpointOffset)
+	w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "key\tsegment\toffset\tvalue size\ttimestamp\texpires\t")
+	entries := 0
+	for {
+		key, value, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			w.Flush()
+			return fail(stderr, "dump-index", err)
+		}
+		fmt.Fprintf(w, "%q\t%d\t%d\t%d\t%d\t%s\t\n", key, value.FileID, value.Offset, value.ValueSize, value.Timestamp, expiry(value.ExpiresAt))
+		entries++
+	}
+	w.Flush()
+	fmt.Fprintf(stdout, "%d entries\n", entries)
+	return 0
+}
+
+// expiry formats an expiry in unix milliseconds, "-" for none.
+func expiry(ms int64) string {
+	if ms == 0 {
+		return "-"
+	}
+	return time.UnixMilli(ms).UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/sayuyere/bcask/internal/fsck"
+)
+
+func runFsck(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	repair := fs.Bool("repair", false, "zero torn segment tails and rebuild the index")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return badUsage(stderr, "fsck")
+	}
+
+	report, err := fsck.Check(fs.Arg(0), fsck.Options{Repair: *repair})
+	if err != nil {
+		return fail(stderr, "fsck", err)
+	}
+	for _, p := range report.Problems {
+		fmt.Fprintln(stdout, p)
+	}
+	for _, r := range report.Repairs {
+		fmt.Fprintln(stdout, "repaired:", r)
+	}
+	fmt.Fprintf(stdout, "%d segments, %d records, %d live keys, %d problems\n",
+		report.Segments, report.Records, report.LiveKeys, len(report.Problems))
+	if !report.OK() && !*repair {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,82 @@
+// Command bcask inspects and maintains bcask database directories.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+type command struct {
+	usage string
+	run   func(args []string, stdout, stderr io.Writer) int
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"get":          {"get DIR KEY", runGet},
+		"put":          {"put DIR KEY VALUE", runPut},
+		"delete":       {"delete DIR KEY", runDelete},
+		"keys":         {"keys [--prefix P] DIR", runKeys},
+		"scan":         {"scan [--prefix P] DIR", runScan},
+		"export":       {"export [--format jsonl|csv|native] [--prefix P] DIR", runExport},
+		"import":       {"import [--format jsonl|csv|native] [--create] DIR FILE|-", runImport},
+		"import-redis": {"import-redis [--aof] [--db N] [--prefix P] SRC DIR", runImportRedis},
+		"stats":        {"stats DIR", runStats},
+		"merge":        {"merge DIR", runMerge},
+		"dump-segment": {"dump-segment DIR N", runDumpSegment},
+		"dump-index":   {"dump-index DIR", runDumpIndex},
+		"fsck":         {"fsck [--repair] DIR", runFsck},
+		"shell":        {"shell [--read-only] DIR", runShell},
+		"serve":        {"serve [--resp [--addr HOST:PORT | --unix PATH]] [--http [--http-addr HOST:PORT]] [--replicate-addr HOST:PORT] [--follow HOST:PORT | --read-only] [--create] DIR", runServe},
+	}
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run dispatches to a subcommand and returns the process exit code: 0 on
+// success, 1 when the command ran but found a problem, 2 on usage or I/O
+// errors.
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		usage(stderr)
+		return 2
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "bcask: unknown command %q\n", args[0])
+		usage(stderr)
+		return 2
+	}
+	return cmd.run(args[1:], stdout, stderr)
+}
+
+// badUsage prints the usage line of one command and returns the exit code
+// for usage errors.
+func badUsage(stderr io.Writer, name string) int {
+	fmt.Fprintln(stderr, "usage: bcask", commands[name].usage)
+	return 2
+}
+
+// fail reports err for a command and returns the exit code for errors.
+func fail(stderr io.Writer, name string, err error) int {
+	fmt.Fprintf(stderr, "bcask %s: %v\n", name, err)
+	return 2
+}
+
+func usage(w io.Writer) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "usage:")
+	for _, name := range names {
+		fmt.Fprintf(w, "  bcask %s\n", commands[name].usage)
+	}
+}
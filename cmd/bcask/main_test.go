@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sayuyere/bcask/internal/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func runCmd(args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := run(args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestCommands(t *testing.T) {
+	root := t.TempDir()
+	b, err := db.Open(root, "cli_db")
+	require.NoError(t, err)
+	require.NoError(t, b.Put("k", "v"))
+	require.NoError(t, b.Close())
+	dir := filepath.Join(root, "cli_db")
+
+	t.Run("usage", func(t *testing.T) {
+		code, _, stderr := runCmd()
+		assert.Equal(t, 2, code)
+		assert.Contains(t, stderr, "bcask fsck")
+
+		code, _, stderr = runCmd("nope")
+		assert.Equal(t, 2, code)
+		assert.Contains(t, stderr, `unknown command "nope"`)
+	})
+
+	t.Run("put get delete", func(t *testing.T) {
+		code, _, _ := runCmd("put", dir, "user/1", "alice")
+		assert.Equal(t, 0, code)
+		code, _, _ = runCmd("put", dir, "user/2", "bob")
+		assert.Equal(t, 0, code)
+
+		code, stdout, _ := runCmd("get", dir, "user/1")
+		assert.Equal(t, 0, code)
+		assert.Equal(t, "alice\n", stdout)
+
+		code, _, _ = runCmd("delete", dir, "user/1")
+		assert.Equal(t, 0, code)
+		code, _, stderr := runCmd("get", dir, "user/1")
+		assert.Equal(t, 1, code)
+		assert.Contains(t, stderr, "key not found")
+		code, _, _ = runCmd("delete", dir, "user/1")
+		assert.Equal(t, 1, code)
+
+		code, _, stderr = runCmd("put", dir, "only-key")
+		assert.Equal(t, 2, code)
+		assert.Contains(t, stderr, "usage: bcask put DIR KEY VALUE")
+	})
+
+	t.Run("directory without a database", func(t *testing.T) {
+		plain := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(plain, "notes.txt"), []byte("not a database"), 0666))
+		for _, args := range [][]string{
+			{"put", plain, "k", "v"},
+			{"get", plain, "k"},
+			{"merge", plain},
+			{"import", plain, "-"},
+			{"shell", plain},
+		} {
+			code, _, stderr := runCmd(args...)
+			assert.Equal(t, 2, code, args)
+			assert.Contains(t, stderr, "no database in directory", args)
+		}
+		entries, err := os.ReadDir(plain)
+		require.NoError(t, err)
+		require.Len(t, entries, 1, "the directory must be left untouched")
+		assert.Equal(t, "notes.txt", entries[0].Name())
+
+		stdin = strings.NewReader("key,value\nfresh,1\n")
+		defer func() { stdin = os.Stdin }()
+		code, stdout, stderr := runCmd("import", "--create", "--format", "csv", plain, "-")
+		assert.Equal(t, 0, code, stderr)
+		assert.Equal(t, "imported 1 keys\n", stdout)
+		code, stdout, _ = runCmd("get", plain, "fresh")
+		assert.Equal(t, 0, code)
+		assert.Equal(t, "1\n", stdout)
+	})
+
+	t.Run("keys and scan", func(t *testing.T) {
+		code, stdout, _ := runCmd("keys", dir)
+		assert.Equal(t, 0, code)
+		assert.Equal(t, "k\nuser/2\n", stdout)
+
+		code, stdout, _ = runCmd("keys", "--prefix", "user/", dir)
+		assert.Equal(t, 0, code)
+		assert.Equal(t, "user/2\n", stdout)
+
+		code, stdout, _ = runCmd("scan", "--prefix", "k", dir)
+		assert.Equal(t, 0, code)
+		assert.Equal(t, "k\tv\n", stdout)
+	})
+
+	t.Run("stats and merge", func(t *testing.T) {
+		code, stdout, _ := runCmd("stats", dir)
+		assert.Equal(t, 0, code)
+		assert.Contains(t, stdout, "keys:          2")
+
+		code, stdout, _ = runCmd("merge", dir)
+		assert.Equal(t, 0, code)
+		assert.Contains(t, stdout, "nothing to merge")
+	})
+
+	t.Run("dump", func(t *testing.T) {
+		code, stdout, _ := runCmd("dump-segment", dir, "0")
+		assert.Equal(t, 0, code)
+		assert.Contains(t, stdout, "segment 0 version 2")
+		assert.Contains(t, stdout, `"user/1"`)
+		assert.Contains(t, stdout, "tombstone")
+
+		code, stdout, _ = runCmd("dump-index", dir)
+		assert.Equal(t, 0, code)
+		assert.Contains(t, stdout, `"user/2"`)
+		assert.Contains(t, stdout, "2 entries")
+
+		code, _, _ = runCmd("dump-segment", dir, "x")
+		assert.Equal(t, 2, code)
+	})
+
+	t.Run("export and import", func(t *testing.T) {
+		copyRoot := t.TempDir()
+		b, err := db.Open(copyRoot, "copy_db")
+		require.NoError(t, err)
+		require.NoError(t, b.Close())
+		copyDir := filepath.Join(copyRoot, "copy_db")
+
+		for _, format := range []string{"jsonl", "csv", "native"} {
+			code, stdout, stderr := runCmd("export", "--format", format, dir)
+			require.Equal(t, 0, code, stderr)
+			file := filepath.Join(copyRoot, "export."+format)
+			require.NoError(t, os.WriteFile(file, []byte(stdout), 0666))
+			code, stdout, stderr = runCmd("import", "--format", format, copyDir, file)
+			assert.Equal(t, 0, code, stderr)
+			assert.Equal(t, "imported 2 keys\n", stdout)
+		}
+		code, stdout, _ := runCmd("export", "--prefix", "user/", copyDir)
+		assert.Equal(t, 0, code)
+		assert.Equal(t, `{"key":"user/2","value":"bob"}`+"\n", stdout)
+
+		stdin = strings.NewReader("key,value\nfixture,1\n")
+		defer func() { stdin = os.Stdin }()
+		code, stdout, _ = runCmd("import", "--format", "csv", copyDir, "-")
+		assert.Equal(t, 0, code)
+		assert.Equal(t, "imported 1 keys\n", stdout)
+
+		code, _, stderr := runCmd("export", "--format", "xml", dir)
+		assert.Equal(t, 2, code)
+		assert.Contains(t, stderr, "unknown format")
+	})
+
+	t.Run("import-redis", func(t *testing.T) {
+		root := t.TempDir()
+		// An RDB with one string key and the checksum turned off.
+		rdb := append([]byte("REDIS0011\x00\x05hello\x05world\xff"), make([]byte, 8)...)
+		rdbFile := filepath.Join(root, "dump.rdb")
+		require.NoError(t, os.WriteFile(rdbFile, rdb, 0666))
+		aofFile := filepath.Join(root, "appendonly.aof")
+		require.NoError(t, os.WriteFile(aofFile, []byte("*3\r\n$5\r\nRPUSH\r\n$4\r\nlist\r\n$1\r\na\r\n"), 0666))
+
+		code, stdout, stderr := runCmd("import-redis", rdbFile, filepath.Join(root, "from_rdb"))
+		require.Equal(t, 0, code, stderr)
+		assert.Equal(t, "imported 1 keys: 1 strings, 0 hashes, 0 lists, 0 sets\n", stdout)
+		code, stdout, _ = runCmd("get", filepath.Join(root, "from_rdb"), "hello")
+		assert.Equal(t, 0, code)
+		assert.Equal(t, "world\n", stdout)
+
+		code, stdout, stderr = runCmd("import-redis", "--aof", "--prefix", "r:", aofFile, filepath.Join(root, "from_aof"))
+		require.Equal(t, 0, code, stderr)
+		assert.Equal(t, "imported 1 keys: 0 strings, 0 hashes, 1 lists, 0 sets\n", stdout)
+		code, stdout, _ = runCmd("get", filepath.Join(root, "from_aof"), "r:list")
+		assert.Equal(t, 0, code)
+		assert.Equal(t, `["a"]`+"\n", stdout)
+
+		code, _, stderr = runCmd("import-redis", rdbFile, filepath.Join(root, "from_rdb"))
+		assert.Equal(t, 2, code)
+		assert.Contains(t, stderr, "database already exists")
+	})
+
+	t.Run("shell", func(t *testing.T) {
+		stdin = strings.NewReader(strings.Join([]string{
+			`put "greeting key" hello world`,
+			`get "greeting key"`,
+			`begin`,
+			`put user/3 carol`,
+			`delete user/2`,
+			`get user/2`,
+			`commit`,
+			`keys user/`,
+			`begin`,
+			`put user/4 dave`,
+			`rollback`,
+			`bogus`,
+			`exit`,
+			`put never applied`,
+		}, "\n"))
+		defer func() { stdin = os.Stdin }()
+
+		code, stdout, stderr := runCmd("shell", dir)
+		assert.Equal(t, 0, code, stderr)
+		for _, want := range []string{
+			"hello world\n",
+			"error: key not found (",
+			"committed 2 writes\n",
+			"user/3\n",
+			"discarded 1 writes\n",
+			`error: usage error, type "help"`,
+		} {
+			assert.Contains(t, stdout, want)
+		}
+		assert.NotContains(t, stdout, "user/2\n")
+		assert.Regexp(t, `\(\d+(\.\d+)?(µs|ms|s)\)\n`, stdout)
+
+		b, err := db.Open(root, "cli_db", db.WithReadOnly())
+		require.NoError(t, err)
+		defer b.Close()
+		s := &shell{b: b}
+		for _, c := range []struct{ line, want string }{
+			{"ge", "get "},
+			{"get us", "get user/3 "},
+			{"get gr", "get greeting key "},
+			{"s", "scan "},
+			{"get zz", ""},
+		} {
+			got, pos, ok := s.complete(c.line, len(c.line), '\t')
+			assert.Equal(t, c.want != "", ok, c.line)
+			assert.Equal(t, c.want, got, c.line)
+			assert.Equal(t, len(got), pos, c.line)
+		}
+		_, err = b.Get("never")
+		assert.Error(t, err)
+	})
+
+	t.Run("serve", func(t *testing.T) {
+		code, _, stderr := runCmd("serve", dir)
+		assert.Equal(t, 2, code)
+		assert.Contains(t, stderr, "usage: bcask serve [--resp")
+		code, _, _ = runCmd("serve", "--follow", "127.0.0.1:1", "--read-only", dir)
+		assert.Equal(t, 2, code, "a follower has to write what it replicates")
+
+		// Unix socket paths are short, so keep it out of the test's temp dir.
+		sockDir, err := os.MkdirTemp("", "bcask")
+		require.NoError(t, err)
+		defer os.RemoveAll(sockDir)
+		sock := filepath.Join(sockDir, "s")
+		stopc := make(chan chan<- os.Signal, 1)
+		notifyStop = func(c chan<- os.Signal) { stopc <- c }
+		defer func() { notifyStop = func(c chan<- os.Signal) {} }()
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		httpAddr := l.Addr().String()
+		l.Close()
+
+		done := make(chan int, 1)
+		go func() {
+			code, _, _ := runCmd("serve", "--resp", "--unix", sock, "--http", "--http-addr", httpAddr, dir)
+			done <- code
+		}()
+		stop := <-stopc
+		conn, err := net.Dial("unix", sock)
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte("SET served yes\r\nGET served\r\n"))
+		require.NoError(t, err)
+		r := bufio.NewReader(conn)
+		for _, want := range []string{"+OK\r\n", "$3\r\n", "yes\r\n"} {
+			line, err := r.ReadString('\n')
+			require.NoError(t, err)
+			assert.Equal(t, want, line)
+		}
+		resp, err := http.Get("http://" + httpAddr + "/keys/served")
+		require.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "yes", string(body))
+		resp, err = http.Get("http://" + httpAddr + "/metrics")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		stop <- os.Interrupt
+		assert.Equal(t, 0, <-done)
+
+		code, stdout, _ := runCmd("get", dir, "served")
+		assert.Equal(t, 0, code)
+		assert.Equal(t, "yes\n", stdout)
+	})
+
+	t.Run("split args", func(t *testing.T) {
+		args, err := splitArgs(`put  "a b" c\tx "q\"uote"`)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"put", "a b", `c\tx`, `q"uote`}, args)
+		_, err = splitArgs(`get "open`)
+		assert.Error(t, err)
+	})
+
+	t.Run("fsck", func(t *testing.T) {
+		code, stdout, _ := runCmd("fsck", dir)
+		assert.Equal(t, 0, code)
+		assert.Contains(t, stdout, "1 segments, 8 records, 4 live keys, 0 problems")
+
+		code, _, _ = runCmd("fsck", filepath.Join(root, "missing"))
+		assert.Equal(t, 2, code)
+	})
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/sayuyere/bcask/internal/consts"
+	"github.com/sayuyere/bcask/internal/metrics"
+	"github.com/sayuyere/bcask/internal/replication"
+	"github.com/sayuyere/bcask/internal/resp"
+	"github.com/sayuyere/bcask/internal/rest"
+)
+
+// notifyStop arranges for c to receive the signals that stop serve; tests
+// replace it to stop the server themselves.
+var notifyStop = func(c chan<- os.Signal) {
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+}
+
+func runServe(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	useRESP := fs.Bool("resp", false, "serve the Redis protocol")
+	addr := fs.String("addr", "127.0.0.1:6379", "TCP address for the Redis protocol")
+	unix := fs.String("unix", "", "unix socket for the Redis protocol instead of TCP")
+	useHTTP := fs.Bool("http", false, "serve the HTTP/JSON API and /metrics")
+	httpAddr := fs.String("http-addr", "127.0.0.1:8080", "TCP address for HTTP")
+	replicateAddr := fs.String("replicate-addr", "", "TCP address to stream the log to followers on")
+	follow := fs.String("follow", "", "replicate the leader at HOST:PORT; only reads are served")
+	readOnly := fs.Bool("read-only", false, "open the database read-only")
+	create := fs.Bool("create", false, "create the database if DIR holds none")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 || (*follow != "" && *readOnly) || (*create && *readOnly) ||
+		!(*useRESP || *useHTTP || *replicateAddr != "" || *follow != "") {
+		return badUsage(stderr, "serve")
+	}
+
+	openDB := openWritable
+	switch {
+	case *create:
+		openDB = openOrCreate
+	case *readOnly:
+		openDB = openReadOnly
+	}
+	b, err := openDB(fs.Arg(0))
+	if err != nil {
+		return fail(stderr, "serve", err)
+	}
+	errc := make(chan error, 3)
+	var closers []func() error
+	shutdown := func(err error) error {
+		for _, close := range closers {
+			if closeErr := close(); err == nil {
+				err = closeErr
+			}
+		}
+		if closeErr := b.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}
+
+	if *follow != "" {
+		f := replication.NewFollower(b, "tcp", *follow)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		b.SetReplica(true)
+		go func() {
+			f.Run(ctx)
+			close(done)
+		}()
+		closers = append(closers, func() error {
+			cancel()
+			<-done
+			return nil
+		})
+		fmt.Fprintf(stdout, "following %s\n", *follow)
+	}
+	if *replicateAddr != "" {
+		l, err := net.Listen("tcp", *replicateAddr)
+		if err != nil {
+			shutdown(nil)
+			return fail(stderr, "serve", err)
+		}
+		leader := replication.NewLeader(b)
+		closers = append(closers, leader.Close)
+		go func() { errc <- leader.Serve(l) }()
+		fmt.Fprintf(stdout, "serving %s (replication) on %s\n", fs.Arg(0), l.Addr())
+	}
+	if *useRESP {
+		l, err := listen(*addr, *unix)
+		if err != nil {
+			shutdown(nil)
+			return fail(stderr, "serve", err)
+		}
+		s := resp.NewServer(b)
+		closers = append(closers, s.Close)
+		go func() { errc <- s.Serve(l) }()
+		fmt.Fprintf(stdout, "serving %s (RESP) on %s\n", fs.Arg(0), l.Addr())
+	}
+	if *useHTTP {
+		l, err := net.Listen("tcp", *httpAddr)
+		if err != nil {
+			shutdown(nil)
+			return fail(stderr, "serve", err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.NewHandler(b))
+		mux.Handle("/", rest.NewHandler(b))
+		s := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		closers = append(closers, func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			return s.Shutdown(ctx)
+		})
+		go func() { errc <- s.Serve(l) }()
+		fmt.Fprintf(stdout, "serving %s (HTTP) on %s\n", fs.Arg(0), l.Addr())
+	}
+
+	stop := make(chan os.Signal, 1)
+	notifyStop(stop)
+	defer signal.Stop(stop)
+	select {
+	case <-stop:
+	case err = <-errc:
+	}
+	if err := shutdown(err); err != nil && !errors.Is(err, consts.ErrorServerClosed) && !errors.Is(err, http.ErrServerClosed) {
+		return fail(stderr, "serve", err)
+	}
+	return 0
+}
+
+// listen opens a unix socket if path is set, replacing a stale socket left
+// by an earlier run, and a TCP listener on addr otherwise.
+func listen(addr, path string) (net.Listener, error) {
+	if path == "" {
+		return net.Listen("tcp", addr)
+	}
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sayuyere/bcask/internal/consts"
+	"github.com/sayuyere/bcask/internal/db"
+	"golang.org/x/term"
+)
+
+// stdin is where the shell reads commands and "import DIR -" reads data
+// from; tests replace it.
+var stdin io.Reader = os.Stdin
+
+const shellHelp = `commands:
+  get KEY              print the value of KEY, staged writes included
+  put KEY VALUE        store VALUE under KEY, words after KEY are joined
+  delete KEY           remove KEY
+  keys [PREFIX]        list keys, optionally only those starting with PREFIX
+  scan [PREFIX]        list keys and values
+  begin                start staging writes
+  commit               apply staged writes as one batch
+  rollback             discard staged writes
+  help                 show this help
+  exit                 leave the shell
+Arguments may be double-quoted to include spaces or escapes.`
+
+// shellCommands are the names offered by tab completion.
+var shellCommands = []string{"begin", "commit", "delete", "exit", "get", "help", "keys", "put", "rollback", "scan"}
+
+func runShell(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("shell", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	readOnly := fs.Bool("read-only", false, "open the database read-only")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return badUsage(stderr, "shell")
+	}
+	b, err := open(fs.Arg(0), *readOnly)
+	if err != nil {
+		return fail(stderr, "shell", err)
+	}
+	defer b.Close()
+
+	s := &shell{b: b}
+	if f, ok := stdin.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		err = s.interactive(f, stdout)
+	} else {
+		err = s.run(stdin, stdout)
+	}
+	if err != nil {
+		return fail(stderr, "shell", err)
+	}
+	return 0
+}
+
+// shell executes one line at a time against a database. Between begin and
+// commit writes are staged in a batch; get sees the staged values.
+type shell struct {
+	b      *db.Bcask
+	out    io.Writer
+	batch  *db.Batch
+	staged map[string]*string // nil value: staged delete
+}
+
+// run reads commands from a non-terminal input until EOF or exit, without
+// prompts or line editing.
+func (s *shell) run(in io.Reader, out io.Writer) error {
+	s.out = out
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(nil, int(consts.SegmentMaxSize))
+	for scanner.Scan() {
+		if s.exec(scanner.Text()) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// interactive runs the shell on a terminal with history (up/down) and tab
+// completion of commands and keys.
+func (s *shell) interactive(f *os.File, out io.Writer) error {
+	state, err := term.MakeRaw(int(f.Fd()))
+	if err != nil {
+		return err
+	}
+	defer term.Restore(int(f.Fd()), state)
+
+	t := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{f, out}, "bcask> ")
+	t.AutoCompleteCallback = s.complete
+	s.out = t
+	fmt.Fprintln(t, `type "help" for commands`)
+	for {
+		line, err := t.ReadLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if s.exec(line) {
+			return nil
+		}
+		if s.batch != nil {
+			t.SetPrompt(fmt.Sprintf("bcask(%d)> ", s.batch.Len()))
+		} else {
+			t.SetPrompt("bcask> ")
+		}
+	}
+}
+
+// exec runs one command line and reports whether the shell should exit.
+func (s *shell) exec(line string) bool {
+	args, err := splitArgs(line)
+	if err != nil {
+		fmt.Fprintln(s.out, "error:", err)
+		return false
+	}
+	if len(args) == 0 {
+		return false
+	}
+	start := time.Now()
+	err = s.dispatch(args)
+	elapsed := time.Since(start)
+	switch {
+	case errors.Is(err, errExit):
+		return true
+	case errors.Is(err, errSilent):
+	case errors.Is(err, errUsage):
+		fmt.Fprintln(s.out, "error:", err)
+	case err != nil:
+		fmt.Fprintf(s.out, "error: %v (%v)\n", err, elapsed.Round(time.Microsecond))
+	default:
+		fmt.Fprintf(s.out, "(%v)\n", elapsed.Round(time.Microsecond))
+	}
+	return false
+}
+
+var (
+	errExit   = errors.New("exit")
+	errSilent = errors.New("no timing")
+	errUsage  = errors.New(`usage error, type "help"`)
+)
+
+func (s *shell) dispatch(args []string) error {
+	cmd, args := args[0], args[1:]
+	switch {
+	case cmd == "exit" || cmd == "quit":
+		if s.batch != nil {
+			fmt.Fprintf(s.out, "discarding %d staged writes\n", s.batch.Len())
+		}
+		return errExit
+	case cmd == "help":
+		fmt.Fprintln(s.out, shellHelp)
+		return errSilent
+	case cmd == "get" && len(args) == 1:
+		return s.get(args[0])
+	case cmd == "put" && len(args) >= 2:
+		return s.put(args[0], strings.Join(args[1:], " "))
+	case cmd == "delete" && len(args) == 1:
+		return s.delete(args[0])
+	case cmd == "keys" && len(args) <= 1:
+		return s.scan(args, false)
+	case cmd == "scan" && len(args) <= 1:
+		return s.scan(args, true)
+	case cmd == "begin" && len(args) == 0:
+		if s.batch != nil {
+			return errors.New("already in a transaction")
+		}
+		s.batch = &db.Batch{}
+		s.staged = make(map[string]*string)
+		return nil
+	case cmd == "commit" && len(args) == 0:
+		if s.batch == nil {
+			return errors.New("not in a transaction")
+		}
+		batch := s.batch
+		s.batch, s.staged = nil, nil
+		if err := s.b.Apply(batch); err != nil {
+			return err
+		}
+		fmt.Fprintf(s.out, "committed %d writes\n", batch.Len())
+		return nil
+	case cmd == "rollback" && len(args) == 0:
+		if s.batch == nil {
+			return errors.New("not in a transaction")
+		}
+		fmt.Fprintf(s.out, "discarded %d writes\n", s.batch.Len())
+		s.batch, s.staged = nil, nil
+		return nil
+	}
+	return errUsage
+}
+
+func (s *shell) get(key string) error {
+	if value, ok := s.staged[key]; ok {
+		if value == nil {
+			return consts.ErrorKeyNotFound
+		}
+		fmt.Fprintln(s.out, *value)
+		return nil
+	}
+	value, err := s.b.Get(key)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(s.out, value)
+	return nil
+}
+
+func (s *shell) put(key, value string) error {
+	if s.batch != nil {
+		s.batch.Put(key, value)
+		s.staged[key] = &value
+		return nil
+	}
+	return s.b.Put(key, value)
+}
+
+func (s *shell) delete(key string) error {
+	if s.batch != nil {
+		s.batch.Delete(key)
+		s.staged[key] = nil
+		return nil
+	}
+	return s.b.Delete(key)
+}
+
+func (s *shell) scan(args []string, values bool) error {
+	prefix := ""
+	if len(args) == 1 {
+		prefix = args[0]
+	}
+	if !values {
+		keys, err := s.b.ListKeysWithPrefix(prefix)
+		for _, key := range keys {
+			fmt.Fprintln(s.out, key)
+		}
+		return err
+	}
+	return s.b.Scan(prefix, func(key, value string) error {
+		_, err := fmt.Fprintf(s.out, "%s\t%s\n", key, value)
+		return err
+	})
+}
+
+// complete is the terminal's tab completion: the first word completes to a
+// command, the second to a key of the database. With several candidates the
+// word is extended to their longest common prefix.
+func (s *shell) complete(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' || pos != len(line) {
+		return "", 0, false
+	}
+	words := strings.Fields(line)
+	if len(line) > 0 && line[len(line)-1] == ' ' {
+		words = append(words, "")
+	}
+	var candidates []string
+	switch len(words) {
+	case 0:
+		return "", 0, false
+	case 1:
+		for _, name := range shellCommands {
+			if strings.HasPrefix(name, words[0]) {
+				candidates = append(candidates, name)
+			}
+		}
+	case 2:
+		switch words[0] {
+		case "get", "put", "delete", "keys", "scan":
+			candidates, _ = s.b.ListKeysWithPrefix(words[1])
+		}
+	}
+	if len(candidates) == 0 {
+		return "", 0, false
+	}
+	word := words[len(words)-1]
+	completed := commonPrefix(candidates)
+	if len(candidates) == 1 {
+		completed += " "
+	}
+	if len(completed) <= len(word) {
+		return "", 0, false
+	}
+	newLine := line + completed[len(word):]
+	return newLine, len(newLine), true
+}
+
+func commonPrefix(words []string) string {
+	sort.Strings(words)
+	first, last := words[0], words[len(words)-1]
+	n := 0
+	for n < len(first) && n < len(last) && first[n] == last[n] {
+		n++
+	}
+	return first[:n]
+}
+
+// splitArgs splits a command line on spaces. Double-quoted arguments may
+// contain spaces and Go escape sequences.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" {
+			return args, nil
+		}
+		if line[0] != '"' {
+			end := strings.IndexAny(line, " \t")
+			if end < 0 {
+				end = len(line)
+			}
+			args = append(args, line[:end])
+			line = line[end:]
+			continue
+		}
+		end := 1
+		for end < len(line) && line[end] != '"' {
+			if line[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(line) {
+			return nil, errors.New("unterminated quote")
+		}
+		arg, err := strconv.Unquote(line[:end+1])
+		if err != nil {
+			return nil, fmt.Errorf("bad quoted argument %s", line[:end+1])
+		}
+		args = append(args, arg)
+		line = line[end+1:]
+	}
+}
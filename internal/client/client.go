@@ -0,0 +1,453 @@
+// Package client talks to a bcask server over the Redis protocol (see
+// package resp) and implements db.ContextDB, so code written against an
+// embedded database can use a remote one by changing only the constructor:
+//
+//	b, err := db.Open(dir, name)
+//	b, err := client.New("tcp", "127.0.0.1:6379")
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sayuyere/bcask/internal/consts"
+	"github.com/sayuyere/bcask/internal/db"
+)
+
+type Options struct {
+	// PoolSize is the maximum number of connections, busy or idle.
+	PoolSize int
+	// DialTimeout bounds connecting; Timeout bounds each command.
+	DialTimeout time.Duration
+	Timeout     time.Duration
+	// MaxRetries is how often a command is retried after a network error,
+	// on a fresh connection, waiting RetryBackoff and then twice as long as
+	// the previous wait in between.
+	MaxRetries   int
+	RetryBackoff time.Duration
+}
+
+type Option func(*Options)
+
+func defaultOptions() Options {
+	return Options{
+		PoolSize:     8,
+		DialTimeout:  5 * time.Second,
+		Timeout:      30 * time.Second,
+		MaxRetries:   3,
+		RetryBackoff: 50 * time.Millisecond,
+	}
+}
+
+func WithPoolSize(n int) Option {
+	return func(o *Options) { o.PoolSize = max(n, 1) }
+}
+
+func WithTimeouts(dial, command time.Duration) Option {
+	return func(o *Options) { o.DialTimeout, o.Timeout = dial, command }
+}
+
+func WithRetries(n int, backoff time.Duration) Option {
+	return func(o *Options) { o.MaxRetries, o.RetryBackoff = max(n, 0), backoff }
+}
+
+// Client is a pool of connections to one server. It is safe for concurrent
+// use.
+type Client struct {
+	network, address string
+	options          Options
+	slots            chan struct{} // one per connection that may exist
+
+	mu     sync.Mutex
+	idle   []*conn
+	closed bool
+	done   chan struct{} // closed by Close
+}
+
+var _ db.ContextDB = (*Client)(nil)
+
+// New returns a client for the server at address on network ("tcp" or
+// "unix"). It connects once to check that the server answers.
+func New(network, address string, opts ...Option) (*Client, error) {
+	options := defaultOptions()
+	for _, opt := range opts {
+		opt(&options)
+	}
+	c := &Client{
+		network: network,
+		address: address,
+		options: options,
+		slots:   make(chan struct{}, options.PoolSize),
+		done:    make(chan struct{}),
+	}
+	if _, err := c.do(context.Background(), true, "PING"); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// get takes an idle connection or dials a new one, waiting while PoolSize
+// connections are in use.
+func (c *Client) get(ctx context.Context) (*conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	select {
+	case c.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, consts.ErrorClientClosed
+	}
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		<-c.slots
+		return nil, consts.ErrorClientClosed
+	}
+	if n := len(c.idle); n > 0 {
+		cn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return cn, nil
+	}
+	c.mu.Unlock()
+	d := net.Dialer{Timeout: c.options.DialTimeout}
+	nc, err := d.DialContext(ctx, c.network, c.address)
+	if err != nil {
+		<-c.slots
+		return nil, err
+	}
+	return newConn(nc), nil
+}
+
+// put returns cn to the pool, or closes it if it is broken or the client
+// was closed.
+func (c *Client) put(cn *conn) {
+	defer func() { <-c.slots }()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || cn.broken {
+		cn.nc.Close()
+		return
+	}
+	c.idle = append(c.idle, cn)
+}
+
+func (c *Client) deadline(ctx context.Context) time.Time {
+	deadline := time.Now().Add(c.options.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		return d
+	}
+	return deadline
+}
+
+// roundTrip sends commands on one connection and reads a reply for each.
+// Commands that are not idempotent are only retried if they were never
+// sent, so a lost reply cannot apply them twice.
+func (c *Client) roundTrip(ctx context.Context, idempotent bool, commands [][]string) ([]any, error) {
+	backoff := c.options.RetryBackoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		var replies []any
+		var sent bool
+		replies, sent, err = c.tryRoundTrip(ctx, commands)
+		if err == nil {
+			return replies, nil
+		}
+		if errors.Is(err, consts.ErrorClientClosed) || ctx.Err() != nil || attempt >= c.options.MaxRetries || (sent && !idempotent) {
+			return nil, err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+func (c *Client) tryRoundTrip(ctx context.Context, commands [][]string) ([]any, bool, error) {
+	cn, err := c.get(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	defer c.put(cn)
+	deadline := c.deadline(ctx)
+	if err := cn.send(commands, deadline); err != nil {
+		return nil, false, err
+	}
+	replies := make([]any, len(commands))
+	for i := range replies {
+		if replies[i], err = cn.readReply(deadline); err != nil {
+			return nil, true, err
+		}
+	}
+	return replies, true, nil
+}
+
+// do runs one command and returns its reply, with error replies as errors.
+func (c *Client) do(ctx context.Context, idempotent bool, args ...string) (any, error) {
+	replies, err := c.roundTrip(ctx, idempotent, [][]string{args})
+	if err != nil {
+		return nil, err
+	}
+	if err, ok := replies[0].(error); ok {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+func (c *Client) Get(key string) (string, error) {
+	return c.GetContext(context.Background(), key)
+}
+
+func (c *Client) GetContext(ctx context.Context, key string) (string, error) {
+	reply, err := c.do(ctx, true, "GET", key)
+	if err != nil {
+		return "", err
+	}
+	return stringReply(reply)
+}
+
+func stringReply(reply any) (string, error) {
+	switch v := reply.(type) {
+	case string:
+		return v, nil
+	case null:
+		return "", consts.ErrorKeyNotFound
+	}
+	return "", fmt.Errorf("bcask client: unexpected reply %v", reply)
+}
+
+func (c *Client) Put(key, value string) error {
+	return c.PutContext(context.Background(), key, value)
+}
+
+func (c *Client) PutContext(ctx context.Context, key, value string) error {
+	_, err := c.do(ctx, true, "SET", key, value)
+	return err
+}
+
+// PutWithTTL stores key so that it expires after ttl, which is rounded to
+// milliseconds.
+func (c *Client) PutWithTTL(key, value string, ttl time.Duration) error {
+	_, err := c.do(context.Background(), true, "SET", key, value, "PX", strconv.FormatInt(max(ttl.Milliseconds(), 1), 10))
+	return err
+}
+
+func (c *Client) Delete(key string) error {
+	return c.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext deletes key. As for an embedded database, deleting a
+// missing key returns consts.ErrorKeyNotFound.
+func (c *Client) DeleteContext(ctx context.Context, key string) error {
+	reply, err := c.do(ctx, false, "DEL", key)
+	if err != nil {
+		return err
+	}
+	if n, _ := reply.(int64); n == 0 {
+		return consts.ErrorKeyNotFound
+	}
+	return nil
+}
+
+// ListKeys returns every key in ascending order.
+func (c *Client) ListKeys() ([]string, error) {
+	return c.ListKeysWithPrefix("")
+}
+
+// ListKeysWithPrefix returns the keys starting with prefix in ascending
+// order.
+func (c *Client) ListKeysWithPrefix(prefix string) ([]string, error) {
+	var keys []string
+	err := c.scan(context.Background(), prefix, func(_ *conn, batch []string) error {
+		keys = append(keys, batch...)
+		return nil
+	})
+	return keys, err
+}
+
+// scanCount is the number of keys asked for per SCAN call.
+const scanCount = "1000"
+
+// scan iterates over the keys starting with prefix in batches. SCAN cursors
+// belong to a connection, so the iteration holds one connection throughout,
+// which fn may use too, and is restarted after the last key seen if that
+// connection fails.
+func (c *Client) scan(ctx context.Context, prefix string, fn func(cn *conn, keys []string) error) error {
+	pattern := escapeGlob(prefix) + "*"
+	last, started := "", false
+	backoff := c.options.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := c.scanOnce(ctx, pattern, func(cn *conn, keys []string) error {
+			var fresh []string
+			for _, key := range keys {
+				if !started || key > last {
+					fresh = append(fresh, key)
+				}
+			}
+			if len(fresh) == 0 {
+				return nil
+			}
+			last, started = fresh[len(fresh)-1], true
+			return fn(cn, fresh)
+		})
+		var connErr *connError
+		if err == nil || attempt >= c.options.MaxRetries || !errors.As(err, &connErr) {
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+func (c *Client) scanOnce(ctx context.Context, pattern string, fn func(cn *conn, keys []string) error) error {
+	cn, err := c.get(ctx)
+	if err != nil {
+		return &connError{err}
+	}
+	defer c.put(cn)
+	cursor := "0"
+	for {
+		reply, err := c.call(ctx, cn, "SCAN", cursor, "MATCH", pattern, "COUNT", scanCount)
+		if err != nil {
+			return err
+		}
+		parts, ok := reply.([]any)
+		if !ok || len(parts) != 2 {
+			return fmt.Errorf("bcask client: unexpected SCAN reply %v", reply)
+		}
+		cursor, _ = parts[0].(string)
+		items, _ := parts[1].([]any)
+		keys := make([]string, 0, len(items))
+		for _, item := range items {
+			if key, ok := item.(string); ok {
+				keys = append(keys, key)
+			}
+		}
+		if err := fn(cn, keys); err != nil {
+			return err
+		}
+		if cursor == "0" || cursor == "" {
+			return nil
+		}
+	}
+}
+
+// connError wraps a failure of the connection itself, as opposed to an
+// error reply.
+type connError struct{ err error }
+
+func (e *connError) Error() string { return e.err.Error() }
+func (e *connError) Unwrap() error { return e.err }
+
+// call runs one command on cn, returning error replies and connection
+// failures (as *connError) as errors.
+func (c *Client) call(ctx context.Context, cn *conn, args ...string) (any, error) {
+	deadline := c.deadline(ctx)
+	if err := cn.send([][]string{args}, deadline); err != nil {
+		return nil, &connError{err}
+	}
+	reply, err := cn.readReply(deadline)
+	if err != nil {
+		return nil, &connError{err}
+	}
+	if err, ok := reply.(error); ok {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// escapeGlob quotes the characters SCAN patterns treat specially.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// Fold calls fn for every key and value in ascending key order, threading
+// acc through the calls. Keys deleted during the fold are skipped. Fold has
+// no way to report errors; it stops at the first one and returns the
+// accumulator as it was.
+func (c *Client) Fold(fn func(key, value string, acc interface{}) interface{}, acc interface{}) interface{} {
+	ctx := context.Background()
+	c.scan(ctx, "", func(cn *conn, keys []string) error {
+		replies, err := c.call(ctx, cn, append([]string{"MGET"}, keys...)...)
+		if err != nil {
+			return err
+		}
+		values, _ := replies.([]any)
+		for i, key := range keys {
+			if i < len(values) {
+				if value, ok := values[i].(string); ok {
+					acc = fn(key, value, acc)
+				}
+			}
+		}
+		return nil
+	})
+	return acc
+}
+
+// Merge runs a full merge on the server.
+func (c *Client) Merge() error {
+	return c.MergeContext(context.Background())
+}
+
+func (c *Client) MergeContext(ctx context.Context) error {
+	_, err := c.do(ctx, true, "BCASK.MERGE")
+	return err
+}
+
+// Sync makes the server sync its segments to disk.
+func (c *Client) Sync() error {
+	return c.SyncContext(context.Background())
+}
+
+func (c *Client) SyncContext(ctx context.Context) error {
+	_, err := c.do(ctx, true, "SAVE")
+	return err
+}
+
+// AddNewSegment makes the server start a new active segment. A replica
+// refuses with consts.ErrorReadOnly.
+func (c *Client) AddNewSegment() error {
+	_, err := c.do(context.Background(), false, "BCASK.ROLL")
+	return err
+}
+
+// Close closes the idle connections; busy ones are closed when their
+// command finishes. It does not affect the server.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	for _, cn := range c.idle {
+		cn.nc.Close()
+	}
+	c.idle = nil
+	return nil
+}
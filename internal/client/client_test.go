@@ -0,0 +1,196 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sayuyere/bcask/internal/consts"
+	"github.com/sayuyere/bcask/internal/db"
+	"github.com/sayuyere/bcask/internal/resp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serve runs a RESP server for b on addr until the test ends or stop is
+// called.
+func serve(t *testing.T, b *db.Bcask, addr string) (string, func()) {
+	l, err := net.Listen("tcp", addr)
+	require.NoError(t, err)
+	s := resp.NewServer(b)
+	go s.Serve(l)
+	var once sync.Once
+	stop := func() { once.Do(func() { s.Close() }) }
+	t.Cleanup(stop)
+	return l.Addr().String(), stop
+}
+
+func openDB(t *testing.T) *db.Bcask {
+	b, err := db.Open(t.TempDir(), "client_db")
+	require.NoError(t, err)
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+// exercise runs the same calls against an embedded and a remote database.
+func exercise(t *testing.T, d db.DB) {
+	require.NoError(t, d.Put("a", "1"))
+	require.NoError(t, d.Put("b", "2"))
+	v, err := d.Get("a")
+	require.NoError(t, err)
+	assert.Equal(t, "1", v)
+	_, err = d.Get("missing")
+	assert.ErrorIs(t, err, consts.ErrorKeyNotFound)
+	assert.ErrorIs(t, d.Delete("missing"), consts.ErrorKeyNotFound)
+	require.NoError(t, d.Delete("b"))
+	keys, err := d.ListKeys()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a"}, keys)
+	sum := d.Fold(func(key, value string, acc interface{}) interface{} {
+		return acc.(string) + key + "=" + value + ";"
+	}, "")
+	assert.Equal(t, "a=1;", sum)
+	assert.NoError(t, d.Sync())
+	assert.NoError(t, d.AddNewSegment())
+	assert.NoError(t, d.Merge())
+}
+
+func TestClient(t *testing.T) {
+	t.Run("SameAsEmbedded", func(t *testing.T) {
+		exercise(t, openDB(t))
+
+		b := openDB(t)
+		addr, _ := serve(t, b, "127.0.0.1:0")
+		c, err := New("tcp", addr)
+		require.NoError(t, err)
+		defer c.Close()
+		exercise(t, c)
+		assert.Len(t, b.DBSegments, 2, "BCASK.ROLL should have added a segment")
+	})
+
+	t.Run("RollOnReplica", func(t *testing.T) {
+		b := openDB(t)
+		b.SetReplica(true)
+		addr, _ := serve(t, b, "127.0.0.1:0")
+		c, err := New("tcp", addr)
+		require.NoError(t, err)
+		defer c.Close()
+		assert.ErrorIs(t, c.AddNewSegment(), consts.ErrorReadOnly)
+		assert.Len(t, b.DBSegments, 1)
+	})
+
+	b := openDB(t)
+	addr, _ := serve(t, b, "127.0.0.1:0")
+	c, err := New("tcp", addr, WithPoolSize(2))
+	require.NoError(t, err)
+	defer c.Close()
+
+	t.Run("ManyKeys", func(t *testing.T) {
+		p := c.Pipeline()
+		for i := 0; i < 2500; i++ {
+			p.Put(fmt.Sprintf("k%04d", i), fmt.Sprint(i))
+		}
+		p.Put("weird*[key]", "x")
+		p.Put("weird-other", "y")
+		results, err := p.Exec(context.Background())
+		require.NoError(t, err)
+		require.Len(t, results, 2502)
+		for _, r := range results {
+			require.NoError(t, r.Err)
+		}
+
+		keys, err := c.ListKeysWithPrefix("k")
+		require.NoError(t, err)
+		assert.Len(t, keys, 2500)
+		assert.Equal(t, "k2499", keys[2499])
+		keys, err = c.ListKeysWithPrefix("weird*[")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"weird*[key]"}, keys)
+
+		total := c.Fold(func(key, value string, acc interface{}) interface{} {
+			return acc.(int) + 1
+		}, 0)
+		assert.Equal(t, 2502, total)
+	})
+
+	t.Run("Pipeline", func(t *testing.T) {
+		p := c.Pipeline()
+		p.Put("p", "1")
+		p.Get("p")
+		p.Delete("p")
+		p.Delete("p")
+		p.Get("p")
+		assert.Equal(t, 5, p.Len())
+		results, err := p.Exec(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, 0, p.Len())
+		assert.NoError(t, results[0].Err)
+		assert.Equal(t, "1", results[1].Value)
+		assert.NoError(t, results[2].Err)
+		assert.ErrorIs(t, results[3].Err, consts.ErrorKeyNotFound)
+		assert.ErrorIs(t, results[4].Err, consts.ErrorKeyNotFound)
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				key := fmt.Sprint("c", i)
+				assert.NoError(t, c.Put(key, key))
+				v, err := c.Get(key)
+				assert.NoError(t, err)
+				assert.Equal(t, key, v)
+			}(i)
+		}
+		wg.Wait()
+	})
+
+	t.Run("Context", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := c.GetContext(ctx, "a")
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("TTL", func(t *testing.T) {
+		require.NoError(t, c.PutWithTTL("ttl", "x", time.Hour))
+		ttl, err := b.TTL("ttl")
+		require.NoError(t, err)
+		assert.Greater(t, ttl, 59*time.Minute)
+	})
+}
+
+func TestClientRetries(t *testing.T) {
+	b := openDB(t)
+	addr, stop := serve(t, b, "127.0.0.1:0")
+	c, err := New("tcp", addr, WithRetries(5, 10*time.Millisecond))
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.Put("k", "v"))
+
+	// The pooled connection dies with the server; the next call must fail
+	// over to a new connection once the server is back.
+	stop()
+	restarted := make(chan struct{})
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		serve(t, b, addr)
+		close(restarted)
+	}()
+	v, err := c.Get("k")
+	require.NoError(t, err)
+	assert.Equal(t, "v", v)
+	<-restarted
+
+	require.NoError(t, c.Close())
+	_, err = c.Get("k")
+	assert.ErrorIs(t, err, consts.ErrorClientClosed)
+
+	_, err = New("tcp", "127.0.0.1:1", WithRetries(0, 0))
+	assert.Error(t, err)
+}
@@ -0,0 +1,139 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sayuyere/bcask/internal/consts"
+)
+
+// ServerError is an error reply from the server that does not correspond
+// to one of the consts errors.
+type ServerError string
+
+func (e ServerError) Error() string { return string(e) }
+
+// knownErrors are the database errors the server forwards as "ERR <text>",
+// turned back into the same values so errors.Is works as for an embedded
+// database.
+var knownErrors = []error{
+	consts.ErrorKeyNotFound,
+	consts.ErrorDiskKeyValueBigEntry,
+	consts.ErrorMergeActiveSegment,
+	consts.ErrorSegmentNotFound,
+	consts.ErrorVersionMismatch,
+}
+
+func replyError(msg string) error {
+	if strings.HasPrefix(msg, "READONLY ") {
+		return consts.ErrorReadOnly
+	}
+	for _, err := range knownErrors {
+		if strings.HasPrefix(msg, "ERR "+err.Error()) {
+			return err
+		}
+	}
+	return ServerError(msg)
+}
+
+// null is the value of a null reply.
+type null struct{}
+
+// conn is one pooled connection speaking RESP2.
+type conn struct {
+	nc     net.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+	broken bool // a network or protocol error left the stream unusable
+}
+
+func newConn(nc net.Conn) *conn {
+	return &conn{nc: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+}
+
+func (c *conn) writeCommand(args []string) {
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.w, "$%d\r\n", len(arg))
+		c.w.WriteString(arg)
+		c.w.WriteString("\r\n")
+	}
+}
+
+// send writes and flushes commands, with deadline as the write deadline.
+func (c *conn) send(commands [][]string, deadline time.Time) error {
+	c.nc.SetWriteDeadline(deadline)
+	for _, args := range commands {
+		c.writeCommand(args)
+	}
+	if err := c.w.Flush(); err != nil {
+		c.broken = true
+		return err
+	}
+	return nil
+}
+
+// readReply reads one reply as string, int64, null, []any or an error
+// value. A returned error means the connection failed.
+func (c *conn) readReply(deadline time.Time) (any, error) {
+	c.nc.SetReadDeadline(deadline)
+	v, err := c.read()
+	if err != nil {
+		c.broken = true
+	}
+	return v, err
+}
+
+func (c *conn) read() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("bcask client: malformed reply")
+	}
+	kind, rest := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return replyError(rest), nil
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(rest)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return null{}, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(rest)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return null{}, nil
+		}
+		values := make([]any, n)
+		for i := range values {
+			if values[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("bcask client: unexpected reply type %q", kind)
+}
@@ -0,0 +1,73 @@
+package client
+
+import (
+	"context"
+
+	"github.com/sayuyere/bcask/internal/consts"
+)
+
+// Pipeline queues commands and sends them in one round trip. It is not safe
+// for concurrent use.
+type Pipeline struct {
+	c          *Client
+	commands   [][]string
+	idempotent bool
+}
+
+// Result is the outcome of one pipelined command. Value is set for Get.
+type Result struct {
+	Value string
+	Err   error
+}
+
+func (c *Client) Pipeline() *Pipeline {
+	return &Pipeline{c: c, idempotent: true}
+}
+
+func (p *Pipeline) Get(key string) {
+	p.commands = append(p.commands, []string{"GET", key})
+}
+
+func (p *Pipeline) Put(key, value string) {
+	p.commands = append(p.commands, []string{"SET", key, value})
+}
+
+func (p *Pipeline) Delete(key string) {
+	p.commands = append(p.commands, []string{"DEL", key})
+	p.idempotent = false
+}
+
+func (p *Pipeline) Len() int {
+	return len(p.commands)
+}
+
+// Exec sends the queued commands and empties the pipeline. Commands fail
+// one by one in their Result; the returned error means the connection
+// failed and it is unknown which commands were applied.
+func (p *Pipeline) Exec(ctx context.Context) ([]Result, error) {
+	commands, idempotent := p.commands, p.idempotent
+	p.commands, p.idempotent = nil, true
+	if len(commands) == 0 {
+		return nil, nil
+	}
+	replies, err := p.c.roundTrip(ctx, idempotent, commands)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]Result, len(commands))
+	for i, reply := range replies {
+		if err, ok := reply.(error); ok {
+			results[i].Err = err
+			continue
+		}
+		switch commands[i][0] {
+		case "GET":
+			results[i].Value, results[i].Err = stringReply(reply)
+		case "DEL":
+			if n, _ := reply.(int64); n == 0 {
+				results[i].Err = consts.ErrorKeyNotFound
+			}
+		}
+	}
+	return results, nil
+}
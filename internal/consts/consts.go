@@ -4,9 +4,64 @@ import "errors"
 
 const SegmentPrefix string = "segment_file_"
 const SegmentMaxSize int64 = 1024 * 1024 * 4 //4MB Segment Size
+const SegmentHeaderSize int64 = 64
+const SegmentFormatVersion uint16 = 2
 const IndexFileName string = "index_file"
+const TempFileSuffix string = ".tmp"
+const MergeFileSuffix string = ".merge"
+const ManifestFileName string = "MANIFEST"
+const LockFileName string = "LOCK"
+const BackupFileName string = "BACKUP"
+const ManifestFormatVersion int = 1
+const IndexTypePrefixTrie string = "prefix_trie"
 
 var ErrorSegmentCapacityFull error = errors.New("segment capacity full: reached maximum segment size, need to create a new segment")
 var ErrorMMapIncompleteWrite error = errors.New("incomplete write: not all data could be written to the memory-mapped segment")
 var ErrorInvalidOffset error = errors.New("invalid offset: offset is out of bounds for the segment")
 var ErrorDiskKeyValueBigEntry error = errors.New("disk key value size is greater than the segment size so we can't store it")
+
+var ErrorIndexBadMagic error = errors.New("index file: bad magic, not a bcask index")
+var ErrorIndexVersion error = errors.New("index file: unsupported format version")
+var ErrorIndexHeaderChecksum error = errors.New("index file: header checksum mismatch")
+var ErrorIndexBodyChecksum error = errors.New("index file: body checksum mismatch")
+var ErrorIndexTruncated error = errors.New("index file: unexpected end of data")
+var ErrorIndexUnsortedEntries error = errors.New("index file: entries are not sorted by key")
+
+var ErrorSegmentBadMagic error = errors.New("segment file: bad magic, not a bcask segment")
+var ErrorSegmentVersion error = errors.New("segment file: unsupported format version")
+var ErrorSegmentHeaderChecksum error = errors.New("segment file: header checksum mismatch")
+var ErrorSegmentIDMismatch error = errors.New("segment file: header segment id does not match file name")
+var ErrorSegmentForeignDatabase error = errors.New("segment file: belongs to a different database")
+var ErrorRecordChecksum error = errors.New("segment file: record checksum mismatch")
+
+var ErrorManifestVersion error = errors.New("manifest: unsupported format version")
+var ErrorManifestInvalid error = errors.New("manifest: invalid manifest")
+var ErrorKeyNotFound error = errors.New("key not found")
+var ErrorSegmentNotFound error = errors.New("segment not found: index points at a segment that is not live")
+
+var ErrorDatabaseLocked error = errors.New("database locked: the database directory is in use by another process")
+var ErrorReadOnly error = errors.New("database is open read-only")
+var ErrorMergeActiveSegment error = errors.New("merge: the active segment cannot be merged")
+
+var ErrorServerClosed error = errors.New("server closed")
+var ErrorVersionMismatch error = errors.New("version mismatch: the key was written since the version was read")
+var ErrorClientClosed error = errors.New("client closed")
+var ErrorLogTruncated error = errors.New("log truncated: a merge dropped tombstones the reader has not seen")
+var ErrorReplicationProtocol error = errors.New("replication: unexpected message")
+var ErrorDatabaseClosed error = errors.New("database closed")
+var ErrorDatabaseExists error = errors.New("database already exists")
+var ErrorDatabaseNotFound error = errors.New("no database in directory")
+var ErrorBackupDestination error = errors.New("backup: destination directory is not empty")
+var ErrorBackupChain error = errors.New("backup: backups do not form a chain from a full backup")
+
+var ErrorDumpFormat error = errors.New("dump: unknown format")
+var ErrorDumpMalformed error = errors.New("dump: malformed record")
+var ErrorDumpBadMagic error = errors.New("dump file: bad magic, not a bcask dump")
+var ErrorDumpVersion error = errors.New("dump file: unsupported format version")
+var ErrorDumpChecksum error = errors.New("dump file: checksum mismatch")
+var ErrorDumpTruncated error = errors.New("dump file: unexpected end of data")
+
+var ErrorRedisFormat error = errors.New("redis import: malformed file")
+var ErrorRedisVersion error = errors.New("redis import: unsupported rdb version")
+var ErrorRedisChecksum error = errors.New("redis import: rdb checksum mismatch")
+var ErrorRedisUnsupported error = errors.New("redis import: unsupported data")
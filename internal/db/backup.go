@@ -0,0 +1,414 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/sayuyere/bcask/internal/consts"
+	"github.com/sayuyere/bcask/internal/item"
+	"github.com/sayuyere/bcask/internal/manifest"
+	"github.com/sayuyere/bcask/internal/segment"
+	"github.com/sayuyere/bcask/internal/uuid"
+)
+
+// backupChunk is how many bytes a backup copies between rate limiter waits,
+// and how many bytes of records a restore applies at a time.
+const backupChunk = 1 << 20
+
+// BackupPosition is the end of the log captured by a backup.
+type BackupPosition struct {
+	Segment int64 `json:"segment"`
+	Offset  int64 `json:"offset"`
+	// SegmentCreated is the creation time from the segment's header. A
+	// merge replaces the segment with one created later.
+	SegmentCreated int64 `json:"segment_created"`
+	// Sequence is the timestamp of the newest record captured.
+	Sequence int64 `json:"sequence"`
+}
+
+// BackupInfo describes a backup. It is kept in the backup's BACKUP file.
+type BackupInfo struct {
+	DatabaseID uuid.UUID `json:"database_id"`
+	// Incremental backups hold the records written after Since. A full
+	// backup is a database of its own and can be opened directly.
+	Incremental bool           `json:"incremental"`
+	Since       BackupPosition `json:"since"`
+	// Until is where the next incremental backup of the chain starts.
+	Until BackupPosition `json:"until"`
+	// Segments lists the segment files of the backup in log order.
+	Segments  []int64   `json:"segments"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ReadBackup returns the description of the backup in dir.
+func ReadBackup(dir string) (*BackupInfo, error) {
+	data, err := os.ReadFile(filepath.Join(dir, consts.BackupFileName))
+	if err != nil {
+		return nil, err
+	}
+	var info BackupInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("%s: %w", dir, err)
+	}
+	return &info, nil
+}
+
+// Backup writes a consistent copy of the database to dstDir, which must be
+// missing or empty, while reads and writes carry on. The copy holds every
+// record written before Backup was called and can be opened like any
+// database.
+//
+// Merges wait until the backup is done, which freezes the set of segments.
+// Sealed segments never change, so they are hard-linked into dstDir, or
+// copied when that fails, e.g. across file systems. The active segment is
+// copied up to the offset it had when the backup started, and the index is
+// checkpointed at that offset; writers are only held up while the index
+// is written. Copying is throttled by MaintenanceRate like a merge.
+func (b *Bcask) Backup(dstDir string) error {
+	return b.backup(dstDir, nil)
+}
+
+// BackupIncremental writes the records added since an earlier backup to
+// dstDir; since is the Until of that backup's BackupInfo. If the segment
+// the earlier backup ended in is unchanged, only its new tail and the
+// segments after it are copied. Once a merge has rewritten it, the records
+// are read from the log in order instead, which fails with
+// consts.ErrorLogTruncated if the merge dropped a delete made after since;
+// a full backup is needed then.
+//
+// Incremental backups are not databases; Restore applies them on top of a
+// full backup.
+func (b *Bcask) BackupIncremental(dstDir string, since BackupPosition) error {
+	return b.backup(dstDir, &since)
+}
+
+func (b *Bcask) backup(dstDir string, since *BackupPosition) error {
+	b.mergeLock.Lock()
+	defer b.mergeLock.Unlock()
+	if err := prepareBackupDir(dstDir); err != nil {
+		return err
+	}
+
+	b.Lock.RLock()
+	if err := b.checkOpen(); err != nil {
+		b.Lock.RUnlock()
+		return err
+	}
+	segments := slices.Clone(b.DBSegments)
+	active := b.activeSegment()
+	end := active.GetOffset()
+	horizon := b.logHorizon
+	info := &BackupInfo{
+		DatabaseID: b.DBID,
+		Until: BackupPosition{
+			Segment:        active.FileID,
+			Offset:         end,
+			SegmentCreated: active.Header.CreatedAt,
+			Sequence:       b.lastStamp,
+		},
+		CreatedAt: time.Now(),
+	}
+	var err error
+	copyTail := false
+	if since == nil {
+		err = b.writeIndexFile(dstDir, active.FileID, end)
+	} else {
+		info.Incremental, info.Since = true, *since
+		if since.Sequence > b.lastStamp {
+			err = fmt.Errorf("%w: position %d is ahead of the log", consts.ErrorBackupChain, since.Sequence)
+		}
+		seg, segErr := b.segmentByID(since.Segment)
+		copyTail = segErr == nil && seg.Header.CreatedAt == since.SegmentCreated
+	}
+	b.Lock.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case since == nil:
+		err = b.backupSegments(dstDir, segments, end)
+		if err == nil {
+			info.Segments = segmentIDs(segments)
+			m := manifest.New(b.DBID, info.Segments)
+			m.LogHorizon = horizon
+			err = manifest.Write(dstDir, m)
+		}
+	case copyTail:
+		info.Segments, err = b.backupTail(dstDir, segments, end, *since)
+	default:
+		info.Segments, err = b.backupLog(dstDir, since.Sequence, info.Until.Sequence)
+	}
+	if err != nil {
+		return err
+	}
+	// The BACKUP file goes last: a directory without one is not a backup.
+	if err := writeBackupInfo(dstDir, info); err != nil {
+		return err
+	}
+	b.logger.Info("backup written", "path", dstDir, "incremental", info.Incremental,
+		"segments", len(info.Segments), "sequence", info.Until.Sequence)
+	return nil
+}
+
+// backupSegments links or copies segments into dir, the last one, the
+// active segment, up to end.
+func (b *Bcask) backupSegments(dir string, segments []*segment.FileSegment, end int64) error {
+	for _, seg := range segments[:len(segments)-1] {
+		if err := os.Link(seg.Path, segment.SegmentPath(dir, seg.FileID)); err == nil {
+			continue
+		}
+		if err := b.copySegment(seg, dir, 0, seg.GetOffset()); err != nil {
+			return err
+		}
+	}
+	return b.copySegment(segments[len(segments)-1], dir, 0, end)
+}
+
+// backupTail copies the records of segments after since: the tail of
+// since's segment and every later segment.
+func (b *Bcask) backupTail(dir string, segments []*segment.FileSegment, end int64, since BackupPosition) ([]int64, error) {
+	i := slices.IndexFunc(segments, func(seg *segment.FileSegment) bool { return seg.FileID == since.Segment })
+	segments = segments[i:]
+	first := segments[0]
+	firstEnd := end
+	if len(segments) > 1 {
+		firstEnd = first.GetOffset()
+	}
+	if err := b.copySegment(first, dir, since.Offset, firstEnd); err != nil {
+		return nil, err
+	}
+	if len(segments) > 1 {
+		if err := b.backupSegments(dir, segments[1:], end); err != nil {
+			return nil, err
+		}
+	}
+	return segmentIDs(segments), nil
+}
+
+// backupLog writes the records after sequence after, up to until, into
+// fresh segments in dir.
+func (b *Bcask) backupLog(dir string, after, until int64) ([]int64, error) {
+	cursor := b.NewLogCursor(after)
+	var ids []int64
+	var out *segment.FileSegment
+	finish := func() error {
+		if out == nil {
+			return nil
+		}
+		end := out.GetOffset()
+		closeSegment(out)
+		out = nil
+		return os.Truncate(segment.SegmentPath(dir, ids[len(ids)-1]), end)
+	}
+	for {
+		records, err := cursor.Next(backupChunk)
+		if err != nil {
+			finish()
+			return nil, err
+		}
+		records = slices.DeleteFunc(records, func(kv item.DiskKV) bool { return kv.Timestamp > until })
+		if len(records) == 0 {
+			break
+		}
+		for _, kv := range records {
+			b.limiter.WaitN(kv.EncodedSize())
+			if out != nil {
+				err = out.Write(kv)
+			}
+			if out == nil || err == consts.ErrorSegmentCapacityFull {
+				if err := finish(); err != nil {
+					return nil, err
+				}
+				id := int64(len(ids))
+				if out, err = segment.NewFileSegment(dir, id, b.DBID, segment.Options{Logger: b.logger}); err != nil {
+					return nil, err
+				}
+				ids = append(ids, id)
+				err = out.Write(kv)
+			}
+			if err != nil {
+				finish()
+				return nil, err
+			}
+		}
+	}
+	if err := finish(); err != nil {
+		return nil, err
+	}
+	return ids, manifest.SyncDir(dir)
+}
+
+// prepareBackupDir creates dir, or checks that it is empty.
+func prepareBackupDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return os.MkdirAll(dir, 0755)
+	}
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("%w: %s", consts.ErrorBackupDestination, dir)
+	}
+	return nil
+}
+
+// copySegment copies the header of seg and its records from offset from
+// up to end into dir.
+func (b *Bcask) copySegment(seg *segment.FileSegment, dir string, from, end int64) error {
+	from = max(from, seg.DataStart())
+	dst, err := os.OpenFile(segment.SegmentPath(dir, seg.FileID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	err = b.copyLimited(dst, io.NewSectionReader(seg.OSFile, 0, seg.DataStart()), seg.DataStart())
+	if err == nil {
+		err = b.copyLimited(dst, io.NewSectionReader(seg.OSFile, from, end-from), end-from)
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if err != nil {
+		dst.Close()
+		return fmt.Errorf("failed to copy segment %d: %w", seg.FileID, err)
+	}
+	return dst.Close()
+}
+
+// copyLimited copies n bytes from src to dst at the maintenance rate.
+func (b *Bcask) copyLimited(dst io.Writer, src io.Reader, n int64) error {
+	for copied := int64(0); copied < n; copied += backupChunk {
+		chunk := min(backupChunk, n-copied)
+		b.limiter.WaitN(chunk)
+		if _, err := io.CopyN(dst, src, chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeBackupInfo(dir string, info *BackupInfo) error {
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, consts.BackupFileName), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return manifest.SyncDir(dir)
+}
+
+// Restore rebuilds a database in dstDir, which must be missing or empty,
+// from a full backup followed by any number of incremental backups, each
+// taken since the one before it. The backups are left untouched.
+func Restore(dstDir string, backups []string, opts ...Option) error {
+	if len(backups) == 0 {
+		return fmt.Errorf("%w: no backups", consts.ErrorBackupChain)
+	}
+	infos := make([]*BackupInfo, len(backups))
+	for i, dir := range backups {
+		info, err := ReadBackup(dir)
+		if err != nil {
+			return err
+		}
+		switch {
+		case i == 0 && info.Incremental:
+			return fmt.Errorf("%w: %s is incremental", consts.ErrorBackupChain, dir)
+		case i > 0 && (!info.Incremental || info.DatabaseID != infos[0].DatabaseID ||
+			info.Since.Sequence != infos[i-1].Until.Sequence):
+			return fmt.Errorf("%w: %s does not follow %s", consts.ErrorBackupChain, dir, backups[i-1])
+		}
+		infos[i] = info
+	}
+	if err := prepareBackupDir(dstDir); err != nil {
+		return err
+	}
+
+	files := []string{consts.ManifestFileName, consts.IndexFileName}
+	for _, id := range infos[0].Segments {
+		files = append(files, filepath.Base(segment.SegmentPath("", id)))
+	}
+	for _, name := range files {
+		if err := copyFile(filepath.Join(backups[0], name), filepath.Join(dstDir, name)); err != nil {
+			return err
+		}
+	}
+	b, err := Open(filepath.Dir(dstDir), filepath.Base(dstDir), opts...)
+	if err != nil {
+		return err
+	}
+	for i, dir := range backups[1:] {
+		for _, id := range infos[i+1].Segments {
+			if err := b.restoreSegment(dir, id); err != nil {
+				b.Close()
+				return err
+			}
+		}
+	}
+	b.logger.Info("backup restored", "path", dstDir, "backups", len(backups))
+	return b.Close()
+}
+
+// restoreSegment applies the records of a segment of an incremental backup.
+func (b *Bcask) restoreSegment(dir string, id int64) error {
+	seg, err := segment.OpenFileSegment(dir, id, b.DBID, segment.Options{ReadOnly: true, Logger: b.logger})
+	if err != nil {
+		return err
+	}
+	defer closeSegment(seg)
+	var batch []item.DiskKV
+	var size int64
+	_, err = seg.Scan(seg.DataStart(), func(_ int64, kv item.DiskKV) error {
+		batch = append(batch, kv)
+		if size += kv.EncodedSize(); size < backupChunk {
+			return nil
+		}
+		err := b.ApplyRecords(batch)
+		batch, size = batch[:0], 0
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return b.ApplyRecords(batch)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
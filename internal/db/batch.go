@@ -0,0 +1,103 @@
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sayuyere/bcask/internal/consts"
+	"github.com/sayuyere/bcask/internal/item"
+)
+
+// BatchOp is one write staged in a Batch. Value is unused for OpDelete.
+type BatchOp struct {
+	Op    Op
+	Key   string
+	Value string
+}
+
+// Batch collects writes to be applied together with Bcask.Apply. The zero
+// value is an empty batch.
+type Batch struct {
+	ops []BatchOp
+}
+
+func (b *Batch) Put(key, value string) {
+	b.ops = append(b.ops, BatchOp{Op: OpPut, Key: key, Value: value})
+}
+
+func (b *Batch) Delete(key string) {
+	b.ops = append(b.ops, BatchOp{Op: OpDelete, Key: key})
+}
+
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Ops returns the staged writes in the order they were added.
+func (b *Batch) Ops() []BatchOp {
+	return b.ops
+}
+
+func (b *Batch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// Apply writes every operation in batch while holding the write lock, so no
+// reader observes part of it. The batch is checked up front: an oversized
+// record or a delete of a key that neither exists nor is put earlier in the
+// batch fails the whole batch before anything is written. An I/O error
+// while writing can still leave a prefix of the batch applied.
+func (b *Bcask) Apply(batch *Batch) error {
+	return b.ApplyContext(context.Background(), batch)
+}
+
+// ApplyContext is Apply with ctx passed to the configured hooks, which see
+// a single OpApply call carrying the batch.
+func (b *Bcask) ApplyContext(ctx context.Context, batch *Batch) error {
+	return b.intercept(ctx, &Call{Op: OpApply, Batch: batch}, func() error {
+		return b.apply(batch)
+	})
+}
+
+func (b *Bcask) apply(batch *Batch) error {
+	b.Lock.Lock()
+	defer b.Lock.Unlock()
+	if err := b.writable(); err != nil {
+		return err
+	}
+	exists := make(map[string]bool)
+	for i, op := range batch.ops {
+		switch op.Op {
+		case OpPut:
+			kv := item.DiskKV{KeySize: int64(len(op.Key)), ValueSize: int64(len(op.Value))}
+			if kv.EncodedSize() > consts.SegmentMaxSize-consts.SegmentHeaderSize {
+				return fmt.Errorf("batch op %d: %w", i, consts.ErrorDiskKeyValueBigEntry)
+			}
+			exists[op.Key] = true
+		case OpDelete:
+			present, ok := exists[op.Key]
+			if !ok {
+				_, err := b.lookup(op.Key)
+				present = err == nil
+			}
+			if !present {
+				return fmt.Errorf("batch op %d: %w: %q", i, consts.ErrorKeyNotFound, op.Key)
+			}
+			exists[op.Key] = false
+		default:
+			return fmt.Errorf("batch op %d: unsupported operation %q", i, op.Op)
+		}
+	}
+	for _, op := range batch.ops {
+		var err error
+		if op.Op == OpPut {
+			err = b.putLocked(op.Key, op.Value, 0)
+		} else {
+			err = b.deleteLocked(op.Key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
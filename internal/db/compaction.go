@@ -0,0 +1,284 @@
+package db
+
+import (
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CompactionOptions configures the background compaction scheduler. A
+// threshold left at zero is disabled; the scheduler only runs when at least
+// one threshold is set.
+type CompactionOptions struct {
+	// Interval is how often thresholds are checked. Defaults to a minute.
+	Interval time.Duration
+
+	// MinDeadRatio triggers a merge once an immutable segment has at least
+	// this fraction of its bytes held by dead records.
+	MinDeadRatio float64
+	// MinDeadBytes triggers a merge once the immutable segments hold at
+	// least this many dead bytes in total.
+	MinDeadBytes int64
+	// MaxSegments triggers a merge once there are more live segments.
+	MaxSegments int
+
+	// Policy chooses which segments to rewrite once a threshold is crossed.
+	// Defaults to the immutable segments over MinDeadRatio; when nothing is
+	// chosen, every immutable segment is merged.
+	Policy MergePolicy
+
+	// Window restricts merges to a time of day. The zero Window allows
+	// merges at any time.
+	Window Window
+}
+
+// Window is a daily time range given as offsets from local midnight. An End
+// before Start wraps past midnight, so {22h, 4h} allows 22:00 to 04:00.
+type Window struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// Contains reports whether t falls inside the window.
+func (w Window) Contains(t time.Time) bool {
+	if w.Start == w.End {
+		return true
+	}
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	since := t.Sub(midnight)
+	if w.Start < w.End {
+		return since >= w.Start && since < w.End
+	}
+	return since >= w.Start || since < w.End
+}
+
+func (c CompactionOptions) enabled() bool {
+	return c.MinDeadRatio > 0 || c.MinDeadBytes > 0 || c.MaxSegments > 0
+}
+
+// candidates returns the segments a background merge should rewrite, and
+// whether the stats cross any threshold at all. Without a Policy, the
+// immutable segments over MinDeadRatio are picked.
+func (c CompactionOptions) candidates(s Stats) ([]int64, bool) {
+	var dead int64
+	for _, seg := range s.Segments {
+		if !seg.Active {
+			dead += seg.DeadBytes
+		}
+	}
+	var ids []int64
+	if c.MinDeadRatio > 0 {
+		ids = MostFragmented(c.MinDeadRatio, 0)(s.Segments)
+	}
+	due := len(ids) > 0 ||
+		(c.MinDeadBytes > 0 && dead >= c.MinDeadBytes) ||
+		(c.MaxSegments > 0 && len(s.Segments) > c.MaxSegments)
+	if due && c.Policy != nil {
+		ids = c.Policy(s.Segments)
+	}
+	return ids, due
+}
+
+// MergePolicy picks the segments to pass to MergeSegments. Returning no
+// segments makes the scheduler fall back to a full Merge.
+type MergePolicy func(segments []SegmentStats) []int64
+
+// MostFragmented picks up to n immutable segments whose dead ratio is at
+// least minDeadRatio, most fragmented first. An n of zero means no limit.
+func MostFragmented(minDeadRatio float64, n int) MergePolicy {
+	return func(segments []SegmentStats) []int64 {
+		var picked []SegmentStats
+		for _, seg := range segments {
+			if !seg.Active && seg.DeadBytes > 0 && seg.DeadRatio() >= minDeadRatio {
+				picked = append(picked, seg)
+			}
+		}
+		sort.SliceStable(picked, func(i, j int) bool { return picked[i].DeadRatio() > picked[j].DeadRatio() })
+		if n > 0 && len(picked) > n {
+			picked = picked[:n]
+		}
+		ids := make([]int64, len(picked))
+		for i, seg := range picked {
+			ids[i] = seg.ID
+		}
+		slices.Sort(ids)
+		return ids
+	}
+}
+
+// CompactionStatus is a snapshot of the background compaction scheduler.
+type CompactionStatus struct {
+	Enabled bool
+	Paused  bool
+	Running bool
+	// Runs counts merges started by the scheduler.
+	Runs      int
+	LastCheck time.Time
+	LastRun   time.Time
+	LastError error
+}
+
+// compactor runs merges in the background whenever the thresholds in opts
+// are crossed. Merges take the same path as Bcask.Merge, so foreground
+// calls only wait for the brief index swap.
+type compactor struct {
+	b      *Bcask
+	opts   CompactionOptions
+	paused atomic.Bool
+	wake   chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+	closed sync.Once
+
+	mu     sync.Mutex
+	status CompactionStatus
+	// fruitless holds the write count at the last merge that reclaimed
+	// nothing, such as one that only found shadowing records; the ticker
+	// does not merge again until more writes arrive.
+	fruitless uint64
+}
+
+// startCompactor launches the scheduler if compaction is configured.
+func (b *Bcask) startCompactor() {
+	opts := b.options.Compaction
+	if b.options.ReadOnly || !opts.enabled() {
+		return
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = time.Minute
+	}
+	c := &compactor{
+		b:      b,
+		opts:   opts,
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		status: CompactionStatus{Enabled: true},
+	}
+	b.compactor = c
+	go c.run()
+}
+
+func (c *compactor) run() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.check(false)
+		case <-c.wake:
+			c.check(true)
+		}
+	}
+}
+
+// check merges once if the scheduler is not paused, the window is open and
+// a threshold has been crossed. Unless forced, it also waits for new writes
+// after a fruitless merge.
+func (c *compactor) check(forced bool) {
+	now := time.Now()
+	c.mu.Lock()
+	c.status.LastCheck = now
+	c.mu.Unlock()
+	if c.paused.Load() || !c.opts.Window.Contains(now) {
+		return
+	}
+	stats := c.b.Stats()
+	writes := stats.Puts + stats.Deletes
+	if !forced && c.fruitless != 0 && c.fruitless == writes {
+		return
+	}
+	ids, due := c.opts.candidates(stats)
+	if !due {
+		return
+	}
+	c.mu.Lock()
+	c.status.Running = true
+	c.status.Runs++
+	c.status.LastRun = now
+	c.mu.Unlock()
+
+	c.b.logger.Info("compaction triggered", "candidates", ids)
+	var err error
+	if len(ids) > 0 {
+		err = c.b.MergeSegments(ids)
+	} else {
+		err = c.b.Merge()
+	}
+
+	c.fruitless = 0
+	if merges := c.b.Stats().Merges; err == nil && len(merges) > 0 && merges[len(merges)-1].BytesReclaimed <= 0 {
+		c.fruitless = writes
+	}
+
+	c.mu.Lock()
+	c.status.Running = false
+	c.status.LastError = err
+	c.mu.Unlock()
+}
+
+// close stops the scheduler and waits for a running merge to finish.
+func (c *compactor) close() {
+	if c == nil {
+		return
+	}
+	c.closed.Do(func() { close(c.stop) })
+	<-c.done
+}
+
+// PauseCompaction stops the scheduler from starting new merges. A merge that
+// is already running is not interrupted.
+func (b *Bcask) PauseCompaction() {
+	if b.compactor != nil {
+		b.compactor.paused.Store(true)
+	}
+}
+
+// ResumeCompaction undoes PauseCompaction.
+func (b *Bcask) ResumeCompaction() {
+	if b.compactor != nil {
+		b.compactor.paused.Store(false)
+	}
+}
+
+// TriggerCompaction asks the scheduler to check its thresholds now instead
+// of at the next interval. It does not wait for the check.
+func (b *Bcask) TriggerCompaction() {
+	if b.compactor == nil {
+		return
+	}
+	select {
+	case b.compactor.wake <- struct{}{}:
+	default:
+	}
+}
+
+// CompactionStatus reports what the scheduler is doing. Enabled is false
+// when no thresholds were configured or the database is read-only.
+func (b *Bcask) CompactionStatus() CompactionStatus {
+	c := b.compactor
+	if c == nil {
+		return CompactionStatus{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.status
+	s.Paused = c.paused.Load()
+	return s
+}
+
+// SetMaintenanceRate changes the merge and recovery I/O limit at runtime,
+// including for a merge that is already running. Zero removes the limit.
+func (b *Bcask) SetMaintenanceRate(bytesPerSec int64) {
+	b.limiter.SetRate(bytesPerSec)
+}
+
+// MaintenanceRate returns the current merge and recovery I/O limit.
+func (b *Bcask) MaintenanceRate() int64 {
+	return b.limiter.Rate()
+}
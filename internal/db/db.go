@@ -1,17 +1,27 @@
 package db
 
 import (
+	"errors"
 	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sayuyere/bcask/internal/consts"
 	"github.com/sayuyere/bcask/internal/index"
 	"github.com/sayuyere/bcask/internal/item"
+	"github.com/sayuyere/bcask/internal/lockfile"
+	"github.com/sayuyere/bcask/internal/manifest"
+	"github.com/sayuyere/bcask/internal/ratelimit"
 	"github.com/sayuyere/bcask/internal/segment"
+	"github.com/sayuyere/bcask/internal/uuid"
 )
 
 type DB interface {
@@ -46,240 +56,718 @@ type DB interface {
 type Bcask struct {
 	Path       string
 	DBName     string
+	DBID       uuid.UUID              // DBID is stamped into every segment header
 	DBSegments []*segment.FileSegment // Assuming Segment is defined in the segment package
 	Lock       sync.RWMutex           // Assuming Sync.RWMutex is defined elsewhere
 	Index      *index.PrefixTrie
+	mergeLock  sync.Mutex // serializes merges, held without Lock while copying
+	options    Options
+	fileLock   *lockfile.Lock
+	logger     *slog.Logger
+	counters   counters
+	compactor  *compactor
+	limiter    *ratelimit.Limiter // throttles merge and recovery I/O
+	lastStamp  int64              // timestamp of the newest record, see nextStamp
+	logHorizon int64              // see manifest.Manifest.LogHorizon
+	replica    atomic.Bool        // see SetReplica
+	appended   chan struct{}      // closed on the next append, see Appended
+	closed     chan struct{}      // closed by Close
+	isClosed   bool               // set by Close under Lock
+	notifyMu   sync.Mutex         // guards appended and closed
 }
 
-func (b *Bcask) Get(key string) (string, error) {
-	// Implementation of Get method
+// activeSegment returns the segment new records are appended to.
+func (b *Bcask) activeSegment() *segment.FileSegment {
+	return b.DBSegments[len(b.DBSegments)-1]
+}
+
+// checkOpen fails with consts.ErrorDatabaseClosed once Close has run. The
+// caller must hold b.Lock.
+func (b *Bcask) checkOpen() error {
+	if b.isClosed {
+		return consts.ErrorDatabaseClosed
+	}
+	return nil
+}
+
+// segmentByID finds a live segment by its file ID. DBSegments is kept
+// sorted by ID, but IDs are not dense once merges have removed segments.
+func (b *Bcask) segmentByID(id int64) (*segment.FileSegment, error) {
+	i := sort.Search(len(b.DBSegments), func(i int) bool { return b.DBSegments[i].FileID >= id })
+	if i == len(b.DBSegments) || b.DBSegments[i].FileID != id {
+		return nil, fmt.Errorf("%w: %d", consts.ErrorSegmentNotFound, id)
+	}
+	return b.DBSegments[i], nil
+}
+
+func (b *Bcask) get(key string) (string, error) {
+	value, _, err := b.getVersion(key)
+	return value, err
+}
+
+// getVersion reads the value of key along with the timestamp of its record.
+func (b *Bcask) getVersion(key string) (string, int64, error) {
+	defer b.counters.getLatency.since(time.Now())
 	b.Lock.RLock()
 	defer b.Lock.RUnlock()
-	item, err := b.Index.Get(key)
+	if err := b.checkOpen(); err != nil {
+		return "", 0, err
+	}
+	b.counters.gets.Add(1)
+	item, err := b.lookup(key)
 	if err != nil {
-		return "", err
+		b.counters.misses.Add(1)
+		return "", 0, err
 	}
-	kv, err := b.DBSegments[item.FileID].Get(item.Offset)
+	seg, err := b.segmentByID(item.FileID)
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
-	return kv.Value, nil
+	kv, err := seg.Get(item.Offset)
+	if err != nil {
+		return "", 0, err
+	}
+	return kv.Value, item.Timestamp, nil
 }
-func (b *Bcask) Put(key, value string) error {
+func (b *Bcask) put(key, value string) error {
 	// Implementation of Put method
-
+	defer b.counters.putLatency.since(time.Now())
 	b.Lock.Lock()
 	defer b.Lock.Unlock()
-	v := item.MemoryItem{
-		FileID:    int64(len(b.DBSegments)) - 1,
-		ValueSize: int64(len(value)),
-		Offset:    b.DBSegments[len(b.DBSegments)-1].GetOffset(),
-		Timestamp: time.Now().Unix(),
-		// To fix this offset stuff ideally when you have written then use the offsett
+	if err := b.writable(); err != nil {
+		return err
 	}
+	return b.putLocked(key, value, 0)
+}
+
+// putLocked appends a record for key expiring at expiresAt (unix ms, 0 for
+// never). The caller must hold b.Lock.
+func (b *Bcask) putLocked(key, value string, expiresAt int64) error {
 	dkv := item.DiskKV{
 		KeySize:   int64(len(key)),
 		ValueSize: int64(len(value)),
 		Key:       key,
 		Value:     value,
-		Timestamp: v.Timestamp,
+		Timestamp: b.nextStamp(),
+		ExpiresAt: expiresAt,
 	}
-	if int64(len(dkv.Encode())) > consts.SegmentMaxSize {
+	if dkv.EncodedSize() > consts.SegmentMaxSize-consts.SegmentHeaderSize {
 		return consts.ErrorDiskKeyValueBigEntry
 	}
-	err := b.DBSegments[len(b.DBSegments)-1].Write(dkv)
-	if err == nil {
-		return b.Index.Set(key, &v)
-	}
+	return b.applyLocked(dkv)
+}
 
+// applyLocked appends dkv to the active segment, rolling over to a new one
+// when it is full, and updates the index. The caller must hold b.Lock.
+func (b *Bcask) applyLocked(dkv item.DiskKV) error {
+	v := item.MemoryItem{
+		FileID:    b.activeSegment().FileID,
+		ValueSize: dkv.ValueSize,
+		Offset:    b.activeSegment().GetOffset(),
+		Timestamp: dkv.Timestamp,
+		ExpiresAt: dkv.ExpiresAt,
+	}
+	old, _ := b.Index.Get(dkv.Key)
+	err := b.activeSegment().Write(dkv)
 	if err == consts.ErrorSegmentCapacityFull {
-		b.AddNewSegment()
-		err = b.DBSegments[len(b.DBSegments)-1].Write(dkv)
-		if err == nil {
-			return b.Index.Set(key, &v)
+		if err := b.AddNewSegment(); err != nil {
+			return err
 		}
+		v.FileID = b.activeSegment().FileID
+		v.Offset = b.activeSegment().GetOffset()
+		err = b.activeSegment().Write(dkv)
 	}
+	if err != nil {
+		return err
+	}
+	b.counters.bytesWritten.Add(dkv.EncodedSize())
+	b.activeSegment().AddLive(dkv.EncodedSize())
+	b.notifyAppended()
+	if old != nil {
+		b.markDead(dkv.Key, old)
+	}
+	if dkv.Tombstone {
+		// A tombstone is never pointed at by the index.
+		b.activeSegment().MarkDead(dkv.EncodedSize())
+		b.counters.deletes.Add(1)
+		if old == nil {
+			return nil
+		}
+		return b.Index.Delete(dkv.Key)
+	}
+	b.counters.puts.Add(1)
+	return b.Index.Set(dkv.Key, &v)
+}
 
-	return err // Placeholder return
+func (b *Bcask) roll() error {
+	b.Lock.Lock()
+	defer b.Lock.Unlock()
+	if err := b.writable(); err != nil {
+		return err
+	}
+	return b.AddNewSegment()
 }
 
+// AddNewSegment rolls over to a fresh active segment and records it in the
+// manifest. The caller must hold b.Lock.
 func (b *Bcask) AddNewSegment() error {
-	fmt.Println("Adding a new segment: ", len(b.DBSegments))
-	b.DBSegments = append(b.DBSegments, segment.NewFileSegment(b.Path, int64(len(b.DBSegments)), 0))
-	return nil
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	if b.options.ReadOnly {
+		return consts.ErrorReadOnly
+	}
+	nextID := b.activeSegment().FileID + 1
+	seg, err := segment.NewFileSegment(b.Path, nextID, b.DBID, b.options.segmentOptions())
+	if err != nil {
+		return fmt.Errorf("failed to add segment: %w", err)
+	}
+	b.DBSegments = append(b.DBSegments, seg)
+	b.logger.Info("segment roll", "from_segment", nextID-1, "segment_id", nextID)
+	return b.writeManifest()
+}
+
+// writeManifest records the current set of live segments. The caller must
+// hold b.Lock.
+func (b *Bcask) writeManifest() error {
+	m := manifest.New(b.DBID, segmentIDs(b.DBSegments))
+	m.LogHorizon = b.logHorizon
+	return manifest.Write(b.Path, m)
 }
 
-func (b *Bcask) Delete(key string) error {
+func (b *Bcask) delete(key string) error {
 	// Implementation of Delete method
+	defer b.counters.deleteLatency.since(time.Now())
 	b.Lock.Lock()
 	defer b.Lock.Unlock()
-	item, err := b.Index.Get(key)
-	if err != nil {
+	if err := b.writable(); err != nil {
 		return err
 	}
-	err = b.DBSegments[item.FileID].Delete(*item)
-	if err != nil {
+	return b.deleteLocked(key)
+}
+
+// deleteLocked removes key by appending a tombstone for it. The caller
+// must hold b.Lock.
+func (b *Bcask) deleteLocked(key string) error {
+	if _, err := b.lookup(key); err != nil {
 		return err
 	}
-	return b.Index.Delete(key)
+	return b.applyLocked(item.DiskKV{
+		KeySize:   int64(len(key)),
+		Key:       key,
+		Timestamp: b.nextStamp(),
+		Tombstone: true,
+	})
 }
+
+// ListKeys returns every key in ascending order.
 func (b *Bcask) ListKeys() ([]string, error) {
-	// Implementation of ListKeys method
+	return b.ListKeysWithPrefix("")
+}
+
+// ListKeysWithPrefix returns the keys starting with prefix in ascending
+// order.
+func (b *Bcask) ListKeysWithPrefix(prefix string) ([]string, error) {
 	b.Lock.RLock()
 	defer b.Lock.RUnlock()
-	return nil, nil // Placeholder return
+	if err := b.checkOpen(); err != nil {
+		return nil, err
+	}
+	var keys []string
+	now := time.Now()
+	err := b.Index.WalkPrefix(prefix, func(key string, value *item.MemoryItem) error {
+		if !value.Expired(now) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
 }
-func (b *Bcask) Fold(fn func(key, value string, acc interface{}) interface{}, acc interface{}) interface{} {
-	// Implementation of Fold method
-	return acc // Placeholder return
+
+// Scan calls fn with every key starting with prefix and its value, in
+// ascending key order. The keys are taken up front and each value is read
+// when its key is reached, so fn may call back into the database; keys
+// deleted in the meantime are skipped. A non-nil error from fn stops the
+// scan and is returned.
+func (b *Bcask) Scan(prefix string, fn func(key, value string) error) error {
+	keys, err := b.ListKeysWithPrefix(prefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		value, err := b.get(key)
+		if errors.Is(err, consts.ErrorKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
 }
-func (b *Bcask) Merge() error {
-	// Implementation of Merge method
-	return nil // Placeholder return
+
+// Fold applies fn to every key and value in ascending key order, threading
+// acc through the calls. It has the same consistency as Scan.
+func (b *Bcask) Fold(fn func(key, value string, acc interface{}) interface{}, acc interface{}) interface{} {
+	b.Scan("", func(key, value string) error {
+		acc = fn(key, value, acc)
+		return nil
+	})
+	return acc
 }
-func (b *Bcask) Sync() error {
+func (b *Bcask) sync() error {
 	// Implementation of Sync method
 	b.Lock.Lock()
-	defer func() {
-		b.Lock.Unlock()
-		for _, v := range b.DBSegments {
-			// v.Close()
-			v.OSFile.Sync()
-		}
-	}()
-	indexfile, err := os.Create(filepath.Join(b.Path, consts.IndexFileName))
-	if err != nil {
-		return err
-	}
-	encodedData, err := b.Index.Encode()
-	if err != nil {
+	defer b.Lock.Unlock()
+	if err := b.checkOpen(); err != nil {
 		return err
 	}
-	writtenByte, err := indexfile.WriteAt(encodedData, 0)
-	if err != nil {
-		return err
+	if b.options.ReadOnly {
+		return nil
 	}
-	if writtenByte != len(encodedData) {
-		return consts.ErrorMMapIncompleteWrite
+	for _, v := range b.DBSegments {
+		start := time.Now()
+		err := v.OSFile.Sync()
+		b.counters.fsyncLatency.since(start)
+		if err != nil {
+			return err
+		}
 	}
-	if err := indexfile.Sync(); err != nil {
-		return err
+	return b.writeIndex()
+}
+
+// Close writes the index and releases the database. Closing it again does
+// nothing.
+func (b *Bcask) Close() error {
+	b.notifyClosed()
+	b.compactor.close()
+	b.mergeLock.Lock()
+	defer b.mergeLock.Unlock()
+	b.Lock.Lock()
+	defer b.Lock.Unlock()
+	if b.isClosed {
+		return nil
 	}
-	if err := indexfile.Close(); err != nil {
-		return err
+	b.isClosed = true
+	defer b.release()
+	if b.options.ReadOnly {
+		return nil
 	}
+	return b.writeIndex()
+}
 
-	return nil // Placeholder return
+// release unmaps and closes the segment files and drops the directory lock.
+func (b *Bcask) release() {
+	for _, v := range b.DBSegments {
+		closeSegment(v)
+	}
+	b.fileLock.Release()
 }
 
-func (b *Bcask) Close() error {
-	// Fix index stuff
-	b.Lock.Lock()
-	defer func() {
-		b.Lock.Unlock()
-		for _, v := range b.DBSegments {
-			// v.Close()
-			v.OSFile.Close()
-		}
+// writeIndex streams the index into a temporary file and renames it over
+// index_file, so a crash mid-write never leaves a torn index behind.
+// The caller must hold b.Lock.
+func (b *Bcask) writeIndex() error {
+	active := b.activeSegment()
+	return b.writeIndexFile(b.Path, active.FileID, active.GetOffset())
+}
 
-	}()
-	indexfile, err := os.OpenFile(filepath.Join(b.Path, consts.IndexFileName), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+// writeIndexFile writes the index to dir checkpointed at the given end of
+// the log. The caller must hold b.Lock, for reading at least.
+func (b *Bcask) writeIndexFile(dir string, segmentID, offset int64) error {
+	indexLoc := filepath.Join(dir, consts.IndexFileName)
+	tmpLoc := indexLoc + consts.TempFileSuffix
+	indexfile, err := os.OpenFile(tmpLoc, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
 	if err != nil {
 		return err
 	}
-	encodedData, err := b.Index.Encode()
-	if err != nil {
-		return err
+	header := index.FileHeader{
+		Flags:             index.FlagPrefixCompressed,
+		CheckpointSegment: segmentID,
+		CheckpointOffset:  offset,
 	}
-	writtenByte, err := indexfile.WriteAt(encodedData, 0)
-	if err != nil {
+	if err := b.Index.EncodeTo(indexfile, header); err != nil {
+		indexfile.Close()
 		return err
 	}
-	if writtenByte != len(encodedData) {
-		return consts.ErrorMMapIncompleteWrite
-	}
-	if err := indexfile.Sync(); err != nil {
+	start := time.Now()
+	err = indexfile.Sync()
+	b.counters.fsyncLatency.since(start)
+	if err != nil {
+		indexfile.Close()
 		return err
 	}
 	if err := indexfile.Close(); err != nil {
 		return err
 	}
+	return os.Rename(tmpLoc, indexLoc)
+}
+
+// NewBcask creates a fresh database in path/dbName, replacing segment 0 if
+// one exists. It panics if the database cannot be created or is locked.
+func NewBcask(path string, dbName string, opts ...Option) *Bcask {
+	b, err := newBcask(path, dbName, buildOptions(opts))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// LoadBcask opens an existing database. The MANIFEST decides which segment
+// files are live; databases created before manifests existed are migrated
+// by scanning the directory once. The index is loaded from index_file and
+// brought up to date by replaying records written after its checkpoint, or
+// rebuilt from the segments when index_file is missing. It panics if the
+// database cannot be opened or is locked.
+func LoadBcask(path string, dbName string, opts ...Option) *Bcask {
+	b, err := loadBcask(path, dbName, buildOptions(opts))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// Open loads the database in path/dbName, creating it if the directory holds
+// no database yet. Unlike NewBcask and LoadBcask it reports failures, such
+// as consts.ErrorDatabaseLocked, as errors.
+func Open(path string, dbName string, opts ...Option) (*Bcask, error) {
+	options := buildOptions(opts)
+	if !hasDatabase(filepath.Join(path, dbName)) && !options.ReadOnly {
+		return newBcask(path, dbName, options)
+	}
+	return loadBcask(path, dbName, options)
+}
+
+// Load is Open for a database that must exist already. A directory holding
+// neither a MANIFEST nor segment files fails with
+// consts.ErrorDatabaseNotFound and is left untouched.
+func Load(path string, dbName string, opts ...Option) (*Bcask, error) {
+	fullPath := filepath.Clean(filepath.Join(path, dbName))
+	if !hasDatabase(fullPath) {
+		return nil, fmt.Errorf("%w: %s", consts.ErrorDatabaseNotFound, fullPath)
+	}
+	return loadBcask(path, dbName, buildOptions(opts))
+}
 
-	return nil // Placeholder return
+// hasDatabase reports whether dir holds a MANIFEST or, for databases that
+// predate it, segment files.
+func hasDatabase(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, consts.ManifestFileName))
+	if !errors.Is(err, os.ErrNotExist) {
+		return true
+	}
+	segments, _ := filepath.Glob(filepath.Join(dir, consts.SegmentPrefix+"*"))
+	return len(segments) > 0
 }
 
-func NewBcask(path string, dbName string) *Bcask {
+func newBcask(path string, dbName string, options Options) (*Bcask, error) {
+	if options.ReadOnly {
+		return nil, fmt.Errorf("cannot create a database: %w", consts.ErrorReadOnly)
+	}
 	// Use filepath.Join for platform-neutral path construction
 	fullPath := filepath.Join(path, dbName)
 	fullPath = filepath.Clean(fullPath)
 	if err := os.MkdirAll(fullPath, 0755); err != nil {
-		panic("failed to create database directory: " + err.Error())
+		return nil, fmt.Errorf("failed to create database directory: %v", err)
+	}
+	fileLock, err := lockfile.Acquire(filepath.Join(fullPath, consts.LockFileName), false)
+	if err != nil {
+		return nil, err
 	}
 	currentIndex := index.NewPrefixTrie()
+	currentIndex.Logger = options.logger()
+	dbID, err := uuid.New()
+	if err != nil {
+		fileLock.Release()
+		return nil, err
+	}
+	firstSegment, err := segment.NewFileSegment(fullPath, 0, dbID, options.segmentOptions())
+	if err != nil {
+		fileLock.Release()
+		return nil, fmt.Errorf("failed to create segment: %v", err)
+	}
 
-	var allSegments []*segment.FileSegment = []*segment.FileSegment{segment.NewFileSegment(fullPath, 0, 0)}
-	return &Bcask{
+	var allSegments []*segment.FileSegment = []*segment.FileSegment{firstSegment}
+	b := &Bcask{
 		Path:       fullPath,
 		DBName:     dbName,
+		DBID:       dbID,
 		DBSegments: allSegments,
 		Lock:       sync.RWMutex{},
 		Index:      currentIndex,
+		options:    options,
+		fileLock:   fileLock,
+		logger:     options.logger(),
+		limiter:    ratelimit.New(options.MaintenanceRate),
+	}
+	if err := b.writeManifest(); err != nil {
+		b.release()
+		return nil, fmt.Errorf("failed to write manifest: %v", err)
 	}
+	b.startCompactor()
+	return b, nil
 }
 
-func LoadBcask(path string, dbName string) *Bcask {
+func loadBcask(path string, dbName string, options Options) (*Bcask, error) {
 	// Use filepath.Join for platform-neutral path construction
 	fullPath := filepath.Join(path, dbName)
 	fullPath = filepath.Clean(fullPath)
-	indexLoc := filepath.Join(fullPath, consts.IndexFileName)
-	indexData, err := os.ReadFile(indexLoc)
-	if err != nil {
-		panic(err)
+	if _, err := os.Stat(fullPath); err != nil {
+		return nil, err
+	}
+	fileLock, err := lockfile.Acquire(filepath.Join(fullPath, consts.LockFileName), options.ReadOnly)
+	if err != nil && !(options.ReadOnly && errors.Is(err, os.ErrNotExist)) {
+		return nil, err
+	}
+	// A read-only opener never creates the LOCK file, so a snapshot that no
+	// writer ever locked is opened without one.
+
+	var segments []*segment.FileSegment
+	var dbID uuid.UUID
+	m, err := manifest.Read(fullPath)
+	switch {
+	case err == nil:
+		dbID = m.DatabaseID
+		segments, err = openSegments(fullPath, m.Segments, dbID, options.segmentOptions())
+	case errors.Is(err, os.ErrNotExist):
+		segments, dbID, err = loadSegments(fullPath, uuid.Nil, options.segmentOptions())
 	}
-	currentIndex := index.NewPrefixTrie()
-	err = currentIndex.Decode(indexData)
 	if err != nil {
-		panic(err)
+		fileLock.Release()
+		return nil, err
 	}
-	return &Bcask{
+
+	currentIndex := index.NewPrefixTrie()
+	currentIndex.Logger = options.logger()
+	b := &Bcask{
 		Path:       fullPath,
 		DBName:     dbName,
-		DBSegments: LoadSegments(fullPath),
+		DBID:       dbID,
+		DBSegments: segments,
 		Lock:       sync.RWMutex{},
 		Index:      currentIndex,
+		options:    options,
+		fileLock:   fileLock,
+		logger:     options.logger(),
+		limiter:    ratelimit.New(options.MaintenanceRate),
+	}
+	if m != nil {
+		b.logHorizon = m.LogHorizon
+		b.warnUnlistedSegments(m.Segments)
+	}
+	if !options.ReadOnly {
+		removeMergeLeftovers(fullPath)
+		if m == nil {
+			if err := b.writeManifest(); err != nil {
+				b.release()
+				return nil, fmt.Errorf("failed to write manifest: %v", err)
+			}
+		}
+		// Records are only appended to segments of the current format, so
+		// older ones are sealed.
+		if b.activeSegment().Header.Version < consts.SegmentFormatVersion {
+			if err := b.AddNewSegment(); err != nil {
+				b.release()
+				return nil, err
+			}
+		}
+	}
+	if err := b.loadIndex(); err != nil {
+		b.release()
+		return nil, err
+	}
+	b.recountSegments()
+	b.startCompactor()
+	return b, nil
+}
+
+func openSegments(dir string, ids []int64, dbID uuid.UUID, opts segment.Options) ([]*segment.FileSegment, error) {
+	segments := make([]*segment.FileSegment, 0, len(ids))
+	for _, id := range ids {
+		seg, err := segment.OpenFileSegment(dir, id, dbID, opts)
+		if err != nil {
+			for _, opened := range segments {
+				closeSegment(opened)
+			}
+			return nil, fmt.Errorf("failed to open segment listed in manifest: %w", err)
+		}
+		segments = append(segments, seg)
+	}
+	return segments, nil
+}
+
+// warnUnlistedSegments reports segment files the manifest does not know
+// about; they are left alone but never read.
+func (b *Bcask) warnUnlistedSegments(listed []int64) {
+	files, _ := filepath.Glob(filepath.Join(b.Path, consts.SegmentPrefix+"*"))
+	for _, file := range files {
+		var id int64
+		if _, err := fmt.Sscanf(filepath.Base(file), consts.SegmentPrefix+"%d", &id); err != nil {
+			continue
+		}
+		if !slices.Contains(listed, id) && filepath.Base(file) == consts.SegmentPrefix+strconv.FormatInt(id, 10) {
+			b.logger.Warn("ignoring segment file not listed in manifest", "segment_id", id, "path", file)
+		}
+	}
+}
+
+// removeMergeLeftovers deletes output of a merge that crashed before it was
+// swapped in; it is not referenced by the manifest.
+func removeMergeLeftovers(dir string) {
+	leftovers, _ := filepath.Glob(filepath.Join(dir, consts.SegmentPrefix+"*"+consts.MergeFileSuffix))
+	for _, leftover := range leftovers {
+		os.Remove(leftover)
+	}
+}
+
+// loadIndex reads index_file and replays every record written after its
+// checkpoint. Without an index file all segments are replayed.
+func (b *Bcask) loadIndex() error {
+	checkpoint := index.FileHeader{
+		CheckpointSegment: b.DBSegments[0].FileID,
+		CheckpointOffset:  b.DBSegments[0].DataStart(),
+	}
+	indexFile, err := os.Open(filepath.Join(b.Path, consts.IndexFileName))
+	switch {
+	case err == nil:
+		defer indexFile.Close()
+		header, err := b.Index.DecodeFrom(indexFile)
+		if err != nil {
+			return err
+		}
+		if header.Version != 0 {
+			checkpoint = header
+		}
+	case errors.Is(err, os.ErrNotExist):
+		b.logger.Warn("index file missing, rebuilding index from segments")
+	default:
+		return err
+	}
+	if err := b.replay(checkpoint.CheckpointSegment, checkpoint.CheckpointOffset); err != nil {
+		return err
+	}
+	return b.Index.WalkPrefix("", func(_ string, value *item.MemoryItem) error {
+		b.lastStamp = max(b.lastStamp, value.Timestamp)
+		return nil
+	})
+}
+
+// replay applies the records stored at or after (fromSegment, fromOffset)
+// to the index, in the order they were written.
+func (b *Bcask) replay(fromSegment int64, fromOffset int64) error {
+	b.logger.Info("recovery started", "from_segment", fromSegment, "from_offset", fromOffset)
+	total := 0
+	now := time.Now()
+	for _, seg := range b.DBSegments {
+		if seg.FileID < fromSegment {
+			continue
+		}
+		start := seg.DataStart()
+		if seg.FileID == fromSegment {
+			start = max(fromOffset, seg.DataStart())
+		}
+		records := 0
+		end, err := seg.Scan(start, func(offset int64, kv item.DiskKV) error {
+			b.limiter.WaitN(kv.EncodedSize())
+			records++
+			b.lastStamp = max(b.lastStamp, kv.Timestamp)
+			if kv.Timestamp == 0 || kv.Tombstone || kv.Expired(now) {
+				return b.Index.Delete(kv.Key)
+			}
+			return b.Index.Set(kv.Key, &item.MemoryItem{
+				FileID:    seg.FileID,
+				ValueSize: kv.ValueSize,
+				Offset:    offset,
+				Timestamp: kv.Timestamp,
+				ExpiresAt: kv.ExpiresAt,
+			})
+		})
+		if err != nil {
+			b.logger.Error("recovery failed", "segment_id", seg.FileID, "offset", end, "error", err)
+			return fmt.Errorf("failed to replay segment %d: %w", seg.FileID, err)
+		}
+		total += records
+		b.logger.Info("recovery progress", "segment_id", seg.FileID, "from_offset", start, "offset", end, "records", records)
+	}
+	b.logger.Info("recovery finished", "records", total)
+	return nil
+}
+
+// LoadSegments opens every segment file in completePath in ID order. All
+// segments must carry dbID in their header; when dbID is nil it is taken
+// from the first segment and returned. It is only used for databases that
+// predate the MANIFEST, whose oldest segments also predate the segment
+// header and record no database ID. A new one is made up if none does.
+func LoadSegments(completePath string, dbID uuid.UUID) ([]*segment.FileSegment, uuid.UUID) {
+	segments, dbID, err := loadSegments(completePath, dbID, segment.Options{})
+	if err != nil {
+		panic(err)
 	}
+	return segments, dbID
 }
 
-func LoadSegments(completePath string) []*segment.FileSegment {
+func loadSegments(completePath string, dbID uuid.UUID, opts segment.Options) ([]*segment.FileSegment, uuid.UUID, error) {
 	files, err := os.ReadDir(completePath)
 	if err != nil {
-		panic(fmt.Sprintf("failed to read segment directory: %v", err))
+		return nil, dbID, fmt.Errorf("failed to read segment directory: %v", err)
 	}
 
-	var segments []*segment.FileSegment
+	var ids []int64
 	for _, file := range files {
 		if file.IsDir() {
 			continue
 		}
-		// Assuming segment files have a specific extension, e.g., ".seg"
-
 		if !strings.HasPrefix(file.Name(), consts.SegmentPrefix) {
 			continue
 		}
-		// Extract segment ID from filename, e.g., "1.seg" -> 1
+		// Extract segment ID from filename, e.g., "segment_file_1" -> 1
 		var id int64
 		_, err := fmt.Sscanf(file.Name(), consts.SegmentPrefix+"%d", &id)
 		if err != nil {
 			continue
 		}
-		seg := segment.OpenFileSegment(completePath, id, 0)
+		ids = append(ids, id)
+	}
+	// ReadDir sorts by name, which puts segment_file_10 before segment_file_2.
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var segments []*segment.FileSegment
+	for _, id := range ids {
+		seg, err := segment.OpenFileSegment(completePath, id, dbID, opts)
+		if err != nil {
+			for _, opened := range segments {
+				closeSegment(opened)
+			}
+			return nil, dbID, fmt.Errorf("failed to open segment: %w", err)
+		}
+		if seg.Header.Version != 0 {
+			dbID = seg.Header.DatabaseID
+		}
 		segments = append(segments, seg)
 	}
+	if dbID.IsNil() {
+		if dbID, err = uuid.New(); err != nil {
+			for _, opened := range segments {
+				closeSegment(opened)
+			}
+			return nil, dbID, err
+		}
+	}
 
 	// If no segments found, create a new one
 	if len(segments) == 0 {
-		segments = append(segments, segment.NewFileSegment(completePath, 0, 0))
+		if opts.ReadOnly {
+			return nil, dbID, fmt.Errorf("no segments in %s: %w", completePath, consts.ErrorReadOnly)
+		}
+		seg, err := segment.NewFileSegment(completePath, 0, dbID, opts)
+		if err != nil {
+			return nil, dbID, fmt.Errorf("failed to create segment: %v", err)
+		}
+		segments = append(segments, seg)
 	}
 
-	return segments
+	return segments, dbID, nil
 }
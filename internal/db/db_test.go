@@ -1,13 +1,25 @@
 package db
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/sayuyere/bcask/internal/consts"
+	"github.com/sayuyere/bcask/internal/index"
+	"github.com/sayuyere/bcask/internal/item"
+	"github.com/sayuyere/bcask/internal/manifest"
+	"github.com/vmihailenco/msgpack/v5"
 )
 
 // Helper function to create a temporary directory for each test
@@ -233,6 +245,43 @@ func TestBcaskIndexSerialization(t *testing.T) {
 		if _, err := os.Stat(indexFilePath); err != nil {
 			t.Errorf("Index file does not exist at %s: %v", indexFilePath, err)
 		}
+		data, err := os.ReadFile(indexFilePath)
+		if err != nil {
+			t.Fatalf("Failed to read index file: %v", err)
+		}
+		if !index.IsIndexFile(data) {
+			t.Errorf("Index file is not in the streamed index format")
+		}
+	})
+
+	t.Run("legacy msgpack index is loaded and rewritten", func(t *testing.T) {
+		indexFilePath := filepath.Join(b.Path, consts.IndexFileName)
+		legacy, err := msgpack.Marshal(b.Index.Root)
+		if err != nil {
+			t.Fatalf("Failed to marshal legacy index: %v", err)
+		}
+		if err := os.WriteFile(indexFilePath, legacy, 0666); err != nil {
+			t.Fatalf("Failed to write legacy index: %v", err)
+		}
+
+		b2 := LoadBcask(tempDir, dbName)
+		got, err := b2.Get("mykey")
+		if err != nil {
+			t.Fatalf("Get after legacy load failed: %v", err)
+		}
+		if got != "myvalue" {
+			t.Errorf("Expected value %q, got %q", "myvalue", got)
+		}
+		if err := b2.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		data, err := os.ReadFile(indexFilePath)
+		if err != nil {
+			t.Fatalf("Failed to read index file: %v", err)
+		}
+		if !index.IsIndexFile(data) {
+			t.Errorf("Legacy index was not rewritten in the streamed format")
+		}
 	})
 }
 
@@ -278,6 +327,8 @@ func TestBcaskDBSerialization(t *testing.T) {
 	})
 
 	t.Run("multiple keys survive reload", func(t *testing.T) {
+		// b was closed by an earlier subtest.
+		b := LoadBcask(tempDir, dbName)
 		keys := []string{"k1", "k2", "k3"}
 		values := []string{"v1", "v2", "v3"}
 		for i := range keys {
@@ -302,6 +353,8 @@ func TestBcaskDBSerialization(t *testing.T) {
 	})
 
 	t.Run("deleted key is not found after reload", func(t *testing.T) {
+		// b was closed by an earlier subtest.
+		b := LoadBcask(tempDir, dbName)
 		key := "todelete"
 		value := "someval"
 		if err := b.Put(key, value); err != nil {
@@ -321,3 +374,1888 @@ func TestBcaskDBSerialization(t *testing.T) {
 		}
 	})
 }
+
+func TestBcaskSegmentHeaders(t *testing.T) {
+	tempDir := createTempDir(t)
+	defer cleanupTempDir(t, tempDir)
+
+	dbName := "segment_header_db"
+	b := NewBcask(tempDir, dbName)
+	if err := b.Put("first", "1"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	t.Run("writes after reload do not clobber existing records", func(t *testing.T) {
+		b2 := LoadBcask(tempDir, dbName)
+		if b2.DBID != b.DBID {
+			t.Errorf("Expected database id %s after reload, got %s", b.DBID, b2.DBID)
+		}
+		if err := b2.Put("second", "2"); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		for key, want := range map[string]string{"first": "1", "second": "2"} {
+			got, err := b2.Get(key)
+			if err != nil {
+				t.Fatalf("Get %q failed: %v", key, err)
+			}
+			if got != want {
+				t.Errorf("Expected %q for %q, got %q", want, key, got)
+			}
+		}
+		if err := b2.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+	})
+
+	t.Run("segment from another database is rejected", func(t *testing.T) {
+		other := NewBcask(tempDir, "other_db")
+		if err := other.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		src := filepath.Join(tempDir, "other_db", consts.SegmentPrefix+"0")
+		dst := filepath.Join(tempDir, dbName, consts.SegmentPrefix+"1")
+		if err := os.Link(src, dst); err != nil {
+			t.Fatalf("Failed to link segment: %v", err)
+		}
+		// Only a database without a MANIFEST picks up segments by scanning.
+		if err := os.Remove(filepath.Join(tempDir, dbName, consts.ManifestFileName)); err != nil {
+			t.Fatalf("Failed to remove manifest: %v", err)
+		}
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Expected LoadBcask to reject a misplaced segment")
+			}
+		}()
+		LoadBcask(tempDir, dbName)
+	})
+
+	t.Run("database written before segment headers loads", func(t *testing.T) {
+		writeHeaderlessDatabase(t, filepath.Join(tempDir, "headerless_db"))
+		b2 := LoadBcask(tempDir, "headerless_db")
+		if b2.DBID.IsNil() {
+			t.Errorf("Expected a database id to be assigned")
+		}
+		for key, want := range map[string]string{"key0": "value0", "key1": "rewritten"} {
+			got, err := b2.Get(key)
+			if err != nil || got != want {
+				t.Errorf("Expected %q for %q, got %q (%v)", want, key, got, err)
+			}
+		}
+		if _, err := b2.Get("key2"); err != consts.ErrorKeyNotFound {
+			t.Errorf("Expected deleted key to be missing, got %v", err)
+		}
+		if len(b2.DBSegments) != 2 || b2.DBSegments[0].Header.Version != 0 {
+			t.Fatalf("Expected the headerless segment to be sealed, got %d segments", len(b2.DBSegments))
+		}
+		if err := b2.Put("key3", "value3"); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if err := b2.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+
+		b3, err := Open(tempDir, "headerless_db")
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		defer b3.Close()
+		if b3.DBID != b2.DBID {
+			t.Errorf("Expected database id %s after reload, got %s", b2.DBID, b3.DBID)
+		}
+		if err := b3.Merge(); err != nil {
+			t.Fatalf("Merge failed: %v", err)
+		}
+		for key, want := range map[string]string{"key0": "value0", "key1": "rewritten", "key3": "value3"} {
+			got, err := b3.Get(key)
+			if err != nil || got != want {
+				t.Errorf("Expected %q for %q after merge, got %q (%v)", want, key, got, err)
+			}
+		}
+		if b3.DBSegments[0].Header.Version != consts.SegmentFormatVersion {
+			t.Errorf("Expected merge to rewrite the headerless segment, got version %d", b3.DBSegments[0].Header.Version)
+		}
+	})
+}
+
+// writeHeaderlessDatabase lays out dir the way the first releases did: a
+// preallocated segment with records from offset 0, a deleted record with its
+// timestamp zeroed, a msgpack index, and no MANIFEST.
+func writeHeaderlessDatabase(t *testing.T, dir string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("Failed to create database directory: %v", err)
+	}
+	trie := index.NewPrefixTrie()
+	data := make([]byte, consts.SegmentMaxSize)
+	var offset int64
+	for _, kv := range [][2]string{{"key0", "value0"}, {"key1", "value1"}, {"key2", "value2"}, {"key1", "rewritten"}} {
+		// timestamp | key_size | value_size | key | value, without flags
+		stamp := uint64(1700000000)
+		if kv[0] == "key2" {
+			stamp = 0
+		} else if err := trie.Set(kv[0], &item.MemoryItem{ValueSize: int64(len(kv[1])), Offset: offset, Timestamp: int64(stamp)}); err != nil {
+			t.Fatalf("Failed to index %q: %v", kv[0], err)
+		}
+		record := binary.BigEndian.AppendUint64(nil, stamp)
+		record = binary.BigEndian.AppendUint64(record, uint64(len(kv[0])))
+		record = binary.BigEndian.AppendUint64(record, uint64(len(kv[1])))
+		record = append(record, kv[0]+kv[1]...)
+		offset += int64(copy(data[offset:], record))
+	}
+	if err := os.WriteFile(filepath.Join(dir, consts.SegmentPrefix+"0"), data, 0666); err != nil {
+		t.Fatalf("Failed to write segment: %v", err)
+	}
+	legacy, err := msgpack.Marshal(trie.Root)
+	if err != nil {
+		t.Fatalf("Failed to marshal legacy index: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, consts.IndexFileName), legacy, 0666); err != nil {
+		t.Fatalf("Failed to write legacy index: %v", err)
+	}
+}
+
+func TestBcaskManifest(t *testing.T) {
+	tempDir := createTempDir(t)
+	defer cleanupTempDir(t, tempDir)
+
+	dbName := "manifest_db"
+	b := NewBcask(tempDir, dbName)
+	m, err := manifest.Read(b.Path)
+	if err != nil {
+		t.Fatalf("Manifest not written by NewBcask: %v", err)
+	}
+	if m.DatabaseID != b.DBID || len(m.Segments) != 1 || m.ActiveSegment != 0 {
+		t.Errorf("Unexpected manifest after create: %+v", m)
+	}
+
+	t.Run("segment roll updates manifest", func(t *testing.T) {
+		if err := b.Put("k", "v"); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		b.Lock.Lock()
+		err := b.AddNewSegment()
+		b.Lock.Unlock()
+		if err != nil {
+			t.Fatalf("AddNewSegment failed: %v", err)
+		}
+		m, err := manifest.Read(b.Path)
+		if err != nil {
+			t.Fatalf("Read manifest failed: %v", err)
+		}
+		if len(m.Segments) != 2 || m.ActiveSegment != 1 {
+			t.Errorf("Expected 2 segments with active 1, got %+v", m)
+		}
+	})
+
+	t.Run("unlisted segment files are ignored on load", func(t *testing.T) {
+		if err := b.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		stray := filepath.Join(b.Path, consts.SegmentPrefix+"7")
+		if err := os.WriteFile(stray, []byte("leftover"), 0666); err != nil {
+			t.Fatalf("Failed to write stray file: %v", err)
+		}
+		b2 := LoadBcask(tempDir, dbName)
+		defer b2.Close()
+		if len(b2.DBSegments) != 2 {
+			t.Errorf("Expected 2 segments from manifest, got %d", len(b2.DBSegments))
+		}
+		got, err := b2.Get("k")
+		if err != nil || got != "v" {
+			t.Errorf("Expected %q, got %q (%v)", "v", got, err)
+		}
+	})
+
+	t.Run("Load does not create a database", func(t *testing.T) {
+		empty := filepath.Join(tempDir, "not_a_db")
+		if err := os.Mkdir(empty, 0755); err != nil {
+			t.Fatalf("Mkdir failed: %v", err)
+		}
+		if _, err := Load(tempDir, "not_a_db"); !errors.Is(err, consts.ErrorDatabaseNotFound) {
+			t.Errorf("Expected ErrorDatabaseNotFound, got %v", err)
+		}
+		if entries, _ := os.ReadDir(empty); len(entries) != 0 {
+			t.Errorf("Load left files behind: %v", entries)
+		}
+	})
+
+	t.Run("index is rebuilt from segments when missing", func(t *testing.T) {
+		b3 := LoadBcask(tempDir, dbName)
+		if err := b3.Put("k2", "v2"); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if err := b3.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		if err := os.Remove(filepath.Join(b3.Path, consts.IndexFileName)); err != nil {
+			t.Fatalf("Failed to remove index: %v", err)
+		}
+		b4 := LoadBcask(tempDir, dbName)
+		defer b4.Close()
+		for key, want := range map[string]string{"k": "v", "k2": "v2"} {
+			got, err := b4.Get(key)
+			if err != nil || got != want {
+				t.Errorf("Expected %q for %q, got %q (%v)", want, key, got, err)
+			}
+		}
+	})
+}
+
+func TestBcaskMerge(t *testing.T) {
+	tempDir := createTempDir(t)
+	defer cleanupTempDir(t, tempDir)
+
+	dbName := "merge_db"
+	b := NewBcask(tempDir, dbName)
+	value := string(make([]byte, 256*1024))
+
+	// Rewrite the same few keys until several segments are full of garbage.
+	for round := 0; round < 8; round++ {
+		for i := 0; i < 4; i++ {
+			if err := b.Put("key"+strconv.Itoa(i), strconv.Itoa(round)+value); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+		}
+	}
+	if err := b.Delete("key3"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	before := len(b.DBSegments)
+	if before < 3 {
+		t.Fatalf("Expected at least 3 segments before merge, got %d", before)
+	}
+
+	if err := b.Merge(); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	if len(b.DBSegments) >= before {
+		t.Errorf("Expected fewer than %d segments after merge, got %d", before, len(b.DBSegments))
+	}
+	check := func(t *testing.T, b *Bcask) {
+		for i := 0; i < 3; i++ {
+			got, err := b.Get("key" + strconv.Itoa(i))
+			if err != nil {
+				t.Fatalf("Get failed: %v", err)
+			}
+			if got != "7"+value {
+				t.Errorf("Unexpected value for key%d after merge", i)
+			}
+		}
+		if _, err := b.Get("key3"); err == nil {
+			t.Errorf("Deleted key resurrected by merge")
+		}
+	}
+	check(t, b)
+
+	m, err := manifest.Read(b.Path)
+	if err != nil {
+		t.Fatalf("Read manifest failed: %v", err)
+	}
+	if len(m.Segments) != len(b.DBSegments) {
+		t.Errorf("Manifest lists %d segments, database has %d", len(m.Segments), len(b.DBSegments))
+	}
+
+	if err := b.Put("after", "merge"); err != nil {
+		t.Fatalf("Put after merge failed: %v", err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	b2 := LoadBcask(tempDir, dbName)
+	defer b2.Close()
+	check(t, b2)
+	if got, err := b2.Get("after"); err != nil || got != "merge" {
+		t.Errorf("Expected %q, got %q (%v)", "merge", got, err)
+	}
+}
+
+func TestBcaskDirectoryLock(t *testing.T) {
+	tempDir := createTempDir(t)
+	defer cleanupTempDir(t, tempDir)
+
+	dbName := "lock_db"
+	b, err := Open(tempDir, dbName)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := b.Put("k", "v"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	t.Run("second writer is rejected while open", func(t *testing.T) {
+		if _, err := Open(tempDir, dbName); !errors.Is(err, consts.ErrorDatabaseLocked) {
+			t.Errorf("Expected ErrorDatabaseLocked, got %v", err)
+		}
+		if _, err := Open(tempDir, dbName, WithReadOnly()); !errors.Is(err, consts.ErrorDatabaseLocked) {
+			t.Errorf("Expected ErrorDatabaseLocked for reader while writer is open, got %v", err)
+		}
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Expected LoadBcask to panic on a locked database")
+			}
+		}()
+		LoadBcask(tempDir, dbName)
+	})
+
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	t.Run("closed handle rejects operations", func(t *testing.T) {
+		if err := b.Put("k", "other"); !errors.Is(err, consts.ErrorDatabaseClosed) {
+			t.Errorf("Expected ErrorDatabaseClosed from Put, got %v", err)
+		}
+		if _, err := b.Get("k"); !errors.Is(err, consts.ErrorDatabaseClosed) {
+			t.Errorf("Expected ErrorDatabaseClosed from Get, got %v", err)
+		}
+		if err := b.Delete("k"); !errors.Is(err, consts.ErrorDatabaseClosed) {
+			t.Errorf("Expected ErrorDatabaseClosed from Delete, got %v", err)
+		}
+		if _, err := b.ListKeys(); !errors.Is(err, consts.ErrorDatabaseClosed) {
+			t.Errorf("Expected ErrorDatabaseClosed from ListKeys, got %v", err)
+		}
+		if err := b.Sync(); !errors.Is(err, consts.ErrorDatabaseClosed) {
+			t.Errorf("Expected ErrorDatabaseClosed from Sync, got %v", err)
+		}
+		if err := b.Merge(); !errors.Is(err, consts.ErrorDatabaseClosed) {
+			t.Errorf("Expected ErrorDatabaseClosed from Merge, got %v", err)
+		}
+		if err := b.AddNewSegment(); !errors.Is(err, consts.ErrorDatabaseClosed) {
+			t.Errorf("Expected ErrorDatabaseClosed from AddNewSegment, got %v", err)
+		}
+	})
+
+	t.Run("readers share the lock and exclude writers", func(t *testing.T) {
+		r1, err := Open(tempDir, dbName, WithReadOnly())
+		if err != nil {
+			t.Fatalf("Read-only open failed: %v", err)
+		}
+		r2, err := Open(tempDir, dbName, WithReadOnly())
+		if err != nil {
+			t.Fatalf("Second read-only open failed: %v", err)
+		}
+		if _, err := Open(tempDir, dbName); !errors.Is(err, consts.ErrorDatabaseLocked) {
+			t.Errorf("Expected ErrorDatabaseLocked for writer while readers are open, got %v", err)
+		}
+		if got, err := r1.Get("k"); err != nil || got != "v" {
+			t.Errorf("Expected %q, got %q (%v)", "v", got, err)
+		}
+		if err := r2.Put("k", "other"); !errors.Is(err, consts.ErrorReadOnly) {
+			t.Errorf("Expected ErrorReadOnly from Put, got %v", err)
+		}
+		if err := r1.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		if err := r2.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+	})
+
+	t.Run("lock is released on close", func(t *testing.T) {
+		b2, err := Open(tempDir, dbName)
+		if err != nil {
+			t.Fatalf("Open after close failed: %v", err)
+		}
+		if err := b2.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+	})
+}
+
+// snapshotDir records the name, size and content of every file in dir.
+func snapshotDir(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Failed to read dir: %v", err)
+	}
+	files := make(map[string]string)
+	for _, e := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", e.Name(), err)
+		}
+		files[e.Name()] = string(data)
+	}
+	return files
+}
+
+func TestBcaskReadOnly(t *testing.T) {
+	tempDir := createTempDir(t)
+	defer cleanupTempDir(t, tempDir)
+
+	b := NewBcask(tempDir, "source")
+	for i := 0; i < 100; i++ {
+		if err := b.Put("key"+strconv.Itoa(i), "value"+strconv.Itoa(i)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	end := b.activeSegment().GetOffset()
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// Build a snapshot the way a backup job would: no LOCK file, segment
+	// trimmed to the bytes in use and no index, so it has to be replayed.
+	snapshot := filepath.Join(tempDir, "snapshot")
+	if err := os.MkdirAll(snapshot, 0755); err != nil {
+		t.Fatalf("Failed to create snapshot dir: %v", err)
+	}
+	seg, err := os.ReadFile(filepath.Join(b.Path, consts.SegmentPrefix+"0"))
+	if err != nil {
+		t.Fatalf("Failed to read segment: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(snapshot, consts.SegmentPrefix+"0"), seg[:end], 0444); err != nil {
+		t.Fatalf("Failed to write segment: %v", err)
+	}
+	mf, err := os.ReadFile(filepath.Join(b.Path, consts.ManifestFileName))
+	if err != nil {
+		t.Fatalf("Failed to read manifest: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(snapshot, consts.ManifestFileName), mf, 0444); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+	before := snapshotDir(t, snapshot)
+
+	ro, err := Open(tempDir, "snapshot", WithReadOnly())
+	if err != nil {
+		t.Fatalf("Read-only open failed: %v", err)
+	}
+	t.Run("reads are served", func(t *testing.T) {
+		got, err := ro.Get("key42")
+		if err != nil || got != "value42" {
+			t.Errorf("Expected %q, got %q (%v)", "value42", got, err)
+		}
+	})
+	t.Run("mutations fail with ErrorReadOnly", func(t *testing.T) {
+		if err := ro.Put("key1", "x"); !errors.Is(err, consts.ErrorReadOnly) {
+			t.Errorf("Put: expected ErrorReadOnly, got %v", err)
+		}
+		if err := ro.Delete("key1"); !errors.Is(err, consts.ErrorReadOnly) {
+			t.Errorf("Delete: expected ErrorReadOnly, got %v", err)
+		}
+		if err := ro.Merge(); !errors.Is(err, consts.ErrorReadOnly) {
+			t.Errorf("Merge: expected ErrorReadOnly, got %v", err)
+		}
+		if err := ro.DBSegments[0].Write(item.DiskKV{Key: "k", KeySize: 1, Timestamp: 1}); !errors.Is(err, consts.ErrorReadOnly) {
+			t.Errorf("Segment write: expected ErrorReadOnly, got %v", err)
+		}
+	})
+	if err := ro.Sync(); err != nil {
+		t.Errorf("Sync failed: %v", err)
+	}
+	if err := ro.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	after := snapshotDir(t, snapshot)
+	if len(after) != len(before) {
+		t.Errorf("Read-only open changed the set of files: %d before, %d after", len(before), len(after))
+	}
+	for name, content := range before {
+		if after[name] != content {
+			t.Errorf("Read-only open modified %s", name)
+		}
+	}
+}
+
+func TestBcaskLogging(t *testing.T) {
+	tempDir := createTempDir(t)
+	defer cleanupTempDir(t, tempDir)
+
+	var buf bytes.Buffer
+	handler := slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})
+	dbName := "logging_db"
+	b := NewBcask(tempDir, dbName, WithLogHandler(handler))
+
+	value := string(make([]byte, 1024*1024))
+	for i := 0; i < 6; i++ {
+		if err := b.Put("key", value); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := b.Merge(); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	b2 := LoadBcask(tempDir, dbName, WithLogHandler(handler))
+	if err := b2.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	logs := buf.String()
+	for _, want := range []string{
+		`"msg":"segment created"`,
+		`"msg":"segment roll","from_segment":0,"segment_id":1`,
+		`"msg":"merge started"`,
+		`"msg":"merge finished"`,
+		`"msg":"recovery progress","segment_id":1`,
+		`"msg":"recovery finished"`,
+	} {
+		if !strings.Contains(logs, want) {
+			t.Errorf("Expected log output to contain %s", want)
+		}
+	}
+
+	t.Run("silent by default", func(t *testing.T) {
+		quiet := NewBcask(tempDir, "quiet_db")
+		defer quiet.Close()
+		if quiet.logger.Enabled(context.Background(), slog.LevelError) {
+			t.Errorf("Logger without a handler should discard everything")
+		}
+	})
+}
+
+func TestBcaskStats(t *testing.T) {
+	tempDir := createTempDir(t)
+	defer cleanupTempDir(t, tempDir)
+
+	dbName := "stats_db"
+	b := NewBcask(tempDir, dbName)
+	recordSize := func(key, value string) int64 {
+		return item.DiskKVHeaderSize + int64(len(key)+len(value))
+	}
+
+	if err := b.Put("a", "1"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := b.Put("b", "22"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := b.Put("a", "333"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := b.Delete("b"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	b.Get("a")
+	b.Get("missing")
+
+	s := b.Stats()
+	t.Run("operation counters", func(t *testing.T) {
+		if s.Puts != 3 || s.Deletes != 1 || s.Gets != 2 || s.Misses != 1 {
+			t.Errorf("Unexpected counters: puts=%d deletes=%d gets=%d misses=%d", s.Puts, s.Deletes, s.Gets, s.Misses)
+		}
+		if s.Keys != 1 {
+			t.Errorf("Expected 1 key, got %d", s.Keys)
+		}
+		if s.IndexMemoryBytes <= 0 {
+			t.Errorf("Expected a positive index memory estimate, got %d", s.IndexMemoryBytes)
+		}
+	})
+
+	t.Run("live and dead bytes", func(t *testing.T) {
+		tombstone := recordSize("b", "")
+		written := recordSize("a", "1") + recordSize("b", "22") + recordSize("a", "333") + tombstone
+		if s.BytesWritten != written {
+			t.Errorf("Expected %d bytes written, got %d", written, s.BytesWritten)
+		}
+		if len(s.Segments) != 1 || !s.Segments[0].Active {
+			t.Fatalf("Expected a single active segment, got %+v", s.Segments)
+		}
+		seg := s.Segments[0]
+		if seg.LiveBytes != recordSize("a", "333") {
+			t.Errorf("Expected %d live bytes, got %d", recordSize("a", "333"), seg.LiveBytes)
+		}
+		if dead := recordSize("a", "1") + recordSize("b", "22") + tombstone; seg.DeadBytes != dead {
+			t.Errorf("Expected %d dead bytes, got %d", dead, seg.DeadBytes)
+		}
+		if seg.BytesUsed != seg.LiveBytes+seg.DeadBytes {
+			t.Errorf("Used bytes %d do not add up to live %d + dead %d", seg.BytesUsed, seg.LiveBytes, seg.DeadBytes)
+		}
+		if seg.Writes != 4 {
+			t.Errorf("Expected 4 segment writes, got %d", seg.Writes)
+		}
+	})
+
+	t.Run("accounting survives reload", func(t *testing.T) {
+		if err := b.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		b2 := LoadBcask(tempDir, dbName)
+		defer b2.Close()
+		s2 := b2.Stats()
+		if s2.LiveBytes != s.LiveBytes || s2.DeadBytes != s.DeadBytes {
+			t.Errorf("Expected live/dead %d/%d after reload, got %d/%d", s.LiveBytes, s.DeadBytes, s2.LiveBytes, s2.DeadBytes)
+		}
+		if s2.Puts != 0 {
+			t.Errorf("Operation counters should start at zero, got %d puts", s2.Puts)
+		}
+	})
+
+	t.Run("merge history", func(t *testing.T) {
+		b3 := NewBcask(tempDir, "stats_merge_db")
+		defer b3.Close()
+		value := string(make([]byte, 1024*1024))
+		for i := 0; i < 6; i++ {
+			if err := b3.Put("key", value); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+		}
+		if err := b3.Merge(); err != nil {
+			t.Fatalf("Merge failed: %v", err)
+		}
+		s3 := b3.Stats()
+		if len(s3.Merges) != 1 {
+			t.Fatalf("Expected 1 merge in history, got %d", len(s3.Merges))
+		}
+		if s3.Merges[0].BytesReclaimed <= 0 {
+			t.Errorf("Expected merge to reclaim space, got %d", s3.Merges[0].BytesReclaimed)
+		}
+		for _, seg := range s3.Segments {
+			if !seg.Active && seg.DeadBytes != 0 {
+				t.Errorf("Merged segment %d still has %d dead bytes", seg.ID, seg.DeadBytes)
+			}
+		}
+	})
+}
+
+type ctxKey struct{}
+
+func TestBcaskHooks(t *testing.T) {
+	tempDir := createTempDir(t)
+	defer cleanupTempDir(t, tempDir)
+
+	var events []string
+	tracer := HookFuncs{
+		BeforeFunc: func(ctx context.Context, call *Call) (context.Context, error) {
+			events = append(events, "before "+string(call.Op)+" "+call.Key)
+			return context.WithValue(ctx, ctxKey{}, "span-"+string(call.Op)), nil
+		},
+		AfterFunc: func(ctx context.Context, call *Call, err error) {
+			span, _ := ctx.Value(ctxKey{}).(string)
+			events = append(events, "after "+span+" "+call.Value+" "+strconv.FormatBool(err == nil))
+		},
+	}
+	errDenied := errors.New("denied")
+	acl := HookFuncs{
+		BeforeFunc: func(ctx context.Context, call *Call) (context.Context, error) {
+			if strings.HasPrefix(call.Key, "secret/") {
+				return ctx, errDenied
+			}
+			return ctx, nil
+		},
+	}
+	b := NewBcask(tempDir, "hooks_db", WithHooks(tracer, acl))
+	defer b.Close()
+
+	if err := b.PutContext(context.Background(), "k", "v"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if v, err := b.Get("k"); err != nil || v != "v" {
+		t.Fatalf("Get = %q, %v", v, err)
+	}
+	if err := b.Put("secret/k", "v"); !errors.Is(err, errDenied) {
+		t.Fatalf("Put of a denied key returned %v", err)
+	}
+	if _, err := b.Get("secret/k"); !errors.Is(err, errDenied) {
+		t.Fatalf("Get of a denied key returned %v", err)
+	}
+	if err := b.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if err := b.Roll(); err != nil {
+		t.Fatalf("Roll failed: %v", err)
+	}
+
+	want := []string{
+		"before put k", "after span-put v true",
+		"before get k", "after span-get v true",
+		"before put secret/k", "after span-put v false",
+		"before get secret/k", "after span-get  false",
+		"before sync ", "after span-sync  true",
+		"before roll ", "after span-roll  true",
+	}
+	if !slices.Equal(events, want) {
+		t.Errorf("Hook events = %q, want %q", events, want)
+	}
+
+	t.Run("cancelled context", func(t *testing.T) {
+		events = nil
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := b.DeleteContext(ctx, "k"); !errors.Is(err, context.Canceled) {
+			t.Errorf("Delete with a cancelled context returned %v", err)
+		}
+		if len(events) != 0 {
+			t.Errorf("Hooks ran for a cancelled call: %q", events)
+		}
+		if _, err := b.Get("k"); err != nil {
+			t.Errorf("Key was deleted despite the cancelled context: %v", err)
+		}
+	})
+
+	t.Run("nil context from Before keeps the previous one", func(t *testing.T) {
+		var got []any
+		lazy := HookFuncs{
+			BeforeFunc: func(ctx context.Context, call *Call) (context.Context, error) {
+				return nil, nil
+			},
+			AfterFunc: func(ctx context.Context, call *Call, err error) {
+				got = append(got, ctx.Value(ctxKey{}))
+			},
+		}
+		b2 := NewBcask(tempDir, "nil_hook_db", WithHooks(tracer, lazy, tracer))
+		defer b2.Close()
+		events = nil
+		ctx := context.WithValue(context.Background(), ctxKey{}, "caller")
+		if err := b2.PutContext(ctx, "k", "v"); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if len(got) != 1 || got[0] != "span-put" {
+			t.Errorf("After of the nil-returning hook saw %q, want the context of the hook before it", got)
+		}
+		want := []string{"before put k", "before put k", "after span-put v true", "after span-put v true"}
+		if !slices.Equal(events, want) {
+			t.Errorf("Hook events = %q, want %q", events, want)
+		}
+	})
+}
+
+func TestBcaskCompaction(t *testing.T) {
+	tempDir := createTempDir(t)
+	defer cleanupTempDir(t, tempDir)
+
+	waitFor := func(cond func() bool) bool {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if cond() {
+				return true
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		return false
+	}
+
+	b := NewBcask(tempDir, "compaction_db", WithCompaction(CompactionOptions{
+		Interval:     10 * time.Millisecond,
+		MinDeadRatio: 0.5,
+	}))
+	defer b.Close()
+	if status := b.CompactionStatus(); !status.Enabled || status.Paused {
+		t.Fatalf("Unexpected initial status %+v", status)
+	}
+
+	b.PauseCompaction()
+	value := string(make([]byte, 1024*1024))
+	for i := 0; i < 8; i++ {
+		if err := b.Put("key", value); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	b.TriggerCompaction()
+	if !waitFor(func() bool { return !b.CompactionStatus().LastCheck.IsZero() }) {
+		t.Fatalf("Scheduler never checked its thresholds")
+	}
+	if runs := b.CompactionStatus().Runs; runs != 0 {
+		t.Errorf("Paused scheduler ran %d merges", runs)
+	}
+
+	b.ResumeCompaction()
+	if !waitFor(func() bool { return len(b.Stats().Merges) > 0 }) {
+		t.Fatalf("Scheduler never merged the fragmented segments")
+	}
+	if !waitFor(func() bool { return !b.CompactionStatus().Running }) {
+		t.Fatalf("Merge never finished")
+	}
+	status := b.CompactionStatus()
+	if status.Runs == 0 || status.LastError != nil {
+		t.Errorf("Unexpected status after merge %+v", status)
+	}
+	if v, err := b.Get("key"); err != nil || v != value {
+		t.Errorf("Get after background merge failed: %v", err)
+	}
+
+	t.Run("disabled without thresholds", func(t *testing.T) {
+		plain := NewBcask(tempDir, "plain_db")
+		defer plain.Close()
+		if plain.CompactionStatus().Enabled {
+			t.Errorf("Compaction should be disabled without thresholds")
+		}
+		plain.TriggerCompaction()
+		plain.PauseCompaction()
+	})
+
+	t.Run("window", func(t *testing.T) {
+		at := func(h int) time.Time { return time.Date(2024, 1, 1, h, 0, 0, 0, time.Local) }
+		day := Window{Start: 9 * time.Hour, End: 17 * time.Hour}
+		night := Window{Start: 22 * time.Hour, End: 4 * time.Hour}
+		cases := []struct {
+			w    Window
+			h    int
+			want bool
+		}{
+			{Window{}, 3, true},
+			{day, 9, true},
+			{day, 17, false},
+			{day, 3, false},
+			{night, 23, true},
+			{night, 2, true},
+			{night, 12, false},
+		}
+		for _, c := range cases {
+			if got := c.w.Contains(at(c.h)); got != c.want {
+				t.Errorf("%+v.Contains(%d:00) = %v, want %v", c.w, c.h, got, c.want)
+			}
+		}
+	})
+
+	t.Run("closing twice", func(t *testing.T) {
+		if err := b.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		if err := b.Close(); err != nil {
+			t.Errorf("Second Close failed: %v", err)
+		}
+	})
+}
+
+func TestBcaskMergeSegments(t *testing.T) {
+	tempDir := createTempDir(t)
+	defer cleanupTempDir(t, tempDir)
+
+	dbName := "merge_segments_db"
+	b := NewBcask(tempDir, dbName)
+	value := func(s string) string { return s + string(make([]byte, 1024*1024)) }
+	// Three records fill a segment: 0 = a1 a2 a3, 1 = b1 b2 x, 2 = c1 c2 x, 3 = d.
+	for _, key := range []string{"a1", "a2", "a3", "b1", "b2", "x", "c1", "c2"} {
+		if err := b.Put(key, value(key)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := b.Put("x", value("x2")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := b.Put("d", value("d")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if got := len(b.DBSegments); got != 4 {
+		t.Fatalf("Expected 4 segments, got %d", got)
+	}
+	for _, key := range []string{"a1", "a2", "c1"} {
+		if err := b.Delete(key); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+
+	policy := MostFragmented(0.5, 0)
+	if ids := policy(b.Stats().Segments); !slices.Equal(ids, []int64{0}) {
+		t.Errorf("MostFragmented(0.5) picked %v, want [0]", ids)
+	}
+	if ids := MostFragmented(0.1, 1)(b.Stats().Segments); !slices.Equal(ids, []int64{0}) {
+		t.Errorf("MostFragmented(0.1, 1) picked %v, want [0]", ids)
+	}
+
+	if err := b.MergeSegments([]int64{3}); !errors.Is(err, consts.ErrorMergeActiveSegment) {
+		t.Errorf("Merging the active segment returned %v", err)
+	}
+	if err := b.MergeSegments([]int64{7}); !errors.Is(err, consts.ErrorSegmentNotFound) {
+		t.Errorf("Merging an unknown segment returned %v", err)
+	}
+
+	untouched := b.DBSegments[1]
+	if err := b.MergeSegments([]int64{0, 2}); err != nil {
+		t.Fatalf("MergeSegments failed: %v", err)
+	}
+	if b.DBSegments[1] != untouched {
+		t.Errorf("Segment 1 was rewritten although it was not selected")
+	}
+	if ids := segmentIDs(b.DBSegments); !slices.Equal(ids, []int64{0, 1, 2, 3}) {
+		t.Errorf("Segments after merge = %v", ids)
+	}
+	// The tombstones of the deletes are in the active segment, which is
+	// not merged; they are all that is dead there.
+	tombstones := 3 * (&item.DiskKV{KeySize: 2, Tombstone: true}).EncodedSize()
+	for _, seg := range b.Stats().Segments {
+		want := int64(0)
+		switch seg.ID {
+		case 1:
+			continue
+		case 3:
+			want = tombstones
+		}
+		if seg.DeadBytes != want {
+			t.Errorf("Segment %d has %d dead bytes, want %d", seg.ID, seg.DeadBytes, want)
+		}
+	}
+	merges := b.Stats().Merges
+	if len(merges) != 1 || !slices.Equal(merges[0].SegmentsIn, []int64{0, 2}) {
+		t.Errorf("Unexpected merge history %+v", merges)
+	}
+
+	check := func(b *Bcask) {
+		t.Helper()
+		for _, key := range []string{"a3", "b1", "b2", "c2", "d"} {
+			if v, err := b.Get(key); err != nil || v != value(key) {
+				t.Errorf("Get(%s) failed: %v", key, err)
+			}
+		}
+		if v, err := b.Get("x"); err != nil || v != value("x2") {
+			t.Errorf("Get(x) returned a stale value or failed: %v", err)
+		}
+		for _, key := range []string{"a1", "a2", "c1"} {
+			if _, err := b.Get(key); err == nil {
+				t.Errorf("Deleted key %s is back", key)
+			}
+		}
+	}
+	check(b)
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// Replaying every segment must still end with the newest value of x.
+	if err := os.Remove(filepath.Join(tempDir, dbName, consts.IndexFileName)); err != nil {
+		t.Fatalf("Failed to remove index file: %v", err)
+	}
+	b2 := LoadBcask(tempDir, dbName)
+	defer b2.Close()
+	check(b2)
+}
+
+func TestBcaskMaintenanceRate(t *testing.T) {
+	tempDir := createTempDir(t)
+	defer cleanupTempDir(t, tempDir)
+
+	dbName := "rate_db"
+	b := NewBcask(tempDir, dbName)
+	value := string(make([]byte, 10*1024))
+	for i := 0; i < 15; i++ {
+		if err := b.Put("key"+strconv.Itoa(i), value); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := os.Remove(filepath.Join(tempDir, dbName, consts.IndexFileName)); err != nil {
+		t.Fatalf("Failed to remove index file: %v", err)
+	}
+
+	// ~150KB replayed at 100KB/s, a second's worth of which is burst.
+	start := time.Now()
+	b = LoadBcask(tempDir, dbName, WithMaintenanceRate(100*1024))
+	defer b.Close()
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("Recovery took %v, expected it to be throttled", elapsed)
+	}
+	if got := b.MaintenanceRate(); got != 100*1024 {
+		t.Errorf("MaintenanceRate = %d", got)
+	}
+	if v, err := b.Get("key14"); err != nil || v != value {
+		t.Errorf("Get after throttled recovery failed: %v", err)
+	}
+
+	b.SetMaintenanceRate(0)
+	if got := b.MaintenanceRate(); got != 0 {
+		t.Errorf("MaintenanceRate after reset = %d", got)
+	}
+}
+
+func TestBcaskScan(t *testing.T) {
+	tempDir := createTempDir(t)
+	defer cleanupTempDir(t, tempDir)
+
+	b := NewBcask(tempDir, "scan_db")
+	defer b.Close()
+	for _, key := range []string{"user/2", "user/10", "order/1", "user/1"} {
+		if err := b.Put(key, "v:"+key); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := b.Delete("user/10"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	keys, err := b.ListKeys()
+	if err != nil || !slices.Equal(keys, []string{"order/1", "user/1", "user/2"}) {
+		t.Errorf("ListKeys = %v, %v", keys, err)
+	}
+	keys, err = b.ListKeysWithPrefix("user/")
+	if err != nil || !slices.Equal(keys, []string{"user/1", "user/2"}) {
+		t.Errorf("ListKeysWithPrefix = %v, %v", keys, err)
+	}
+
+	var scanned []string
+	err = b.Scan("user/", func(key, value string) error {
+		scanned = append(scanned, key+"="+value)
+		// Callbacks may write to the database while scanning.
+		return b.Delete("user/2")
+	})
+	if err != nil || !slices.Equal(scanned, []string{"user/1=v:user/1"}) {
+		t.Errorf("Scan = %v, %v", scanned, err)
+	}
+
+	count := b.Fold(func(key, value string, acc interface{}) interface{} {
+		return acc.(int) + 1
+	}, 0)
+	if count != 2 {
+		t.Errorf("Fold counted %v keys, want 2", count)
+	}
+
+	if _, err := b.Get("user/2"); !errors.Is(err, consts.ErrorKeyNotFound) {
+		t.Errorf("Get of a deleted key returned %v", err)
+	}
+}
+
+func TestBcaskApply(t *testing.T) {
+	tempDir := createTempDir(t)
+	defer cleanupTempDir(t, tempDir)
+
+	b := NewBcask(tempDir, "batch_db")
+	defer b.Close()
+	if err := b.Put("old", "1"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	var batch Batch
+	batch.Put("a", "1")
+	batch.Put("b", "2")
+	batch.Delete("a")
+	batch.Delete("old")
+	if err := b.Apply(&batch); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	keys, _ := b.ListKeys()
+	if !slices.Equal(keys, []string{"b"}) {
+		t.Errorf("Keys after Apply = %v, want [b]", keys)
+	}
+
+	t.Run("rejected batches write nothing", func(t *testing.T) {
+		batch.Reset()
+		batch.Put("c", "3")
+		batch.Delete("missing")
+		if err := b.Apply(&batch); !errors.Is(err, consts.ErrorKeyNotFound) {
+			t.Errorf("Apply with a missing delete returned %v", err)
+		}
+		batch.Reset()
+		batch.Put("c", "3")
+		batch.Put("big", string(make([]byte, consts.SegmentMaxSize)))
+		if err := b.Apply(&batch); !errors.Is(err, consts.ErrorDiskKeyValueBigEntry) {
+			t.Errorf("Apply with an oversized value returned %v", err)
+		}
+		if _, err := b.Get("c"); err == nil {
+			t.Errorf("Rejected batch was partially applied")
+		}
+	})
+}
+
+func TestBcaskExpiry(t *testing.T) {
+	tempDir := createTempDir(t)
+	defer cleanupTempDir(t, tempDir)
+
+	dbName := "expiry_db"
+	b := NewBcask(tempDir, dbName)
+	big := string(make([]byte, 1024*1024))
+	// 0 = short a b long plain, 1 = c and later writes.
+	if err := b.PutWithTTL("short", big, 50*time.Millisecond); err != nil {
+		t.Fatalf("PutWithTTL failed: %v", err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if err := b.Put(key, big); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := b.PutWithTTL("long", "v", time.Hour); err != nil {
+		t.Fatalf("PutWithTTL failed: %v", err)
+	}
+	if err := b.Put("plain", "v"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := b.Put("c", big); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	if ttl, err := b.TTL("long"); err != nil || ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Errorf("TTL(long) = %v, %v", ttl, err)
+	}
+	if ttl, err := b.TTL("plain"); err != nil || ttl != NoExpiry {
+		t.Errorf("TTL(plain) = %v, %v", ttl, err)
+	}
+	if _, err := b.TTL("missing"); !errors.Is(err, consts.ErrorKeyNotFound) {
+		t.Errorf("TTL(missing) returned %v", err)
+	}
+
+	t.Run("conditional writes", func(t *testing.T) {
+		if v, err := b.PutWithOptions("plain", "x", PutOptions{IfAbsent: true}); err != nil || v != 0 {
+			t.Errorf("IfAbsent overwrote an existing key: %v, %v", v, err)
+		}
+		if v, err := b.PutWithOptions("new", "x", PutOptions{IfPresent: true}); err != nil || v != 0 {
+			t.Errorf("IfPresent created a missing key: %v, %v", v, err)
+		}
+		if v, err := b.PutWithOptions("plain", "v", PutOptions{IfPresent: true}); err != nil || v == 0 {
+			t.Errorf("IfPresent did not write an existing key: %v, %v", v, err)
+		}
+		if _, err := b.Get("new"); err == nil {
+			t.Errorf("Key written despite its condition")
+		}
+	})
+
+	time.Sleep(60 * time.Millisecond)
+	if _, err := b.Get("short"); !errors.Is(err, consts.ErrorKeyNotFound) {
+		t.Errorf("Get of an expired key returned %v", err)
+	}
+	if err := b.Delete("short"); !errors.Is(err, consts.ErrorKeyNotFound) {
+		t.Errorf("Delete of an expired key returned %v", err)
+	}
+	if keys, _ := b.ListKeys(); !slices.Equal(keys, []string{"a", "b", "c", "long", "plain"}) {
+		t.Errorf("ListKeys = %v", keys)
+	}
+	if keys := b.Stats().Keys; keys != 5 {
+		t.Errorf("Stats counts %d keys, want 5 without the expired one", keys)
+	}
+	if v, err := b.PutWithOptions("short", "again", PutOptions{IfAbsent: true}); err != nil || v == 0 {
+		t.Errorf("IfAbsent did not write over an expired key: %v, %v", v, err)
+	}
+	if ttl, err := b.TTL("short"); err != nil || ttl != NoExpiry {
+		t.Errorf("Rewritten key kept its expiry: %v, %v", ttl, err)
+	}
+	if err := b.Delete("short"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	if err := b.Merge(); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	if merges := b.Stats().Merges; len(merges) != 1 || merges[0].RecordsMoved != 3 || merges[0].BytesReclaimed < int64(len(big)) {
+		t.Errorf("Merge should have moved a, b and long and dropped short, got %+v", merges)
+	}
+
+	check := func(b *Bcask) {
+		t.Helper()
+		if ttl, err := b.TTL("long"); err != nil || ttl <= 59*time.Minute {
+			t.Errorf("TTL(long) after reload = %v, %v", ttl, err)
+		}
+		for _, key := range []string{"a", "b", "c", "plain"} {
+			if _, err := b.Get(key); err != nil {
+				t.Errorf("Get(%s) failed: %v", key, err)
+			}
+		}
+		if _, err := b.Get("short"); err == nil {
+			t.Errorf("Expired key is back")
+		}
+	}
+	check(b)
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	b = LoadBcask(tempDir, dbName)
+	check(b)
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := os.Remove(filepath.Join(tempDir, dbName, consts.IndexFileName)); err != nil {
+		t.Fatalf("Failed to remove index file: %v", err)
+	}
+	b = LoadBcask(tempDir, dbName)
+	defer b.Close()
+	check(b)
+}
+
+func TestBcaskVersions(t *testing.T) {
+	tempDir := createTempDir(t)
+	defer cleanupTempDir(t, tempDir)
+
+	dbName := "version_db"
+	b := NewBcask(tempDir, dbName)
+	var last int64
+	for i := 0; i < 100; i++ {
+		if err := b.Put("k", strconv.Itoa(i)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		_, v, err := b.GetVersion("k")
+		if err != nil || v <= last {
+			t.Fatalf("Version %d after %d: %v", v, last, err)
+		}
+		last = v
+	}
+
+	if v, err := b.PutWithOptions("k", "stale", PutOptions{IfVersion: last - 1}); err != nil || v != 0 {
+		t.Errorf("Put with a stale version wrote %d: %v", v, err)
+	}
+	v, err := b.PutWithOptions("k", "fresh", PutOptions{IfVersion: last})
+	if err != nil || v <= last {
+		t.Fatalf("Put with the current version returned %d: %v", v, err)
+	}
+	if err := b.DeleteVersion("k", last); !errors.Is(err, consts.ErrorVersionMismatch) {
+		t.Errorf("DeleteVersion with a stale version returned %v", err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	b = LoadBcask(tempDir, dbName)
+	defer b.Close()
+	if value, got, err := b.GetVersion("k"); err != nil || value != "fresh" || got != v {
+		t.Errorf("GetVersion after reload = %q, %d, %v; want fresh, %d", value, got, err, v)
+	}
+	if err := b.Put("other", "x"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, got, _ := b.GetVersion("other"); got <= v {
+		t.Errorf("Version after reload %d is not above %d", got, v)
+	}
+	if err := b.DeleteVersion("k", v); err != nil {
+		t.Errorf("DeleteVersion failed: %v", err)
+	}
+}
+
+func TestBcaskLog(t *testing.T) {
+	tempDir := createTempDir(t)
+	defer cleanupTempDir(t, tempDir)
+
+	b := NewBcask(tempDir, "log_db")
+	defer b.Close()
+	big := strings.Repeat("v", 1024*1024)
+	for _, key := range []string{"a", "b", "c", "d", "a"} {
+		if err := b.Put(key, big); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if len(b.DBSegments) < 2 {
+		t.Fatalf("Expected the log to span segments, got %d", len(b.DBSegments))
+	}
+	roll := func() {
+		b.Lock.Lock()
+		defer b.Lock.Unlock()
+		if err := b.AddNewSegment(); err != nil {
+			t.Fatalf("AddNewSegment failed: %v", err)
+		}
+	}
+
+	read := func(c *LogCursor) []string {
+		var ops []string
+		for {
+			records, err := c.Next(1)
+			if err != nil {
+				t.Fatalf("Next failed: %v", err)
+			}
+			if len(records) == 0 {
+				return ops
+			}
+			if len(records) != 1 {
+				t.Fatalf("Next(1) returned %d records", len(records))
+			}
+			if records[0].Tombstone {
+				ops = append(ops, "-"+records[0].Key)
+			} else {
+				ops = append(ops, records[0].Key)
+			}
+		}
+	}
+
+	// A merge rewrites the segments under a cursor; it continues after the
+	// last record it returned.
+	mid := b.NewLogCursor(0)
+	mid.Next(1)
+	roll()
+	if err := b.Put("e", "1"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := b.Merge(); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	if ops := read(mid); !slices.Equal(ops, []string{"b", "c", "d", "a", "e"}) {
+		t.Errorf("Log after merge = %v", ops)
+	}
+
+	if err := b.Delete("b"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	c := b.NewLogCursor(0)
+	if ops := read(c); !slices.Equal(ops, []string{"b", "c", "d", "a", "e", "-b"}) {
+		t.Errorf("Log = %v", ops)
+	}
+	if c.Position() != b.Sequence() {
+		t.Errorf("Cursor stopped at %d, the newest record is %d", c.Position(), b.Sequence())
+	}
+
+	// Once a merge drops the tombstone of b, a cursor that has not read it
+	// cannot continue; one that has, or one starting over, can.
+	roll()
+	if err := b.Merge(); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	if _, err := b.NewLogCursor(1).Next(1); !errors.Is(err, consts.ErrorLogTruncated) {
+		t.Errorf("Reading across a dropped tombstone returned %v", err)
+	}
+	if ops := read(c); len(ops) != 0 {
+		t.Errorf("Cursor at the end read %v", ops)
+	}
+	if ops := read(b.NewLogCursor(0)); !slices.Equal(ops, []string{"c", "d", "a", "e"}) {
+		t.Errorf("Log after dropping the tombstone = %v", ops)
+	}
+
+	t.Run("apply", func(t *testing.T) {
+		replica := NewBcask(tempDir, "replica_db")
+		defer replica.Close()
+		replica.SetReplica(true)
+		if err := replica.Put("x", "1"); !errors.Is(err, consts.ErrorReadOnly) {
+			t.Errorf("Put on a replica returned %v", err)
+		}
+		if err := replica.Roll(); !errors.Is(err, consts.ErrorReadOnly) || len(replica.DBSegments) != 1 {
+			t.Errorf("Roll on a replica returned %v and left %d segments", err, len(replica.DBSegments))
+		}
+		records, err := b.NewLogCursor(0).Next(consts.SegmentMaxSize * 4)
+		if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		for i := 0; i < 2; i++ {
+			if err := replica.ApplyRecords(records); err != nil {
+				t.Fatalf("ApplyRecords failed: %v", err)
+			}
+		}
+		if replica.Sequence() != records[len(records)-1].Timestamp || replica.Stats().Puts != uint64(len(records)) {
+			t.Errorf("Replica at %d with %d puts after applying %d records twice", replica.Sequence(), replica.Stats().Puts, len(records))
+		}
+		if keys, _ := replica.ListKeys(); !slices.Equal(keys, []string{"a", "c", "d", "e"}) {
+			t.Errorf("Replica keys = %v", keys)
+		}
+
+		if err := replica.Reset(); err != nil {
+			t.Fatalf("Reset failed: %v", err)
+		}
+		if keys, _ := replica.ListKeys(); len(keys) != 0 || replica.Sequence() != 0 {
+			t.Errorf("Reset left keys %v at %d", keys, replica.Sequence())
+		}
+	})
+
+	// Records from before segment headers share second-resolution
+	// timestamps; none of them may be skipped.
+	t.Run("headerless database", func(t *testing.T) {
+		writeHeaderlessDatabase(t, filepath.Join(tempDir, "headerless_db"))
+		legacy, err := Open(tempDir, "headerless_db")
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		defer legacy.Close()
+		if err := legacy.Put("key3", "value3"); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if ops := read(legacy.NewLogCursor(0)); !slices.Equal(ops, []string{"key0", "key1", "key1", "key3"}) {
+			t.Errorf("Log = %v", ops)
+		}
+		if ops := read(legacy.NewLogCursor(1700000000)); !slices.Equal(ops, []string{"key0", "key1", "key1", "key3"}) {
+			t.Errorf("Log resumed at a legacy timestamp = %v", ops)
+		}
+		if ops := read(legacy.NewLogCursor(legacy.Sequence())); len(ops) != 0 {
+			t.Errorf("Cursor at the end read %v", ops)
+		}
+		if err := legacy.Merge(); err != nil {
+			t.Fatalf("Merge failed: %v", err)
+		}
+		if ops := read(legacy.NewLogCursor(0)); !slices.Equal(ops, []string{"key0", "key1", "key3"}) {
+			t.Errorf("Log after merge = %v", ops)
+		}
+
+		replica := NewBcask(tempDir, "headerless_replica_db")
+		defer replica.Close()
+		records, err := legacy.NewLogCursor(0).Next(consts.SegmentMaxSize)
+		if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		for i := 0; i < 2; i++ {
+			if err := replica.ApplyRecords(records); err != nil {
+				t.Fatalf("ApplyRecords failed: %v", err)
+			}
+		}
+		for key, want := range map[string]string{"key0": "value0", "key1": "rewritten", "key3": "value3"} {
+			if got, err := replica.Get(key); err != nil || got != want {
+				t.Errorf("Expected %q for %q on the replica, got %q (%v)", want, key, got, err)
+			}
+		}
+	})
+}
+
+func TestBcaskSubscribe(t *testing.T) {
+	tempDir := createTempDir(t)
+	defer cleanupTempDir(t, tempDir)
+
+	b := NewBcask(tempDir, "subscribe_db")
+	for _, key := range []string{"user/1", "order/1", "user/2"} {
+		if err := b.Put(key, key+"-v1"); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	next := func(s *Subscription) Event {
+		t.Helper()
+		select {
+		case ev, ok := <-s.Events():
+			if !ok {
+				t.Fatalf("Subscription ended: %v", s.Err())
+			}
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No event")
+		}
+		return Event{}
+	}
+
+	replay, err := b.Subscribe("user/", 0)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	live, err := b.Subscribe("user/", uint64(b.Sequence())+1)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	if err := b.Put("order/2", "x"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := b.Put("user/1", "user/1-v2"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := b.Delete("user/2"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	var seqs []uint64
+	for i, want := range []Event{
+		{Op: OpPut, Key: "user/1", Value: "user/1-v1"},
+		{Op: OpPut, Key: "user/2", Value: "user/2-v1"},
+		{Op: OpPut, Key: "user/1", Value: "user/1-v2"},
+		{Op: OpDelete, Key: "user/2"},
+	} {
+		ev := next(replay)
+		if ev.Op != want.Op || ev.Key != want.Key || ev.Value != want.Value {
+			t.Errorf("Event %d = %+v, want %+v", i, ev, want)
+		}
+		if ev.Timestamp.UnixNano() != int64(ev.Sequence) {
+			t.Errorf("Event %d has timestamp %v for sequence %d", i, ev.Timestamp, ev.Sequence)
+		}
+		seqs = append(seqs, ev.Sequence)
+	}
+	if !slices.IsSorted(seqs) {
+		t.Errorf("Sequences out of order: %v", seqs)
+	}
+	if ev := next(live); ev.Key != "user/1" || ev.Sequence != seqs[2] {
+		t.Errorf("First live event = %+v, want the second put of user/1", ev)
+	}
+
+	// Resuming from a sequence starts with that event.
+	resumed, err := b.Subscribe("", seqs[3])
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	if ev := next(resumed); ev.Op != OpDelete || ev.Sequence != seqs[3] {
+		t.Errorf("Resumed at %+v, want the delete at %d", ev, seqs[3])
+	}
+
+	live.Close()
+	for range live.Events() {
+	}
+	if live.Err() != nil {
+		t.Errorf("Closed subscription reports %v", live.Err())
+	}
+
+	// A merge that drops the delete of user/2 makes its sequence unreachable.
+	b.Lock.Lock()
+	b.AddNewSegment()
+	b.Lock.Unlock()
+	if err := b.Merge(); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	if _, err := b.Subscribe("", seqs[3]); !errors.Is(err, consts.ErrorLogTruncated) {
+		t.Errorf("Subscribing before a dropped delete returned %v", err)
+	}
+
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	for range replay.Events() {
+	}
+	if !errors.Is(replay.Err(), consts.ErrorDatabaseClosed) {
+		t.Errorf("Subscription after Close reports %v", replay.Err())
+	}
+
+	t.Run("headerless database", func(t *testing.T) {
+		writeHeaderlessDatabase(t, filepath.Join(tempDir, "headerless_db"))
+		legacy, err := Open(tempDir, "headerless_db")
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		defer legacy.Close()
+		s, err := legacy.Subscribe("key0", 0)
+		if err != nil {
+			t.Fatalf("Subscribe failed: %v", err)
+		}
+		defer s.Close()
+		ev := next(s)
+		if ev.Sequence != 1700000000 || !ev.Timestamp.Equal(time.Unix(1700000000, 0)) {
+			t.Errorf("Legacy event has sequence %d and timestamp %v", ev.Sequence, ev.Timestamp)
+		}
+	})
+}
+
+func TestBcaskWatch(t *testing.T) {
+	tempDir := createTempDir(t)
+	defer cleanupTempDir(t, tempDir)
+
+	b := NewBcask(tempDir, "watch_db")
+	if err := b.Put("config", "v1"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	_, v1, _ := b.GetVersion("config")
+
+	type result struct {
+		value   string
+		version int64
+		err     error
+	}
+	watch := func(version int64) <-chan result {
+		done := make(chan result, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			value, version, err := b.WatchVersion(ctx, "config", version)
+			done <- result{value, version, err}
+		}()
+		return done
+	}
+
+	done := watch(v1)
+	if err := b.Put("other", "x"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	select {
+	case r := <-done:
+		t.Fatalf("Watch returned %+v after a write to another key", r)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if err := b.Put("config", "v2"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	r := <-done
+	_, v2, _ := b.GetVersion("config")
+	if r.err != nil || r.value != "v2" || r.version != v2 {
+		t.Errorf("Watch returned %+v, want v2 at %d", r, v2)
+	}
+
+	// A stale version returns at once.
+	if r := <-watch(v1); r.value != "v2" || r.version != v2 {
+		t.Errorf("Watching a stale version returned %+v", r)
+	}
+
+	done = watch(v2)
+	if err := b.Delete("config"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if r := <-done; !errors.Is(r.err, consts.ErrorKeyNotFound) {
+		t.Errorf("Watch after delete returned %+v", r)
+	}
+
+	if err := b.PutWithTTL("config", "v3", 50*time.Millisecond); err != nil {
+		t.Fatalf("PutWithTTL failed: %v", err)
+	}
+	_, v3, _ := b.GetVersion("config")
+	if r := <-watch(v3); !errors.Is(r.err, consts.ErrorKeyNotFound) {
+		t.Errorf("Watch of an expiring key returned %+v", r)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := b.Watch(ctx, "config"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Watch without changes returned %v", err)
+	}
+
+	done = watch(0)
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if r := <-done; !errors.Is(r.err, consts.ErrorDatabaseClosed) {
+		t.Errorf("Watch after Close returned %+v", r)
+	}
+}
+
+func TestBcaskBackup(t *testing.T) {
+	tempDir := createTempDir(t)
+	defer cleanupTempDir(t, tempDir)
+
+	b := NewBcask(tempDir, "backup_db")
+	big := strings.Repeat("v", 1<<20)
+	want := map[string]string{}
+	for i := 0; i < 8; i++ {
+		key := "key" + strconv.Itoa(i)
+		if err := b.Put(key, big+key); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		want[key] = big + key
+	}
+	if err := b.Delete("key3"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	delete(want, "key3")
+	if err := b.PutWithTTL("ttl", "x", time.Hour); err != nil {
+		t.Fatalf("PutWithTTL failed: %v", err)
+	}
+	want["ttl"] = "x"
+	if len(b.DBSegments) < 3 {
+		t.Fatalf("Expected several segments, got %d", len(b.DBSegments))
+	}
+
+	// Writers keep going while the backup runs.
+	stop := make(chan struct{})
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := b.Put("concurrent"+strconv.Itoa(i), "x"); err != nil {
+				t.Errorf("Concurrent Put failed: %v", err)
+				return
+			}
+		}
+	}()
+	dst := filepath.Join(tempDir, "backup")
+	if err := b.Backup(dst); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	close(stop)
+	<-writerDone
+
+	// Changes after the backup, merges included, do not reach it.
+	if err := b.Put("key0", "changed"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := b.Delete("key1"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := b.Merge(); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	if err := b.Backup(dst); !errors.Is(err, consts.ErrorBackupDestination) {
+		t.Errorf("Backup into a non-empty directory returned %v", err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := b.Backup(filepath.Join(tempDir, "closed")); !errors.Is(err, consts.ErrorDatabaseClosed) {
+		t.Errorf("Backup of a closed database returned %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dst, consts.IndexFileName)); err != nil {
+		t.Errorf("Backup has no index: %v", err)
+	}
+	restored, err := Open(tempDir, "backup")
+	if err != nil {
+		t.Fatalf("Opening the backup failed: %v", err)
+	}
+	defer restored.Close()
+	got := map[string]string{}
+	restored.Scan("", func(key, value string) error {
+		if !strings.HasPrefix(key, "concurrent") {
+			got[key] = value
+		}
+		return nil
+	})
+	if len(got) != len(want) {
+		t.Errorf("Backup holds %d keys, want %d", len(got), len(want))
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("Backup has %q = %.10q, want %.10q", key, got[key], value)
+		}
+	}
+	if ttl, err := restored.TTL("ttl"); err != nil || ttl < 59*time.Minute {
+		t.Errorf("Backup lost the TTL: %v, %v", ttl, err)
+	}
+	if restored.DBID != b.DBID {
+		t.Errorf("Backup has database ID %v, want %v", restored.DBID, b.DBID)
+	}
+	if err := restored.Put("after-restore", "1"); err != nil {
+		t.Errorf("Writing to the backup failed: %v", err)
+	}
+}
+
+func TestBcaskIncrementalBackup(t *testing.T) {
+	tempDir := createTempDir(t)
+	defer cleanupTempDir(t, tempDir)
+
+	b := NewBcask(tempDir, "incremental_db")
+	defer b.Close()
+	big := strings.Repeat("v", 1<<20)
+	put := func(key, value string) {
+		t.Helper()
+		if err := b.Put(key, value); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	var chain []string
+	backup := func(name string) *BackupInfo {
+		t.Helper()
+		dir := filepath.Join(tempDir, name)
+		var err error
+		if len(chain) == 0 {
+			err = b.Backup(dir)
+		} else {
+			prev, _ := ReadBackup(chain[len(chain)-1])
+			err = b.BackupIncremental(dir, prev.Until)
+		}
+		if err != nil {
+			t.Fatalf("Backup %s failed: %v", name, err)
+		}
+		chain = append(chain, dir)
+		info, err := ReadBackup(dir)
+		if err != nil {
+			t.Fatalf("ReadBackup failed: %v", err)
+		}
+		return info
+	}
+
+	put("a", "1")
+	put("b", "1")
+	full := backup("full")
+	if full.Incremental || full.Until.Sequence != b.Sequence() {
+		t.Errorf("Full backup info = %+v", full)
+	}
+
+	put("a", "2")
+	if err := b.Delete("b"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := b.PutWithTTL("ttl", "x", time.Hour); err != nil {
+		t.Fatalf("PutWithTTL failed: %v", err)
+	}
+	inc1 := backup("inc1")
+	if !slices.Equal(inc1.Segments, []int64{full.Until.Segment}) || inc1.Since != full.Until {
+		t.Errorf("First incremental = %+v, want the tail of segment %d", inc1, full.Until.Segment)
+	}
+
+	for i := 0; i < 6; i++ {
+		put("big"+strconv.Itoa(i), big)
+	}
+	inc2 := backup("inc2")
+	if len(inc2.Segments) < 2 || inc2.Segments[0] != inc1.Until.Segment {
+		t.Errorf("Second incremental copied segments %v", inc2.Segments)
+	}
+
+	// Rewriting the segment inc2 ended in, keeping its deletes, makes the
+	// next backup read the log instead.
+	put("c", "1")
+	if err := b.Delete("big0"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	b.Lock.Lock()
+	b.AddNewSegment()
+	b.Lock.Unlock()
+	if err := b.MergeSegments([]int64{inc2.Until.Segment}); err != nil {
+		t.Fatalf("MergeSegments failed: %v", err)
+	}
+	put("d", "1")
+	inc3 := backup("inc3")
+	if inc3.Segments[0] != 0 {
+		t.Errorf("Third incremental copied segments %v, want log records", inc3.Segments)
+	}
+
+	restored := filepath.Join(tempDir, "restored")
+	if err := Restore(restored, chain); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	r, err := Open(tempDir, "restored")
+	if err != nil {
+		t.Fatalf("Opening the restored database failed: %v", err)
+	}
+	want, got := map[string]string{}, map[string]string{}
+	b.Scan("", func(key, value string) error { want[key] = value; return nil })
+	r.Scan("", func(key, value string) error { got[key] = value; return nil })
+	if !maps.Equal(got, want) {
+		t.Errorf("Restored %d keys, want %d", len(got), len(want))
+	}
+	if _, err := r.TTL("ttl"); err != nil {
+		t.Errorf("Restored TTL: %v", err)
+	}
+	if r.Sequence() != inc3.Until.Sequence {
+		t.Errorf("Restored sequence %d, want %d", r.Sequence(), inc3.Until.Sequence)
+	}
+	r.Close()
+
+	if err := Restore(filepath.Join(tempDir, "gap"), []string{chain[0], chain[2]}); !errors.Is(err, consts.ErrorBackupChain) {
+		t.Errorf("Restoring with a gap returned %v", err)
+	}
+	if err := Restore(filepath.Join(tempDir, "no_full"), chain[1:]); !errors.Is(err, consts.ErrorBackupChain) {
+		t.Errorf("Restoring without a full backup returned %v", err)
+	}
+
+	// A merge that drops a delete made after the last backup breaks the chain.
+	if err := b.Delete("c"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	b.Lock.Lock()
+	b.AddNewSegment()
+	b.Lock.Unlock()
+	if err := b.Merge(); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	if err := b.BackupIncremental(filepath.Join(tempDir, "inc4"), inc3.Until); !errors.Is(err, consts.ErrorLogTruncated) {
+		t.Errorf("Backup after a dropped delete returned %v", err)
+	}
+}
+
+func TestBcaskBulkLoader(t *testing.T) {
+	tempDir := createTempDir(t)
+	defer cleanupTempDir(t, tempDir)
+
+	l, err := NewBulkLoader(tempDir, "bulk_db")
+	if err != nil {
+		t.Fatalf("NewBulkLoader failed: %v", err)
+	}
+	big := strings.Repeat("v", 100<<10)
+	for i := 0; i < 100; i++ {
+		if err := l.Put("key"+strconv.Itoa(i), big+strconv.Itoa(i), time.Time{}); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := l.Put("key0", "again", time.Time{}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := l.Put("ttl", "x", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := l.Put("expired", "x", time.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if _, err := NewBulkLoader(tempDir, "bulk_db"); !errors.Is(err, consts.ErrorDatabaseExists) {
+		t.Errorf("Loading into an existing database returned %v", err)
+	}
+
+	b, err := Open(tempDir, "bulk_db")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer b.Close()
+	if len(b.DBSegments) < 3 {
+		t.Errorf("Expected the load to roll segments, got %d", len(b.DBSegments))
+	}
+	keys, _ := b.ListKeys()
+	if len(keys) != 101 {
+		t.Errorf("Loaded %d keys, want 101", len(keys))
+	}
+	if got, _ := b.Get("key0"); got != "again" {
+		t.Errorf("key0 = %.10q, want the later value", got)
+	}
+	if got, _ := b.Get("key99"); got != big+"99" {
+		t.Errorf("key99 = %.10q", got)
+	}
+	if ttl, err := b.TTL("ttl"); err != nil || ttl < 59*time.Minute {
+		t.Errorf("TTL of ttl = %v, %v", ttl, err)
+	}
+	if _, err := b.Get("expired"); !errors.Is(err, consts.ErrorKeyNotFound) {
+		t.Errorf("Expired key read returned %v", err)
+	}
+	overwritten := item.DiskKV{KeySize: 4, ValueSize: int64(len(big) + 1)}
+	if s := b.Stats(); s.DeadBytes != overwritten.EncodedSize() {
+		t.Errorf("Dead bytes = %d, want the overwritten key0", s.DeadBytes)
+	}
+}
@@ -0,0 +1,105 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/sayuyere/bcask/internal/consts"
+	"github.com/sayuyere/bcask/internal/item"
+)
+
+// NoExpiry is returned by TTL for keys that never expire.
+const NoExpiry time.Duration = -1
+
+// PutOptions control a conditional or expiring write.
+type PutOptions struct {
+	// TTL makes the key expire after this long. Zero means never; any
+	// earlier expiry of the key is cleared by the write.
+	TTL time.Duration
+	// IfAbsent only writes when the key does not exist.
+	IfAbsent bool
+	// IfPresent only writes when the key exists.
+	IfPresent bool
+	// IfVersion only writes when the key exists at this version.
+	IfVersion int64
+}
+
+// PutWithOptions writes key like Put, subject to opts. It returns the
+// version written, or 0 when a condition did not hold, which is not an
+// error.
+func (b *Bcask) PutWithOptions(key, value string, opts PutOptions) (int64, error) {
+	return b.PutWithOptionsContext(context.Background(), key, value, opts)
+}
+
+func (b *Bcask) PutWithOptionsContext(ctx context.Context, key, value string, opts PutOptions) (int64, error) {
+	var version int64
+	err := b.intercept(ctx, &Call{Op: OpPut, Key: key, Value: value}, func() error {
+		var err error
+		version, err = b.putWithOptions(key, value, opts)
+		return err
+	})
+	return version, err
+}
+
+func (b *Bcask) putWithOptions(key, value string, opts PutOptions) (int64, error) {
+	defer b.counters.putLatency.since(time.Now())
+	b.Lock.Lock()
+	defer b.Lock.Unlock()
+	if err := b.writable(); err != nil {
+		return 0, err
+	}
+	if opts.IfAbsent || opts.IfPresent || opts.IfVersion != 0 {
+		current, err := b.lookup(key)
+		exists := err == nil
+		if (opts.IfAbsent && exists) || (opts.IfPresent && !exists) ||
+			(opts.IfVersion != 0 && (!exists || current.Timestamp != opts.IfVersion)) {
+			return 0, nil
+		}
+	}
+	var expiresAt int64
+	if opts.TTL > 0 {
+		expiresAt = time.Now().Add(opts.TTL).UnixMilli()
+	}
+	if err := b.putLocked(key, value, expiresAt); err != nil {
+		return 0, err
+	}
+	return b.lastStamp, nil
+}
+
+// PutWithTTL stores key so that it expires after ttl. Expired keys read as
+// missing and their records are dropped by the next merge.
+func (b *Bcask) PutWithTTL(key, value string, ttl time.Duration) error {
+	_, err := b.PutWithOptions(key, value, PutOptions{TTL: ttl})
+	return err
+}
+
+// TTL returns how long key has left to live, or NoExpiry. A missing or
+// expired key returns consts.ErrorKeyNotFound.
+func (b *Bcask) TTL(key string) (time.Duration, error) {
+	b.Lock.RLock()
+	defer b.Lock.RUnlock()
+	if err := b.checkOpen(); err != nil {
+		return 0, err
+	}
+	value, err := b.lookup(key)
+	if err != nil {
+		return 0, err
+	}
+	if value.ExpiresAt == 0 {
+		return NoExpiry, nil
+	}
+	return time.Until(time.UnixMilli(value.ExpiresAt)), nil
+}
+
+// lookup returns the index entry of key, treating expired keys as missing.
+// The caller must hold b.Lock.
+func (b *Bcask) lookup(key string) (*item.MemoryItem, error) {
+	value, err := b.Index.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if value.Expired(time.Now()) {
+		return nil, consts.ErrorKeyNotFound
+	}
+	return value, nil
+}
@@ -0,0 +1,159 @@
+package db
+
+import "context"
+
+// Op names a database operation seen by hooks.
+type Op string
+
+const (
+	OpGet    Op = "get"
+	OpPut    Op = "put"
+	OpDelete Op = "delete"
+	OpMerge  Op = "merge"
+	OpSync   Op = "sync"
+	OpApply  Op = "apply"
+	OpRoll   Op = "roll"
+)
+
+// Call describes one operation passed to hooks. Value is the value being
+// written for OpPut, and the value read once a successful OpGet returns.
+// Batch holds the writes of an OpApply.
+type Call struct {
+	Op    Op
+	Key   string
+	Value string
+	Batch *Batch
+}
+
+// Hook intercepts database operations, e.g. to start and end a tracing span,
+// write an audit log or enforce access control.
+//
+// Before runs ahead of the operation and may return a derived context, which
+// is the one handed to the next hook and the matching After. Returning a nil
+// context keeps the one Before was given. A non-nil error aborts the
+// operation and is returned to the caller. After runs once the operation has
+// finished with its result, for every hook whose Before succeeded. Hooks run
+// in registration order before and reverse order after, and never while the
+// database lock is held.
+type Hook interface {
+	Before(ctx context.Context, call *Call) (context.Context, error)
+	After(ctx context.Context, call *Call, err error)
+}
+
+// HookFuncs adapts a pair of functions to Hook. Either may be nil.
+type HookFuncs struct {
+	BeforeFunc func(ctx context.Context, call *Call) (context.Context, error)
+	AfterFunc  func(ctx context.Context, call *Call, err error)
+}
+
+func (h HookFuncs) Before(ctx context.Context, call *Call) (context.Context, error) {
+	if h.BeforeFunc == nil {
+		return ctx, nil
+	}
+	return h.BeforeFunc(ctx, call)
+}
+
+func (h HookFuncs) After(ctx context.Context, call *Call, err error) {
+	if h.AfterFunc != nil {
+		h.AfterFunc(ctx, call, err)
+	}
+}
+
+// ContextDB is DB with context-aware variants of its operations.
+type ContextDB interface {
+	DB
+	GetContext(ctx context.Context, key string) (string, error)
+	PutContext(ctx context.Context, key, value string) error
+	DeleteContext(ctx context.Context, key string) error
+	MergeContext(ctx context.Context) error
+	SyncContext(ctx context.Context) error
+}
+
+var _ ContextDB = (*Bcask)(nil)
+
+func (b *Bcask) Get(key string) (string, error) {
+	return b.GetContext(context.Background(), key)
+}
+
+func (b *Bcask) GetContext(ctx context.Context, key string) (string, error) {
+	call := &Call{Op: OpGet, Key: key}
+	err := b.intercept(ctx, call, func() error {
+		value, err := b.get(key)
+		call.Value = value
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return call.Value, nil
+}
+
+func (b *Bcask) Put(key, value string) error {
+	return b.PutContext(context.Background(), key, value)
+}
+
+func (b *Bcask) PutContext(ctx context.Context, key, value string) error {
+	return b.intercept(ctx, &Call{Op: OpPut, Key: key, Value: value}, func() error {
+		return b.put(key, value)
+	})
+}
+
+func (b *Bcask) Delete(key string) error {
+	return b.DeleteContext(context.Background(), key)
+}
+
+func (b *Bcask) DeleteContext(ctx context.Context, key string) error {
+	return b.intercept(ctx, &Call{Op: OpDelete, Key: key}, func() error {
+		return b.delete(key)
+	})
+}
+
+func (b *Bcask) Sync() error {
+	return b.SyncContext(context.Background())
+}
+
+func (b *Bcask) SyncContext(ctx context.Context) error {
+	return b.intercept(ctx, &Call{Op: OpSync}, b.sync)
+}
+
+// Roll starts a new active segment on behalf of a client. Unlike
+// AddNewSegment it takes the lock itself, runs the hooks and fails with
+// consts.ErrorReadOnly on a replica.
+func (b *Bcask) Roll() error {
+	return b.RollContext(context.Background())
+}
+
+func (b *Bcask) RollContext(ctx context.Context) error {
+	return b.intercept(ctx, &Call{Op: OpRoll}, b.roll)
+}
+
+// intercept runs fn between the Before and After calls of every hook. A
+// context that is already done fails the call before any hook runs.
+func (b *Bcask) intercept(ctx context.Context, call *Call, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	hooks := b.options.Hooks
+	if len(hooks) == 0 {
+		return fn()
+	}
+	ctxs := make([]context.Context, 0, len(hooks))
+	var err error
+	for _, h := range hooks {
+		var next context.Context
+		if next, err = h.Before(ctx, call); err != nil {
+			break
+		}
+		if next != nil {
+			ctx = next
+		}
+		ctxs = append(ctxs, ctx)
+	}
+	if err == nil {
+		err = fn()
+	}
+	for i := len(ctxs) - 1; i >= 0; i-- {
+		hooks[i].After(ctxs[i], call, err)
+	}
+	return err
+}
@@ -0,0 +1,214 @@
+package db
+
+import (
+	"errors"
+	"math"
+
+	"github.com/sayuyere/bcask/internal/consts"
+	"github.com/sayuyere/bcask/internal/item"
+	"github.com/sayuyere/bcask/internal/segment"
+)
+
+// The segments hold every record in the order it was written, and record
+// timestamps strictly increase, so a record's timestamp is also its
+// position in that log. Merges keep the order: they only drop records and
+// copy the rest into segments with the same or lower IDs.
+//
+// Records written before timestamps became sequence numbers carry Unix
+// seconds, which repeat. A position in that part of the log is ambiguous,
+// so readers resuming there see every record with that timestamp again.
+
+// legacyStampLimit is above any timestamp in seconds and below any in
+// nanoseconds.
+const legacyStampLimit = 1 << 40
+
+// legacyStamp reports whether ts is a timestamp in seconds written before
+// timestamps became unique.
+func legacyStamp(ts int64) bool {
+	return ts < legacyStampLimit
+}
+
+// seenStamp reports whether a reader positioned at after has already seen
+// the record with timestamp ts.
+func seenStamp(ts, after int64) bool {
+	return ts < after || ts == after && !legacyStamp(ts)
+}
+
+// Sequence returns the timestamp of the newest record, 0 for an empty
+// database.
+func (b *Bcask) Sequence() int64 {
+	b.Lock.RLock()
+	defer b.Lock.RUnlock()
+	return b.lastStamp
+}
+
+// Appended returns a channel that is closed when the next record is
+// appended.
+func (b *Bcask) Appended() <-chan struct{} {
+	b.notifyMu.Lock()
+	defer b.notifyMu.Unlock()
+	if b.appended == nil {
+		b.appended = make(chan struct{})
+	}
+	return b.appended
+}
+
+// notifyAppended wakes everyone waiting on Appended.
+func (b *Bcask) notifyAppended() {
+	b.notifyMu.Lock()
+	defer b.notifyMu.Unlock()
+	if b.appended != nil {
+		close(b.appended)
+		b.appended = nil
+	}
+}
+
+// closing returns a channel that is closed when the database is closed.
+func (b *Bcask) closing() <-chan struct{} {
+	b.notifyMu.Lock()
+	defer b.notifyMu.Unlock()
+	if b.closed == nil {
+		b.closed = make(chan struct{})
+	}
+	return b.closed
+}
+
+func (b *Bcask) notifyClosed() {
+	b.notifyMu.Lock()
+	defer b.notifyMu.Unlock()
+	if b.closed == nil {
+		b.closed = make(chan struct{})
+	}
+	select {
+	case <-b.closed:
+	default:
+		close(b.closed)
+	}
+}
+
+// LogCursor reads records, tombstones included, in the order they were
+// written. It is not safe for concurrent use.
+type LogCursor struct {
+	b      *Bcask
+	after  int64                // timestamp of the last record returned
+	seg    *segment.FileSegment // segment being read, nil until located
+	offset int64
+	// horizon is the log horizon the cursor has accounted for. Reading
+	// from the start, records dropped before the cursor was created
+	// cannot be missed.
+	horizon int64
+}
+
+// NewLogCursor returns a cursor over the records written after the record
+// with timestamp after; 0 reads the log from the start.
+func (b *Bcask) NewLogCursor(after int64) *LogCursor {
+	c := &LogCursor{b: b, after: after}
+	if after == 0 {
+		b.Lock.RLock()
+		c.horizon = b.logHorizon
+		b.Lock.RUnlock()
+	}
+	return c
+}
+
+// Position returns the timestamp of the last record returned by Next.
+func (c *LogCursor) Position() int64 {
+	return c.after
+}
+
+var errCursorFull = errors.New("cursor batch full")
+
+// Next returns the records that follow the last one returned, as many as
+// fit in limit bytes but at least one, or none when the cursor has reached
+// the end of the log. It fails with consts.ErrorLogTruncated when a merge
+// dropped a tombstone the cursor would have returned; the reader has to
+// start over from 0. After Close it fails with consts.ErrorDatabaseClosed.
+func (c *LogCursor) Next(limit int64) ([]item.DiskKV, error) {
+	b := c.b
+	b.Lock.RLock()
+	defer b.Lock.RUnlock()
+	if err := b.checkOpen(); err != nil {
+		return nil, err
+	}
+	if b.logHorizon > c.horizon {
+		if b.logHorizon > c.after {
+			return nil, consts.ErrorLogTruncated
+		}
+		c.horizon = b.logHorizon
+	}
+	i := -1
+	if c.seg != nil {
+		i = b.segmentIndex(c.seg)
+	}
+	// Continuing in the same segment, everything past c.offset is new.
+	// On the first call, or after a merge replaced the segment, records
+	// already returned are skipped by their timestamp.
+	relocated := i < 0
+	if relocated {
+		i = c.locate()
+		c.seg, c.offset = b.DBSegments[i], b.DBSegments[i].DataStart()
+	}
+	var records []item.DiskKV
+	var size int64
+	for {
+		_, err := c.seg.Scan(c.offset, func(offset int64, kv item.DiskKV) error {
+			if len(records) > 0 && size+kv.EncodedSize() > limit {
+				return errCursorFull
+			}
+			c.offset = offset + kv.EncodedSize()
+			// Records deleted in place have timestamp 0.
+			if kv.Timestamp != 0 && !(relocated && seenStamp(kv.Timestamp, c.after)) {
+				records = append(records, kv)
+				size += kv.EncodedSize()
+				c.after = kv.Timestamp
+			}
+			return nil
+		})
+		if err != nil && err != errCursorFull {
+			return nil, err
+		}
+		if err == errCursorFull || i == len(b.DBSegments)-1 {
+			return records, nil
+		}
+		i++
+		c.seg, c.offset = b.DBSegments[i], b.DBSegments[i].DataStart()
+		relocated = false
+	}
+}
+
+// segmentIndex returns the position of seg in DBSegments, or -1 if it is no
+// longer live. The caller must hold b.Lock.
+func (b *Bcask) segmentIndex(seg *segment.FileSegment) int {
+	for i, live := range b.DBSegments {
+		if live == seg {
+			return i
+		}
+	}
+	return -1
+}
+
+// locate returns the index of the segment to start reading at: the last
+// one whose successor starts with a record already seen. The caller must
+// hold b.Lock.
+func (c *LogCursor) locate() int {
+	segments := c.b.DBSegments
+	i := 0
+	for i+1 < len(segments) && seenStamp(firstStamp(segments[i+1]), c.after) {
+		i++
+	}
+	return i
+}
+
+// firstStamp returns the timestamp of the first record in seg that is not
+// marked deleted, or math.MaxInt64 if there is none.
+func firstStamp(seg *segment.FileSegment) int64 {
+	stamp := int64(math.MaxInt64)
+	seg.Scan(seg.DataStart(), func(_ int64, kv item.DiskKV) error {
+		if kv.Timestamp == 0 {
+			return nil
+		}
+		stamp = kv.Timestamp
+		return errCursorFull
+	})
+	return stamp
+}
@@ -0,0 +1,350 @@
+package db
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/sayuyere/bcask/internal/consts"
+	"github.com/sayuyere/bcask/internal/item"
+	"github.com/sayuyere/bcask/internal/segment"
+)
+
+// mergeMove remembers where a live record was copied from and to, so the
+// index can be repointed once the merge output is swapped in.
+type mergeMove struct {
+	key string
+	old item.MemoryItem
+	new item.MemoryItem
+	// expired moves are not copied; the key is removed from the index.
+	expired bool
+}
+
+// Merge compacts every immutable segment, dropping overwritten and deleted
+// records. Records are copied without holding b.Lock, so Get and Put keep
+// running; the lock is only taken to swap the merged segments in.
+//
+// Merged output reuses the IDs of the segments it replaces, lowest first.
+// A record never moves to a segment with a higher ID than the one it came
+// from, so replaying segments in ID order still yields the newest value.
+func (b *Bcask) Merge() error {
+	return b.MergeContext(context.Background())
+}
+
+// MergeContext is Merge with ctx passed to the configured hooks.
+func (b *Bcask) MergeContext(ctx context.Context) error {
+	return b.intercept(ctx, &Call{Op: OpMerge}, b.merge)
+}
+
+func (b *Bcask) merge() error {
+	b.mergeLock.Lock()
+	defer b.mergeLock.Unlock()
+
+	b.Lock.RLock()
+	if err := b.checkOpen(); err != nil {
+		b.Lock.RUnlock()
+		return err
+	}
+	inputs := append([]*segment.FileSegment(nil), b.DBSegments[:len(b.DBSegments)-1]...)
+	b.Lock.RUnlock()
+	return b.mergeRuns([][]*segment.FileSegment{inputs})
+}
+
+// MergeSegments compacts only the given immutable segments and leaves the
+// others untouched. A record may only move to a lower segment ID if no
+// unmerged segment lies in between, so the selection is split into runs of
+// adjacent live segments and each run is merged on its own.
+func (b *Bcask) MergeSegments(ids []int64) error {
+	return b.intercept(context.Background(), &Call{Op: OpMerge}, func() error {
+		return b.mergeSegments(ids)
+	})
+}
+
+func (b *Bcask) mergeSegments(ids []int64) error {
+	b.mergeLock.Lock()
+	defer b.mergeLock.Unlock()
+
+	b.Lock.RLock()
+	err := b.checkOpen()
+	var runs [][]*segment.FileSegment
+	if err == nil {
+		runs, err = b.mergeRunsFor(ids)
+	}
+	b.Lock.RUnlock()
+	if err != nil {
+		return err
+	}
+	return b.mergeRuns(runs)
+}
+
+// mergeRunsFor groups the segments named by ids into runs of segments that
+// are adjacent in DBSegments. The caller must hold b.Lock and b.mergeLock.
+func (b *Bcask) mergeRunsFor(ids []int64) ([][]*segment.FileSegment, error) {
+	want := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		if _, err := b.segmentByID(id); err != nil {
+			return nil, err
+		}
+		if id == b.activeSegment().FileID {
+			return nil, fmt.Errorf("%w: %d", consts.ErrorMergeActiveSegment, id)
+		}
+		want[id] = true
+	}
+	var runs [][]*segment.FileSegment
+	var run []*segment.FileSegment
+	for _, seg := range b.DBSegments {
+		if want[seg.FileID] {
+			run = append(run, seg)
+			continue
+		}
+		if len(run) > 0 {
+			runs = append(runs, run)
+			run = nil
+		}
+	}
+	return runs, nil
+}
+
+// mergeRuns merges each run of adjacent segments and records the whole call
+// as one MergeRecord. The caller must hold b.mergeLock.
+func (b *Bcask) mergeRuns(runs [][]*segment.FileSegment) error {
+	if b.options.ReadOnly {
+		return consts.ErrorReadOnly
+	}
+	record := MergeRecord{StartedAt: time.Now()}
+	for _, inputs := range runs {
+		if len(inputs) == 0 {
+			continue
+		}
+		b.logger.Info("merge started", "segments", segmentIDs(inputs))
+		outputs, moves, horizon, err := b.copyLive(inputs)
+		if err == nil {
+			err = b.swapMerged(inputs, outputs, moves, horizon)
+		} else {
+			for _, out := range outputs {
+				closeSegment(out)
+				os.Remove(out.Path)
+			}
+		}
+		if err != nil {
+			b.logger.Error("merge failed", "segments", segmentIDs(inputs), "error", err)
+			return fmt.Errorf("merge failed: %w", err)
+		}
+		record.SegmentsIn = append(record.SegmentsIn, segmentIDs(inputs)...)
+		record.SegmentsOut += len(outputs)
+		for _, mv := range moves {
+			if !mv.expired {
+				record.RecordsMoved++
+			}
+		}
+		record.BytesReclaimed += usedBytes(inputs) - usedBytes(outputs)
+	}
+	if len(record.SegmentsIn) == 0 {
+		return nil
+	}
+	record.Duration = time.Since(record.StartedAt)
+	b.counters.recordMerge(record)
+	b.logger.Info("merge finished", "segments_in", len(record.SegmentsIn), "segments_out", record.SegmentsOut,
+		"records_moved", record.RecordsMoved, "bytes_reclaimed", record.BytesReclaimed, "duration", record.Duration)
+	return nil
+}
+
+func usedBytes(segments []*segment.FileSegment) int64 {
+	var total int64
+	for _, seg := range segments {
+		total += seg.GetOffset() - seg.DataStart()
+	}
+	return total
+}
+
+func segmentIDs(segments []*segment.FileSegment) []int64 {
+	ids := make([]int64, len(segments))
+	for i, seg := range segments {
+		ids[i] = seg.FileID
+	}
+	return ids
+}
+
+// copyLive writes the records of inputs that the index still points at into
+// fresh segments. Output i takes the ID of inputs[i].
+//
+// Deleted and expired records are dropped only when inputs start at the
+// oldest live segment. Otherwise an older record for the same key may sit
+// in an earlier segment that is not being merged, and the dropped record is
+// what keeps a replay from bringing it back, so it is copied as well.
+// The returned horizon is the timestamp of the newest tombstone dropped.
+func (b *Bcask) copyLive(inputs []*segment.FileSegment) ([]*segment.FileSegment, []mergeMove, int64, error) {
+	var outputs []*segment.FileSegment
+	var moves []mergeMove
+	var horizon int64
+	b.Lock.RLock()
+	keepShadows := inputs[0] != b.DBSegments[0]
+	b.Lock.RUnlock()
+	now := time.Now()
+	nextOutput := func() error {
+		if len(outputs) == len(inputs) {
+			return fmt.Errorf("merge output outgrew its %d input segments", len(inputs))
+		}
+		id := inputs[len(outputs)].FileID
+		out, err := segment.NewFileSegmentAt(segment.SegmentPath(b.Path, id)+consts.MergeFileSuffix, id, b.DBID, b.options.segmentOptions())
+		if err != nil {
+			return err
+		}
+		outputs = append(outputs, out)
+		return nil
+	}
+
+	for i, in := range inputs {
+		_, err := in.Scan(in.DataStart(), func(offset int64, kv item.DiskKV) error {
+			b.limiter.WaitN(kv.EncodedSize())
+			current, err := b.Index.Get(kv.Key)
+			if err != nil || current.FileID != in.FileID || current.Offset != offset {
+				current = nil // overwritten or deleted since
+			}
+			switch {
+			case kv.Timestamp == 0 || kv.Tombstone || kv.Expired(now):
+				if keepShadows {
+					break
+				}
+				if kv.Tombstone {
+					horizon = max(horizon, kv.Timestamp)
+				}
+				if current != nil && kv.Timestamp != 0 {
+					moves = append(moves, mergeMove{key: kv.Key, old: *current, expired: true})
+				}
+				return nil
+			case current == nil:
+				return nil
+			}
+			b.limiter.WaitN(kv.EncodedSize())
+			if len(outputs) == 0 {
+				if err := nextOutput(); err != nil {
+					return err
+				}
+			}
+			out := outputs[len(outputs)-1]
+			to := out.GetOffset()
+			err = out.Write(kv)
+			if err == consts.ErrorSegmentCapacityFull {
+				if err := nextOutput(); err != nil {
+					return err
+				}
+				out = outputs[len(outputs)-1]
+				to = out.GetOffset()
+				err = out.Write(kv)
+			}
+			if err != nil {
+				return err
+			}
+			if len(outputs)-1 > i {
+				return fmt.Errorf("record from segment %d would move to segment %d", in.FileID, out.FileID)
+			}
+			if current == nil {
+				return nil // kept only to shadow older records
+			}
+			moved := *current
+			moved.FileID = out.FileID
+			moved.Offset = to
+			moves = append(moves, mergeMove{key: kv.Key, old: *current, new: moved})
+			return nil
+		})
+		if err != nil {
+			return outputs, nil, 0, err
+		}
+	}
+	for _, out := range outputs {
+		if err := out.Sync(); err != nil {
+			return outputs, nil, 0, err
+		}
+		if err := out.OSFile.Sync(); err != nil {
+			return outputs, nil, 0, err
+		}
+	}
+	return outputs, moves, horizon, nil
+}
+
+// swapMerged replaces inputs with outputs under b.Lock. Records that were
+// overwritten or deleted while copying are marked deleted in the output.
+// horizon raises the log horizon recorded in the manifest.
+func (b *Bcask) swapMerged(inputs, outputs []*segment.FileSegment, moves []mergeMove, horizon int64) error {
+	b.Lock.Lock()
+	defer b.Lock.Unlock()
+
+	outputByID := make(map[int64]*segment.FileSegment, len(outputs))
+	for _, out := range outputs {
+		outputByID[out.FileID] = out
+	}
+	for _, mv := range moves {
+		current, err := b.Index.Get(mv.key)
+		if mv.expired {
+			if err == nil && *current == mv.old {
+				if err := b.Index.Delete(mv.key); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err == nil && *current == mv.old {
+			moved := mv.new
+			if err := b.Index.Set(mv.key, &moved); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := outputByID[mv.new.FileID].Delete(mv.new); err != nil {
+			return err
+		}
+	}
+
+	// Without an index file a crash below is recovered by replaying the
+	// segments, which is correct whichever files have been renamed so far.
+	indexLoc := filepath.Join(b.Path, consts.IndexFileName)
+	if err := os.Remove(indexLoc); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, out := range outputs {
+		if err := out.Rename(segment.SegmentPath(b.Path, out.FileID)); err != nil {
+			return err
+		}
+	}
+	merged := make(map[int64]bool, len(inputs))
+	for _, in := range inputs {
+		merged[in.FileID] = true
+	}
+	segments := append([]*segment.FileSegment(nil), outputs...)
+	for _, seg := range b.DBSegments {
+		if !merged[seg.FileID] {
+			segments = append(segments, seg)
+		}
+	}
+	slices.SortFunc(segments, func(x, y *segment.FileSegment) int { return cmp.Compare(x.FileID, y.FileID) })
+	b.DBSegments = segments
+	b.logHorizon = max(b.logHorizon, horizon)
+	b.recountSegments()
+	if err := b.writeManifest(); err != nil {
+		return err
+	}
+	// Inputs whose ID was not reused are only deleted once the manifest no
+	// longer lists them.
+	for _, in := range inputs[len(outputs):] {
+		if err := os.Remove(in.Path); err != nil {
+			return err
+		}
+	}
+	if err := b.writeIndex(); err != nil {
+		return err
+	}
+	for _, in := range inputs {
+		closeSegment(in)
+	}
+	return nil
+}
+
+func closeSegment(seg *segment.FileSegment) {
+	seg.Close()
+	seg.OSFile.Close()
+}
@@ -0,0 +1,89 @@
+package db
+
+import (
+	"log/slog"
+
+	"github.com/sayuyere/bcask/internal/logging"
+	"github.com/sayuyere/bcask/internal/segment"
+)
+
+// Options configures how a database is opened.
+type Options struct {
+	// ReadOnly opens the database under a shared lock, so any number of
+	// read-only openers can coexist but no writer can. Segments are mapped
+	// read-only at their current size, nothing in the directory is created,
+	// truncated or rewritten (not even index_file on Close), and mutating
+	// calls fail with consts.ErrorReadOnly.
+	ReadOnly bool
+
+	// LogHandler receives structured events from the database, its segments
+	// and its index. The default discards everything.
+	LogHandler slog.Handler
+
+	// Hooks intercept Get, Put, Delete, Merge and Sync, in order.
+	Hooks []Hook
+
+	// Compaction configures background merges. The zero value disables them.
+	Compaction CompactionOptions
+
+	// MaintenanceRate caps the bytes per second read and written by merges
+	// and read by recovery scans. Zero means unlimited.
+	MaintenanceRate int64
+}
+
+type Option func(*Options)
+
+func WithReadOnly() Option {
+	return func(o *Options) {
+		o.ReadOnly = true
+	}
+}
+
+// WithLogHandler routes segment roll, merge, recovery and corruption events
+// to h.
+func WithLogHandler(h slog.Handler) Option {
+	return func(o *Options) {
+		o.LogHandler = h
+	}
+}
+
+// WithHooks appends hooks that run around every Get, Put, Delete, Merge
+// and Sync.
+func WithHooks(hooks ...Hook) Option {
+	return func(o *Options) {
+		o.Hooks = append(o.Hooks, hooks...)
+	}
+}
+
+// WithCompaction starts a scheduler that merges in the background whenever
+// one of the thresholds in c is crossed.
+func WithCompaction(c CompactionOptions) Option {
+	return func(o *Options) {
+		o.Compaction = c
+	}
+}
+
+// WithMaintenanceRate limits merge and recovery I/O to bytesPerSec, so
+// background work on the segment files does not starve Get. The limit can be
+// changed later with Bcask.SetMaintenanceRate.
+func WithMaintenanceRate(bytesPerSec int64) Option {
+	return func(o *Options) {
+		o.MaintenanceRate = bytesPerSec
+	}
+}
+
+func buildOptions(opts []Option) Options {
+	var o Options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+func (o Options) logger() *slog.Logger {
+	return logging.New(o.LogHandler)
+}
+
+func (o Options) segmentOptions() segment.Options {
+	return segment.Options{ReadOnly: o.ReadOnly, Logger: o.logger()}
+}
@@ -0,0 +1,96 @@
+package db
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/sayuyere/bcask/internal/consts"
+	"github.com/sayuyere/bcask/internal/index"
+	"github.com/sayuyere/bcask/internal/item"
+	"github.com/sayuyere/bcask/internal/segment"
+)
+
+// SetReplica switches the database in and out of replica mode. A replica
+// serves reads, but Put, Delete and the other client writes fail with
+// consts.ErrorReadOnly; it only changes through ApplyRecords.
+func (b *Bcask) SetReplica(replica bool) {
+	b.replica.Store(replica)
+}
+
+// writable returns the error a client write fails with, if any. The caller
+// must hold b.Lock.
+func (b *Bcask) writable() error {
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	if b.options.ReadOnly || b.replica.Load() {
+		return consts.ErrorReadOnly
+	}
+	return nil
+}
+
+// ApplyRecords appends records read from another database's log, keeping
+// their timestamps, and updates the index. Records not newer than
+// Sequence have been applied before and are skipped, so a batch can be
+// applied again after a reconnect. Legacy records with timestamp Sequence
+// are applied again, in order.
+func (b *Bcask) ApplyRecords(records []item.DiskKV) error {
+	b.Lock.Lock()
+	defer b.Lock.Unlock()
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	if b.options.ReadOnly {
+		return consts.ErrorReadOnly
+	}
+	for _, kv := range records {
+		if seenStamp(kv.Timestamp, b.lastStamp) {
+			continue
+		}
+		if kv.EncodedSize() > consts.SegmentMaxSize-consts.SegmentHeaderSize {
+			return consts.ErrorDiskKeyValueBigEntry
+		}
+		if err := b.applyLocked(kv); err != nil {
+			return err
+		}
+		b.lastStamp = kv.Timestamp
+	}
+	return nil
+}
+
+// Reset removes every key and segment, leaving an empty database with the
+// same ID and Sequence 0. A replica resets when it can no longer catch up
+// with its leader record by record.
+func (b *Bcask) Reset() error {
+	b.mergeLock.Lock()
+	defer b.mergeLock.Unlock()
+	b.Lock.Lock()
+	defer b.Lock.Unlock()
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	if b.options.ReadOnly {
+		return consts.ErrorReadOnly
+	}
+	nextID := b.activeSegment().FileID + 1
+	seg, err := segment.NewFileSegment(b.Path, nextID, b.DBID, b.options.segmentOptions())
+	if err != nil {
+		return fmt.Errorf("failed to add segment: %w", err)
+	}
+	old := b.DBSegments
+	b.DBSegments = []*segment.FileSegment{seg}
+	b.Index = index.NewPrefixTrie()
+	b.Index.Logger = b.logger
+	b.lastStamp, b.logHorizon = 0, 0
+	if err := b.writeManifest(); err != nil {
+		return err
+	}
+	for _, seg := range old {
+		closeSegment(seg)
+		if err := os.Remove(seg.Path); err != nil {
+			return err
+		}
+	}
+	b.logger.Info("database reset", "segment_id", nextID)
+	return b.writeIndex()
+}
@@ -0,0 +1,225 @@
+package db
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sayuyere/bcask/internal/item"
+)
+
+// maxMergeHistory bounds how many past merges Stats reports.
+const maxMergeHistory = 32
+
+// LatencyBuckets are the upper bounds of the latency histograms, spanning
+// fast in-memory lookups up to long merges.
+var LatencyBuckets = [...]time.Duration{
+	10 * time.Microsecond, 50 * time.Microsecond, 100 * time.Microsecond, 250 * time.Microsecond,
+	500 * time.Microsecond, time.Millisecond, 2500 * time.Microsecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond, 100 * time.Millisecond,
+	250 * time.Millisecond, 500 * time.Millisecond, time.Second, 2500 * time.Millisecond,
+	5 * time.Second, 10 * time.Second, 30 * time.Second, time.Minute,
+}
+
+// Histogram is a snapshot of a latency distribution. Counts[i] is the
+// number of observations no larger than LatencyBuckets[i] (non-cumulative);
+// observations above the last bucket are only included in Count and Sum.
+type Histogram struct {
+	Counts []uint64
+	Count  uint64
+	Sum    time.Duration
+}
+
+type histogram struct {
+	counts [len(LatencyBuckets)]atomic.Uint64
+	count  atomic.Uint64
+	sum    atomic.Int64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	for i, bound := range LatencyBuckets {
+		if d <= bound {
+			h.counts[i].Add(1)
+			break
+		}
+	}
+	h.count.Add(1)
+	h.sum.Add(int64(d))
+}
+
+func (h *histogram) since(start time.Time) {
+	h.observe(time.Since(start))
+}
+
+func (h *histogram) snapshot() Histogram {
+	s := Histogram{Counts: make([]uint64, len(LatencyBuckets))}
+	for i := range s.Counts {
+		s.Counts[i] = h.counts[i].Load()
+	}
+	s.Count = h.count.Load()
+	s.Sum = time.Duration(h.sum.Load())
+	return s
+}
+
+// SegmentStats describes the space use of one segment.
+type SegmentStats struct {
+	ID     int64
+	Active bool
+	// BytesUsed is the size of all records in the segment, live or not.
+	BytesUsed int64
+	LiveBytes int64
+	DeadBytes int64
+	Reads     uint64
+	Writes    uint64
+}
+
+// DeadRatio is the fraction of used bytes held by dead records.
+func (s SegmentStats) DeadRatio() float64 {
+	if s.BytesUsed == 0 {
+		return 0
+	}
+	return float64(s.DeadBytes) / float64(s.BytesUsed)
+}
+
+// MergeRecord describes one completed merge.
+type MergeRecord struct {
+	StartedAt      time.Time
+	Duration       time.Duration
+	SegmentsIn     []int64
+	SegmentsOut    int
+	RecordsMoved   int
+	BytesReclaimed int64
+}
+
+// Stats is a point-in-time view of the database.
+type Stats struct {
+	// Keys counts the live keys; expired ones still in the index are left
+	// out.
+	Keys     int
+	Segments []SegmentStats
+	// BytesWritten counts bytes appended to segments since the database was
+	// opened, merge output excluded.
+	BytesWritten int64
+	LiveBytes    int64
+	DeadBytes    int64
+	// IndexMemoryBytes is an estimate of the memory held by the index.
+	IndexMemoryBytes int64
+	Merges           []MergeRecord
+
+	Gets    uint64
+	Puts    uint64
+	Deletes uint64
+	Misses  uint64
+
+	GetLatency    Histogram
+	PutLatency    Histogram
+	DeleteLatency Histogram
+	// FsyncLatency covers each fsync of a segment or index file.
+	FsyncLatency Histogram
+	MergeLatency Histogram
+}
+
+// DeadRatio is the fraction of all used segment bytes held by dead records.
+func (s Stats) DeadRatio() float64 {
+	if s.LiveBytes+s.DeadBytes == 0 {
+		return 0
+	}
+	return float64(s.DeadBytes) / float64(s.LiveBytes+s.DeadBytes)
+}
+
+// counters are the operation counters kept by a Bcask.
+type counters struct {
+	gets         atomic.Uint64
+	puts         atomic.Uint64
+	deletes      atomic.Uint64
+	misses       atomic.Uint64
+	bytesWritten atomic.Int64
+
+	getLatency    histogram
+	putLatency    histogram
+	deleteLatency histogram
+	fsyncLatency  histogram
+	mergeLatency  histogram
+
+	mergeLock sync.Mutex
+	merges    []MergeRecord
+}
+
+func (c *counters) recordMerge(m MergeRecord) {
+	c.mergeLatency.observe(m.Duration)
+	c.mergeLock.Lock()
+	defer c.mergeLock.Unlock()
+	c.merges = append(c.merges, m)
+	if len(c.merges) > maxMergeHistory {
+		c.merges = c.merges[len(c.merges)-maxMergeHistory:]
+	}
+}
+
+// Stats returns key count, per-segment space accounting, index memory,
+// merge history and operation counters.
+func (b *Bcask) Stats() Stats {
+	b.Lock.RLock()
+	defer b.Lock.RUnlock()
+	s := Stats{
+		Segments:         make([]SegmentStats, 0, len(b.DBSegments)),
+		BytesWritten:     b.counters.bytesWritten.Load(),
+		IndexMemoryBytes: b.Index.MemoryEstimate(),
+		Gets:             b.counters.gets.Load(),
+		Puts:             b.counters.puts.Load(),
+		Deletes:          b.counters.deletes.Load(),
+		Misses:           b.counters.misses.Load(),
+		GetLatency:       b.counters.getLatency.snapshot(),
+		PutLatency:       b.counters.putLatency.snapshot(),
+		DeleteLatency:    b.counters.deleteLatency.snapshot(),
+		FsyncLatency:     b.counters.fsyncLatency.snapshot(),
+		MergeLatency:     b.counters.mergeLatency.snapshot(),
+	}
+	now := time.Now()
+	b.Index.Walk(func(_ string, value *item.MemoryItem) error {
+		if !value.Expired(now) {
+			s.Keys++
+		}
+		return nil
+	})
+	for i, seg := range b.DBSegments {
+		ss := SegmentStats{
+			ID:        seg.FileID,
+			Active:    i == len(b.DBSegments)-1,
+			BytesUsed: seg.GetOffset() - seg.DataStart(),
+			LiveBytes: seg.LiveBytes(),
+			DeadBytes: seg.DeadBytes(),
+			Reads:     seg.Reads(),
+			Writes:    seg.Writes(),
+		}
+		s.LiveBytes += ss.LiveBytes
+		s.DeadBytes += ss.DeadBytes
+		s.Segments = append(s.Segments, ss)
+	}
+	b.counters.mergeLock.Lock()
+	s.Merges = append([]MergeRecord(nil), b.counters.merges...)
+	b.counters.mergeLock.Unlock()
+	return s
+}
+
+// recountSegments recomputes live and dead bytes of every segment from the
+// index. It is used after recovery and merges, where incremental accounting
+// is not available. The caller must hold b.Lock or have exclusive access.
+func (b *Bcask) recountSegments() {
+	live := make(map[int64]int64, len(b.DBSegments))
+	b.Index.Walk(func(key string, value *item.MemoryItem) error {
+		live[value.FileID] += value.RecordSize(key)
+		return nil
+	})
+	for _, seg := range b.DBSegments {
+		used := seg.GetOffset() - seg.DataStart()
+		seg.SetAccounting(live[seg.FileID], used-live[seg.FileID])
+	}
+}
+
+// markDead accounts for the record old points at no longer being live.
+// The caller must hold b.Lock.
+func (b *Bcask) markDead(key string, old *item.MemoryItem) {
+	if seg, err := b.segmentByID(old.FileID); err == nil {
+		seg.MarkDead(old.RecordSize(key))
+	}
+}
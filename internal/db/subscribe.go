@@ -0,0 +1,128 @@
+package db
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sayuyere/bcask/internal/consts"
+	"github.com/sayuyere/bcask/internal/item"
+)
+
+// Event is one change seen by a subscriber. Sequence orders events; it is
+// the timestamp of the change's record, see LogCursor. Timestamp is when
+// the change was made, to the second for records written before
+// timestamps became sequence numbers.
+type Event struct {
+	Op        Op // OpPut or OpDelete
+	Key       string
+	Value     string // empty for OpDelete
+	Sequence  uint64
+	Timestamp time.Time
+}
+
+// stampTime returns the time a record with timestamp ts was written.
+func stampTime(ts int64) time.Time {
+	if legacyStamp(ts) {
+		return time.Unix(ts, 0)
+	}
+	return time.Unix(0, ts)
+}
+
+// subscriptionBatch is how many bytes of records a subscription reads at a
+// time.
+const subscriptionBatch = 1 << 20
+
+// Subscription delivers the changes to a set of keys in the order they
+// were made.
+type Subscription struct {
+	events chan Event
+	stop   chan struct{}
+	once   sync.Once
+	err    error // set before events is closed
+}
+
+// Subscribe returns the changes to keys starting with prefix, beginning at
+// sequence fromSeq. Changes still in the segments are replayed first, then
+// new ones are delivered as they are written; pass Sequence()+1 to see new
+// changes only. Changes a merge has dropped, such as overwritten values,
+// are not replayed, so a replay yields at least the latest change of every
+// key. Subscribe fails with consts.ErrorLogTruncated when a merge dropped a
+// delete at or after fromSeq.
+//
+// Events are read from the segments, so a subscriber that falls behind
+// holds up neither writers nor other subscribers.
+func (b *Bcask) Subscribe(prefix string, fromSeq uint64) (*Subscription, error) {
+	after := int64(0)
+	if fromSeq > 0 {
+		after = int64(min(fromSeq-1, math.MaxInt64))
+	}
+	cursor := b.NewLogCursor(after)
+	appended := b.Appended()
+	first, err := cursor.Next(subscriptionBatch)
+	if err != nil {
+		return nil, err
+	}
+	s := &Subscription{events: make(chan Event, 64), stop: make(chan struct{})}
+	go func() {
+		s.err = s.run(b, prefix, cursor, first, appended)
+		close(s.events)
+	}()
+	return s, nil
+}
+
+func (s *Subscription) run(b *Bcask, prefix string, cursor *LogCursor, records []item.DiskKV, appended <-chan struct{}) error {
+	closed := b.closing()
+	for {
+		for _, kv := range records {
+			if !strings.HasPrefix(kv.Key, prefix) {
+				continue
+			}
+			ev := Event{Op: OpPut, Key: kv.Key, Value: kv.Value, Sequence: uint64(kv.Timestamp), Timestamp: stampTime(kv.Timestamp)}
+			if kv.Tombstone {
+				ev.Op, ev.Value = OpDelete, ""
+			}
+			select {
+			case s.events <- ev:
+			case <-s.stop:
+				return nil
+			case <-closed:
+				return consts.ErrorDatabaseClosed
+			}
+		}
+		if len(records) == 0 {
+			select {
+			case <-appended:
+			case <-s.stop:
+				return nil
+			case <-closed:
+				return consts.ErrorDatabaseClosed
+			}
+		}
+		appended = b.Appended()
+		var err error
+		if records, err = cursor.Next(subscriptionBatch); err != nil {
+			return err
+		}
+	}
+}
+
+// Events returns the channel events are delivered on. It is closed when
+// the subscription ends; Err then tells why.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Err returns nil after Close, consts.ErrorDatabaseClosed if the database
+// was closed, and consts.ErrorLogTruncated if a merge dropped a delete the
+// subscriber had not received yet. It is only valid once Events is closed.
+func (s *Subscription) Err() error {
+	return s.err
+}
+
+// Close ends the subscription. Events may still hold undelivered events.
+func (s *Subscription) Close() error {
+	s.once.Do(func() { close(s.stop) })
+	return nil
+}
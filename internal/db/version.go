@@ -0,0 +1,65 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/sayuyere/bcask/internal/consts"
+)
+
+// Every record carries the time it was written in unix nanoseconds. Within
+// one database the timestamps strictly increase, so the timestamp of a
+// key's record doubles as the version of its value: it changes on every
+// write and survives merges, which copy records unchanged.
+
+// nextStamp returns the timestamp for a new record: the current time, or
+// one past the newest record if the clock has not moved on or went back.
+// The caller must hold b.Lock.
+func (b *Bcask) nextStamp() int64 {
+	b.lastStamp = max(time.Now().UnixNano(), b.lastStamp+1)
+	return b.lastStamp
+}
+
+// GetVersion returns the value of key and its version.
+func (b *Bcask) GetVersion(key string) (string, int64, error) {
+	return b.GetVersionContext(context.Background(), key)
+}
+
+func (b *Bcask) GetVersionContext(ctx context.Context, key string) (string, int64, error) {
+	var version int64
+	call := &Call{Op: OpGet, Key: key}
+	err := b.intercept(ctx, call, func() error {
+		var err error
+		call.Value, version, err = b.getVersion(key)
+		return err
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	return call.Value, version, nil
+}
+
+// DeleteVersion deletes key only if its current version is version, and
+// returns consts.ErrorVersionMismatch otherwise.
+func (b *Bcask) DeleteVersion(key string, version int64) error {
+	return b.DeleteVersionContext(context.Background(), key, version)
+}
+
+func (b *Bcask) DeleteVersionContext(ctx context.Context, key string, version int64) error {
+	return b.intercept(ctx, &Call{Op: OpDelete, Key: key}, func() error {
+		defer b.counters.deleteLatency.since(time.Now())
+		b.Lock.Lock()
+		defer b.Lock.Unlock()
+		if err := b.writable(); err != nil {
+			return err
+		}
+		current, err := b.lookup(key)
+		if err != nil {
+			return err
+		}
+		if current.Timestamp != version {
+			return consts.ErrorVersionMismatch
+		}
+		return b.deleteLocked(key)
+	})
+}
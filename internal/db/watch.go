@@ -0,0 +1,65 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/sayuyere/bcask/internal/consts"
+)
+
+// Watch blocks until key is written, deleted or expires, and returns its
+// new value and version like GetVersion: a key that is gone returns
+// consts.ErrorKeyNotFound. Writing the same value again counts as a
+// change.
+func (b *Bcask) Watch(ctx context.Context, key string) (string, int64, error) {
+	version, _ := b.peekVersion(key)
+	return b.WatchVersion(ctx, key, version)
+}
+
+// WatchVersion is Watch for a caller that already read key at version, 0
+// if it was missing. It returns at once if key changed since, so no change
+// is lost between a read and the watch.
+func (b *Bcask) WatchVersion(ctx context.Context, key string, version int64) (string, int64, error) {
+	closed := b.closing()
+	for {
+		appended := b.Appended()
+		current, expiresAt := b.peekVersion(key)
+		if current != version {
+			return b.GetVersionContext(ctx, key)
+		}
+		// Expiry appends nothing, so wake up for it.
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if expiresAt != 0 {
+			timer = time.NewTimer(time.Until(time.UnixMilli(expiresAt)))
+			expired = timer.C
+		}
+		var err error
+		select {
+		case <-appended:
+		case <-expired:
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-closed:
+			err = consts.ErrorDatabaseClosed
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return "", 0, err
+		}
+	}
+}
+
+// peekVersion returns the version of key, 0 if it is missing, and when it
+// expires.
+func (b *Bcask) peekVersion(key string) (version, expiresAt int64) {
+	b.Lock.RLock()
+	defer b.Lock.RUnlock()
+	value, err := b.lookup(key)
+	if err != nil {
+		return 0, 0
+	}
+	return value.Timestamp, value.ExpiresAt
+}
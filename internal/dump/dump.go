@@ -0,0 +1,292 @@
+// Package dump exports the live keys of a database to a portable file and
+// imports such files back, for moving data between environments and for
+// seeding test fixtures.
+//
+// Three formats are supported:
+//
+//   - FormatJSONL: one {"key": ..., "value": ...} object per line. A key or
+//     value that is not valid UTF-8 is stored base64 encoded under
+//     "key_base64" or "value_base64" instead.
+//   - FormatCSV: a "key,value,encoding" header, then one row per key. The
+//     encoding column is "base64" for rows whose key and value are base64
+//     encoded, which is done when either is not valid UTF-8 or holds a
+//     carriage return, and empty otherwise. Hand-written files may leave
+//     the column out.
+//   - FormatNative: a compact binary format with checksums, see native.go.
+package dump
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sayuyere/bcask/internal/consts"
+	"github.com/sayuyere/bcask/internal/db"
+)
+
+type Format string
+
+const (
+	FormatJSONL  Format = "jsonl"
+	FormatCSV    Format = "csv"
+	FormatNative Format = "native"
+)
+
+// Formats lists the supported formats.
+var Formats = []Format{FormatJSONL, FormatCSV, FormatNative}
+
+// ParseFormat returns the format named s.
+func ParseFormat(s string) (Format, error) {
+	if slices.Contains(Formats, Format(s)) {
+		return Format(s), nil
+	}
+	return "", fmt.Errorf("%w: %q", consts.ErrorDumpFormat, s)
+}
+
+// importBatchBytes is roughly how many bytes of keys and values Import
+// writes per batch.
+const importBatchBytes = 1 << 20
+
+type encoder interface {
+	encode(key, value string) error
+	// close writes any trailer and flushes; it does not close the writer.
+	close() error
+}
+
+type decoder interface {
+	// next returns the next pair, or io.EOF after the last one.
+	next() (key, value string, err error)
+}
+
+// Export writes every live key starting with prefix and its value to w, in
+// ascending key order, and returns how many pairs it wrote. Keys are taken
+// from the index and each value is read when its key is reached, so Export
+// has the consistency of db.Bcask.Scan.
+func Export(b *db.Bcask, w io.Writer, format Format, prefix string) (int, error) {
+	bw := bufio.NewWriter(w)
+	enc, err := newEncoder(bw, format)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	err = b.Scan(prefix, func(key, value string) error {
+		n++
+		return enc.encode(key, value)
+	})
+	if err == nil {
+		err = enc.close()
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	return n, err
+}
+
+// Import reads pairs from r and puts them into b in batches, overwriting
+// existing keys. It returns how many pairs were written; after an error a
+// prefix of the input may have been imported.
+func Import(b *db.Bcask, r io.Reader, format Format) (int, error) {
+	dec, err := newDecoder(r, format)
+	if err != nil {
+		return 0, err
+	}
+	var batch db.Batch
+	size, read, imported := 0, 0, 0
+	flush := func() error {
+		if batch.Len() == 0 {
+			return nil
+		}
+		if err := b.Apply(&batch); err != nil {
+			return err
+		}
+		imported += batch.Len()
+		batch.Reset()
+		size = 0
+		return nil
+	}
+	for {
+		key, value, err := dec.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return imported, fmt.Errorf("record %d: %w", read+1, err)
+		}
+		read++
+		batch.Put(key, value)
+		if size += len(key) + len(value); size >= importBatchBytes {
+			if err := flush(); err != nil {
+				return imported, err
+			}
+		}
+	}
+	return imported, flush()
+}
+
+func newEncoder(w io.Writer, format Format) (encoder, error) {
+	switch format {
+	case FormatJSONL:
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		return &jsonEncoder{enc: enc}, nil
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write([]string{"key", "value", "encoding"}); err != nil {
+			return nil, err
+		}
+		return &csvEncoder{w: cw}, nil
+	case FormatNative:
+		return newNativeEncoder(w)
+	}
+	return nil, fmt.Errorf("%w: %q", consts.ErrorDumpFormat, format)
+}
+
+func newDecoder(r io.Reader, format Format) (decoder, error) {
+	switch format {
+	case FormatJSONL:
+		return &jsonDecoder{dec: json.NewDecoder(r)}, nil
+	case FormatCSV:
+		return newCSVDecoder(r)
+	case FormatNative:
+		return newNativeDecoder(r)
+	}
+	return nil, fmt.Errorf("%w: %q", consts.ErrorDumpFormat, format)
+}
+
+// jsonRecord is one line of FormatJSONL. Byte slices are base64 encoded by
+// encoding/json.
+type jsonRecord struct {
+	Key         *string `json:"key,omitempty"`
+	KeyBase64   []byte  `json:"key_base64,omitempty"`
+	Value       *string `json:"value,omitempty"`
+	ValueBase64 []byte  `json:"value_base64,omitempty"`
+}
+
+type jsonEncoder struct {
+	enc *json.Encoder
+}
+
+func (e *jsonEncoder) encode(key, value string) error {
+	var rec jsonRecord
+	if utf8.ValidString(key) {
+		rec.Key = &key
+	} else {
+		rec.KeyBase64 = []byte(key)
+	}
+	if utf8.ValidString(value) {
+		rec.Value = &value
+	} else {
+		rec.ValueBase64 = []byte(value)
+	}
+	return e.enc.Encode(&rec)
+}
+
+func (e *jsonEncoder) close() error {
+	return nil
+}
+
+type jsonDecoder struct {
+	dec *json.Decoder
+}
+
+func (d *jsonDecoder) next() (string, string, error) {
+	var rec jsonRecord
+	if err := d.dec.Decode(&rec); err != nil {
+		if err == io.EOF {
+			return "", "", err
+		}
+		return "", "", fmt.Errorf("%w: %v", consts.ErrorDumpMalformed, err)
+	}
+	var key, value string
+	switch {
+	case rec.Key != nil:
+		key = *rec.Key
+	case rec.KeyBase64 != nil:
+		key = string(rec.KeyBase64)
+	default:
+		return "", "", fmt.Errorf("%w: no key", consts.ErrorDumpMalformed)
+	}
+	switch {
+	case rec.Value != nil:
+		value = *rec.Value
+	case rec.ValueBase64 != nil:
+		value = string(rec.ValueBase64)
+	default:
+		return "", "", fmt.Errorf("%w: no value for %q", consts.ErrorDumpMalformed, key)
+	}
+	return key, value, nil
+}
+
+const csvBase64 = "base64"
+
+type csvEncoder struct {
+	w *csv.Writer
+}
+
+func (e *csvEncoder) encode(key, value string) error {
+	// encoding/csv drops the carriage return of "\r\n" inside quoted
+	// fields, so such rows are encoded too.
+	if plainCSV(key) && plainCSV(value) {
+		return e.w.Write([]string{key, value, ""})
+	}
+	enc := base64.StdEncoding
+	return e.w.Write([]string{enc.EncodeToString([]byte(key)), enc.EncodeToString([]byte(value)), csvBase64})
+}
+
+func plainCSV(s string) bool {
+	return utf8.ValidString(s) && !strings.Contains(s, "\r")
+}
+
+func (e *csvEncoder) close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type csvDecoder struct {
+	r *csv.Reader
+}
+
+func newCSVDecoder(r io.Reader) (*csvDecoder, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("%w: missing header", consts.ErrorDumpMalformed)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", consts.ErrorDumpMalformed, err)
+	}
+	if !slices.Equal(header, []string{"key", "value", "encoding"}) && !slices.Equal(header, []string{"key", "value"}) {
+		return nil, fmt.Errorf("%w: header %q, want key,value[,encoding]", consts.ErrorDumpMalformed, header)
+	}
+	cr.FieldsPerRecord = len(header)
+	return &csvDecoder{r: cr}, nil
+}
+
+func (d *csvDecoder) next() (string, string, error) {
+	row, err := d.r.Read()
+	if err == io.EOF {
+		return "", "", err
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %v", consts.ErrorDumpMalformed, err)
+	}
+	if len(row) == 2 || row[2] == "" {
+		return row[0], row[1], nil
+	}
+	if row[2] != csvBase64 {
+		return "", "", fmt.Errorf("%w: unknown encoding %q", consts.ErrorDumpMalformed, row[2])
+	}
+	key, keyErr := base64.StdEncoding.DecodeString(row[0])
+	value, valueErr := base64.StdEncoding.DecodeString(row[1])
+	if err := errors.Join(keyErr, valueErr); err != nil {
+		return "", "", fmt.Errorf("%w: %v", consts.ErrorDumpMalformed, err)
+	}
+	return string(key), string(value), nil
+}
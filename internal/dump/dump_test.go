@@ -0,0 +1,129 @@
+package dump
+
+import (
+	"bytes"
+	"encoding/json"
+	"maps"
+	"strings"
+	"testing"
+
+	"github.com/sayuyere/bcask/internal/consts"
+	"github.com/sayuyere/bcask/internal/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func contents(b *db.Bcask) map[string]string {
+	return b.Fold(func(key, value string, acc interface{}) interface{} {
+		acc.(map[string]string)[key] = value
+		return acc
+	}, map[string]string{}).(map[string]string)
+}
+
+func TestDump(t *testing.T) {
+	src, err := db.Open(t.TempDir(), "src")
+	require.NoError(t, err)
+	defer src.Close()
+	pairs := map[string]string{
+		"plain":          "value",
+		"empty":          "",
+		"csv,\"quoted\"": "a,b\n\"c\"",
+		"crlf":           "line\r\nline",
+		"html":           "<a href=\"x\">&</a>",
+		"unicode ключ":   "значение ✓",
+		"binary":         "\x00\x01\xfe\xff",
+		"other/big":      strings.Repeat("b", 700<<10),
+		"other/bigger":   strings.Repeat("c", 900<<10),
+		"other/ line":    "x",
+	}
+	for key, value := range pairs {
+		require.NoError(t, src.Put(key, value))
+	}
+
+	for _, format := range Formats {
+		t.Run(string(format), func(t *testing.T) {
+			var buf bytes.Buffer
+			n, err := Export(src, &buf, format, "")
+			require.NoError(t, err)
+			assert.Equal(t, len(pairs), n)
+
+			dst, err := db.Open(t.TempDir(), "dst")
+			require.NoError(t, err)
+			defer dst.Close()
+			require.NoError(t, dst.Put("plain", "overwritten"))
+			n, err = Import(dst, bytes.NewReader(buf.Bytes()), format)
+			require.NoError(t, err)
+			assert.Equal(t, len(pairs), n)
+			assert.True(t, maps.Equal(pairs, contents(dst)), "imported data differs")
+
+			buf.Reset()
+			n, err = Export(src, &buf, format, "other/")
+			require.NoError(t, err)
+			assert.Equal(t, 3, n)
+		})
+	}
+
+	t.Run("JSONL", func(t *testing.T) {
+		var buf bytes.Buffer
+		_, err := Export(src, &buf, FormatJSONL, "binary")
+		require.NoError(t, err)
+		assert.Equal(t, `{"key":"binary","value_base64":"AAH+/w=="}`+"\n", buf.String())
+
+		// Keys are only base64 encoded when they are not valid UTF-8.
+		buf.Reset()
+		enc, err := newEncoder(&buf, FormatJSONL)
+		require.NoError(t, err)
+		require.NoError(t, enc.encode("\xff", "<&>"))
+		assert.Equal(t, `{"key_base64":"/w==","value":"<&>"}`+"\n", buf.String())
+		key, value, err := (&jsonDecoder{dec: json.NewDecoder(&buf)}).next()
+		require.NoError(t, err)
+		assert.Equal(t, "\xff", key)
+		assert.Equal(t, "<&>", value)
+
+		dst, err := db.Open(t.TempDir(), "dst")
+		require.NoError(t, err)
+		defer dst.Close()
+		_, err = Import(dst, strings.NewReader(`{"key":"a","value":"1"}`+"\n"+`{"key":"b"}`), FormatJSONL)
+		assert.ErrorIs(t, err, consts.ErrorDumpMalformed)
+		assert.ErrorContains(t, err, "record 2")
+	})
+
+	t.Run("CSV", func(t *testing.T) {
+		dst, err := db.Open(t.TempDir(), "dst")
+		require.NoError(t, err)
+		defer dst.Close()
+		n, err := Import(dst, strings.NewReader("key,value\nuser/1,alice\n\"user/2\",\"b,o,b\"\n"), FormatCSV)
+		require.NoError(t, err)
+		assert.Equal(t, 2, n)
+		assert.Equal(t, map[string]string{"user/1": "alice", "user/2": "b,o,b"}, contents(dst))
+
+		_, err = Import(dst, strings.NewReader("name,value\na,b\n"), FormatCSV)
+		assert.ErrorIs(t, err, consts.ErrorDumpMalformed)
+		_, err = Import(dst, strings.NewReader("key,value,encoding\na,b,rot13\n"), FormatCSV)
+		assert.ErrorIs(t, err, consts.ErrorDumpMalformed)
+	})
+
+	t.Run("Native", func(t *testing.T) {
+		var buf bytes.Buffer
+		_, err := Export(src, &buf, FormatNative, "")
+		require.NoError(t, err)
+		dump := buf.Bytes()
+		dst, err := db.Open(t.TempDir(), "dst")
+		require.NoError(t, err)
+		defer dst.Close()
+
+		corrupt := bytes.Clone(dump)
+		corrupt[len(corrupt)/2] ^= 0xff
+		_, err = Import(dst, bytes.NewReader(corrupt), FormatNative)
+		assert.ErrorIs(t, err, consts.ErrorDumpChecksum)
+
+		_, err = Import(dst, bytes.NewReader(dump[:len(dump)-6]), FormatNative)
+		assert.ErrorIs(t, err, consts.ErrorDumpTruncated)
+
+		_, err = Import(dst, strings.NewReader(`{"key":"a","value":"1"}`), FormatNative)
+		assert.ErrorIs(t, err, consts.ErrorDumpBadMagic)
+	})
+
+	_, err = ParseFormat("xml")
+	assert.ErrorIs(t, err, consts.ErrorDumpFormat)
+}
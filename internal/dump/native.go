@@ -0,0 +1,184 @@
+package dump
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/sayuyere/bcask/internal/consts"
+)
+
+// FormatNative layout (all integers big endian unless noted):
+//
+//	header  | magic "BCDP" | version u16 | reserved u16 |
+//	records | tag 0x01 | key length uvarint | value length uvarint | key | value | record crc u32 |  (repeated)
+//	trailer | tag 0x00 | record count u64 | body crc u32 |
+//
+// A record crc covers the record from its tag to the end of its value, the
+// body crc everything between the header and itself. The count and body crc
+// detect a dump that was cut short between records.
+
+const (
+	nativeVersion    uint16 = 1
+	nativeHeaderSize int    = 8
+
+	tagEnd    byte = 0x00
+	tagRecord byte = 0x01
+)
+
+var nativeMagic = [4]byte{'B', 'C', 'D', 'P'}
+
+type nativeEncoder struct {
+	w       io.Writer
+	body    hash.Hash32
+	count   uint64
+	scratch []byte
+}
+
+func newNativeEncoder(w io.Writer) (*nativeEncoder, error) {
+	header := make([]byte, nativeHeaderSize)
+	copy(header, nativeMagic[:])
+	binary.BigEndian.PutUint16(header[4:6], nativeVersion)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &nativeEncoder{w: w, body: crc32.NewIEEE()}, nil
+}
+
+func (e *nativeEncoder) write(p []byte) error {
+	e.body.Write(p)
+	_, err := e.w.Write(p)
+	return err
+}
+
+func (e *nativeEncoder) encode(key, value string) error {
+	buf := append(e.scratch[:0], tagRecord)
+	buf = binary.AppendUvarint(buf, uint64(len(key)))
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+	buf = append(buf, key...)
+	buf = append(buf, value...)
+	buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+	e.scratch = buf
+	e.count++
+	return e.write(buf)
+}
+
+func (e *nativeEncoder) close() error {
+	buf := binary.BigEndian.AppendUint64([]byte{tagEnd}, e.count)
+	if err := e.write(buf); err != nil {
+		return err
+	}
+	_, err := e.w.Write(binary.BigEndian.AppendUint32(nil, e.body.Sum32()))
+	return err
+}
+
+type nativeDecoder struct {
+	r     *bufio.Reader
+	body  hash.Hash32
+	count uint64
+	done  bool
+}
+
+func newNativeDecoder(r io.Reader) (*nativeDecoder, error) {
+	d := &nativeDecoder{r: bufio.NewReader(r), body: crc32.NewIEEE()}
+	header := make([]byte, nativeHeaderSize)
+	if err := d.readFull(header, false); err != nil {
+		return nil, err
+	}
+	if [4]byte(header[0:4]) != nativeMagic {
+		return nil, consts.ErrorDumpBadMagic
+	}
+	if v := binary.BigEndian.Uint16(header[4:6]); v == 0 || v > nativeVersion {
+		return nil, fmt.Errorf("%w: %d", consts.ErrorDumpVersion, v)
+	}
+	return d, nil
+}
+
+// readFull fills p, adding it to the body crc if body is set.
+func (d *nativeDecoder) readFull(p []byte, body bool) error {
+	if _, err := io.ReadFull(d.r, p); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return consts.ErrorDumpTruncated
+		}
+		return err
+	}
+	if body {
+		d.body.Write(p)
+	}
+	return nil
+}
+
+// readLength reads a uvarint length, appending its bytes to rec.
+func (d *nativeDecoder) readLength(rec []byte) ([]byte, uint64, error) {
+	n, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, 0, consts.ErrorDumpTruncated
+		}
+		return nil, 0, fmt.Errorf("%w: %v", consts.ErrorDumpMalformed, err)
+	}
+	if n > uint64(consts.SegmentMaxSize) {
+		return nil, 0, fmt.Errorf("%w: length %d", consts.ErrorDumpMalformed, n)
+	}
+	return binary.AppendUvarint(rec, n), n, nil
+}
+
+func (d *nativeDecoder) next() (string, string, error) {
+	if d.done {
+		return "", "", io.EOF
+	}
+	tag := make([]byte, 1)
+	if err := d.readFull(tag, true); err != nil {
+		return "", "", err
+	}
+	switch tag[0] {
+	case tagEnd:
+		return "", "", d.readTrailer()
+	case tagRecord:
+	default:
+		return "", "", fmt.Errorf("%w: tag %#x", consts.ErrorDumpMalformed, tag[0])
+	}
+	rec, keyLen, err := d.readLength(tag)
+	if err != nil {
+		return "", "", err
+	}
+	rec, valueLen, err := d.readLength(rec)
+	if err != nil {
+		return "", "", err
+	}
+	d.body.Write(rec[1:])
+	data := make([]byte, keyLen+valueLen+4)
+	if err := d.readFull(data, true); err != nil {
+		return "", "", err
+	}
+	payload, sum := data[:keyLen+valueLen], data[keyLen+valueLen:]
+	crc := crc32.Update(crc32.ChecksumIEEE(rec), crc32.IEEETable, payload)
+	if binary.BigEndian.Uint32(sum) != crc {
+		return "", "", fmt.Errorf("%w: record %d", consts.ErrorDumpChecksum, d.count+1)
+	}
+	d.count++
+	return string(payload[:keyLen]), string(payload[keyLen:]), nil
+}
+
+func (d *nativeDecoder) readTrailer() error {
+	count := make([]byte, 8)
+	if err := d.readFull(count, true); err != nil {
+		return err
+	}
+	sum := make([]byte, 4)
+	if err := d.readFull(sum, false); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(sum) != d.body.Sum32() {
+		return fmt.Errorf("%w: body", consts.ErrorDumpChecksum)
+	}
+	if n := binary.BigEndian.Uint64(count); n != d.count {
+		return fmt.Errorf("%w: trailer counts %d records, read %d", consts.ErrorDumpMalformed, n, d.count)
+	}
+	d.done = true
+	return io.EOF
+}
@@ -0,0 +1,512 @@
+// Package fsck checks a closed database directory for damage and optionally
+// repairs it.
+//
+// A record must be framed sanely: key and value sizes must fit in the
+// segment. Records in segments of format version 2 and later also carry a
+// checksum, which must match; older records are judged by their framing
+// alone. Segment headers, the MANIFEST and index_file are checksummed or
+// validated in full.
+package fsck
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sayuyere/bcask/internal/consts"
+	"github.com/sayuyere/bcask/internal/index"
+	"github.com/sayuyere/bcask/internal/item"
+	"github.com/sayuyere/bcask/internal/lockfile"
+	"github.com/sayuyere/bcask/internal/manifest"
+	"github.com/sayuyere/bcask/internal/segment"
+	"github.com/sayuyere/bcask/internal/uuid"
+)
+
+// Kind classifies a problem.
+type Kind string
+
+const (
+	KindManifestMissing Kind = "manifest-missing"
+	KindManifestCorrupt Kind = "manifest-corrupt"
+	KindSegmentMissing  Kind = "segment-missing"
+	KindSegmentOrphaned Kind = "segment-orphaned"
+	KindSegmentHeader   Kind = "segment-header"
+	KindTornRecord      Kind = "torn-record"
+	KindBadChecksum     Kind = "bad-checksum"
+	KindTrailingData    Kind = "trailing-data"
+	KindIndexMissing    Kind = "index-missing"
+	KindIndexCorrupt    Kind = "index-corrupt"
+	KindIndexBadOffset  Kind = "index-bad-offset"
+	KindIndexStaleEntry Kind = "index-stale-entry"
+	KindIndexMissingKey Kind = "index-missing-key"
+	KindIndexLegacy     Kind = "index-legacy-format"
+)
+
+// Problem is one finding. Segment and Offset are -1 when they do not apply.
+type Problem struct {
+	Kind    Kind
+	Segment int64
+	Offset  int64
+	Key     string
+	Detail  string
+}
+
+func (p Problem) String() string {
+	var b strings.Builder
+	b.WriteString(string(p.Kind))
+	if p.Segment >= 0 {
+		fmt.Fprintf(&b, " segment=%d", p.Segment)
+	}
+	if p.Offset >= 0 {
+		fmt.Fprintf(&b, " offset=%d", p.Offset)
+	}
+	if p.Key != "" {
+		fmt.Fprintf(&b, " key=%q", p.Key)
+	}
+	if p.Detail != "" {
+		b.WriteString(": ")
+		b.WriteString(p.Detail)
+	}
+	return b.String()
+}
+
+// Report is the result of a check.
+type Report struct {
+	Segments int
+	Records  int
+	// LiveKeys is the number of keys a replay of the segments ends with.
+	LiveKeys int
+	Problems []Problem
+	// Repairs lists what Repair mode changed on disk.
+	Repairs []string
+}
+
+// OK reports whether no problems were found.
+func (r *Report) OK() bool {
+	return len(r.Problems) == 0
+}
+
+type Options struct {
+	// Repair zeroes torn segment tails, truncates segments at the first
+	// record that fails its checksum, rewrites a missing MANIFEST and
+	// rebuilds index_file from the segments. Orphaned and unreadable
+	// segments are reported but never touched.
+	Repair bool
+}
+
+type location struct {
+	segment int64
+	offset  int64
+	size    int64 // value size
+	stamp   int64
+	expires int64 // unix ms, 0 if the record does not expire
+}
+
+func (l location) expired(now time.Time) bool {
+	return l.expires != 0 && l.expires <= now.UnixMilli()
+}
+
+type scannedSegment struct {
+	id      int64
+	header  segment.Header
+	end     int64 // offset after the last good record
+	records map[int64]item.DiskKV
+	torn    bool
+	dropped int // records from end on, zeroed along with the tail
+}
+
+// Check validates the database in dir. It takes the directory lock, so the
+// database must not be open elsewhere; a check without Repair takes it
+// shared and works on a read-only snapshot too.
+func Check(dir string, opts Options) (*Report, error) {
+	lock, err := lockfile.Acquire(filepath.Join(dir, consts.LockFileName), !opts.Repair)
+	if err != nil && !(!opts.Repair && errors.Is(err, os.ErrNotExist)) {
+		return nil, err
+	}
+	defer lock.Release()
+
+	c := &checker{dir: dir, opts: opts, report: &Report{}, now: time.Now()}
+	if err := c.run(); err != nil {
+		return nil, err
+	}
+	return c.report, nil
+}
+
+type checker struct {
+	dir    string
+	opts   Options
+	report *Report
+	dbID   uuid.UUID
+	now    time.Time
+}
+
+func (c *checker) problem(kind Kind, seg, offset int64, key, detail string) {
+	c.report.Problems = append(c.report.Problems, Problem{Kind: kind, Segment: seg, Offset: offset, Key: key, Detail: detail})
+}
+
+func (c *checker) repaired(format string, args ...any) {
+	c.report.Repairs = append(c.report.Repairs, fmt.Sprintf(format, args...))
+}
+
+func (c *checker) run() error {
+	onDisk, err := segmentFiles(c.dir)
+	if err != nil {
+		return err
+	}
+
+	ids := onDisk
+	m, err := manifest.Read(c.dir)
+	switch {
+	case err == nil:
+		c.dbID = m.DatabaseID
+		ids = m.Segments
+		for _, id := range onDisk {
+			if !slices.Contains(m.Segments, id) {
+				c.problem(KindSegmentOrphaned, id, -1, "", "segment file is not listed in the manifest and is ignored")
+			}
+		}
+	case errors.Is(err, os.ErrNotExist):
+		c.problem(KindManifestMissing, -1, -1, "", "live segments are taken from the directory listing")
+	default:
+		c.problem(KindManifestCorrupt, -1, -1, "", err.Error())
+		return nil // nothing else can be trusted
+	}
+
+	var segments []*scannedSegment
+	for _, id := range ids {
+		seg, err := c.scanSegment(id)
+		if err != nil {
+			return err
+		}
+		if seg != nil {
+			segments = append(segments, seg)
+		}
+	}
+	c.report.Segments = len(segments)
+
+	if m == nil && c.opts.Repair && len(segments) > 0 && !c.dbID.IsNil() {
+		var live []int64
+		for _, seg := range segments {
+			live = append(live, seg.id)
+		}
+		if err := manifest.Write(c.dir, manifest.New(c.dbID, live)); err != nil {
+			return err
+		}
+		c.repaired("wrote MANIFEST listing segments %v", live)
+	}
+
+	c.checkIndex(segments)
+	return nil
+}
+
+// scanSegment validates the header and walks the records of one segment,
+// zeroing a torn tail in Repair mode. A record failing its checksum with
+// only zeroes after it is torn too; elsewhere the segment ends there, and
+// Repair mode zeroes it and every record after it. It returns nil for
+// segments that cannot be read at all.
+func (c *checker) scanSegment(id int64) (*scannedSegment, error) {
+	path := segment.SegmentPath(c.dir, id)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		c.problem(KindSegmentMissing, id, -1, "", "segment listed in the manifest does not exist")
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	header, err := segment.DecodeFileHeader(data, int64(len(data)), id)
+	if err == nil && header.SegmentID != id {
+		err = fmt.Errorf("%w: header says %d", consts.ErrorSegmentIDMismatch, header.SegmentID)
+	}
+	if err == nil && !c.dbID.IsNil() && header.Version != 0 && header.DatabaseID != c.dbID {
+		err = fmt.Errorf("%w: %s", consts.ErrorSegmentForeignDatabase, header.DatabaseID)
+	}
+	if err != nil {
+		c.problem(KindSegmentHeader, id, 0, "", err.Error())
+		return nil, nil
+	}
+	if c.dbID.IsNil() {
+		c.dbID = header.DatabaseID
+	}
+
+	seg := &scannedSegment{id: id, header: header, records: make(map[int64]item.DiskKV)}
+	offset := header.DataStart()
+	size := int64(len(data))
+	for offset+item.DiskKVHeaderSize <= size {
+		var kv item.DiskKV
+		complete := kv.DecodeHeader(data[offset:])
+		if kv.Timestamp == 0 && kv.KeySize == 0 && kv.ValueSize == 0 {
+			break
+		}
+		if !complete || kv.KeySize < 0 || kv.ValueSize < 0 || kv.KeySize > size || kv.ValueSize > size ||
+			kv.Timestamp < 0 || offset+kv.EncodedSize() > size {
+			c.problem(KindTornRecord, id, offset, "",
+				fmt.Sprintf("key size %d, value size %d, timestamp %d", kv.KeySize, kv.ValueSize, kv.Timestamp))
+			seg.torn = true
+			break
+		}
+		record := data[offset : offset+kv.EncodedSize()]
+		kv.Decode(record)
+		if header.Checksummed() && !item.ChecksumMatches(record) {
+			if bytes.IndexFunc(data[offset+kv.EncodedSize():], func(r rune) bool { return r != 0 }) < 0 {
+				c.problem(KindTornRecord, id, offset, kv.Key, "last record does not match its checksum")
+				seg.torn = true
+				break
+			}
+			seg.dropped = countRecords(data, offset)
+			c.problem(KindBadChecksum, id, offset, kv.Key,
+				fmt.Sprintf("record does not match its checksum; it and the %d records after it are unreadable", seg.dropped-1))
+			seg.torn = true
+			break
+		}
+		seg.records[offset] = kv
+		c.report.Records++
+		offset += kv.EncodedSize()
+	}
+	seg.end = offset
+
+	if !seg.torn {
+		if i := bytes.IndexFunc(data[min(offset, size):], func(r rune) bool { return r != 0 }); i >= 0 {
+			c.problem(KindTrailingData, id, offset+int64(i), "", "non-zero bytes after the last record")
+			seg.torn = true
+		}
+	}
+	if seg.torn && c.opts.Repair {
+		if err := zeroTail(path, offset); err != nil {
+			return nil, err
+		}
+		if seg.dropped > 0 {
+			c.repaired("zeroed segment %d from offset %d, dropping %d records", id, offset, seg.dropped)
+		} else {
+			c.repaired("zeroed segment %d from offset %d", id, offset)
+		}
+	}
+	return seg, nil
+}
+
+// countRecords returns how many sanely framed records follow one another
+// in data from offset on.
+func countRecords(data []byte, offset int64) int {
+	size := int64(len(data))
+	n := 0
+	for offset+item.DiskKVHeaderSize <= size {
+		var kv item.DiskKV
+		complete := kv.DecodeHeader(data[offset:])
+		if !complete || kv.KeySize == 0 && kv.ValueSize == 0 && kv.Timestamp == 0 ||
+			kv.KeySize < 0 || kv.ValueSize < 0 || kv.KeySize > size || kv.ValueSize > size ||
+			offset+kv.EncodedSize() > size {
+			break
+		}
+		n++
+		offset += kv.EncodedSize()
+	}
+	return n
+}
+
+// zeroTail clears everything from offset to the end of the preallocated
+// segment file.
+func zeroTail(path string, offset int64) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+	if err := f.Truncate(consts.SegmentMaxSize); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// replay applies records in segment order the way recovery does, stopping
+// at the given checkpoint.
+func replay(segments []*scannedSegment, untilSegment, untilOffset int64) map[string]location {
+	live := make(map[string]location)
+	for _, seg := range segments {
+		if seg.id > untilSegment {
+			break
+		}
+		offsets := make([]int64, 0, len(seg.records))
+		for offset := range seg.records {
+			offsets = append(offsets, offset)
+		}
+		slices.Sort(offsets)
+		for _, offset := range offsets {
+			if seg.id == untilSegment && offset >= untilOffset {
+				break
+			}
+			kv := seg.records[offset]
+			if kv.Timestamp == 0 || kv.Tombstone {
+				delete(live, kv.Key)
+				continue
+			}
+			live[kv.Key] = location{segment: seg.id, offset: offset, size: kv.ValueSize, stamp: kv.Timestamp, expires: kv.ExpiresAt}
+		}
+	}
+	return live
+}
+
+// checkIndex compares index_file with a replay of the segments up to the
+// index checkpoint, and in Repair mode rewrites it from a full replay.
+func (c *checker) checkIndex(segments []*scannedSegment) {
+	full := replay(segments, int64(^uint64(0)>>1), 0)
+	for _, loc := range full {
+		if !loc.expired(c.now) {
+			c.report.LiveKeys++
+		}
+	}
+
+	bad := c.verifyIndex(segments)
+	if bad && c.opts.Repair && len(segments) > 0 {
+		if err := writeIndex(c.dir, full, segments[len(segments)-1]); err != nil {
+			c.problem(KindIndexCorrupt, -1, -1, "", "rebuild failed: "+err.Error())
+			return
+		}
+		c.repaired("rebuilt %s with %d keys", consts.IndexFileName, len(full))
+	}
+}
+
+// verifyIndex reports index problems and whether index_file needs a rebuild.
+func (c *checker) verifyIndex(segments []*scannedSegment) bool {
+	f, err := os.Open(filepath.Join(c.dir, consts.IndexFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		c.problem(KindIndexMissing, -1, -1, "", "the index will be rebuilt from the segments on open")
+		return true
+	}
+	if err != nil {
+		c.problem(KindIndexCorrupt, -1, -1, "", err.Error())
+		return true
+	}
+	defer f.Close()
+
+	r, err := index.NewReader(f)
+	if errors.Is(err, consts.ErrorIndexBadMagic) {
+		c.problem(KindIndexLegacy, -1, -1, "", "index_file predates the streamed format and cannot be cross-checked")
+		return true
+	}
+	if err != nil {
+		c.problem(KindIndexCorrupt, -1, -1, "", err.Error())
+		return true
+	}
+	byID := make(map[int64]*scannedSegment, len(segments))
+	for _, seg := range segments {
+		byID[seg.id] = seg
+	}
+	header := r.Header()
+	expected := replay(segments, header.CheckpointSegment, header.CheckpointOffset)
+
+	bad := false
+	seen := make(map[string]bool, len(expected))
+	for {
+		key, value, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			c.problem(KindIndexCorrupt, -1, -1, "", err.Error())
+			return true
+		}
+		seen[key] = true
+		seg, ok := byID[value.FileID]
+		if !ok {
+			c.problem(KindIndexBadOffset, value.FileID, value.Offset, key, "entry points at a segment that is not live")
+			bad = true
+			continue
+		}
+		kv, ok := seg.records[value.Offset]
+		if !ok || kv.Key != key || kv.ValueSize != value.ValueSize {
+			c.problem(KindIndexBadOffset, value.FileID, value.Offset, key, "entry does not point at a record for this key")
+			bad = true
+			continue
+		}
+		if want, ok := expected[key]; !ok || want.segment != value.FileID || want.offset != value.Offset {
+			c.problem(KindIndexStaleEntry, value.FileID, value.Offset, key, "a replay of the segments does not end at this record")
+			bad = true
+		}
+	}
+	for key, loc := range expected {
+		// Recovery drops expired keys, so the index need not have them.
+		if !seen[key] && !loc.expired(c.now) {
+			c.problem(KindIndexMissingKey, loc.segment, loc.offset, key, "live record is not in the index")
+			bad = true
+		}
+	}
+	return bad
+}
+
+// writeIndex writes live as a new index_file checkpointed at the end of the
+// last segment.
+func writeIndex(dir string, live map[string]location, last *scannedSegment) error {
+	keys := make([]string, 0, len(live))
+	for key := range live {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	path := filepath.Join(dir, consts.IndexFileName)
+	tmp := path + consts.TempFileSuffix
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	err = func() error {
+		w, err := index.NewWriter(f, index.FileHeader{
+			Flags:             index.FlagPrefixCompressed,
+			CheckpointSegment: last.id,
+			CheckpointOffset:  last.end,
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			loc := live[key]
+			if err := w.Write(key, &item.MemoryItem{FileID: loc.segment, ValueSize: loc.size, Offset: loc.offset, Timestamp: loc.stamp, ExpiresAt: loc.expires}); err != nil {
+				return err
+			}
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		return f.Sync()
+	}()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// segmentFiles lists the IDs of the segment files in dir in ascending order.
+func segmentFiles(dir string) ([]int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, consts.SegmentPrefix) {
+			continue
+		}
+		id, err := strconv.ParseInt(strings.TrimPrefix(name, consts.SegmentPrefix), 10, 64)
+		if err != nil {
+			continue // merge leftovers and temporary files
+		}
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
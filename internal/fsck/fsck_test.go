@@ -0,0 +1,177 @@
+package fsck
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/sayuyere/bcask/internal/consts"
+	"github.com/sayuyere/bcask/internal/db"
+	"github.com/sayuyere/bcask/internal/segment"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func kinds(r *Report) []Kind {
+	var out []Kind
+	for _, p := range r.Problems {
+		out = append(out, p.Kind)
+	}
+	return out
+}
+
+func TestCheck(t *testing.T) {
+	root := t.TempDir()
+	b, err := db.Open(root, "fsck_db")
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, b.Put("key"+strconv.Itoa(i), "value"+strconv.Itoa(i)))
+	}
+	require.NoError(t, b.Delete("key3"))
+	end := b.DBSegments[0].GetOffset()
+	require.NoError(t, b.Close())
+	dir := filepath.Join(root, "fsck_db")
+
+	t.Run("clean", func(t *testing.T) {
+		report, err := Check(dir, Options{})
+		require.NoError(t, err)
+		assert.True(t, report.OK(), "%v", report.Problems)
+		assert.Equal(t, 1, report.Segments)
+		assert.Equal(t, 11, report.Records)
+		assert.Equal(t, 9, report.LiveKeys)
+	})
+
+	t.Run("torn tail and corrupt index", func(t *testing.T) {
+		f, err := os.OpenFile(segment.SegmentPath(dir, 0), os.O_RDWR, 0)
+		require.NoError(t, err)
+		torn := make([]byte, 24)
+		binary.BigEndian.PutUint64(torn[0:8], 1)
+		binary.BigEndian.PutUint64(torn[8:16], 1<<40)
+		_, err = f.WriteAt(torn, end)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		indexPath := filepath.Join(dir, consts.IndexFileName)
+		data, err := os.ReadFile(indexPath)
+		require.NoError(t, err)
+		data[len(data)-1] ^= 0xff
+		require.NoError(t, os.WriteFile(indexPath, data, 0666))
+
+		report, err := Check(dir, Options{})
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []Kind{KindTornRecord, KindIndexCorrupt}, kinds(report))
+		assert.Equal(t, end, report.Problems[0].Offset)
+		assert.Empty(t, report.Repairs)
+
+		report, err = Check(dir, Options{Repair: true})
+		require.NoError(t, err)
+		assert.Len(t, report.Repairs, 2)
+
+		report, err = Check(dir, Options{})
+		require.NoError(t, err)
+		assert.True(t, report.OK(), "%v", report.Problems)
+
+		b, err := db.Open(root, "fsck_db")
+		require.NoError(t, err)
+		defer b.Close()
+		v, err := b.Get("key9")
+		require.NoError(t, err)
+		assert.Equal(t, "value9", v)
+		_, err = b.Get("key3")
+		assert.Error(t, err)
+	})
+
+	t.Run("stale index and orphaned segment", func(t *testing.T) {
+		indexPath := filepath.Join(dir, consts.IndexFileName)
+		stale, err := os.ReadFile(indexPath)
+		require.NoError(t, err)
+
+		b, err := db.Open(root, "fsck_db")
+		require.NoError(t, err)
+		// Deletes append a tombstone that replay applies, so only a record
+		// marked deleted in place, as merge does, leaves the index stale.
+		loc, err := b.Index.Get("key5")
+		require.NoError(t, err)
+		require.NoError(t, b.DBSegments[0].Delete(*loc))
+		require.NoError(t, b.Close())
+		require.NoError(t, os.WriteFile(indexPath, stale, 0666))
+		require.NoError(t, os.WriteFile(segment.SegmentPath(dir, 9), nil, 0666))
+
+		report, err := Check(dir, Options{})
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []Kind{KindSegmentOrphaned, KindIndexStaleEntry}, kinds(report))
+
+		report, err = Check(dir, Options{Repair: true})
+		require.NoError(t, err)
+		report, err = Check(dir, Options{})
+		require.NoError(t, err)
+		assert.Equal(t, []Kind{KindSegmentOrphaned}, kinds(report))
+		assert.Equal(t, 8, report.LiveKeys)
+	})
+
+	t.Run("bad checksum", func(t *testing.T) {
+		b, err := db.Open(root, "fsck_db")
+		require.NoError(t, err)
+		loc, err := b.Index.Get("key1")
+		require.NoError(t, err)
+		require.NoError(t, b.Close())
+
+		f, err := os.OpenFile(segment.SegmentPath(dir, 0), os.O_RDWR, 0)
+		require.NoError(t, err)
+		flipped := loc.Offset + 24 + int64(len("key1"))
+		value := make([]byte, 1)
+		_, err = f.ReadAt(value, flipped)
+		require.NoError(t, err)
+		value[0] ^= 0x01
+		_, err = f.WriteAt(value, flipped)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		_, err = db.Open(root, "fsck_db")
+		assert.ErrorIs(t, err, consts.ErrorRecordChecksum)
+
+		// Nothing after the bad record can be trusted to be framed right,
+		// so the segment ends there: key1 to key9 and key3's tombstone.
+		report, err := Check(dir, Options{})
+		require.NoError(t, err)
+		assert.Equal(t, []Kind{KindSegmentOrphaned, KindBadChecksum}, kinds(report)[:2])
+		assert.Equal(t, loc.Offset, report.Problems[1].Offset)
+		assert.Contains(t, report.Problems[1].Detail, "the 9 records after it")
+		assert.Contains(t, kinds(report), KindIndexBadOffset)
+		assert.Equal(t, 1, report.LiveKeys)
+
+		report, err = Check(dir, Options{Repair: true})
+		require.NoError(t, err)
+		require.Len(t, report.Repairs, 2)
+		assert.Contains(t, report.Repairs[0], "dropping 10 records")
+		report, err = Check(dir, Options{})
+		require.NoError(t, err)
+		assert.Equal(t, []Kind{KindSegmentOrphaned}, kinds(report))
+		assert.Equal(t, 1, report.LiveKeys)
+
+		data, err := os.ReadFile(segment.SegmentPath(dir, 0))
+		require.NoError(t, err)
+		assert.Equal(t, make([]byte, len(data)-int(loc.Offset)), data[loc.Offset:])
+
+		b, err = db.Open(root, "fsck_db")
+		require.NoError(t, err)
+		defer b.Close()
+		_, err = b.Get("key1")
+		assert.ErrorIs(t, err, consts.ErrorKeyNotFound)
+		_, err = b.Get("key2")
+		assert.ErrorIs(t, err, consts.ErrorKeyNotFound)
+		v, err := b.Get("key0")
+		require.NoError(t, err)
+		assert.Equal(t, "value0", v)
+	})
+
+	t.Run("locked", func(t *testing.T) {
+		b, err := db.Open(root, "fsck_db")
+		require.NoError(t, err)
+		defer b.Close()
+		_, err = Check(dir, Options{Repair: true})
+		assert.ErrorIs(t, err, consts.ErrorDatabaseLocked)
+	})
+}
@@ -0,0 +1,364 @@
+package index
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/sayuyere/bcask/internal/consts"
+	"github.com/sayuyere/bcask/internal/item"
+)
+
+// On-disk index layout (all integers big endian unless noted):
+//
+//	header  | magic "BCIX" | version u16 | flags u16 | checkpoint segment i64 | checkpoint offset i64 | reserved u32 | header crc u32 |
+//	entries | tag 0x01 | key | file_id varint | value_size varint | offset varint | timestamp varint | expires_at varint |  (repeated, sorted by key)
+//	trailer | tag 0x00 | entry count u64 | body crc u32 |
+//
+// With FlagPrefixCompressed the key is stored as uvarint(shared prefix length
+// with the previous key) | uvarint(suffix length) | suffix, otherwise as
+// uvarint(length) | key. The body crc covers everything between the header
+// and the crc itself, so a file can be written and read as a stream.
+// Version 1 files have no expires_at and are still read.
+
+const (
+	FormatVersion uint16 = 2
+	HeaderSize    int    = 32
+
+	// FlagPrefixCompressed stores every key relative to the previous one.
+	FlagPrefixCompressed uint16 = 1 << 0
+
+	tagEnd   byte = 0x00
+	tagEntry byte = 0x01
+)
+
+var magic = [4]byte{'B', 'C', 'I', 'X'}
+
+// FileHeader is the fixed-size preamble of an index file. Checkpoint records
+// the active segment position the index was taken at.
+type FileHeader struct {
+	Version           uint16
+	Flags             uint16
+	CheckpointSegment int64
+	CheckpointOffset  int64
+}
+
+func (h FileHeader) encode() []byte {
+	buf := make([]byte, HeaderSize)
+	copy(buf[0:4], magic[:])
+	binary.BigEndian.PutUint16(buf[4:6], h.Version)
+	binary.BigEndian.PutUint16(buf[6:8], h.Flags)
+	binary.BigEndian.PutUint64(buf[8:16], uint64(h.CheckpointSegment))
+	binary.BigEndian.PutUint64(buf[16:24], uint64(h.CheckpointOffset))
+	binary.BigEndian.PutUint32(buf[28:32], crc32.ChecksumIEEE(buf[:28]))
+	return buf
+}
+
+func decodeFileHeader(buf []byte) (FileHeader, error) {
+	if len(buf) < HeaderSize {
+		return FileHeader{}, consts.ErrorIndexTruncated
+	}
+	if [4]byte(buf[0:4]) != magic {
+		return FileHeader{}, consts.ErrorIndexBadMagic
+	}
+	if binary.BigEndian.Uint32(buf[28:32]) != crc32.ChecksumIEEE(buf[:28]) {
+		return FileHeader{}, consts.ErrorIndexHeaderChecksum
+	}
+	h := FileHeader{
+		Version:           binary.BigEndian.Uint16(buf[4:6]),
+		Flags:             binary.BigEndian.Uint16(buf[6:8]),
+		CheckpointSegment: int64(binary.BigEndian.Uint64(buf[8:16])),
+		CheckpointOffset:  int64(binary.BigEndian.Uint64(buf[16:24])),
+	}
+	if h.Version == 0 || h.Version > FormatVersion {
+		return FileHeader{}, fmt.Errorf("%w: %d", consts.ErrorIndexVersion, h.Version)
+	}
+	return h, nil
+}
+
+// IsIndexFile reports whether data starts with the streamed index magic.
+func IsIndexFile(data []byte) bool {
+	return len(data) >= len(magic) && [4]byte(data[0:4]) == magic
+}
+
+// Writer streams index entries to an underlying writer. Entries must be
+// written in ascending key order; Close writes the trailer but does not
+// close the underlying writer.
+type Writer struct {
+	bw      *bufio.Writer
+	crc     hash.Hash32
+	header  FileHeader
+	prevKey string
+	count   uint64
+	scratch [binary.MaxVarintLen64]byte
+	started bool
+}
+
+func NewWriter(w io.Writer, header FileHeader) (*Writer, error) {
+	if header.Version == 0 {
+		header.Version = FormatVersion
+	}
+	iw := &Writer{
+		bw:     bufio.NewWriter(w),
+		crc:    crc32.NewIEEE(),
+		header: header,
+	}
+	if _, err := iw.bw.Write(header.encode()); err != nil {
+		return nil, fmt.Errorf("failed to write index header: %v", err)
+	}
+	return iw, nil
+}
+
+func (w *Writer) write(p []byte) error {
+	w.crc.Write(p)
+	_, err := w.bw.Write(p)
+	return err
+}
+
+func (w *Writer) writeUvarint(v uint64) error {
+	n := binary.PutUvarint(w.scratch[:], v)
+	return w.write(w.scratch[:n])
+}
+
+func (w *Writer) writeVarint(v int64) error {
+	n := binary.PutVarint(w.scratch[:], v)
+	return w.write(w.scratch[:n])
+}
+
+// Write appends a single key and its location to the stream.
+func (w *Writer) Write(key string, value *item.MemoryItem) error {
+	if w.started && key <= w.prevKey {
+		return consts.ErrorIndexUnsortedEntries
+	}
+	if err := w.write([]byte{tagEntry}); err != nil {
+		return err
+	}
+	if w.header.Flags&FlagPrefixCompressed != 0 {
+		shared := commonPrefixLen(w.prevKey, key)
+		if err := w.writeUvarint(uint64(shared)); err != nil {
+			return err
+		}
+		if err := w.writeUvarint(uint64(len(key) - shared)); err != nil {
+			return err
+		}
+		if err := w.write([]byte(key[shared:])); err != nil {
+			return err
+		}
+	} else {
+		if err := w.writeUvarint(uint64(len(key))); err != nil {
+			return err
+		}
+		if err := w.write([]byte(key)); err != nil {
+			return err
+		}
+	}
+	fields := []int64{value.FileID, value.ValueSize, value.Offset, value.Timestamp, value.ExpiresAt}
+	if w.header.Version < 2 {
+		fields = fields[:4]
+	}
+	for _, v := range fields {
+		if err := w.writeVarint(v); err != nil {
+			return err
+		}
+	}
+	w.prevKey = key
+	w.started = true
+	w.count++
+	return nil
+}
+
+// Close writes the trailer and flushes buffered data.
+func (w *Writer) Close() error {
+	if err := w.write([]byte{tagEnd}); err != nil {
+		return err
+	}
+	var count [8]byte
+	binary.BigEndian.PutUint64(count[:], w.count)
+	if err := w.write(count[:]); err != nil {
+		return err
+	}
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], w.crc.Sum32())
+	if _, err := w.bw.Write(sum[:]); err != nil {
+		return err
+	}
+	return w.bw.Flush()
+}
+
+// Reader decodes an index stream one entry at a time.
+type Reader struct {
+	br      *bufio.Reader
+	crc     hash.Hash32
+	header  FileHeader
+	prevKey string
+	count   uint64
+	done    bool
+}
+
+func NewReader(r io.Reader) (*Reader, error) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	buf := make([]byte, HeaderSize)
+	if _, err := io.ReadFull(br, buf); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+			if IsIndexFile(buf) {
+				return nil, consts.ErrorIndexTruncated
+			}
+			return nil, consts.ErrorIndexBadMagic
+		}
+		return nil, err
+	}
+	header, err := decodeFileHeader(buf)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{br: br, crc: crc32.NewIEEE(), header: header}, nil
+}
+
+func (r *Reader) Header() FileHeader {
+	return r.header
+}
+
+// ReadByte implements io.ByteReader so varints can be decoded while the
+// body checksum is being accumulated.
+func (r *Reader) ReadByte() (byte, error) {
+	b, err := r.br.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	r.crc.Write([]byte{b})
+	return b, nil
+}
+
+func (r *Reader) readFull(p []byte) error {
+	if _, err := io.ReadFull(r.br, p); err != nil {
+		return consts.ErrorIndexTruncated
+	}
+	r.crc.Write(p)
+	return nil
+}
+
+func (r *Reader) readUvarint() (uint64, error) {
+	v, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, consts.ErrorIndexTruncated
+	}
+	return v, nil
+}
+
+// Next returns the next entry. It returns io.EOF once the trailer has been
+// read and the body checksum verified.
+func (r *Reader) Next() (string, *item.MemoryItem, error) {
+	if r.done {
+		return "", nil, io.EOF
+	}
+	tag, err := r.ReadByte()
+	if err != nil {
+		return "", nil, consts.ErrorIndexTruncated
+	}
+	switch tag {
+	case tagEnd:
+		return "", nil, r.finish()
+	case tagEntry:
+	default:
+		return "", nil, fmt.Errorf("index file: unknown entry tag 0x%02x", tag)
+	}
+
+	var key string
+	if r.header.Flags&FlagPrefixCompressed != 0 {
+		shared, err := r.readUvarint()
+		if err != nil {
+			return "", nil, err
+		}
+		if shared > uint64(len(r.prevKey)) {
+			return "", nil, fmt.Errorf("index file: shared prefix %d longer than previous key", shared)
+		}
+		suffix, err := r.readBytes()
+		if err != nil {
+			return "", nil, err
+		}
+		key = r.prevKey[:shared] + string(suffix)
+	} else {
+		raw, err := r.readBytes()
+		if err != nil {
+			return "", nil, err
+		}
+		key = string(raw)
+	}
+	if r.count > 0 && key <= r.prevKey {
+		return "", nil, consts.ErrorIndexUnsortedEntries
+	}
+
+	var fields [5]int64
+	n := len(fields)
+	if r.header.Version < 2 {
+		n = 4
+	}
+	for i := range fields[:n] {
+		v, err := binary.ReadVarint(r)
+		if err != nil {
+			return "", nil, consts.ErrorIndexTruncated
+		}
+		fields[i] = v
+	}
+	r.prevKey = key
+	r.count++
+	return key, &item.MemoryItem{
+		FileID:    fields[0],
+		ValueSize: fields[1],
+		Offset:    fields[2],
+		Timestamp: fields[3],
+		ExpiresAt: fields[4],
+	}, nil
+}
+
+func (r *Reader) readBytes() ([]byte, error) {
+	n, err := r.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(consts.SegmentMaxSize) {
+		// A key can never be larger than a segment, so this is corruption.
+		return nil, fmt.Errorf("index file: key length %d exceeds segment size", n)
+	}
+	buf := make([]byte, n)
+	if err := r.readFull(buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (r *Reader) finish() error {
+	var count [8]byte
+	if err := r.readFull(count[:]); err != nil {
+		return err
+	}
+	var sum [4]byte
+	if _, err := io.ReadFull(r.br, sum[:]); err != nil {
+		return consts.ErrorIndexTruncated
+	}
+	if binary.BigEndian.Uint64(count[:]) != r.count {
+		return fmt.Errorf("index file: trailer count %d does not match %d entries read", binary.BigEndian.Uint64(count[:]), r.count)
+	}
+	if binary.BigEndian.Uint32(sum[:]) != r.crc.Sum32() {
+		return consts.ErrorIndexBodyChecksum
+	}
+	r.done = true
+	return io.EOF
+}
+
+func commonPrefixLen(a, b string) int {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
@@ -1,10 +1,17 @@
 package index
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
+	"io"
+	"log/slog"
+	"sort"
 	"sync"
 
+	"github.com/sayuyere/bcask/internal/consts"
 	"github.com/sayuyere/bcask/internal/item"
+	"github.com/sayuyere/bcask/internal/logging"
 	"github.com/vmihailenco/msgpack/v5"
 )
 
@@ -29,6 +36,10 @@ type Index interface {
 	Encode() ([]byte, error)
 	// Decode deserializes the index from a byte slice.
 	Decode(data []byte) error
+	// EncodeTo streams the index to w in the versioned index file format.
+	EncodeTo(w io.Writer, header FileHeader) error
+	// DecodeFrom loads the index incrementally from r and returns the file header.
+	DecodeFrom(r io.Reader) (FileHeader, error)
 }
 
 type PrefixTrieNode struct {
@@ -40,6 +51,8 @@ type PrefixTrieNode struct {
 
 type PrefixTrie struct {
 	Root *PrefixTrieNode `json:"root"`
+	// Logger receives index load events; nil is silent.
+	Logger *slog.Logger `json:"-"`
 }
 
 func (t *PrefixTrie) Close() error {
@@ -55,14 +68,14 @@ func (t *PrefixTrie) Get(key string) (*item.MemoryItem, error) {
 	node := t.Root
 	for _, char := range key {
 		if _, exists := node.Children[char]; !exists {
-			return nil, fmt.Errorf("key not found")
+			return nil, consts.ErrorKeyNotFound
 		}
 		node = node.Children[char]
 	}
 	if node.IsEnd {
 		return node.Value, nil
 	}
-	return nil, fmt.Errorf("key not found")
+	return nil, consts.ErrorKeyNotFound
 }
 
 func (t *PrefixTrie) Set(key string, value *item.MemoryItem) error {
@@ -164,19 +177,171 @@ func (t *PrefixTrie) Iterate() (<-chan map[string]*item.MemoryItem, error) {
 	return ch, nil
 }
 
+// walk visits every key in ascending order. It uses an explicit stack so the
+// depth of the trie does not translate into recursion depth.
+func (t *PrefixTrie) walk(fn func(key string, value *item.MemoryItem) error) error {
+	return walkFrom(t.Root, nil, fn)
+}
+
+// walkFrom visits every key below node in ascending order; prefix is the
+// key node stands for.
+func walkFrom(node *PrefixTrieNode, prefix []rune, fn func(key string, value *item.MemoryItem) error) error {
+	type frame struct {
+		node *PrefixTrieNode
+		key  []rune
+	}
+	stack := []frame{{node: node, key: prefix}}
+	for len(stack) > 0 {
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if top.node.IsEnd {
+			if err := fn(string(top.key), top.node.Value); err != nil {
+				return err
+			}
+		}
+		chars := make([]rune, 0, len(top.node.Children))
+		for char := range top.node.Children {
+			chars = append(chars, char)
+		}
+		// Push in descending order so the smallest child is popped first.
+		sort.Slice(chars, func(i, j int) bool { return chars[i] > chars[j] })
+		for _, char := range chars {
+			key := make([]rune, len(top.key)+1)
+			copy(key, top.key)
+			key[len(top.key)] = char
+			stack = append(stack, frame{node: top.node.Children[char], key: key})
+		}
+	}
+	return nil
+}
+
+// Walk calls fn for every key in ascending order while holding the read
+// lock, so fn must not modify the trie. A non-nil error from fn stops the
+// walk and is returned.
+func (t *PrefixTrie) Walk(fn func(key string, value *item.MemoryItem) error) error {
+	t.Root.RWLock.RLock()
+	defer t.Root.RWLock.RUnlock()
+	return t.walk(fn)
+}
+
+// WalkPrefix is Walk restricted to keys starting with prefix. Only the
+// subtrie below prefix is visited.
+func (t *PrefixTrie) WalkPrefix(prefix string, fn func(key string, value *item.MemoryItem) error) error {
+	t.Root.RWLock.RLock()
+	defer t.Root.RWLock.RUnlock()
+	node := t.Root
+	for _, char := range prefix {
+		next, ok := node.Children[char]
+		if !ok {
+			return nil
+		}
+		node = next
+	}
+	return walkFrom(node, []rune(prefix), fn)
+}
+
+// Approximate in-memory sizes used by MemoryEstimate, for 64-bit platforms.
+const (
+	nodeOverhead     = 64 // PrefixTrieNode struct plus an empty map header
+	childOverhead    = 24 // map bucket share for one rune -> pointer entry
+	memoryItemSize   = 40
+	estimateMapSlack = 2 // maps keep roughly twice the slots they use
+)
+
+// MemoryEstimate returns a rough number of bytes held by the trie.
+func (t *PrefixTrie) MemoryEstimate() int64 {
+	t.Root.RWLock.RLock()
+	defer t.Root.RWLock.RUnlock()
+	var total int64
+	stack := []*PrefixTrieNode{t.Root}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		total += nodeOverhead + int64(len(node.Children))*childOverhead*estimateMapSlack
+		if node.Value != nil {
+			total += memoryItemSize
+		}
+		for _, child := range node.Children {
+			stack = append(stack, child)
+		}
+	}
+	return total
+}
+
 func (t *PrefixTrie) Encode() ([]byte, error) {
-	// Serialize using MessagePack
+	var buf bytes.Buffer
+	if err := t.EncodeTo(&buf, FileHeader{Flags: FlagPrefixCompressed}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// EncodeTo writes the trie as a flat, sorted stream of entries.
+func (t *PrefixTrie) EncodeTo(w io.Writer, header FileHeader) error {
 	t.Root.RWLock.RLock()
 	defer t.Root.RWLock.RUnlock()
-	data, err := msgpack.Marshal(t.Root)
+	iw, err := NewWriter(w, header)
 	if err != nil {
-		return nil, fmt.Errorf("failed to encode trie: %v", err)
+		return err
+	}
+	if err := t.walk(iw.Write); err != nil {
+		return fmt.Errorf("failed to encode trie: %v", err)
 	}
-	return data, nil
+	if err := iw.Close(); err != nil {
+		return fmt.Errorf("failed to encode trie: %v", err)
+	}
+	return nil
 }
 
+// Decode accepts both the streamed index format and the legacy msgpack
+// encoding of the whole node tree, so old index files can be migrated.
 func (t *PrefixTrie) Decode(data []byte) error {
-	// Implement deserialization logic here
+	if IsIndexFile(data) {
+		_, err := t.DecodeFrom(bytes.NewReader(data))
+		return err
+	}
+	return t.decodeLegacy(data)
+}
+
+// DecodeFrom replaces the contents of the trie with the entries read from r.
+// Legacy msgpack input is detected and decoded in one piece.
+func (t *PrefixTrie) DecodeFrom(r io.Reader) (FileHeader, error) {
+	br := bufio.NewReader(r)
+	peek, _ := br.Peek(len(magic))
+	if !IsIndexFile(peek) {
+		data, err := io.ReadAll(br)
+		if err != nil {
+			return FileHeader{}, fmt.Errorf("failed to read index: %v", err)
+		}
+		logging.OrDiscard(t.Logger).Info("loading legacy msgpack index", "bytes", len(data))
+		return FileHeader{}, t.decodeLegacy(data)
+	}
+
+	ir, err := NewReader(br)
+	if err != nil {
+		return FileHeader{}, err
+	}
+	loaded := NewPrefixTrie()
+	for {
+		key, value, err := ir.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logging.OrDiscard(t.Logger).Error("index file corrupt", "entry", ir.count, "error", err)
+			return FileHeader{}, fmt.Errorf("failed to decode trie: %w", err)
+		}
+		loaded.Set(key, value)
+	}
+	t.Root.RWLock.Lock()
+	defer t.Root.RWLock.Unlock()
+	t.Root = loaded.Root
+	logging.OrDiscard(t.Logger).Debug("index loaded", "entries", ir.count,
+		"checkpoint_segment", ir.Header().CheckpointSegment, "checkpoint_offset", ir.Header().CheckpointOffset)
+	return ir.Header(), nil
+}
+
+func (t *PrefixTrie) decodeLegacy(data []byte) error {
 	t.Root.RWLock.Lock()
 	defer t.Root.RWLock.Unlock()
 	var root PrefixTrieNode
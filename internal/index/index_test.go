@@ -1,12 +1,17 @@
 package index
 
 import (
+	"bytes"
+	"fmt"
+	"io"
 	"testing"
 	"time"
 
+	"github.com/sayuyere/bcask/internal/consts"
 	"github.com/sayuyere/bcask/internal/item"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
 )
 
 func TestIndex(t *testing.T) {
@@ -103,3 +108,167 @@ func TestIndex(t *testing.T) {
 	})
 
 }
+
+func TestIndexFileFormat(t *testing.T) {
+	fill := func(t *testing.T, n int) *PrefixTrie {
+		t.Helper()
+		trie := NewPrefixTrie()
+		for i := 0; i < n; i++ {
+			err := trie.Set(fmt.Sprintf("user:%05d", i), &item.MemoryItem{
+				FileID:    int64(i % 3),
+				ValueSize: int64(i),
+				Offset:    int64(i * 64),
+				Timestamp: 1700000000 + int64(i),
+				ExpiresAt: int64(i%2) * 1700000000123,
+			})
+			require.NoError(t, err)
+		}
+		return trie
+	}
+
+	t.Run("StreamRoundTrip", func(t *testing.T) {
+		for _, flags := range []uint16{0, FlagPrefixCompressed} {
+			trie := fill(t, 500)
+			var buf bytes.Buffer
+			header := FileHeader{Flags: flags, CheckpointSegment: 2, CheckpointOffset: 4096}
+			require.NoError(t, trie.EncodeTo(&buf, header))
+
+			loaded := NewPrefixTrie()
+			got, err := loaded.DecodeFrom(&buf)
+			require.NoError(t, err)
+			assert.Equal(t, FormatVersion, got.Version)
+			assert.Equal(t, flags, got.Flags)
+			assert.Equal(t, int64(2), got.CheckpointSegment)
+			assert.Equal(t, int64(4096), got.CheckpointOffset)
+
+			count, err := loaded.Count()
+			require.NoError(t, err)
+			assert.Equal(t, 500, count)
+			value, err := loaded.Get("user:00123")
+			require.NoError(t, err)
+			assert.Equal(t, int64(123*64), value.Offset)
+			assert.Equal(t, int64(1700000000123), value.ExpiresAt)
+		}
+	})
+
+	t.Run("Version1Files", func(t *testing.T) {
+		var buf bytes.Buffer
+		w, err := NewWriter(&buf, FileHeader{Version: 1, Flags: FlagPrefixCompressed})
+		require.NoError(t, err)
+		require.NoError(t, w.Write("a", &item.MemoryItem{FileID: 1, ValueSize: 2, Offset: 64, Timestamp: 5, ExpiresAt: 99}))
+		require.NoError(t, w.Write("b", &item.MemoryItem{FileID: 1, ValueSize: 3, Offset: 90, Timestamp: 6}))
+		require.NoError(t, w.Close())
+
+		loaded := NewPrefixTrie()
+		header, err := loaded.DecodeFrom(&buf)
+		require.NoError(t, err)
+		assert.Equal(t, uint16(1), header.Version)
+		value, err := loaded.Get("a")
+		require.NoError(t, err)
+		assert.Equal(t, item.MemoryItem{FileID: 1, ValueSize: 2, Offset: 64, Timestamp: 5}, *value)
+		value, err = loaded.Get("b")
+		require.NoError(t, err)
+		assert.Equal(t, int64(90), value.Offset)
+	})
+
+	t.Run("EntriesAreSorted", func(t *testing.T) {
+		trie := NewPrefixTrie()
+		for _, key := range []string{"b", "abc", "a", "ab", "c"} {
+			require.NoError(t, trie.Set(key, &item.MemoryItem{}))
+		}
+		data, err := trie.Encode()
+		require.NoError(t, err)
+
+		r, err := NewReader(bytes.NewReader(data))
+		require.NoError(t, err)
+		var keys []string
+		for {
+			key, _, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			keys = append(keys, key)
+		}
+		assert.Equal(t, []string{"a", "ab", "abc", "b", "c"}, keys)
+	})
+
+	t.Run("PrefixCompressionIsSmaller", func(t *testing.T) {
+		trie := fill(t, 200)
+		var plain, compressed bytes.Buffer
+		require.NoError(t, trie.EncodeTo(&plain, FileHeader{}))
+		require.NoError(t, trie.EncodeTo(&compressed, FileHeader{Flags: FlagPrefixCompressed}))
+		assert.Less(t, compressed.Len(), plain.Len())
+	})
+
+	t.Run("CorruptionIsDetected", func(t *testing.T) {
+		data, err := fill(t, 10).Encode()
+		require.NoError(t, err)
+
+		body := bytes.Clone(data)
+		body[HeaderSize+5] ^= 0xff
+		_, err = NewPrefixTrie().DecodeFrom(bytes.NewReader(body))
+		assert.Error(t, err)
+
+		header := bytes.Clone(data)
+		header[10] ^= 0xff
+		_, err = NewPrefixTrie().DecodeFrom(bytes.NewReader(header))
+		assert.ErrorIs(t, err, consts.ErrorIndexHeaderChecksum)
+
+		_, err = NewPrefixTrie().DecodeFrom(bytes.NewReader(data[:len(data)-3]))
+		assert.Error(t, err)
+	})
+
+	t.Run("LegacyMsgpackDecode", func(t *testing.T) {
+		trie := fill(t, 20)
+		legacy, err := msgpack.Marshal(trie.Root)
+		require.NoError(t, err)
+
+		loaded := NewPrefixTrie()
+		require.NoError(t, loaded.Decode(legacy))
+		value, err := loaded.Get("user:00007")
+		require.NoError(t, err)
+		assert.Equal(t, int64(7), value.ValueSize)
+
+		streamed := NewPrefixTrie()
+		_, err = streamed.DecodeFrom(bytes.NewReader(legacy))
+		require.NoError(t, err)
+		count, err := streamed.Count()
+		require.NoError(t, err)
+		assert.Equal(t, 20, count)
+	})
+}
+
+func TestIndexWalk(t *testing.T) {
+	trie := NewPrefixTrie()
+	empty := trie.MemoryEstimate()
+	for _, key := range []string{"beta", "alpha", "alphabet"} {
+		require.NoError(t, trie.Set(key, &item.MemoryItem{ValueSize: int64(len(key))}))
+	}
+
+	var keys []string
+	err := trie.Walk(func(key string, value *item.MemoryItem) error {
+		keys = append(keys, key)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"alpha", "alphabet", "beta"}, keys)
+	assert.Greater(t, trie.MemoryEstimate(), empty)
+
+	t.Run("WalkPrefix", func(t *testing.T) {
+		for prefix, want := range map[string][]string{
+			"alph":  {"alpha", "alphabet"},
+			"alpha": {"alpha", "alphabet"},
+			"b":     {"beta"},
+			"gamma": nil,
+			"":      {"alpha", "alphabet", "beta"},
+		} {
+			var got []string
+			require.NoError(t, trie.WalkPrefix(prefix, func(key string, value *item.MemoryItem) error {
+				got = append(got, key)
+				return nil
+			}))
+			assert.Equal(t, want, got, "prefix %q", prefix)
+		}
+	})
+}
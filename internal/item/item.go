@@ -2,6 +2,8 @@ package item
 
 import (
 	"encoding/binary"
+	"hash/crc32"
+	"time"
 
 	mmap "github.com/edsrzf/mmap-go"
 )
@@ -11,6 +13,8 @@ type MemoryItem struct {
 	ValueSize int64 `json:"value_size"`
 	Offset    int64 `json:"offset"`
 	Timestamp int64 `json:"timestamp"`
+	// ExpiresAt is the expiry in unix milliseconds, 0 for none.
+	ExpiresAt int64 `json:"expires_at,omitempty"`
 }
 
 type DiskKV struct {
@@ -19,6 +23,64 @@ type DiskKV struct {
 	Key       string `json:"key"`
 	Value     string `json:"value"`
 	Timestamp int64  `json:"timestamp"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+	// Tombstone records mark Key as deleted and carry no value.
+	Tombstone bool `json:"tombstone,omitempty"`
+}
+
+// DiskKVHeaderSize is the fixed part of an encoded record:
+// timestamp, key_size and value_size.
+const DiskKVHeaderSize int64 = 24
+
+// FlagExpires is set in the encoded key_size of a record that carries an
+// expiry. The expiry follows the fixed header as 8 more bytes, so records
+// without one keep the original layout.
+const FlagExpires int64 = 1 << 62
+
+// FlagTombstone is set in the encoded key_size of a tombstone record.
+const FlagTombstone int64 = 1 << 61
+
+// FlagChecksum is set in the encoded key_size of a record that carries a
+// crc32 of itself in the upper half of value_size, which no value size
+// reaches. The crc covers the whole encoded record with that half zeroed.
+// Records written before checksums existed do not have it.
+const FlagChecksum int64 = 1 << 60
+
+// sizeMask clears the checksum from an encoded value_size.
+const sizeMask int64 = 1<<32 - 1
+
+// expirySize is the size of the optional expiry field.
+const expirySize int64 = 8
+
+func (d *DiskKV) extraSize() int64 {
+	if d.ExpiresAt != 0 {
+		return expirySize
+	}
+	return 0
+}
+
+// EncodedSize returns the number of bytes the record occupies in a segment.
+func (d *DiskKV) EncodedSize() int64 {
+	return DiskKVHeaderSize + d.extraSize() + d.KeySize + d.ValueSize
+}
+
+// Expired reports whether the record has an expiry at or before now.
+func (d *DiskKV) Expired(now time.Time) bool {
+	return d.ExpiresAt != 0 && d.ExpiresAt <= now.UnixMilli()
+}
+
+// RecordSize returns the size of the on-disk record the item points at.
+func (m *MemoryItem) RecordSize(key string) int64 {
+	size := DiskKVHeaderSize + int64(len(key)) + m.ValueSize
+	if m.ExpiresAt != 0 {
+		size += expirySize
+	}
+	return size
+}
+
+// Expired reports whether the item has an expiry at or before now.
+func (m *MemoryItem) Expired(now time.Time) bool {
+	return m.ExpiresAt != 0 && m.ExpiresAt <= now.UnixMilli()
 }
 
 func int64ToBytesBigEndian(n int64) []byte {
@@ -28,30 +90,77 @@ func int64ToBytesBigEndian(n int64) []byte {
 }
 
 func (d *DiskKV) Encode() []byte {
-	// CRC | timestamp | key_size | value_size | key | value
-	encoded := make([]byte, 0)
+	// timestamp | key_size (| FlagExpires | FlagTombstone | FlagChecksum) | crc u32 | value_size u32 (| expires_at) | key | value
+	encoded := make([]byte, 0, d.EncodedSize())
+	keySize := d.KeySize | FlagChecksum
+	if d.ExpiresAt != 0 {
+		keySize |= FlagExpires
+	}
+	if d.Tombstone {
+		keySize |= FlagTombstone
+	}
 	encoded = append(encoded, int64ToBytesBigEndian(d.Timestamp)...)
-	encoded = append(encoded, int64ToBytesBigEndian(d.KeySize)...)
+	encoded = append(encoded, int64ToBytesBigEndian(keySize)...)
 	encoded = append(encoded, int64ToBytesBigEndian(d.ValueSize)...)
+	if d.ExpiresAt != 0 {
+		encoded = append(encoded, int64ToBytesBigEndian(d.ExpiresAt)...)
+	}
 	encoded = append(encoded, []byte(d.Key)...)
 	encoded = append(encoded, []byte(d.Value)...)
+	binary.BigEndian.PutUint32(encoded[16:20], crc32.ChecksumIEEE(encoded))
 	return encoded
 }
 
-func (d *DiskKV) Decode(data []byte) {
-	if len(data) < 24 { // 8 bytes for timestamp, 8 for key_size, 8 for value_size
-		return // Not enough data to decode
+// ChecksumMatches reports whether record, one whole encoded record, carries
+// a checksum and matches it.
+func ChecksumMatches(record []byte) bool {
+	if int64(len(record)) < DiskKVHeaderSize || int64(binary.BigEndian.Uint64(record[8:16]))&FlagChecksum == 0 {
+		return false
+	}
+	h := crc32.NewIEEE()
+	h.Write(record[:16])
+	h.Write(make([]byte, 4))
+	h.Write(record[20:])
+	return h.Sum32() == binary.BigEndian.Uint32(record[16:20])
+}
+
+// DecodeHeader decodes the fixed header and the expiry, if any, leaving Key
+// and Value empty. It returns false if data is too short for them.
+func (d *DiskKV) DecodeHeader(data []byte) bool {
+	if int64(len(data)) < DiskKVHeaderSize {
+		return false
 	}
 	d.Timestamp = int64(binary.BigEndian.Uint64(data[:8]))
 	d.KeySize = int64(binary.BigEndian.Uint64(data[8:16]))
 	d.ValueSize = int64(binary.BigEndian.Uint64(data[16:24]))
+	d.ExpiresAt = 0
+	if d.KeySize&FlagChecksum != 0 {
+		d.KeySize &^= FlagChecksum
+		d.ValueSize &= sizeMask
+	}
+	d.Tombstone = d.KeySize&FlagTombstone != 0
+	d.KeySize &^= FlagTombstone
+	if d.KeySize&FlagExpires != 0 {
+		d.KeySize &^= FlagExpires
+		if int64(len(data)) < DiskKVHeaderSize+expirySize {
+			return false
+		}
+		d.ExpiresAt = int64(binary.BigEndian.Uint64(data[24:32]))
+	}
+	return true
+}
 
-	if len(data) < 24+int(d.KeySize)+int(d.ValueSize) {
+func (d *DiskKV) Decode(data []byte) {
+	if !d.DecodeHeader(data) {
+		return // Not enough data to decode
+	}
+	keyStart := DiskKVHeaderSize + d.extraSize()
+	if d.KeySize < 0 || d.ValueSize < 0 || int64(len(data)) < d.EncodedSize() {
 		return // Not enough data to decode key and value
 	}
 
-	d.Key = string(data[24 : 24+int(d.KeySize)])
-	d.Value = string(data[24+int(d.KeySize) : 24+int(d.KeySize)+int(d.ValueSize)])
+	d.Key = string(data[keyStart : keyStart+d.KeySize])
+	d.Value = string(data[keyStart+d.KeySize : d.EncodedSize()])
 }
 
 func (m *DiskKV) DecodeToMemoryItem() MemoryItem {
@@ -60,28 +169,28 @@ func (m *DiskKV) DecodeToMemoryItem() MemoryItem {
 		ValueSize: m.ValueSize,
 		Offset:    0, // Offset is not set in DiskKV, so we set it to 0
 		Timestamp: m.Timestamp,
+		ExpiresAt: m.ExpiresAt,
 	}
 }
 
 func (m *DiskKV) DecodeFromMMapedFile(mm *mmap.MMap, offset int64) {
-	// Ensure we have enough data for the header
 	mmInstance := (*mm)
-	if int(offset)+24 > len(mmInstance) {
+	if offset < 0 || offset > int64(len(mmInstance)) {
+		return
+	}
+	data := mmInstance[offset:]
+	if !m.DecodeHeader(data) {
 		return
 	}
-	m.Timestamp = int64(binary.BigEndian.Uint64(mmInstance[offset : offset+8]))
-	m.KeySize = int64(binary.BigEndian.Uint64(mmInstance[offset+8 : offset+16]))
-	m.ValueSize = int64(binary.BigEndian.Uint64(mmInstance[offset+16 : offset+24]))
-	keyStart := offset + 24
+	keyStart := DiskKVHeaderSize + m.extraSize()
 	keyEnd := keyStart + m.KeySize
-	valueStart := keyEnd
-	valueEnd := valueStart + m.ValueSize
+	valueEnd := keyEnd + m.ValueSize
 
 	// Defensive bounds check
-	if keyEnd > int64(len(mmInstance)) || valueEnd > int64(len(mmInstance)) {
+	if m.KeySize < 0 || m.ValueSize < 0 || keyEnd > int64(len(data)) || valueEnd > int64(len(data)) {
 		return
 	}
 
-	m.Key = string(mmInstance[keyStart:keyEnd])
-	m.Value = string(mmInstance[valueStart:valueEnd])
+	m.Key = string(data[keyStart:keyEnd])
+	m.Value = string(data[keyEnd:valueEnd])
 }
@@ -2,6 +2,7 @@ package item
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -17,13 +18,21 @@ func TestDiskKVEncode(t *testing.T) {
 
 	expected := []byte{
 		0x00, 0x00, 0x00, 0x00, 0x60, 0xB6, 0x1D, 0x58, // Timestamp
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03, // KeySize
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x05, // ValueSize
+		0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03, // KeySize | FlagChecksum
+		0xBA, 0xEA, 0x65, 0xCA, 0x00, 0x00, 0x00, 0x05, // Checksum | ValueSize
 		0x6B, 0x65, 0x79, // Key
 		0x76, 0x61, 0x6C, 0x75, 0x65, // Value
 	}
 	result := d.Encode()
 	assert.Equal(t, expected, result)
+	assert.True(t, ChecksumMatches(result))
+
+	decoded := &DiskKV{}
+	decoded.Decode(result)
+	assert.Equal(t, d, decoded)
+
+	result[len(result)-1] ^= 1
+	assert.False(t, ChecksumMatches(result), "a flipped value bit must fail the checksum")
 }
 func TestDiskKVDecode(t *testing.T) {
 	data := []byte{
@@ -34,6 +43,8 @@ func TestDiskKVDecode(t *testing.T) {
 		0x76, 0x61, 0x6C, 0x75, 0x65, // Value
 	}
 
+	// Records written before checksums existed.
+	assert.False(t, ChecksumMatches(data))
 	d := &DiskKV{}
 	d.Decode(data)
 
@@ -43,3 +54,53 @@ func TestDiskKVDecode(t *testing.T) {
 	assert.Equal(t, "key", d.Key)
 	assert.Equal(t, "value", d.Value)
 }
+
+func TestDiskKVExpiry(t *testing.T) {
+	d := &DiskKV{
+		KeySize:   3,
+		ValueSize: 5,
+		Key:       "key",
+		Value:     "value",
+		Timestamp: 1622547800,
+		ExpiresAt: 1622547800123,
+	}
+
+	expected := []byte{
+		0x00, 0x00, 0x00, 0x00, 0x60, 0xB6, 0x1D, 0x58, // Timestamp
+		0x50, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03, // KeySize | FlagExpires | FlagChecksum
+		0x46, 0x00, 0x99, 0xAD, 0x00, 0x00, 0x00, 0x05, // Checksum | ValueSize
+		0x00, 0x00, 0x01, 0x79, 0xC7, 0x62, 0xA0, 0x3B, // ExpiresAt
+		0x6B, 0x65, 0x79, // Key
+		0x76, 0x61, 0x6C, 0x75, 0x65, // Value
+	}
+	encoded := d.Encode()
+	assert.Equal(t, expected, encoded)
+	assert.Equal(t, int64(len(expected)), d.EncodedSize())
+
+	decoded := &DiskKV{}
+	decoded.Decode(encoded)
+	assert.Equal(t, d, decoded)
+
+	m := decoded.DecodeToMemoryItem()
+	assert.Equal(t, d.EncodedSize(), m.RecordSize("key"))
+	assert.False(t, m.Expired(time.UnixMilli(d.ExpiresAt-1)))
+	assert.True(t, m.Expired(time.UnixMilli(d.ExpiresAt)))
+	assert.False(t, (&MemoryItem{}).Expired(time.Now()))
+}
+
+func TestDiskKVTombstone(t *testing.T) {
+	d := &DiskKV{KeySize: 3, Key: "key", Timestamp: 1622547800, Tombstone: true}
+
+	expected := []byte{
+		0x00, 0x00, 0x00, 0x00, 0x60, 0xB6, 0x1D, 0x58, // Timestamp
+		0x30, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03, // KeySize | FlagTombstone | FlagChecksum
+		0x9D, 0x78, 0x28, 0xBD, 0x00, 0x00, 0x00, 0x00, // Checksum | ValueSize
+		0x6B, 0x65, 0x79, // Key
+	}
+	encoded := d.Encode()
+	assert.Equal(t, expected, encoded)
+
+	decoded := &DiskKV{}
+	decoded.Decode(encoded)
+	assert.Equal(t, d, decoded)
+}
@@ -0,0 +1,50 @@
+package lockfile
+
+import (
+	"os"
+)
+
+// Lock is an advisory lock held on a file for the lifetime of an open
+// database. Exclusive locks are held by writers, shared locks by read-only
+// openers; the kernel drops the lock if the process dies.
+type Lock struct {
+	Path   string
+	Shared bool
+	file   *os.File
+}
+
+// Acquire takes the lock on path without blocking. If it is held in a
+// conflicting mode by anyone else consts.ErrorDatabaseLocked is returned.
+// Exclusive locks create the lock file; shared locks only open an existing
+// one and report os.ErrNotExist otherwise, so readers never write.
+func Acquire(path string, shared bool) (*Lock, error) {
+	var f *os.File
+	var err error
+	if shared {
+		f, err = os.Open(path)
+	} else {
+		f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := lock(f, shared); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Lock{Path: path, Shared: shared, file: f}, nil
+}
+
+// Release drops the lock. Calling it more than once is a no-op.
+func (l *Lock) Release() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	f := l.file
+	l.file = nil
+	if err := unlock(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
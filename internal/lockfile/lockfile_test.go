@@ -0,0 +1,52 @@
+//go:build unix
+
+package lockfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sayuyere/bcask/internal/consts"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), consts.LockFileName)
+
+	t.Run("ExclusiveExcludesEveryone", func(t *testing.T) {
+		l, err := Acquire(path, false)
+		require.NoError(t, err)
+
+		_, err = Acquire(path, false)
+		assert.ErrorIs(t, err, consts.ErrorDatabaseLocked)
+		_, err = Acquire(path, true)
+		assert.ErrorIs(t, err, consts.ErrorDatabaseLocked)
+
+		require.NoError(t, l.Release())
+		require.NoError(t, l.Release())
+
+		again, err := Acquire(path, false)
+		require.NoError(t, err)
+		require.NoError(t, again.Release())
+	})
+
+	t.Run("SharedDoesNotCreate", func(t *testing.T) {
+		_, err := Acquire(filepath.Join(t.TempDir(), consts.LockFileName), true)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("SharedAllowsReaders", func(t *testing.T) {
+		a, err := Acquire(path, true)
+		require.NoError(t, err)
+		b, err := Acquire(path, true)
+		require.NoError(t, err)
+
+		_, err = Acquire(path, false)
+		assert.ErrorIs(t, err, consts.ErrorDatabaseLocked)
+
+		require.NoError(t, a.Release())
+		require.NoError(t, b.Release())
+	})
+}
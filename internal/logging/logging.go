@@ -0,0 +1,38 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+)
+
+// discardHandler drops every record; it keeps bcask silent unless the
+// embedding application hands in its own handler.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+var discard = slog.New(discardHandler{})
+
+// Discard returns a logger that never emits anything.
+func Discard() *slog.Logger {
+	return discard
+}
+
+// OrDiscard returns l, or the discarding logger when l is nil.
+func OrDiscard(l *slog.Logger) *slog.Logger {
+	if l == nil {
+		return discard
+	}
+	return l
+}
+
+// New wraps h in a logger, falling back to Discard for a nil handler.
+func New(h slog.Handler) *slog.Logger {
+	if h == nil {
+		return discard
+	}
+	return slog.New(h)
+}
@@ -0,0 +1,26 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogging(t *testing.T) {
+	t.Run("DiscardIsSilent", func(t *testing.T) {
+		assert.False(t, Discard().Enabled(context.Background(), slog.LevelError))
+		assert.Same(t, Discard(), OrDiscard(nil))
+		assert.Same(t, Discard(), New(nil))
+	})
+
+	t.Run("HandlerIsUsed", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger := New(slog.NewTextHandler(&buf, nil))
+		assert.Same(t, logger, OrDiscard(logger))
+		logger.Info("segment roll", "segment_id", 3)
+		assert.Contains(t, buf.String(), "segment_id=3")
+	})
+}
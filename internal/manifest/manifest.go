@@ -0,0 +1,128 @@
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/sayuyere/bcask/internal/consts"
+	"github.com/sayuyere/bcask/internal/uuid"
+)
+
+// Manifest is the source of truth for which segment files make up a
+// database. It is rewritten atomically whenever the set of live segments
+// changes (segment roll, merge).
+type Manifest struct {
+	FormatVersion int       `json:"format_version"`
+	DatabaseID    uuid.UUID `json:"database_id"`
+	SegmentSize   int64     `json:"segment_size"`
+	IndexType     string    `json:"index_type"`
+	// Segments lists the live segment IDs in ascending order, the last one
+	// is the active segment.
+	Segments      []int64 `json:"segments"`
+	ActiveSegment int64   `json:"active_segment"`
+	// LogHorizon is the timestamp of the newest tombstone a merge dropped.
+	// Reading the log from an earlier position would miss that delete.
+	LogHorizon int64 `json:"log_horizon,omitempty"`
+}
+
+func New(dbID uuid.UUID, segments []int64) *Manifest {
+	m := &Manifest{
+		FormatVersion: consts.ManifestFormatVersion,
+		DatabaseID:    dbID,
+		SegmentSize:   consts.SegmentMaxSize,
+		IndexType:     consts.IndexTypePrefixTrie,
+		Segments:      slices.Clone(segments),
+	}
+	if len(segments) > 0 {
+		m.ActiveSegment = segments[len(segments)-1]
+	}
+	return m
+}
+
+// Validate checks that the manifest can be served by this build.
+func (m *Manifest) Validate() error {
+	if m.FormatVersion == 0 || m.FormatVersion > consts.ManifestFormatVersion {
+		return fmt.Errorf("%w: %d", consts.ErrorManifestVersion, m.FormatVersion)
+	}
+	if m.DatabaseID.IsNil() {
+		return fmt.Errorf("%w: missing database id", consts.ErrorManifestInvalid)
+	}
+	if m.SegmentSize != consts.SegmentMaxSize {
+		return fmt.Errorf("%w: segment size %d, this build uses %d", consts.ErrorManifestInvalid, m.SegmentSize, consts.SegmentMaxSize)
+	}
+	if m.IndexType != consts.IndexTypePrefixTrie {
+		return fmt.Errorf("%w: unknown index type %q", consts.ErrorManifestInvalid, m.IndexType)
+	}
+	if len(m.Segments) == 0 {
+		return fmt.Errorf("%w: no segments", consts.ErrorManifestInvalid)
+	}
+	for i := 1; i < len(m.Segments); i++ {
+		if m.Segments[i] <= m.Segments[i-1] {
+			return fmt.Errorf("%w: segments are not in ascending order", consts.ErrorManifestInvalid)
+		}
+	}
+	if m.ActiveSegment != m.Segments[len(m.Segments)-1] {
+		return fmt.Errorf("%w: active segment %d is not the newest segment", consts.ErrorManifestInvalid, m.ActiveSegment)
+	}
+	return nil
+}
+
+// Read loads the manifest from dir. A missing manifest is reported with an
+// error satisfying errors.Is(err, os.ErrNotExist).
+func Read(dir string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, consts.ManifestFileName))
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%w: %v", consts.ErrorManifestInvalid, err)
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// Write replaces the manifest in dir atomically: the new content is synced
+// to a temporary file which is then renamed over the old one.
+func Write(dir string, m *Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %v", err)
+	}
+	loc := filepath.Join(dir, consts.ManifestFileName)
+	tmpLoc := loc + consts.TempFileSuffix
+	f, err := os.OpenFile(tmpLoc, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpLoc, loc); err != nil {
+		return err
+	}
+	return SyncDir(dir)
+}
+
+// SyncDir fsyncs a directory so renames inside it are durable.
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
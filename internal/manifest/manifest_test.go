@@ -0,0 +1,59 @@
+package manifest
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sayuyere/bcask/internal/consts"
+	"github.com/sayuyere/bcask/internal/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifest(t *testing.T) {
+	dir := t.TempDir()
+	dbID, err := uuid.New()
+	require.NoError(t, err)
+
+	t.Run("MissingManifest", func(t *testing.T) {
+		_, err := Read(dir)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("WriteRead", func(t *testing.T) {
+		m := New(dbID, []int64{0, 2, 5})
+		require.NoError(t, Write(dir, m))
+
+		got, err := Read(dir)
+		require.NoError(t, err)
+		assert.Equal(t, m, got)
+		assert.Equal(t, int64(5), got.ActiveSegment)
+
+		_, err = os.Stat(filepath.Join(dir, consts.ManifestFileName+consts.TempFileSuffix))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("Validate", func(t *testing.T) {
+		assert.NoError(t, New(dbID, []int64{1}).Validate())
+
+		m := New(dbID, []int64{3, 1})
+		assert.ErrorIs(t, m.Validate(), consts.ErrorManifestInvalid)
+
+		m = New(dbID, []int64{1})
+		m.SegmentSize = 1024
+		assert.ErrorIs(t, m.Validate(), consts.ErrorManifestInvalid)
+
+		m = New(dbID, []int64{1})
+		m.FormatVersion = consts.ManifestFormatVersion + 1
+		assert.ErrorIs(t, m.Validate(), consts.ErrorManifestVersion)
+
+		assert.ErrorIs(t, New(uuid.Nil, []int64{1}).Validate(), consts.ErrorManifestInvalid)
+	})
+
+	t.Run("CorruptManifest", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, consts.ManifestFileName), []byte("{"), 0666))
+		_, err := Read(dir)
+		assert.ErrorIs(t, err, consts.ErrorManifestInvalid)
+	})
+}
@@ -0,0 +1,181 @@
+// Package metrics exposes bcask statistics in the Prometheus text
+// exposition format (version 0.0.4), so the store can be scraped like any
+// other service without pulling in a client library.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sayuyere/bcask/internal/db"
+)
+
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Handler serves the metrics of one database on every request.
+type Handler struct {
+	DB *db.Bcask
+	// Labels are attached to every sample, e.g. {"db": "users"}.
+	Labels map[string]string
+}
+
+// NewHandler returns a handler labelling samples with the database name.
+func NewHandler(b *db.Bcask) *Handler {
+	return &Handler{DB: b, Labels: map[string]string{"db": b.DBName}}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", ContentType)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := Write(w, h.DB.Stats(), h.Labels); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Write renders s in the text exposition format with labels on every sample.
+func Write(w io.Writer, s db.Stats, labels map[string]string) error {
+	e := &encoder{w: bufio.NewWriter(w), base: formatLabels(labels)}
+
+	e.family("bcask_operations_total", "counter", "Operations served, by operation.")
+	e.sample("bcask_operations_total", `op="get"`, float64(s.Gets))
+	e.sample("bcask_operations_total", `op="put"`, float64(s.Puts))
+	e.sample("bcask_operations_total", `op="delete"`, float64(s.Deletes))
+
+	e.family("bcask_get_misses_total", "counter", "Get calls for keys that do not exist.")
+	e.sample("bcask_get_misses_total", "", float64(s.Misses))
+
+	e.family("bcask_operation_duration_seconds", "histogram", "Latency of Get, Put and Delete.")
+	e.histogram("bcask_operation_duration_seconds", `op="get"`, s.GetLatency)
+	e.histogram("bcask_operation_duration_seconds", `op="put"`, s.PutLatency)
+	e.histogram("bcask_operation_duration_seconds", `op="delete"`, s.DeleteLatency)
+
+	e.family("bcask_fsync_duration_seconds", "histogram", "Latency of fsync on segment and index files.")
+	e.histogram("bcask_fsync_duration_seconds", "", s.FsyncLatency)
+
+	e.family("bcask_merge_duration_seconds", "histogram", "Duration of completed merges.")
+	e.histogram("bcask_merge_duration_seconds", "", s.MergeLatency)
+
+	e.family("bcask_keys", "gauge", "Number of live keys.")
+	e.sample("bcask_keys", "", float64(s.Keys))
+
+	e.family("bcask_segments", "gauge", "Number of live segment files.")
+	e.sample("bcask_segments", "", float64(len(s.Segments)))
+
+	e.family("bcask_bytes_written_total", "counter", "Bytes appended to segments since open.")
+	e.sample("bcask_bytes_written_total", "", float64(s.BytesWritten))
+
+	e.family("bcask_live_bytes", "gauge", "Bytes held by live records.")
+	e.sample("bcask_live_bytes", "", float64(s.LiveBytes))
+	e.family("bcask_dead_bytes", "gauge", "Bytes held by overwritten or deleted records.")
+	e.sample("bcask_dead_bytes", "", float64(s.DeadBytes))
+	e.family("bcask_dead_bytes_ratio", "gauge", "Fraction of used segment bytes that are dead.")
+	e.sample("bcask_dead_bytes_ratio", "", s.DeadRatio())
+
+	e.family("bcask_segment_live_bytes", "gauge", "Bytes held by live records, per segment.")
+	for _, seg := range s.Segments {
+		e.sample("bcask_segment_live_bytes", segmentLabel(seg), float64(seg.LiveBytes))
+	}
+	e.family("bcask_segment_dead_bytes", "gauge", "Bytes held by dead records, per segment.")
+	for _, seg := range s.Segments {
+		e.sample("bcask_segment_dead_bytes", segmentLabel(seg), float64(seg.DeadBytes))
+	}
+
+	e.family("bcask_index_memory_bytes", "gauge", "Estimated memory held by the in-memory index.")
+	e.sample("bcask_index_memory_bytes", "", float64(s.IndexMemoryBytes))
+
+	if e.err != nil {
+		return e.err
+	}
+	return e.w.Flush()
+}
+
+func segmentLabel(seg db.SegmentStats) string {
+	return fmt.Sprintf(`segment="%d"`, seg.ID)
+}
+
+type encoder struct {
+	w    *bufio.Writer
+	base string
+	err  error
+}
+
+func (e *encoder) printf(format string, args ...any) {
+	if e.err == nil {
+		_, e.err = fmt.Fprintf(e.w, format, args...)
+	}
+}
+
+func (e *encoder) family(name, kind, help string) {
+	e.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (e *encoder) sample(name, labels string, value float64) {
+	e.printf("%s%s %s\n", name, e.labels(labels), formatFloat(value))
+}
+
+func (e *encoder) histogram(name, labels string, h db.Histogram) {
+	var cumulative uint64
+	for i, bound := range db.LatencyBuckets {
+		if i < len(h.Counts) {
+			cumulative += h.Counts[i]
+		}
+		le := `le="` + formatFloat(bound.Seconds()) + `"`
+		e.sample(name+"_bucket", joinLabels(labels, le), float64(cumulative))
+	}
+	e.sample(name+"_bucket", joinLabels(labels, `le="+Inf"`), float64(h.Count))
+	e.sample(name+"_sum", labels, h.Sum.Seconds())
+	e.sample(name+"_count", labels, float64(h.Count))
+}
+
+func (e *encoder) labels(extra string) string {
+	all := joinLabels(e.base, extra)
+	if all == "" {
+		return ""
+	}
+	return "{" + all + "}"
+}
+
+func joinLabels(a, b string) string {
+	switch {
+	case a == "":
+		return b
+	case b == "":
+		return a
+	}
+	return a + "," + b
+}
+
+func formatLabels(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = name + `="` + escapeLabel(labels[name]) + `"`
+	}
+	return strings.Join(parts, ",")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sayuyere/bcask/internal/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	t.Run("Write", func(t *testing.T) {
+		s := db.Stats{
+			Keys:      2,
+			Gets:      5,
+			Misses:    1,
+			LiveBytes: 300,
+			DeadBytes: 100,
+			Segments: []db.SegmentStats{
+				{ID: 0, BytesUsed: 250, LiveBytes: 150, DeadBytes: 100},
+				{ID: 1, Active: true, BytesUsed: 150, LiveBytes: 150},
+			},
+			GetLatency: db.Histogram{
+				Counts: make([]uint64, len(db.LatencyBuckets)),
+				Count:  3,
+				Sum:    1500 * time.Microsecond,
+			},
+		}
+		s.GetLatency.Counts[1] = 2 // <= 50µs
+		s.GetLatency.Counts[5] = 1 // <= 1ms
+
+		var out strings.Builder
+		require.NoError(t, Write(&out, s, map[string]string{"db": `we"ird`}))
+		text := out.String()
+
+		for _, line := range []string{
+			`# TYPE bcask_operations_total counter`,
+			`bcask_operations_total{db="we\"ird",op="get"} 5`,
+			`bcask_get_misses_total{db="we\"ird"} 1`,
+			`bcask_operation_duration_seconds_bucket{db="we\"ird",op="get",le="1e-05"} 0`,
+			`bcask_operation_duration_seconds_bucket{db="we\"ird",op="get",le="5e-05"} 2`,
+			`bcask_operation_duration_seconds_bucket{db="we\"ird",op="get",le="0.001"} 3`,
+			`bcask_operation_duration_seconds_bucket{db="we\"ird",op="get",le="+Inf"} 3`,
+			`bcask_operation_duration_seconds_sum{db="we\"ird",op="get"} 0.0015`,
+			`bcask_operation_duration_seconds_count{db="we\"ird",op="get"} 3`,
+			`bcask_segments{db="we\"ird"} 2`,
+			`bcask_dead_bytes_ratio{db="we\"ird"} 0.25`,
+			`bcask_segment_dead_bytes{db="we\"ird",segment="0"} 100`,
+			`# TYPE bcask_fsync_duration_seconds histogram`,
+			`# TYPE bcask_merge_duration_seconds histogram`,
+		} {
+			assert.Contains(t, text, line+"\n")
+		}
+	})
+
+	t.Run("Handler", func(t *testing.T) {
+		b, err := db.Open(t.TempDir(), "metrics_db")
+		require.NoError(t, err)
+		defer b.Close()
+		require.NoError(t, b.Put("k", "v"))
+		_, err = b.Get("k")
+		require.NoError(t, err)
+
+		rec := httptest.NewRecorder()
+		NewHandler(b).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, ContentType, rec.Header().Get("Content-Type"))
+		assert.Contains(t, rec.Body.String(), `bcask_operations_total{db="metrics_db",op="put"} 1`)
+		assert.Contains(t, rec.Body.String(), `bcask_operation_duration_seconds_count{db="metrics_db",op="get"} 1`)
+
+		rec = httptest.NewRecorder()
+		NewHandler(b).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/metrics", nil))
+		assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	})
+}
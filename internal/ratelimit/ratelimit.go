@@ -0,0 +1,75 @@
+// Package ratelimit provides a byte-rate token bucket for background I/O.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter limits throughput to a number of bytes per second, with a burst of
+// one second's worth of bytes. A rate of zero or less means unlimited. The
+// rate can be changed at any time; callers already waiting keep the delay
+// they were given.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func New(bytesPerSec int64) *Limiter {
+	return &Limiter{rate: bytesPerSec, tokens: float64(bytesPerSec), last: time.Now()}
+}
+
+// SetRate changes the limit. A rate of zero or less removes it.
+func (l *Limiter) SetRate(bytesPerSec int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	l.rate = bytesPerSec
+	if l.tokens > float64(bytesPerSec) {
+		l.tokens = float64(bytesPerSec)
+	}
+}
+
+func (l *Limiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// WaitN blocks until n bytes may be transferred. Requests larger than the
+// burst are allowed and push the bucket into debt, which later callers wait
+// out. WaitN is a no-op on a nil Limiter.
+func (l *Limiter) WaitN(n int64) {
+	if l == nil || n <= 0 {
+		return
+	}
+	if d := l.reserve(n); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func (l *Limiter) reserve(n int64) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
+
+func (l *Limiter) refill(now time.Time) {
+	if l.rate > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+		if l.tokens > float64(l.rate) {
+			l.tokens = float64(l.rate)
+		}
+	}
+	l.last = now
+}
@@ -0,0 +1,48 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiter(t *testing.T) {
+	t.Run("burst then wait", func(t *testing.T) {
+		l := New(10000)
+		start := time.Now()
+		l.WaitN(10000)
+		assert.Less(t, time.Since(start), 50*time.Millisecond)
+
+		start = time.Now()
+		l.WaitN(2000)
+		assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+	})
+
+	t.Run("unlimited", func(t *testing.T) {
+		l := New(0)
+		start := time.Now()
+		for i := 0; i < 100; i++ {
+			l.WaitN(1 << 30)
+		}
+		assert.Less(t, time.Since(start), 50*time.Millisecond)
+
+		var nilLimiter *Limiter
+		nilLimiter.WaitN(1 << 30)
+	})
+
+	t.Run("set rate", func(t *testing.T) {
+		l := New(100)
+		l.WaitN(100)
+		l.SetRate(0)
+		assert.Equal(t, int64(0), l.Rate())
+		start := time.Now()
+		l.WaitN(1 << 20)
+		assert.Less(t, time.Since(start), 50*time.Millisecond)
+
+		l.SetRate(10000)
+		start = time.Now()
+		l.WaitN(2000)
+		assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+	})
+}
@@ -0,0 +1,879 @@
+package redisimport
+
+import (
+	"bufio"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/sayuyere/bcask/internal/consts"
+	"github.com/sayuyere/bcask/internal/db"
+	"github.com/sayuyere/bcask/internal/resp"
+)
+
+// ImportAOF replays an append-only file and loads the keys it leaves
+// behind into l. path is either a single AOF, which may start with an RDB
+// preamble, or a Redis 7 appendonly directory, whose manifest lists a base
+// file and the incremental files to replay on top of it.
+//
+// The commands are replayed in memory, so the data set has to fit. Expire
+// times relative to when a command ran, which Redis itself rewrites to
+// absolute ones when logging, are taken relative to the import.
+func ImportAOF(l *db.BulkLoader, path string, opts Options) (Stats, error) {
+	imp := newImporter(l, opts)
+	files, err := aofFiles(path)
+	if err != nil {
+		return imp.stats, err
+	}
+	s := &aofState{dbs: map[int]map[string]*value{}, now: imp.now}
+	for _, file := range files {
+		truncated, err := s.replayFile(file)
+		if err != nil {
+			return imp.stats, err
+		}
+		imp.stats.Truncated = imp.stats.Truncated || truncated
+	}
+	// Later databases overwrite earlier ones, and keys are loaded in order.
+	for _, n := range sortedKeys(s.dbs) {
+		if !imp.wants(n) {
+			continue
+		}
+		keys := s.dbs[n]
+		for _, key := range sortedKeys(keys) {
+			if err := imp.put(key, keys[key]); err != nil {
+				return imp.stats, err
+			}
+		}
+	}
+	return imp.stats, nil
+}
+
+func sortedKeys[K cmp.Ordered, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// aofFiles returns the files to replay for path, in order.
+func aofFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	manifests, err := filepath.Glob(filepath.Join(path, "*.manifest"))
+	if err != nil {
+		return nil, err
+	}
+	if len(manifests) != 1 {
+		return nil, fmt.Errorf("%w: %s holds %d AOF manifests, want 1", consts.ErrorRedisFormat, path, len(manifests))
+	}
+	data, err := os.ReadFile(manifests[0])
+	if err != nil {
+		return nil, err
+	}
+	// Each line reads "file NAME seq N type T", where T is b for the base
+	// file, i for an incremental one and h for history that was already
+	// merged into the base.
+	var base string
+	var incrs []string
+	for i, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields)%2 != 0 {
+			return nil, fmt.Errorf("%w: manifest line %d", consts.ErrorRedisFormat, i+1)
+		}
+		attrs := map[string]string{}
+		for j := 0; j < len(fields); j += 2 {
+			attrs[fields[j]] = fields[j+1]
+		}
+		file := filepath.Join(path, filepath.Base(attrs["file"]))
+		switch attrs["type"] {
+		case "b":
+			base = file
+		case "i":
+			incrs = append(incrs, file)
+		case "h":
+		default:
+			return nil, fmt.Errorf("%w: manifest line %d", consts.ErrorRedisFormat, i+1)
+		}
+	}
+	if base != "" {
+		incrs = append([]string{base}, incrs...)
+	}
+	return incrs, nil
+}
+
+// aofState is the data set as replayed so far.
+type aofState struct {
+	dbs map[int]map[string]*value
+	db  int
+	now int64
+	// multi holds the commands of an open MULTI, which only apply once
+	// their EXEC is read.
+	multi   [][]string
+	inMulti bool
+}
+
+// replayFile applies the commands of one file. It reports whether the file
+// ended inside a command.
+func (s *aofState) replayFile(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	if head, _ := r.Peek(5); string(head) == "REDIS" {
+		err := parseRDB(r, func(n int, key string, v *value) error {
+			s.keyspace(n)[key] = v
+			return nil
+		})
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	s.db, s.multi, s.inMulti = 0, nil, false
+	for n := 1; ; n++ {
+		args, err := resp.ReadCommand(r)
+		if err == io.EOF {
+			return false, nil
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return true, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("%s: command %d: %w: %v", path, n, consts.ErrorRedisFormat, err)
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if err := s.exec(args); err != nil {
+			return false, fmt.Errorf("%s: command %d: %w", path, n, err)
+		}
+	}
+}
+
+func (s *aofState) keyspace(n int) map[string]*value {
+	keys, ok := s.dbs[n]
+	if !ok {
+		keys = map[string]*value{}
+		s.dbs[n] = keys
+	}
+	return keys
+}
+
+func (s *aofState) exec(args []string) error {
+	name := strings.ToLower(args[0])
+	switch {
+	case name == "multi":
+		s.inMulti, s.multi = true, nil
+		return nil
+	case name == "exec":
+		s.inMulti = false
+		for _, cmd := range s.multi {
+			if err := s.apply(cmd); err != nil {
+				return err
+			}
+		}
+		s.multi = nil
+		return nil
+	case s.inMulti:
+		s.multi = append(s.multi, args)
+		return nil
+	}
+	return s.apply(args)
+}
+
+// aofCommand is one entry of the replay table. arity counts the command
+// name like Redis does: positive is exact, negative is a minimum.
+type aofCommand struct {
+	arity int
+	run   func(s *aofState, args []string) error
+}
+
+var aofCommands map[string]aofCommand
+
+func init() {
+	aofCommands = map[string]aofCommand{
+		"select":   {2, (*aofState).selectDB},
+		"flushdb":  {-1, (*aofState).flushDB},
+		"flushall": {-1, (*aofState).flushAll},
+		"del":      {-2, (*aofState).del},
+		"unlink":   {-2, (*aofState).del},
+		"rename":   {3, (*aofState).rename},
+		"renamenx": {3, (*aofState).rename},
+		"move":     {3, (*aofState).move},
+
+		"expire":    {-3, (*aofState).expire},
+		"pexpire":   {-3, (*aofState).expire},
+		"expireat":  {-3, (*aofState).expire},
+		"pexpireat": {-3, (*aofState).expire},
+		"persist":   {2, (*aofState).persist},
+
+		"set":         {-3, (*aofState).set},
+		"setex":       {4, (*aofState).setex},
+		"psetex":      {4, (*aofState).setex},
+		"setnx":       {3, (*aofState).setnx},
+		"getset":      {3, (*aofState).getset},
+		"getdel":      {2, (*aofState).del},
+		"mset":        {-3, (*aofState).mset},
+		"msetnx":      {-3, (*aofState).mset},
+		"append":      {3, (*aofState).appendString},
+		"setrange":    {4, (*aofState).setrange},
+		"incr":        {2, (*aofState).incr},
+		"decr":        {2, (*aofState).incr},
+		"incrby":      {3, (*aofState).incr},
+		"decrby":      {3, (*aofState).incr},
+		"incrbyfloat": {3, (*aofState).incrByFloat},
+
+		"hset":         {-4, (*aofState).hset},
+		"hmset":        {-4, (*aofState).hset},
+		"hsetnx":       {4, (*aofState).hset},
+		"hdel":         {-3, (*aofState).hdel},
+		"hincrby":      {4, (*aofState).hincrby},
+		"hincrbyfloat": {4, (*aofState).hincrby},
+
+		"lpush":     {-3, (*aofState).push},
+		"rpush":     {-3, (*aofState).push},
+		"lpushx":    {-3, (*aofState).push},
+		"rpushx":    {-3, (*aofState).push},
+		"lpop":      {-2, (*aofState).pop},
+		"rpop":      {-2, (*aofState).pop},
+		"lset":      {4, (*aofState).lset},
+		"ltrim":     {4, (*aofState).ltrim},
+		"lrem":      {4, (*aofState).lrem},
+		"linsert":   {5, (*aofState).linsert},
+		"rpoplpush": {3, (*aofState).lmove},
+		"lmove":     {5, (*aofState).lmove},
+
+		"sadd":  {-3, (*aofState).sadd},
+		"srem":  {-3, (*aofState).srem},
+		"smove": {4, (*aofState).smove},
+	}
+}
+
+// otherTypePrefixes are the prefixes of commands that write types which are
+// not imported. The keys they create are tracked so that DEL, RENAME and
+// EXPIRE of them replay correctly.
+var otherTypePrefixes = []string{"z", "x", "pf", "geo"}
+
+// ignoredCommands change nothing an import keeps.
+var ignoredCommands = map[string]bool{"function": true, "script": true}
+
+func (s *aofState) apply(args []string) error {
+	name := strings.ToLower(args[0])
+	cmd, ok := aofCommands[name]
+	if !ok {
+		if ignoredCommands[name] {
+			return nil
+		}
+		for _, prefix := range otherTypePrefixes {
+			if strings.HasPrefix(name, prefix) && len(args) > 1 {
+				s.otherType(name, args)
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: command %q", consts.ErrorRedisUnsupported, args[0])
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) || len(args) < -cmd.arity {
+		return fmt.Errorf("%w: wrong number of arguments for %q", consts.ErrorRedisFormat, args[0])
+	}
+	return cmd.run(s, args)
+}
+
+// otherType records the key written by a command on a type that is not
+// imported. The ...STORE commands replace their destination; the others
+// only create a missing key.
+func (s *aofState) otherType(name string, args []string) {
+	key := args[1]
+	if name == "xgroup" {
+		if len(args) < 3 {
+			return
+		}
+		key = args[2]
+	}
+	if strings.HasSuffix(name, "store") || s.lookup(key) == nil {
+		s.keys()[key] = &value{kind: kindOther}
+	}
+}
+
+func (s *aofState) keys() map[string]*value {
+	return s.keyspace(s.db)
+}
+
+func (s *aofState) lookup(key string) *value {
+	return s.keys()[key]
+}
+
+// lookupKind returns the value of key, creating an empty one of kind k
+// when there is none. Redis never logs a command that failed, so a key of
+// another kind means the file is not what it claims to be.
+func (s *aofState) lookupKind(key string, k kind) (*value, error) {
+	v := s.lookup(key)
+	if v == nil {
+		v = &value{kind: k}
+		switch k {
+		case kindHash:
+			v.hash = map[string]string{}
+		case kindSet:
+			v.set = map[string]struct{}{}
+		}
+		s.keys()[key] = v
+	}
+	if v.kind != k {
+		return nil, fmt.Errorf("%w: wrong type for key %q", consts.ErrorRedisFormat, key)
+	}
+	return v, nil
+}
+
+// dropEmpty deletes key if it holds an empty collection, as Redis does.
+func (s *aofState) dropEmpty(key string, v *value) {
+	if (v.kind == kindHash && len(v.hash) == 0) || (v.kind == kindList && len(v.list) == 0) || (v.kind == kindSet && len(v.set) == 0) {
+		delete(s.keys(), key)
+	}
+}
+
+func parseInt(arg string) (int64, error) {
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q is not an integer", consts.ErrorRedisFormat, arg)
+	}
+	return n, nil
+}
+
+func (s *aofState) selectDB(args []string) error {
+	n, err := parseInt(args[1])
+	s.db = int(n)
+	return err
+}
+
+func (s *aofState) flushDB([]string) error {
+	delete(s.dbs, s.db)
+	return nil
+}
+
+func (s *aofState) flushAll([]string) error {
+	clear(s.dbs)
+	return nil
+}
+
+func (s *aofState) del(args []string) error {
+	for _, key := range args[1:] {
+		delete(s.keys(), key)
+	}
+	return nil
+}
+
+func (s *aofState) rename(args []string) error {
+	v := s.lookup(args[1])
+	if v == nil || (strings.EqualFold(args[0], "renamenx") && s.lookup(args[2]) != nil) {
+		return nil
+	}
+	delete(s.keys(), args[1])
+	s.keys()[args[2]] = v
+	return nil
+}
+
+func (s *aofState) move(args []string) error {
+	n, err := parseInt(args[2])
+	if err != nil {
+		return err
+	}
+	v := s.lookup(args[1])
+	dst := s.keyspace(int(n))
+	if v == nil || dst[args[1]] != nil {
+		return nil
+	}
+	delete(s.keys(), args[1])
+	dst[args[1]] = v
+	return nil
+}
+
+// expire handles EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT. Their NX, XX, GT
+// and LT conditions held when Redis logged the command, so they are
+// ignored.
+func (s *aofState) expire(args []string) error {
+	n, err := parseInt(args[2])
+	if err != nil {
+		return err
+	}
+	v := s.lookup(args[1])
+	if v == nil {
+		return nil
+	}
+	name := strings.ToLower(args[0])
+	if !strings.HasPrefix(name, "p") {
+		n *= 1000
+	}
+	if !strings.HasSuffix(name, "at") {
+		n += s.now
+	}
+	// A time in the past deletes the key right away; Redis logs a DEL for
+	// it instead, but older versions did not.
+	if n <= s.now {
+		delete(s.keys(), args[1])
+		return nil
+	}
+	v.expiresAt = n
+	return nil
+}
+
+func (s *aofState) persist(args []string) error {
+	if v := s.lookup(args[1]); v != nil {
+		v.expiresAt = 0
+	}
+	return nil
+}
+
+// set handles SET with the EX, PX, EXAT, PXAT, KEEPTTL, NX, XX and GET
+// options.
+func (s *aofState) set(args []string) error {
+	var expiresAt int64
+	keepTTL, nx, xx := false, false, false
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); opt {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GET":
+		case "KEEPTTL":
+			keepTTL = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if i+1 == len(args) {
+				return fmt.Errorf("%w: SET %s without a time", consts.ErrorRedisFormat, opt)
+			}
+			n, err := parseInt(args[i+1])
+			if err != nil {
+				return err
+			}
+			if opt == "EX" || opt == "EXAT" {
+				n *= 1000
+			}
+			if opt == "EX" || opt == "PX" {
+				n += s.now
+			}
+			expiresAt = n
+			i++
+		default:
+			return fmt.Errorf("%w: SET option %q", consts.ErrorRedisFormat, args[i])
+		}
+	}
+	old := s.lookup(args[1])
+	if (nx && old != nil) || (xx && old == nil) {
+		return nil
+	}
+	if keepTTL && old != nil {
+		expiresAt = old.expiresAt
+	}
+	s.keys()[args[1]] = &value{kind: kindString, str: args[2], expiresAt: expiresAt}
+	return nil
+}
+
+func (s *aofState) setex(args []string) error {
+	n, err := parseInt(args[2])
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(args[0], "setex") {
+		n *= 1000
+	}
+	s.keys()[args[1]] = &value{kind: kindString, str: args[3], expiresAt: s.now + n}
+	return nil
+}
+
+func (s *aofState) setnx(args []string) error {
+	if s.lookup(args[1]) == nil {
+		s.keys()[args[1]] = &value{kind: kindString, str: args[2]}
+	}
+	return nil
+}
+
+func (s *aofState) getset(args []string) error {
+	s.keys()[args[1]] = &value{kind: kindString, str: args[2]}
+	return nil
+}
+
+func (s *aofState) mset(args []string) error {
+	if len(args)%2 != 1 {
+		return fmt.Errorf("%w: wrong number of arguments for %q", consts.ErrorRedisFormat, args[0])
+	}
+	if strings.EqualFold(args[0], "msetnx") {
+		for i := 1; i < len(args); i += 2 {
+			if s.lookup(args[i]) != nil {
+				return nil
+			}
+		}
+	}
+	for i := 1; i < len(args); i += 2 {
+		s.keys()[args[i]] = &value{kind: kindString, str: args[i+1]}
+	}
+	return nil
+}
+
+func (s *aofState) appendString(args []string) error {
+	v, err := s.lookupKind(args[1], kindString)
+	if err == nil {
+		v.str += args[2]
+	}
+	return err
+}
+
+func (s *aofState) setrange(args []string) error {
+	offset, err := parseInt(args[2])
+	if err != nil {
+		return err
+	}
+	if offset < 0 || offset+int64(len(args[3])) > maxRDBString {
+		return fmt.Errorf("%w: SETRANGE offset %d", consts.ErrorRedisFormat, offset)
+	}
+	if args[3] == "" {
+		return nil
+	}
+	v, err := s.lookupKind(args[1], kindString)
+	if err != nil {
+		return err
+	}
+	b := []byte(v.str)
+	if end := int(offset) + len(args[3]); end > len(b) {
+		b = append(b, make([]byte, end-len(b))...)
+	}
+	copy(b[offset:], args[3])
+	v.str = string(b)
+	return nil
+}
+
+// incr handles INCR, DECR, INCRBY and DECRBY.
+func (s *aofState) incr(args []string) error {
+	by := int64(1)
+	if len(args) == 3 {
+		var err error
+		if by, err = parseInt(args[2]); err != nil {
+			return err
+		}
+	}
+	if strings.HasPrefix(strings.ToLower(args[0]), "decr") {
+		by = -by
+	}
+	v, err := s.lookupKind(args[1], kindString)
+	if err != nil {
+		return err
+	}
+	n := int64(0)
+	if v.str != "" {
+		if n, err = parseInt(v.str); err != nil {
+			return err
+		}
+	}
+	v.str = strconv.FormatInt(n+by, 10)
+	return nil
+}
+
+func (s *aofState) incrByFloat(args []string) error {
+	v, err := s.lookupKind(args[1], kindString)
+	if err != nil {
+		return err
+	}
+	sum, err := addFloat(v.str, args[2])
+	v.str = sum
+	return err
+}
+
+// addFloat adds the decimal numbers a, which may be empty for 0, and b.
+func addFloat(a, b string) (string, error) {
+	x, y := 0.0, 0.0
+	var err error
+	if a != "" {
+		x, err = strconv.ParseFloat(a, 64)
+	}
+	if err == nil {
+		y, err = strconv.ParseFloat(b, 64)
+	}
+	if err != nil {
+		return a, fmt.Errorf("%w: %q or %q is not a number", consts.ErrorRedisFormat, a, b)
+	}
+	return strconv.FormatFloat(x+y, 'f', -1, 64), nil
+}
+
+// hset handles HSET, HMSET and HSETNX.
+func (s *aofState) hset(args []string) error {
+	if len(args)%2 != 0 {
+		return fmt.Errorf("%w: wrong number of arguments for %q", consts.ErrorRedisFormat, args[0])
+	}
+	v, err := s.lookupKind(args[1], kindHash)
+	if err != nil {
+		return err
+	}
+	nx := strings.EqualFold(args[0], "hsetnx")
+	for i := 2; i < len(args); i += 2 {
+		if _, ok := v.hash[args[i]]; nx && ok {
+			continue
+		}
+		v.hash[args[i]] = args[i+1]
+	}
+	return nil
+}
+
+func (s *aofState) hdel(args []string) error {
+	v := s.lookup(args[1])
+	if v == nil || v.kind != kindHash {
+		return nil
+	}
+	for _, field := range args[2:] {
+		delete(v.hash, field)
+	}
+	s.dropEmpty(args[1], v)
+	return nil
+}
+
+// hincrby handles HINCRBY and HINCRBYFLOAT.
+func (s *aofState) hincrby(args []string) error {
+	v, err := s.lookupKind(args[1], kindHash)
+	if err != nil {
+		return err
+	}
+	old := v.hash[args[2]]
+	if strings.EqualFold(args[0], "hincrbyfloat") {
+		v.hash[args[2]], err = addFloat(old, args[3])
+		return err
+	}
+	by, err := parseInt(args[3])
+	if err != nil {
+		return err
+	}
+	n := int64(0)
+	if old != "" {
+		if n, err = parseInt(old); err != nil {
+			return err
+		}
+	}
+	v.hash[args[2]] = strconv.FormatInt(n+by, 10)
+	return nil
+}
+
+// push handles LPUSH, RPUSH and their X variants, which only push to an
+// existing list.
+func (s *aofState) push(args []string) error {
+	name := strings.ToLower(args[0])
+	if strings.HasSuffix(name, "x") && s.lookup(args[1]) == nil {
+		return nil
+	}
+	v, err := s.lookupKind(args[1], kindList)
+	if err != nil {
+		return err
+	}
+	for _, elem := range args[2:] {
+		if name[0] == 'l' {
+			v.list = slices.Insert(v.list, 0, elem)
+		} else {
+			v.list = append(v.list, elem)
+		}
+	}
+	return nil
+}
+
+// pop handles LPOP and RPOP with an optional count.
+func (s *aofState) pop(args []string) error {
+	count := int64(1)
+	if len(args) > 2 {
+		var err error
+		if count, err = parseInt(args[2]); err != nil {
+			return err
+		}
+	}
+	v := s.lookup(args[1])
+	if v == nil || v.kind != kindList {
+		return nil
+	}
+	n := int(min(count, int64(len(v.list))))
+	if strings.EqualFold(args[0], "lpop") {
+		v.list = v.list[n:]
+	} else {
+		v.list = v.list[:len(v.list)-n]
+	}
+	s.dropEmpty(args[1], v)
+	return nil
+}
+
+// listIndex resolves a possibly negative list index.
+func listIndex(arg string, length int) (int, error) {
+	i, err := parseInt(arg)
+	if err != nil {
+		return 0, err
+	}
+	if i < 0 {
+		i += int64(length)
+	}
+	return int(max(i, -1)), nil
+}
+
+func (s *aofState) lset(args []string) error {
+	v, err := s.lookupKind(args[1], kindList)
+	if err != nil {
+		return err
+	}
+	i, err := listIndex(args[2], len(v.list))
+	if err != nil {
+		return err
+	}
+	if i < 0 || i >= len(v.list) {
+		return fmt.Errorf("%w: LSET index out of range", consts.ErrorRedisFormat)
+	}
+	v.list[i] = args[3]
+	return nil
+}
+
+func (s *aofState) ltrim(args []string) error {
+	v := s.lookup(args[1])
+	if v == nil || v.kind != kindList {
+		return nil
+	}
+	start, err := listIndex(args[2], len(v.list))
+	if err != nil {
+		return err
+	}
+	stop, err := listIndex(args[3], len(v.list))
+	if err != nil {
+		return err
+	}
+	start, stop = max(start, 0), min(stop, len(v.list)-1)
+	if start > stop {
+		v.list = nil
+	} else {
+		v.list = v.list[start : stop+1]
+	}
+	s.dropEmpty(args[1], v)
+	return nil
+}
+
+// lrem removes count occurrences of an element from the head, from the
+// tail when count is negative, or all of them when it is 0.
+func (s *aofState) lrem(args []string) error {
+	count, err := parseInt(args[2])
+	if err != nil {
+		return err
+	}
+	v := s.lookup(args[1])
+	if v == nil || v.kind != kindList {
+		return nil
+	}
+	fromTail := count < 0
+	if fromTail {
+		count = -count
+		slices.Reverse(v.list)
+	}
+	removed := int64(0)
+	kept := v.list[:0]
+	for _, elem := range v.list {
+		if elem == args[3] && (count == 0 || removed < count) {
+			removed++
+			continue
+		}
+		kept = append(kept, elem)
+	}
+	v.list = kept
+	if fromTail {
+		slices.Reverse(v.list)
+	}
+	s.dropEmpty(args[1], v)
+	return nil
+}
+
+func (s *aofState) linsert(args []string) error {
+	v := s.lookup(args[1])
+	if v == nil || v.kind != kindList {
+		return nil
+	}
+	i := slices.Index(v.list, args[3])
+	if i < 0 {
+		return nil
+	}
+	if strings.EqualFold(args[2], "after") {
+		i++
+	}
+	v.list = slices.Insert(v.list, i, args[4])
+	return nil
+}
+
+// lmove handles LMOVE and RPOPLPUSH, which is LMOVE RIGHT LEFT.
+func (s *aofState) lmove(args []string) error {
+	from, to := "right", "left"
+	if len(args) == 5 {
+		from, to = strings.ToLower(args[3]), strings.ToLower(args[4])
+	}
+	src := s.lookup(args[1])
+	if src == nil || src.kind != kindList || len(src.list) == 0 {
+		return nil
+	}
+	var elem string
+	if from == "left" {
+		elem, src.list = src.list[0], src.list[1:]
+	} else {
+		elem, src.list = src.list[len(src.list)-1], src.list[:len(src.list)-1]
+	}
+	s.dropEmpty(args[1], src)
+	dst, err := s.lookupKind(args[2], kindList)
+	if err != nil {
+		return err
+	}
+	if to == "left" {
+		dst.list = slices.Insert(dst.list, 0, elem)
+	} else {
+		dst.list = append(dst.list, elem)
+	}
+	return nil
+}
+
+func (s *aofState) sadd(args []string) error {
+	v, err := s.lookupKind(args[1], kindSet)
+	if err != nil {
+		return err
+	}
+	for _, member := range args[2:] {
+		v.set[member] = struct{}{}
+	}
+	return nil
+}
+
+func (s *aofState) srem(args []string) error {
+	v := s.lookup(args[1])
+	if v == nil || v.kind != kindSet {
+		return nil
+	}
+	for _, member := range args[2:] {
+		delete(v.set, member)
+	}
+	s.dropEmpty(args[1], v)
+	return nil
+}
+
+func (s *aofState) smove(args []string) error {
+	src := s.lookup(args[1])
+	if src == nil || src.kind != kindSet {
+		return nil
+	}
+	if _, ok := src.set[args[3]]; !ok {
+		return nil
+	}
+	delete(src.set, args[3])
+	s.dropEmpty(args[1], src)
+	dst, err := s.lookupKind(args[2], kindSet)
+	if err == nil {
+		dst.set[args[3]] = struct{}{}
+	}
+	return err
+}
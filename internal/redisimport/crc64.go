@@ -0,0 +1,13 @@
+package redisimport
+
+import "hash/crc64"
+
+// crcTable is for the Jones polynomial RDB checksums use, in the reversed
+// form hash/crc64 expects.
+var crcTable = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+// crcUpdate adds p to an RDB checksum. Redis does not invert the crc
+// before and after like hash/crc64 does, so the inversions are undone.
+func crcUpdate(crc uint64, p []byte) uint64 {
+	return ^crc64.Update(^crc, crcTable, p)
+}
@@ -0,0 +1,299 @@
+package redisimport
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+
+	"github.com/sayuyere/bcask/internal/consts"
+)
+
+// The compact encodings Redis stores small collections in. Each is read
+// from a string of the RDB file into its elements; for hashes the elements
+// alternate between field and value.
+
+// Byte widths of the integer encodings of ziplist and listpack entries.
+var (
+	ziplistIntWidth  = map[byte]int{0xc0: 2, 0xd0: 4, 0xe0: 8, 0xf0: 3, 0xfe: 1}
+	listpackIntWidth = map[byte]int{0xf1: 2, 0xf2: 3, 0xf3: 4, 0xf4: 8}
+)
+
+// lzfDecompress expands an LZF compressed string to its size bytes.
+func lzfDecompress(in []byte, size int) ([]byte, error) {
+	out := make([]byte, 0, size)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 1<<5 {
+			// Literal run of ctrl+1 bytes.
+			n := ctrl + 1
+			if i+n > len(in) || len(out)+n > size {
+				return nil, fmt.Errorf("%w: bad lzf literal", consts.ErrorRedisFormat)
+			}
+			out = append(out, in[i:i+n]...)
+			i += n
+			continue
+		}
+		// Back reference of length n+2.
+		n := ctrl >> 5
+		if n == 7 {
+			if i == len(in) {
+				return nil, fmt.Errorf("%w: bad lzf reference", consts.ErrorRedisFormat)
+			}
+			n += int(in[i])
+			i++
+		}
+		if i == len(in) {
+			return nil, fmt.Errorf("%w: bad lzf reference", consts.ErrorRedisFormat)
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[i]) - 1
+		i++
+		if ref < 0 || len(out)+n+2 > size {
+			return nil, fmt.Errorf("%w: bad lzf reference", consts.ErrorRedisFormat)
+		}
+		// The reference may overlap what it produces, so copy bytewise.
+		for j := 0; j < n+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != size {
+		return nil, fmt.Errorf("%w: lzf data expands to %d bytes, want %d", consts.ErrorRedisFormat, len(out), size)
+	}
+	return out, nil
+}
+
+// span returns b[pos:pos+n], failing when that is out of range.
+func span(b []byte, pos, n int) ([]byte, error) {
+	if n < 0 || pos+n > len(b) {
+		return nil, fmt.Errorf("%w: encoded value ends early", consts.ErrorRedisFormat)
+	}
+	return b[pos : pos+n], nil
+}
+
+// intLE decodes a little endian two's complement integer of len(p) bytes.
+func intLE(p []byte) int64 {
+	var v uint64
+	for i := len(p) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(p[i])
+	}
+	shift := 64 - 8*len(p)
+	return int64(v<<shift) >> shift
+}
+
+// ziplistEntries decodes a ziplist, the encoding of small lists and hashes
+// up to Redis 6.
+func ziplistEntries(b []byte) ([]string, error) {
+	var out []string
+	// zlbytes u32 | zltail u32 | zllen u16 | entries | 0xff
+	pos := 10
+	for {
+		if pos >= len(b) {
+			return nil, fmt.Errorf("%w: ziplist without end marker", consts.ErrorRedisFormat)
+		}
+		if b[pos] == 0xff {
+			return out, nil
+		}
+		if b[pos] < 254 {
+			pos++
+		} else {
+			pos += 5
+		}
+		if pos >= len(b) {
+			return nil, fmt.Errorf("%w: ziplist entry ends early", consts.ErrorRedisFormat)
+		}
+		enc := b[pos]
+		var p []byte
+		var err error
+		switch {
+		case enc>>6 == 0:
+			p, err = span(b, pos+1, int(enc&0x3f))
+			pos++
+		case enc>>6 == 1:
+			var n []byte
+			if n, err = span(b, pos+1, 1); err == nil {
+				p, err = span(b, pos+2, int(enc&0x3f)<<8|int(n[0]))
+			}
+			pos += 2
+		case enc>>6 == 2:
+			var n []byte
+			if n, err = span(b, pos+1, 4); err == nil {
+				p, err = span(b, pos+5, int(binary.BigEndian.Uint32(n)))
+			}
+			pos += 5
+		case enc >= 0xf1 && enc <= 0xfd:
+			// A 4 bit immediate holding 0 to 12.
+			out = append(out, strconv.Itoa(int(enc&0x0f)-1))
+			pos++
+			continue
+		default:
+			width := ziplistIntWidth[enc]
+			if width == 0 {
+				return nil, fmt.Errorf("%w: ziplist encoding %#x", consts.ErrorRedisFormat, enc)
+			}
+			if p, err = span(b, pos+1, width); err != nil {
+				return nil, err
+			}
+			out = append(out, strconv.FormatInt(intLE(p), 10))
+			pos += 1 + width
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, string(p))
+		pos += len(p)
+	}
+}
+
+// listpackEntries decodes a listpack, which replaced the ziplist in Redis 7.
+func listpackEntries(b []byte) ([]string, error) {
+	var out []string
+	// total bytes u32 | count u16 | entries | 0xff
+	pos := 6
+	for {
+		if pos >= len(b) {
+			return nil, fmt.Errorf("%w: listpack without end marker", consts.ErrorRedisFormat)
+		}
+		enc := b[pos]
+		if enc == 0xff {
+			return out, nil
+		}
+		var (
+			entry string
+			size  int // of the encoding byte(s) and data
+			p     []byte
+			err   error
+		)
+		switch {
+		case enc&0x80 == 0:
+			entry, size = strconv.Itoa(int(enc)), 1
+		case enc&0xc0 == 0x80:
+			size = 1 + int(enc&0x3f)
+			p, err = span(b, pos+1, size-1)
+			entry = string(p)
+		case enc&0xe0 == 0xc0:
+			if p, err = span(b, pos+1, 1); err == nil {
+				v := int(enc&0x1f)<<8 | int(p[0])
+				if v >= 1<<12 {
+					v -= 1 << 13
+				}
+				entry = strconv.Itoa(v)
+			}
+			size = 2
+		case enc&0xf0 == 0xe0:
+			if p, err = span(b, pos+1, 1); err == nil {
+				n := int(enc&0x0f)<<8 | int(p[0])
+				size = 2 + n
+				p, err = span(b, pos+2, n)
+				entry = string(p)
+			}
+		case enc == 0xf0:
+			if p, err = span(b, pos+1, 4); err == nil {
+				n := int(binary.LittleEndian.Uint32(p))
+				size = 5 + n
+				p, err = span(b, pos+5, n)
+				entry = string(p)
+			}
+		default:
+			width := listpackIntWidth[enc]
+			if width == 0 {
+				return nil, fmt.Errorf("%w: listpack encoding %#x", consts.ErrorRedisFormat, enc)
+			}
+			if p, err = span(b, pos+1, width); err == nil {
+				entry = strconv.FormatInt(intLE(p), 10)
+			}
+			size = 1 + width
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, entry)
+		pos += size + backlenSize(size)
+	}
+}
+
+// backlenSize returns how many bytes a listpack entry of size bytes uses to
+// store its size backwards, 7 bits per byte.
+func backlenSize(size int) int {
+	switch {
+	case size <= 127:
+		return 1
+	case size < 16383:
+		return 2
+	case size < 2097151:
+		return 3
+	case size < 268435455:
+		return 4
+	}
+	return 5
+}
+
+// intsetEntries decodes an intset, the encoding of small sets of integers.
+func intsetEntries(b []byte) ([]string, error) {
+	if len(b) < 8 {
+		return nil, fmt.Errorf("%w: intset header ends early", consts.ErrorRedisFormat)
+	}
+	width := int(binary.LittleEndian.Uint32(b[0:4]))
+	n := int(binary.LittleEndian.Uint32(b[4:8]))
+	if (width != 2 && width != 4 && width != 8) || len(b) != 8+width*n {
+		return nil, fmt.Errorf("%w: intset of %d %d byte integers in %d bytes", consts.ErrorRedisFormat, n, width, len(b))
+	}
+	out := make([]string, n)
+	for i := range out {
+		out[i] = strconv.FormatInt(intLE(b[8+i*width:8+(i+1)*width]), 10)
+	}
+	return out, nil
+}
+
+// zipmapEntries decodes a zipmap, the encoding of small hashes before
+// Redis 2.6.
+func zipmapEntries(b []byte) ([]string, error) {
+	var out []string
+	// zmlen u8 | (len | key | len | free u8 | value | free bytes)* | 0xff
+	pos := 1
+	for {
+		if pos >= len(b) {
+			return nil, fmt.Errorf("%w: zipmap without end marker", consts.ErrorRedisFormat)
+		}
+		if b[pos] == 0xff {
+			if len(out)%2 != 0 {
+				return nil, fmt.Errorf("%w: zipmap field without value", consts.ErrorRedisFormat)
+			}
+			return out, nil
+		}
+		n, next, err := zipmapLen(b, pos)
+		if err != nil {
+			return nil, err
+		}
+		free := 0
+		if len(out)%2 == 1 {
+			if next >= len(b) {
+				return nil, fmt.Errorf("%w: zipmap entry ends early", consts.ErrorRedisFormat)
+			}
+			free = int(b[next])
+			next++
+		}
+		p, err := span(b, next, n)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, string(p))
+		pos = next + n + free
+	}
+}
+
+// zipmapLen reads the length at b[pos] and returns it with the position
+// after it.
+func zipmapLen(b []byte, pos int) (int, int, error) {
+	switch {
+	case b[pos] < 254:
+		return int(b[pos]), pos + 1, nil
+	case b[pos] == 254:
+		p, err := span(b, pos+1, 4)
+		if err != nil {
+			return 0, 0, err
+		}
+		return int(binary.LittleEndian.Uint32(p)), pos + 5, nil
+	}
+	return 0, 0, fmt.Errorf("%w: zipmap length %#x", consts.ErrorRedisFormat, b[pos])
+}
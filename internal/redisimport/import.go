@@ -0,0 +1,186 @@
+// Package redisimport loads the contents of a Redis server into a new
+// database, from an RDB snapshot or an append-only file (AOF), for
+// migrating data off Redis. The files are parsed here; no Redis library or
+// server is needed.
+//
+// Every Redis key becomes one bcask key, with its expiration kept:
+//
+//   - a string is stored as is;
+//   - a hash is stored as a JSON object of its fields;
+//   - a list is stored as a JSON array;
+//   - a set is stored as a JSON array of its members in ascending order.
+//
+// JSON strings hold UTF-8, so a field, element or member that is not valid
+// UTF-8 gets its bad bytes replaced and the key is counted in Stats.Lossy.
+// Keys of other types (sorted sets, streams, ...) are skipped, as are keys
+// that are not valid UTF-8, and counted in Stats.Skipped.
+//
+// Keys are written with a db.BulkLoader, so the import appends whole
+// batches of records instead of putting keys one by one.
+package redisimport
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sayuyere/bcask/internal/db"
+)
+
+// AllDatabases makes Options.Database import every Redis database into
+// the one bcask keyspace. Where databases share a key, the highest
+// numbered database wins.
+const AllDatabases = -1
+
+// Options controls an import. The zero value imports database 0.
+type Options struct {
+	// Database is the Redis database (SELECT index) to import, or
+	// AllDatabases.
+	Database int
+	// Prefix is prepended to every key, e.g. to keep the keys of several
+	// Redis servers apart.
+	Prefix string
+}
+
+// Stats counts the keys an import saw.
+type Stats struct {
+	Strings int
+	Hashes  int
+	Lists   int
+	Sets    int
+	// Expired keys had expired by the time of the import and were left out.
+	Expired int
+	// Skipped keys are of a type that is not imported or have a key that is
+	// not valid UTF-8.
+	Skipped int
+	// Lossy hashes, lists and sets had bytes replaced to encode them as JSON.
+	Lossy int
+	// Truncated is set when an AOF ended in the middle of a command, as it
+	// does after a crash. Like Redis, the import drops the partial command.
+	Truncated bool
+}
+
+// Imported returns the number of keys written.
+func (s Stats) Imported() int {
+	return s.Strings + s.Hashes + s.Lists + s.Sets
+}
+
+type kind uint8
+
+const (
+	kindString kind = iota
+	kindHash
+	kindList
+	kindSet
+	// kindOther stands for the types that are parsed but not imported.
+	kindOther
+)
+
+// value is a Redis value as read from a file or built by replaying one.
+type value struct {
+	kind kind
+	str  string
+	hash map[string]string
+	list []string
+	set  map[string]struct{}
+	// expiresAt is the expiration in unix milliseconds, 0 for never.
+	expiresAt int64
+}
+
+// importer writes values to a BulkLoader and counts them.
+type importer struct {
+	l     *db.BulkLoader
+	opts  Options
+	now   int64
+	stats Stats
+}
+
+func newImporter(l *db.BulkLoader, opts Options) *importer {
+	return &importer{l: l, opts: opts, now: time.Now().UnixMilli()}
+}
+
+// wants reports whether keys of Redis database n are imported.
+func (imp *importer) wants(n int) bool {
+	return imp.opts.Database == AllDatabases || imp.opts.Database == n
+}
+
+func (imp *importer) put(key string, v *value) error {
+	key = imp.opts.Prefix + key
+	switch {
+	case v.expiresAt != 0 && v.expiresAt <= imp.now:
+		imp.stats.Expired++
+		return nil
+	case v.kind == kindOther || !utf8.ValidString(key):
+		imp.stats.Skipped++
+		return nil
+	}
+	data, lossy := encode(v)
+	if lossy {
+		imp.stats.Lossy++
+	}
+	var expiresAt time.Time
+	if v.expiresAt != 0 {
+		expiresAt = time.UnixMilli(v.expiresAt)
+	}
+	if err := imp.l.Put(key, data, expiresAt); err != nil {
+		return fmt.Errorf("key %q: %w", key, err)
+	}
+	switch v.kind {
+	case kindString:
+		imp.stats.Strings++
+	case kindHash:
+		imp.stats.Hashes++
+	case kindList:
+		imp.stats.Lists++
+	case kindSet:
+		imp.stats.Sets++
+	}
+	return nil
+}
+
+// encode returns the bcask value for v and whether encoding it lost bytes.
+func encode(v *value) (string, bool) {
+	var doc any
+	lossy := false
+	check := func(s string) {
+		lossy = lossy || !utf8.ValidString(s)
+	}
+	switch v.kind {
+	case kindString:
+		return v.str, false
+	case kindHash:
+		for field, val := range v.hash {
+			check(field)
+			check(val)
+		}
+		doc = v.hash
+		if v.hash == nil {
+			doc = map[string]string{}
+		}
+	case kindList:
+		for _, elem := range v.list {
+			check(elem)
+		}
+		doc = v.list
+		if v.list == nil {
+			doc = []string{}
+		}
+	case kindSet:
+		members := make([]string, 0, len(v.set))
+		for member := range v.set {
+			check(member)
+			members = append(members, member)
+		}
+		slices.Sort(members)
+		doc = members
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	// Maps of strings and slices of strings always encode.
+	_ = enc.Encode(doc)
+	return string(bytes.TrimSuffix(buf.Bytes(), []byte("\n"))), lossy
+}
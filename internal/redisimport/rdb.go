@@ -0,0 +1,489 @@
+package redisimport
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/sayuyere/bcask/internal/consts"
+	"github.com/sayuyere/bcask/internal/db"
+)
+
+// rdbMaxVersion is the newest RDB format read, written by Redis 7.4.
+const rdbMaxVersion = 12
+
+// maxRDBString bounds the strings read, as Redis bounds its values.
+const maxRDBString = 512 << 20
+
+// RDB opcodes, which introduce everything in the file that is not a key.
+const (
+	opSlotInfo     = 0xf4
+	opFunction2    = 0xf5
+	opFunction     = 0xf6
+	opModuleAux    = 0xf7
+	opIdle         = 0xf8
+	opFreq         = 0xf9
+	opAux          = 0xfa
+	opResizeDB     = 0xfb
+	opExpireTimeMS = 0xfc
+	opExpireTime   = 0xfd
+	opSelectDB     = 0xfe
+	opEOF          = 0xff
+)
+
+// RDB value types. Types that are left out are not imported.
+const (
+	typeString        = 0
+	typeList          = 1
+	typeSet           = 2
+	typeZSet          = 3
+	typeHash          = 4
+	typeZSet2         = 5
+	typeHashZipmap    = 9
+	typeListZiplist   = 10
+	typeSetIntset     = 11
+	typeZSetZiplist   = 12
+	typeHashZiplist   = 13
+	typeListQuicklist = 14
+	typeHashListpack  = 16
+	typeZSetListpack  = 17
+	typeListQuick2    = 18
+	typeSetListpack   = 20
+)
+
+// unsupportedTypes names the value types an import fails on. Their
+// encodings are not parsed, so the rest of the file cannot be read.
+var unsupportedTypes = map[byte]string{
+	6:  "module",
+	7:  "module",
+	15: "stream",
+	19: "stream",
+	21: "stream",
+	22: "hash with field expirations",
+	23: "hash with field expirations",
+	24: "hash with field expirations",
+	25: "hash with field expirations",
+}
+
+// ImportRDB loads the keys of an RDB snapshot, as written by SAVE or
+// BGSAVE, into l.
+func ImportRDB(l *db.BulkLoader, r io.Reader, opts Options) (Stats, error) {
+	imp := newImporter(l, opts)
+	err := parseRDB(bufio.NewReader(r), func(n int, key string, v *value) error {
+		if !imp.wants(n) {
+			return nil
+		}
+		return imp.put(key, v)
+	})
+	return imp.stats, err
+}
+
+// rdbReader reads an RDB file, keeping its checksum.
+type rdbReader struct {
+	r   *bufio.Reader
+	crc uint64
+}
+
+// parseRDB reads an RDB file up to and including its checksum and calls fn
+// with every key, the database it is in and its value. It leaves r at the
+// end of the RDB data, where an AOF continues with commands.
+func parseRDB(r *bufio.Reader, fn func(n int, key string, v *value) error) error {
+	d := &rdbReader{r: r}
+	header := make([]byte, 9)
+	if err := d.readFull(header); err != nil {
+		return err
+	}
+	if string(header[:5]) != "REDIS" {
+		return fmt.Errorf("%w: not an RDB file", consts.ErrorRedisFormat)
+	}
+	version, err := strconv.Atoi(string(header[5:]))
+	if err != nil {
+		return fmt.Errorf("%w: bad version %q", consts.ErrorRedisFormat, header[5:])
+	}
+	if version < 1 || version > rdbMaxVersion {
+		return fmt.Errorf("%w: %d", consts.ErrorRedisVersion, version)
+	}
+	dbIndex := 0
+	var expiresAt int64
+	for {
+		op, err := d.readByte()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case opEOF:
+			return d.checkSum(version)
+		case opSelectDB:
+			n, err := d.readLength()
+			if err != nil {
+				return err
+			}
+			dbIndex = int(n)
+		case opExpireTimeMS:
+			p, err := d.readBytes(8)
+			if err != nil {
+				return err
+			}
+			expiresAt = int64(binary.LittleEndian.Uint64(p))
+		case opExpireTime:
+			p, err := d.readBytes(4)
+			if err != nil {
+				return err
+			}
+			expiresAt = int64(binary.LittleEndian.Uint32(p)) * 1000
+		case opAux:
+			if err := d.skipStrings(2); err != nil {
+				return err
+			}
+		case opFunction2:
+			if err := d.skipStrings(1); err != nil {
+				return err
+			}
+		case opResizeDB:
+			if err := d.skipLengths(2); err != nil {
+				return err
+			}
+		case opSlotInfo:
+			if err := d.skipLengths(3); err != nil {
+				return err
+			}
+		case opIdle:
+			if err := d.skipLengths(1); err != nil {
+				return err
+			}
+		case opFreq:
+			if _, err := d.readByte(); err != nil {
+				return err
+			}
+		case opModuleAux, opFunction:
+			return fmt.Errorf("%w: rdb opcode %#x", consts.ErrorRedisUnsupported, op)
+		default:
+			key, err := d.readString()
+			if err != nil {
+				return err
+			}
+			v, err := d.readValue(op)
+			if err != nil {
+				return fmt.Errorf("key %q: %w", key, err)
+			}
+			v.expiresAt = expiresAt
+			expiresAt = 0
+			if err := fn(dbIndex, key, v); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (d *rdbReader) readFull(p []byte) error {
+	if _, err := io.ReadFull(d.r, p); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("%w: unexpected end of file", consts.ErrorRedisFormat)
+		}
+		return err
+	}
+	d.crc = crcUpdate(d.crc, p)
+	return nil
+}
+
+func (d *rdbReader) readBytes(n int) ([]byte, error) {
+	p := make([]byte, n)
+	return p, d.readFull(p)
+}
+
+func (d *rdbReader) readByte() (byte, error) {
+	var p [1]byte
+	err := d.readFull(p[:])
+	return p[0], err
+}
+
+// checkSum reads the checksum that ends files since version 5 and compares
+// it with the data read. Redis writes 0 when checksums are turned off.
+func (d *rdbReader) checkSum(version int) error {
+	if version < 5 {
+		return nil
+	}
+	want := d.crc
+	p, err := d.readBytes(8)
+	if err != nil {
+		return err
+	}
+	if got := binary.LittleEndian.Uint64(p); got != 0 && got != want {
+		return fmt.Errorf("%w: file has %#x, data has %#x", consts.ErrorRedisChecksum, got, want)
+	}
+	return nil
+}
+
+// readLengthOrEncoding reads a length. When encoded is set, the string that
+// would follow is instead stored in the special encoding n.
+func (d *rdbReader) readLengthOrEncoding() (n uint64, encoded bool, err error) {
+	b, err := d.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3f), false, nil
+	case 1:
+		next, err := d.readByte()
+		return uint64(b&0x3f)<<8 | uint64(next), false, err
+	case 3:
+		return uint64(b & 0x3f), true, nil
+	}
+	switch b {
+	case 0x80:
+		p, err := d.readBytes(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(p)), false, nil
+	case 0x81:
+		p, err := d.readBytes(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(p), false, nil
+	}
+	return 0, false, fmt.Errorf("%w: length encoding %#x", consts.ErrorRedisFormat, b)
+}
+
+func (d *rdbReader) readLength() (uint64, error) {
+	n, encoded, err := d.readLengthOrEncoding()
+	if err == nil && encoded {
+		err = fmt.Errorf("%w: encoded string where a length belongs", consts.ErrorRedisFormat)
+	}
+	return n, err
+}
+
+// readCount reads the number of elements of a collection.
+func (d *rdbReader) readCount() (int, error) {
+	n, err := d.readLength()
+	if err == nil && n > maxRDBString {
+		err = fmt.Errorf("%w: collection of %d elements", consts.ErrorRedisFormat, n)
+	}
+	return int(n), err
+}
+
+func (d *rdbReader) readString() (string, error) {
+	p, err := d.readStringBytes()
+	return string(p), err
+}
+
+func (d *rdbReader) readStringBytes() ([]byte, error) {
+	n, encoded, err := d.readLengthOrEncoding()
+	if err != nil {
+		return nil, err
+	}
+	if !encoded {
+		if n > maxRDBString {
+			return nil, fmt.Errorf("%w: string of %d bytes", consts.ErrorRedisFormat, n)
+		}
+		return d.readBytes(int(n))
+	}
+	switch n {
+	case 0, 1, 2:
+		// Integers of 1, 2 and 4 bytes.
+		p, err := d.readBytes(1 << n)
+		if err != nil {
+			return nil, err
+		}
+		return strconv.AppendInt(nil, intLE(p), 10), nil
+	case 3:
+		size, err := d.readLength()
+		if err != nil {
+			return nil, err
+		}
+		usize, err := d.readLength()
+		if err != nil {
+			return nil, err
+		}
+		if size > maxRDBString || usize > maxRDBString {
+			return nil, fmt.Errorf("%w: lzf string of %d bytes", consts.ErrorRedisFormat, usize)
+		}
+		p, err := d.readBytes(int(size))
+		if err != nil {
+			return nil, err
+		}
+		return lzfDecompress(p, int(usize))
+	}
+	return nil, fmt.Errorf("%w: string encoding %d", consts.ErrorRedisFormat, n)
+}
+
+func (d *rdbReader) skipStrings(n int) error {
+	for i := 0; i < n; i++ {
+		if _, err := d.readStringBytes(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *rdbReader) skipLengths(n int) error {
+	for i := 0; i < n; i++ {
+		if _, err := d.readLength(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readStrings reads a count followed by that many strings.
+func (d *rdbReader) readStrings() ([]string, error) {
+	n, err := d.readCount()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, 0, min(n, 1024))
+	for i := 0; i < n; i++ {
+		s, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+// readEncoded reads a string holding a compact encoding and decodes it.
+func (d *rdbReader) readEncoded(decode func([]byte) ([]string, error)) ([]string, error) {
+	p, err := d.readStringBytes()
+	if err != nil {
+		return nil, err
+	}
+	return decode(p)
+}
+
+// readValue reads a value of type typ.
+func (d *rdbReader) readValue(typ byte) (*value, error) {
+	var (
+		elems []string
+		err   error
+	)
+	switch typ {
+	case typeString:
+		s, err := d.readString()
+		return &value{kind: kindString, str: s}, err
+	case typeList:
+		elems, err = d.readStrings()
+		return &value{kind: kindList, list: elems}, err
+	case typeListZiplist:
+		elems, err = d.readEncoded(ziplistEntries)
+		return &value{kind: kindList, list: elems}, err
+	case typeListQuicklist, typeListQuick2:
+		elems, err = d.readQuicklist(typ == typeListQuick2)
+		return &value{kind: kindList, list: elems}, err
+	case typeSet:
+		elems, err = d.readStrings()
+		return setOf(elems), err
+	case typeSetIntset:
+		elems, err = d.readEncoded(intsetEntries)
+		return setOf(elems), err
+	case typeSetListpack:
+		elems, err = d.readEncoded(listpackEntries)
+		return setOf(elems), err
+	case typeHash:
+		n, err := d.readCount()
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < 2*n && err == nil; i++ {
+			var s string
+			s, err = d.readString()
+			elems = append(elems, s)
+		}
+		return hashOf(elems, err)
+	case typeHashZipmap:
+		return hashOf(d.readEncoded(zipmapEntries))
+	case typeHashZiplist:
+		return hashOf(d.readEncoded(ziplistEntries))
+	case typeHashListpack:
+		return hashOf(d.readEncoded(listpackEntries))
+	case typeZSet, typeZSet2:
+		return &value{kind: kindOther}, d.skipZSet(typ == typeZSet2)
+	case typeZSetZiplist, typeZSetListpack:
+		return &value{kind: kindOther}, d.skipStrings(1)
+	}
+	if name, ok := unsupportedTypes[typ]; ok {
+		return nil, fmt.Errorf("%w: %s value", consts.ErrorRedisUnsupported, name)
+	}
+	return nil, fmt.Errorf("%w: value type %d", consts.ErrorRedisFormat, typ)
+}
+
+// readQuicklist reads the nodes of a quicklist, each a ziplist, or for
+// version 2 a listpack or a single plain element.
+func (d *rdbReader) readQuicklist(v2 bool) ([]string, error) {
+	n, err := d.readCount()
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for i := 0; i < n; i++ {
+		decode := ziplistEntries
+		if v2 {
+			container, err := d.readLength()
+			if err != nil {
+				return nil, err
+			}
+			switch container {
+			case 1:
+				decode = func(p []byte) ([]string, error) { return []string{string(p)}, nil }
+			case 2:
+				decode = listpackEntries
+			default:
+				return nil, fmt.Errorf("%w: quicklist container %d", consts.ErrorRedisFormat, container)
+			}
+		}
+		elems, err := d.readEncoded(decode)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, elems...)
+	}
+	return out, nil
+}
+
+// skipZSet reads past a sorted set of member and score pairs. Version 1
+// scores are strings with a one byte length, version 2 ones binary doubles.
+func (d *rdbReader) skipZSet(v2 bool) error {
+	n, err := d.readCount()
+	for i := 0; i < n && err == nil; i++ {
+		if err = d.skipStrings(1); err != nil {
+			break
+		}
+		if v2 {
+			_, err = d.readBytes(8)
+			continue
+		}
+		var size byte
+		if size, err = d.readByte(); err == nil && size < 253 {
+			// 253 to 255 stand for NaN and the infinities.
+			_, err = d.readBytes(int(size))
+		}
+	}
+	return err
+}
+
+func setOf(members []string) *value {
+	set := make(map[string]struct{}, len(members))
+	for _, m := range members {
+		set[m] = struct{}{}
+	}
+	return &value{kind: kindSet, set: set}
+}
+
+func hashOf(elems []string, err error) (*value, error) {
+	if err != nil {
+		return nil, err
+	}
+	if len(elems)%2 != 0 {
+		return nil, fmt.Errorf("%w: hash field without value", consts.ErrorRedisFormat)
+	}
+	hash := make(map[string]string, len(elems)/2)
+	for i := 0; i < len(elems); i += 2 {
+		hash[elems[i]] = elems[i+1]
+	}
+	return &value{kind: kindHash, hash: hash}, nil
+}
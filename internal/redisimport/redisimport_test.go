@@ -0,0 +1,466 @@
+package redisimport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sayuyere/bcask/internal/consts"
+	"github.com/sayuyere/bcask/internal/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rdb builds RDB files the way Redis writes them.
+type rdb struct {
+	bytes.Buffer
+}
+
+func newRDB(version int) *rdb {
+	b := &rdb{}
+	fmt.Fprintf(b, "REDIS%04d", version)
+	return b
+}
+
+func (b *rdb) length(n int) {
+	switch {
+	case n < 1<<6:
+		b.WriteByte(byte(n))
+	case n < 1<<14:
+		b.WriteByte(0x40 | byte(n>>8))
+		b.WriteByte(byte(n))
+	default:
+		b.WriteByte(0x80)
+		b.Write(binary.BigEndian.AppendUint32(nil, uint32(n)))
+	}
+}
+
+func (b *rdb) str(s string) {
+	b.length(len(s))
+	b.WriteString(s)
+}
+
+func (b *rdb) key(typ byte, key string) {
+	b.WriteByte(typ)
+	b.str(key)
+}
+
+func (b *rdb) expireMS(at time.Time) {
+	b.WriteByte(opExpireTimeMS)
+	b.Write(binary.LittleEndian.AppendUint64(nil, uint64(at.UnixMilli())))
+}
+
+func (b *rdb) end() []byte {
+	b.WriteByte(opEOF)
+	return binary.LittleEndian.AppendUint64(b.Bytes(), crcUpdate(0, b.Bytes()))
+}
+
+// ziplist encodes strings and, for ints, the 4 bit immediate or int16
+// entries.
+func ziplist(entries ...any) string {
+	var body []byte
+	for _, e := range entries {
+		body = append(body, 0) // prevlen, unused when reading forwards
+		switch e := e.(type) {
+		case string:
+			body = append(append(body, byte(len(e))), e...)
+		case int:
+			if e >= 0 && e <= 12 {
+				body = append(body, 0xf1+byte(e))
+			} else {
+				body = binary.LittleEndian.AppendUint16(append(body, 0xc0), uint16(e))
+			}
+		}
+	}
+	head := binary.LittleEndian.AppendUint32(nil, uint32(11+len(body)))
+	head = binary.LittleEndian.AppendUint32(head, 0)
+	head = binary.LittleEndian.AppendUint16(head, uint16(len(entries)))
+	return string(append(append(head, body...), 0xff))
+}
+
+// listpack encodes strings and, for ints, the 7 bit, 13 bit or int16
+// entries.
+func listpack(entries ...any) string {
+	var body []byte
+	for _, e := range entries {
+		var entry []byte
+		switch e := e.(type) {
+		case string:
+			entry = append([]byte{0x80 | byte(len(e))}, e...)
+		case int:
+			switch {
+			case e >= 0 && e < 128:
+				entry = []byte{byte(e)}
+			case e >= -4096 && e < 4096:
+				v := uint16(e) & 0x1fff
+				entry = []byte{0xc0 | byte(v>>8), byte(v)}
+			default:
+				entry = binary.LittleEndian.AppendUint16([]byte{0xf1}, uint16(e))
+			}
+		}
+		body = append(append(body, entry...), byte(len(entry)))
+	}
+	head := binary.LittleEndian.AppendUint32(nil, uint32(7+len(body)))
+	head = binary.LittleEndian.AppendUint16(head, uint16(len(entries)))
+	return string(append(append(head, body...), 0xff))
+}
+
+func intset(values ...int16) string {
+	p := binary.LittleEndian.AppendUint32(nil, 2)
+	p = binary.LittleEndian.AppendUint32(p, uint32(len(values)))
+	for _, v := range values {
+		p = binary.LittleEndian.AppendUint16(p, uint16(v))
+	}
+	return string(p)
+}
+
+// load runs an import into a new database and returns it opened.
+func load(t *testing.T, fn func(l *db.BulkLoader) (Stats, error)) (*db.Bcask, Stats) {
+	t.Helper()
+	dir := t.TempDir()
+	l, err := db.NewBulkLoader(dir, "db")
+	require.NoError(t, err)
+	stats, err := fn(l)
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+	b, err := db.Open(dir, "db")
+	require.NoError(t, err)
+	t.Cleanup(func() { b.Close() })
+	return b, stats
+}
+
+func get(t *testing.T, b *db.Bcask, key string) string {
+	t.Helper()
+	v, err := b.Get(key)
+	require.NoError(t, err, key)
+	return v
+}
+
+func TestCRC(t *testing.T) {
+	assert.Equal(t, uint64(0xe9c6d914c4b8d9ca), crcUpdate(0, []byte("123456789")))
+	assert.Equal(t, uint64(0xe9c6d914c4b8d9ca), crcUpdate(crcUpdate(0, []byte("1234")), []byte("56789")))
+}
+
+func TestEncodings(t *testing.T) {
+	// "a" followed by a reference repeating it 9 times.
+	out, err := lzfDecompress([]byte{0x00, 'a', 0xe0, 0x00, 0x00}, 10)
+	require.NoError(t, err)
+	assert.Equal(t, "aaaaaaaaaa", string(out))
+	_, err = lzfDecompress([]byte{0x00, 'a', 0xe0, 0x00, 0x05}, 10)
+	assert.ErrorIs(t, err, consts.ErrorRedisFormat)
+
+	elems, err := ziplistEntries([]byte(ziplist("a", 7, -300, strings.Repeat("x", 40))))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "7", "-300", strings.Repeat("x", 40)}, elems)
+
+	elems, err = listpackEntries([]byte(listpack("a", 100, -5, 30000)))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "100", "-5", "30000"}, elems)
+
+	elems, err = intsetEntries([]byte(intset(-1, 2, 300)))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"-1", "2", "300"}, elems)
+
+	zipmap := []byte{2, 1, 'f', 1, 2, 'v', 'x', 'x', 0xff}
+	elems, err = zipmapEntries(zipmap)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"f", "v"}, elems)
+
+	for _, bad := range []string{"", ziplist("a")[:12], listpack("abc")[:8], intset(1)[:9]} {
+		_, zlErr := ziplistEntries([]byte(bad))
+		_, lpErr := listpackEntries([]byte(bad))
+		assert.ErrorIs(t, zlErr, consts.ErrorRedisFormat)
+		assert.ErrorIs(t, lpErr, consts.ErrorRedisFormat)
+	}
+}
+
+func testRDB() []byte {
+	later := time.Now().Add(time.Hour)
+	b := newRDB(11)
+	b.WriteByte(opAux)
+	b.str("redis-ver")
+	b.str("7.2.0")
+	b.WriteByte(opSelectDB)
+	b.length(0)
+	b.WriteByte(opResizeDB)
+	b.length(12)
+	b.length(2)
+
+	b.key(typeString, "str")
+	b.str("hello")
+	b.key(typeString, "int")
+	b.Write([]byte{0xc1, 0xd2, 0x04}) // int16 1234
+	b.key(typeString, "lzf")
+	b.Write([]byte{0xc3, 5, 10, 0x00, 'a', 0xe0, 0x00, 0x00})
+	b.expireMS(later)
+	b.key(typeString, "ttl")
+	b.str("soon")
+	b.expireMS(time.Now().Add(-time.Hour))
+	b.key(typeString, "expired")
+	b.str("gone")
+	b.WriteByte(opExpireTime)
+	b.Write(binary.LittleEndian.AppendUint32(nil, uint32(later.Unix())))
+	b.key(typeList, "list")
+	b.length(2)
+	b.str("a")
+	b.str("b")
+	b.key(typeListQuick2, "quicklist")
+	b.length(2)
+	b.length(2)
+	b.str(listpack("a", 1))
+	b.length(1)
+	b.str("plain")
+	b.key(typeListZiplist, "ziplist")
+	b.str(ziplist("z", 2))
+	b.key(typeSet, "set")
+	b.length(2)
+	b.str("y")
+	b.str("x")
+	b.key(typeSetIntset, "intset")
+	b.str(intset(3, 1, 2))
+	b.key(typeSetListpack, "setlp")
+	b.str(listpack("m", "<&>"))
+	b.key(typeHash, "hash")
+	b.length(1)
+	b.str("f")
+	b.str("v")
+	b.key(typeHashListpack, "hashlp")
+	b.str(listpack("f", 1, "g", "\xff"))
+	b.key(typeHashZiplist, "hashzl")
+	b.str(ziplist("f", "v"))
+	b.WriteByte(opIdle)
+	b.length(1000)
+	b.key(typeZSet2, "zset")
+	b.length(1)
+	b.str("m")
+	b.Write(binary.LittleEndian.AppendUint64(nil, 0))
+	b.WriteByte(opFreq)
+	b.WriteByte(5)
+	b.key(typeZSetListpack, "zsetlp")
+	b.str(listpack("m", 1))
+	b.key(typeString, "\xffbinary")
+	b.str("v")
+
+	b.WriteByte(opSelectDB)
+	b.length(1)
+	b.key(typeString, "str")
+	b.str("db1")
+	b.key(typeString, "only1")
+	b.str("x")
+	return b.end()
+}
+
+func TestImportRDB(t *testing.T) {
+	data := testRDB()
+	b, stats := load(t, func(l *db.BulkLoader) (Stats, error) {
+		return ImportRDB(l, bytes.NewReader(data), Options{})
+	})
+	assert.Equal(t, Stats{Strings: 4, Hashes: 3, Lists: 3, Sets: 3, Expired: 1, Skipped: 3, Lossy: 1}, stats)
+	assert.Equal(t, 13, stats.Imported())
+
+	assert.Equal(t, "hello", get(t, b, "str"))
+	assert.Equal(t, "1234", get(t, b, "int"))
+	assert.Equal(t, "aaaaaaaaaa", get(t, b, "lzf"))
+	assert.Equal(t, "soon", get(t, b, "ttl"))
+	ttl, err := b.TTL("ttl")
+	require.NoError(t, err)
+	assert.InDelta(t, time.Hour, ttl, float64(time.Minute))
+	_, err = b.Get("expired")
+	assert.ErrorIs(t, err, consts.ErrorKeyNotFound)
+
+	assert.Equal(t, `["a","b"]`, get(t, b, "list"))
+	ttl, err = b.TTL("list")
+	require.NoError(t, err)
+	assert.InDelta(t, time.Hour, ttl, float64(time.Minute))
+	assert.Equal(t, `["a","1","plain"]`, get(t, b, "quicklist"))
+	assert.Equal(t, `["z","2"]`, get(t, b, "ziplist"))
+	assert.Equal(t, `["x","y"]`, get(t, b, "set"))
+	assert.Equal(t, `["1","2","3"]`, get(t, b, "intset"))
+	assert.Equal(t, `["<&>","m"]`, get(t, b, "setlp"))
+	assert.Equal(t, `{"f":"v"}`, get(t, b, "hash"))
+	assert.Equal(t, `{"f":"1","g":"�"}`, get(t, b, "hashlp"))
+	assert.Equal(t, `{"f":"v"}`, get(t, b, "hashzl"))
+	_, err = b.Get("zset")
+	assert.ErrorIs(t, err, consts.ErrorKeyNotFound)
+	_, err = b.Get("only1")
+	assert.ErrorIs(t, err, consts.ErrorKeyNotFound)
+
+	t.Run("AllDatabases", func(t *testing.T) {
+		b, stats := load(t, func(l *db.BulkLoader) (Stats, error) {
+			return ImportRDB(l, bytes.NewReader(data), Options{Database: AllDatabases, Prefix: "r1:"})
+		})
+		assert.Equal(t, 15, stats.Imported())
+		assert.Equal(t, "db1", get(t, b, "r1:str"))
+		assert.Equal(t, "x", get(t, b, "r1:only1"))
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		l, err := db.NewBulkLoader(t.TempDir(), "db")
+		require.NoError(t, err)
+		defer l.Close()
+
+		corrupt := bytes.Clone(data)
+		corrupt[len(corrupt)-20] ^= 0xff
+		_, err = ImportRDB(l, bytes.NewReader(corrupt), Options{})
+		assert.ErrorIs(t, err, consts.ErrorRedisChecksum)
+
+		// A zero checksum means checksums were turned off.
+		unchecked := bytes.Clone(data)
+		copy(unchecked[len(unchecked)-8:], make([]byte, 8))
+		_, err = ImportRDB(l, bytes.NewReader(unchecked), Options{})
+		assert.NoError(t, err)
+
+		_, err = ImportRDB(l, bytes.NewReader(data[:len(data)/2]), Options{})
+		assert.ErrorIs(t, err, consts.ErrorRedisFormat)
+		_, err = ImportRDB(l, strings.NewReader("REDIS0099"), Options{})
+		assert.ErrorIs(t, err, consts.ErrorRedisVersion)
+		_, err = ImportRDB(l, strings.NewReader("*1\r\n$4\r\nPING\r\n"), Options{})
+		assert.ErrorIs(t, err, consts.ErrorRedisFormat)
+
+		stream := newRDB(11)
+		stream.key(15, "events")
+		_, err = ImportRDB(l, bytes.NewReader(stream.end()), Options{})
+		assert.ErrorIs(t, err, consts.ErrorRedisUnsupported)
+		assert.ErrorContains(t, err, `key "events": redis import: unsupported data: stream value`)
+	})
+}
+
+// aof encodes commands the way Redis logs them.
+func aof(commands ...string) string {
+	var sb strings.Builder
+	for _, cmd := range commands {
+		args := strings.Fields(cmd)
+		fmt.Fprintf(&sb, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(&sb, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	return sb.String()
+}
+
+func TestImportAOF(t *testing.T) {
+	later := time.Now().Add(time.Hour).UnixMilli()
+	commands := aof(
+		"SELECT 0",
+		"SET str hello",
+		"SET ttl v PXAT "+fmt.Sprint(later),
+		"SET keep v EX 100",
+		"SET keep v2 KEEPTTL",
+		"SET cleared v EX 100",
+		"SET cleared v2",
+		"SETNX str ignored",
+		"INCR counter",
+		"INCRBY counter 41",
+		"INCRBYFLOAT float 1.5",
+		"APPEND str ,world",
+		"MSET a 1 b 2",
+		"DEL b",
+		"RPUSH list a b c d",
+		"LPUSH list z",
+		"LPOP list",
+		"RPOP list",
+		"LINSERT list BEFORE b x",
+		"LREM list 1 x",
+		"RPUSH emptied only",
+		"LPOP emptied",
+		"HSET hash f v g w",
+		"HDEL hash g",
+		"HINCRBY hash n 3",
+		"SADD set b a c",
+		"SREM set c",
+		"MULTI",
+		"SET tx 1",
+		"RPUSH tx-list 1",
+		"EXEC",
+		"ZADD zset 1 m",
+		"SET gone v",
+		"PEXPIREAT gone 1",
+		"SET renamed v",
+		"RENAME renamed moved",
+		"PEXPIREAT moved "+fmt.Sprint(later),
+		"SELECT 1",
+		"SET other db1",
+	)
+	// A command cut short by a crash, then an unfinished transaction.
+	partial := aof("MULTI", "SET uncommitted v") + "*3\r\n$3\r\nSET\r\n$1\r\nx"
+
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	require.NoError(t, os.WriteFile(path, []byte(commands+partial), 0o644))
+	b, stats := load(t, func(l *db.BulkLoader) (Stats, error) {
+		return ImportAOF(l, path, Options{})
+	})
+	assert.Equal(t, Stats{Strings: 9, Hashes: 1, Lists: 2, Sets: 1, Skipped: 1, Truncated: true}, stats)
+
+	assert.Equal(t, "hello,world", get(t, b, "str"))
+	assert.Equal(t, "42", get(t, b, "counter"))
+	assert.Equal(t, "1.5", get(t, b, "float"))
+	assert.Equal(t, "1", get(t, b, "a"))
+	assert.Equal(t, `["a","b","c"]`, get(t, b, "list"))
+	assert.Equal(t, `{"f":"v","n":"3"}`, get(t, b, "hash"))
+	assert.Equal(t, `["a","b"]`, get(t, b, "set"))
+	assert.Equal(t, "1", get(t, b, "tx"))
+	assert.Equal(t, "v", get(t, b, "moved"))
+	for _, key := range []string{"b", "emptied", "zset", "gone", "renamed", "other", "uncommitted"} {
+		_, err := b.Get(key)
+		assert.ErrorIs(t, err, consts.ErrorKeyNotFound, key)
+	}
+	for key, want := range map[string]time.Duration{"ttl": time.Hour, "moved": time.Hour, "keep": 100 * time.Second, "cleared": db.NoExpiry, "str": db.NoExpiry} {
+		ttl, err := b.TTL(key)
+		require.NoError(t, err, key)
+		assert.InDelta(t, want, ttl, float64(time.Minute), key)
+	}
+
+	t.Run("Preamble", func(t *testing.T) {
+		// Redis 7 keeps a base RDB and incremental AOFs in a directory.
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "appendonly.aof.1.base.rdb"), testRDB(), 0o644))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "appendonly.aof.1.incr.aof"), []byte(aof("DEL hash", "SADD set z")), 0o644))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "appendonly.aof.2.incr.aof"), []byte(aof("SET str replaced")), 0o644))
+		manifest := "file appendonly.aof.1.base.rdb seq 1 type b\n" +
+			"file appendonly.aof.1.incr.aof seq 1 type i\n" +
+			"file appendonly.aof.2.incr.aof seq 2 type i\n"
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "appendonly.aof.manifest"), []byte(manifest), 0o644))
+		b, stats := load(t, func(l *db.BulkLoader) (Stats, error) {
+			return ImportAOF(l, dir, Options{})
+		})
+		assert.Equal(t, 12, stats.Imported())
+		assert.Equal(t, "replaced", get(t, b, "str"))
+		assert.Equal(t, `["x","y","z"]`, get(t, b, "set"))
+		_, err := b.Get("hash")
+		assert.ErrorIs(t, err, consts.ErrorKeyNotFound)
+
+		// A single file may also start with the RDB.
+		path := filepath.Join(t.TempDir(), "appendonly.aof")
+		require.NoError(t, os.WriteFile(path, append(testRDB(), aof("SET str after")...), 0o644))
+		b, _ = load(t, func(l *db.BulkLoader) (Stats, error) {
+			return ImportAOF(l, path, Options{})
+		})
+		assert.Equal(t, "after", get(t, b, "str"))
+		assert.Equal(t, `["a","b"]`, get(t, b, "list"))
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		l, err := db.NewBulkLoader(t.TempDir(), "db")
+		require.NoError(t, err)
+		defer l.Close()
+		for contents, want := range map[string]error{
+			aof("EVAL script 0"):                  consts.ErrorRedisUnsupported,
+			aof("SET a"):                          consts.ErrorRedisFormat,
+			aof("SET s v", "RPUSH s x"):           consts.ErrorRedisFormat,
+			aof("SET s v EX soon"):                consts.ErrorRedisFormat,
+			"*1\r\n%4\r\nPING\r\n":                consts.ErrorRedisFormat,
+			aof("SELECT 0") + "*x\r\n":            consts.ErrorRedisFormat,
+			aof("INCR s", "APPEND s x", "INCR s"): consts.ErrorRedisFormat,
+		} {
+			path := filepath.Join(t.TempDir(), "appendonly.aof")
+			require.NoError(t, os.WriteFile(path, []byte(contents), 0o644))
+			_, err := ImportAOF(l, path, Options{})
+			assert.ErrorIs(t, err, want, contents)
+		}
+	})
+}
@@ -0,0 +1,181 @@
+package replication
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sayuyere/bcask/internal/consts"
+	"github.com/sayuyere/bcask/internal/db"
+	"github.com/sayuyere/bcask/internal/logging"
+	"github.com/sayuyere/bcask/internal/uuid"
+)
+
+// Follower applies a leader's log to a local database.
+type Follower struct {
+	DB               *db.Bcask
+	Network, Address string
+	Logger           *slog.Logger
+	// Heartbeat must match the leader's; the stream is considered dead
+	// after three heartbeats without a message. DefaultHeartbeat when zero.
+	Heartbeat time.Duration
+	// RetryBackoff is the first wait before reconnecting, doubled after
+	// every failed attempt up to MaxBackoff.
+	RetryBackoff time.Duration
+	MaxBackoff   time.Duration
+
+	mu       sync.Mutex
+	leaderID uuid.UUID
+	synced   bool
+	changed  chan struct{} // closed when synced changes
+}
+
+// NewFollower returns a follower that applies the log of the leader at
+// address on network ("tcp" or "unix") to b.
+func NewFollower(b *db.Bcask, network, address string) *Follower {
+	return &Follower{
+		DB:           b,
+		Network:      network,
+		Address:      address,
+		RetryBackoff: 50 * time.Millisecond,
+		MaxBackoff:   5 * time.Second,
+	}
+}
+
+func (f *Follower) heartbeat() time.Duration {
+	if f.Heartbeat > 0 {
+		return f.Heartbeat
+	}
+	return DefaultHeartbeat
+}
+
+// Run puts the database in replica mode and follows the leader until ctx
+// is done, reconnecting after failures. It returns ctx.Err(). The database
+// stays a replica afterwards; DB.SetReplica(false) promotes it.
+func (f *Follower) Run(ctx context.Context) error {
+	f.DB.SetReplica(true)
+	logger := logging.OrDiscard(f.Logger).With("leader", f.Address)
+	backoff := f.RetryBackoff
+	for {
+		started := time.Now()
+		err := f.follow(ctx, logger)
+		f.setSynced(false)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if time.Since(started) > f.MaxBackoff {
+			backoff = f.RetryBackoff
+		}
+		logger.Warn("replication stream lost", "error", err, "retry_in", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff = min(2*backoff, f.MaxBackoff)
+	}
+}
+
+// Synced reports whether the follower has caught up with the leader since
+// it last connected.
+func (f *Follower) Synced() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.synced
+}
+
+// WaitSynced blocks until the follower has caught up with the leader.
+func (f *Follower) WaitSynced(ctx context.Context) error {
+	for {
+		f.mu.Lock()
+		if f.synced {
+			f.mu.Unlock()
+			return nil
+		}
+		if f.changed == nil {
+			f.changed = make(chan struct{})
+		}
+		changed := f.changed
+		f.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (f *Follower) setSynced(synced bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.synced == synced {
+		return
+	}
+	f.synced = synced
+	if f.changed != nil {
+		close(f.changed)
+		f.changed = nil
+	}
+}
+
+// follow runs one connection to the leader.
+func (f *Follower) follow(ctx context.Context, logger *slog.Logger) error {
+	dialer := net.Dialer{Timeout: f.heartbeat() * 3}
+	nc, err := dialer.DialContext(ctx, f.Network, f.Address)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+	stop := context.AfterFunc(ctx, func() { nc.Close() })
+	defer stop()
+
+	position := f.DB.Sequence()
+	nc.SetWriteDeadline(time.Now().Add(f.heartbeat() * 3))
+	if err := writeHandshake(nc, f.leaderID, position); err != nil {
+		return err
+	}
+	r := bufio.NewReader(nc)
+	for first := true; ; first = false {
+		nc.SetReadDeadline(time.Now().Add(f.heartbeat() * 3))
+		kind, payload, err := readFrame(r)
+		if err != nil {
+			return err
+		}
+		if first != (kind == msgHello) {
+			return fmt.Errorf("%w: message %q", consts.ErrorReplicationProtocol, kind)
+		}
+		switch kind {
+		case msgHello:
+			if len(payload) != 17 {
+				return fmt.Errorf("%w: hello of %d bytes", consts.ErrorReplicationProtocol, len(payload))
+			}
+			copy(f.leaderID[:], payload)
+			reset := payload[16]&flagReset != 0
+			if reset {
+				logger.Warn("replication position lost, discarding local data", "position", position)
+				if err := f.DB.Reset(); err != nil {
+					return err
+				}
+			}
+			logger.Info("replication stream started", "position", position, "reset", reset)
+		case msgRecords:
+			records, err := decodeRecords(payload)
+			if err != nil {
+				return err
+			}
+			if err := f.DB.ApplyRecords(records); err != nil {
+				return err
+			}
+		case msgSynced:
+			logger.Info("replica caught up", "position", f.DB.Sequence())
+			f.setSynced(true)
+		case msgPing:
+		default:
+			return fmt.Errorf("%w: message %q", consts.ErrorReplicationProtocol, kind)
+		}
+	}
+}
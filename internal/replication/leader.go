@@ -0,0 +1,232 @@
+package replication
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sayuyere/bcask/internal/consts"
+	"github.com/sayuyere/bcask/internal/db"
+	"github.com/sayuyere/bcask/internal/logging"
+)
+
+// DefaultHeartbeat is how often an idle leader pings its followers.
+const DefaultHeartbeat = time.Second
+
+// Leader streams the log of one database to followers.
+type Leader struct {
+	DB     *db.Bcask
+	Logger *slog.Logger
+	// Heartbeat is how often an idle stream is pinged, DefaultHeartbeat
+	// when zero. It must match the followers' setting.
+	Heartbeat time.Duration
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+// NewLeader returns a leader for b that logs nothing.
+func NewLeader(b *db.Bcask) *Leader {
+	return &Leader{DB: b}
+}
+
+func (l *Leader) init() {
+	if l.listeners == nil {
+		l.listeners = make(map[net.Listener]struct{})
+		l.conns = make(map[net.Conn]struct{})
+		l.ctx, l.cancel = context.WithCancel(context.Background())
+	}
+}
+
+func (l *Leader) heartbeat() time.Duration {
+	if l.Heartbeat > 0 {
+		return l.Heartbeat
+	}
+	return DefaultHeartbeat
+}
+
+// Serve accepts followers on ln until Close is called, then returns
+// consts.ErrorServerClosed.
+func (l *Leader) Serve(ln net.Listener) error {
+	l.mu.Lock()
+	l.init()
+	if l.closed {
+		l.mu.Unlock()
+		ln.Close()
+		return consts.ErrorServerClosed
+	}
+	l.listeners[ln] = struct{}{}
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		delete(l.listeners, ln)
+		l.mu.Unlock()
+	}()
+
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			l.mu.Lock()
+			closed := l.closed
+			l.mu.Unlock()
+			if closed {
+				return consts.ErrorServerClosed
+			}
+			return err
+		}
+		l.mu.Lock()
+		if l.closed {
+			l.mu.Unlock()
+			nc.Close()
+			return consts.ErrorServerClosed
+		}
+		l.conns[nc] = struct{}{}
+		l.wg.Add(1)
+		l.mu.Unlock()
+		go l.serveConn(nc)
+	}
+}
+
+// Close stops all listeners and disconnects every follower. It does not
+// close the database.
+func (l *Leader) Close() error {
+	l.mu.Lock()
+	l.init()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	l.cancel()
+	var err error
+	for ln := range l.listeners {
+		if closeErr := ln.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	for nc := range l.conns {
+		nc.Close()
+	}
+	l.mu.Unlock()
+	l.wg.Wait()
+	return err
+}
+
+func (l *Leader) serveConn(nc net.Conn) {
+	defer func() {
+		nc.Close()
+		l.mu.Lock()
+		delete(l.conns, nc)
+		l.mu.Unlock()
+		l.wg.Done()
+	}()
+	logger := logging.OrDiscard(l.Logger).With("follower", nc.RemoteAddr())
+	err := l.stream(nc, logger)
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, net.ErrClosed), errors.Is(err, consts.ErrorServerClosed):
+		logger.Info("replication stream closed")
+	default:
+		logger.Warn("replication stream failed", "error", err)
+	}
+}
+
+// stream sends the records after the follower's position, then tails the
+// log until the connection fails or the leader is closed.
+func (l *Leader) stream(nc net.Conn, logger *slog.Logger) error {
+	nc.SetReadDeadline(time.Now().Add(l.heartbeat() * 3))
+	leaderID, position, err := readHandshake(nc)
+	if err != nil {
+		return err
+	}
+	nc.SetReadDeadline(time.Time{})
+
+	// The position only means something in this database's log, and only
+	// if no merge has dropped tombstones after it.
+	reset := position > 0 && ((!leaderID.IsNil() && leaderID != l.DB.DBID) || position > l.DB.Sequence())
+	cursor := l.DB.NewLogCursor(position)
+	appended := l.DB.Appended()
+	records, err := cursor.Next(batchSize)
+	if errors.Is(err, consts.ErrorLogTruncated) {
+		reset = true
+	} else if err != nil {
+		return err
+	}
+	if reset {
+		cursor = l.DB.NewLogCursor(0)
+		if records, err = cursor.Next(batchSize); err != nil {
+			return err
+		}
+	}
+	logger.Info("replication stream started", "position", position, "reset", reset)
+
+	w := bufio.NewWriter(nc)
+	hello := append([]byte(nil), l.DB.DBID[:]...)
+	if reset {
+		hello = append(hello, flagReset)
+	} else {
+		hello = append(hello, 0)
+	}
+	if err := writeFrame(w, msgHello, hello); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(l.heartbeat())
+	defer ticker.Stop()
+	synced := false
+	for {
+		if len(records) > 0 {
+			nc.SetWriteDeadline(time.Now().Add(l.heartbeat() * 3))
+			if err := writeFrame(w, msgRecords, encodeRecords(records)); err != nil {
+				return err
+			}
+		} else {
+			if !synced {
+				synced = true
+				if err := writeFrame(w, msgSynced, nil); err != nil {
+					return err
+				}
+			}
+			if err := l.wait(appended, ticker, nc, w); err != nil {
+				return err
+			}
+		}
+		// Past the catch-up a truncated log ends the stream; the follower
+		// reconnects and is reset.
+		appended = l.DB.Appended()
+		if records, err = cursor.Next(batchSize); err != nil {
+			return err
+		}
+	}
+}
+
+// wait flushes the stream and blocks until appended is closed, pinging the
+// follower every heartbeat meanwhile. A follower that stopped reading
+// fails the write deadline, one that disconnected fails the ping.
+func (l *Leader) wait(appended <-chan struct{}, ticker *time.Ticker, nc net.Conn, w *bufio.Writer) error {
+	for {
+		nc.SetWriteDeadline(time.Now().Add(l.heartbeat() * 3))
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		select {
+		case <-appended:
+			return nil
+		case <-ticker.C:
+			if err := writeFrame(w, msgPing, nil); err != nil {
+				return err
+			}
+		case <-l.ctx.Done():
+			return consts.ErrorServerClosed
+		}
+	}
+}
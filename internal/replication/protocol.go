@@ -0,0 +1,136 @@
+// Package replication keeps a follower database in step with a leader by
+// shipping the leader's segment records, tombstones included, in the order
+// they were written.
+//
+// A record's timestamp is its position in the leader's log (see
+// db.LogCursor). The follower applies records with their timestamps, so
+// the position it resumes from after a reconnect or restart is simply the
+// newest timestamp it holds, db.Bcask.Sequence.
+//
+// The follower opens the stream with
+//
+//	"BCRP" | version (1 byte) | leader database ID (16 bytes) | position (int64)
+//
+// where the leader ID is the one it followed before, or zeros. The leader
+// replies with a stream of frames, kind (1 byte) | length (uint32) |
+// payload, starting with a hello.
+package replication
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/sayuyere/bcask/internal/consts"
+	"github.com/sayuyere/bcask/internal/item"
+	"github.com/sayuyere/bcask/internal/uuid"
+)
+
+const (
+	magic           = "BCRP"
+	protocolVersion = 1
+	handshakeSize   = len(magic) + 1 + 16 + 8
+)
+
+const (
+	// msgHello carries the leader database ID and flags.
+	msgHello byte = 'H'
+	// msgRecords carries encoded records, back to back.
+	msgRecords byte = 'R'
+	// msgSynced tells the follower it has every record the leader had when
+	// the message was sent.
+	msgSynced byte = 'S'
+	// msgPing keeps an idle stream alive.
+	msgPing byte = 'P'
+)
+
+// flagReset in a hello tells the follower to discard its data: its
+// position cannot be continued from, and the stream starts at 0.
+const flagReset byte = 1
+
+// batchSize is how many bytes of records the leader reads per frame.
+const batchSize = 1 << 20
+
+// maxFrame bounds the payload of a frame: a batch ends with at most one
+// record that did not fit, and a record fits in a segment.
+const maxFrame = batchSize + consts.SegmentMaxSize
+
+func writeHandshake(w io.Writer, leaderID uuid.UUID, position int64) error {
+	buf := make([]byte, 0, handshakeSize)
+	buf = append(buf, magic...)
+	buf = append(buf, protocolVersion)
+	buf = append(buf, leaderID[:]...)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(position))
+	_, err := w.Write(buf)
+	return err
+}
+
+func readHandshake(r io.Reader) (uuid.UUID, int64, error) {
+	var leaderID uuid.UUID
+	buf := make([]byte, handshakeSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return leaderID, 0, err
+	}
+	if string(buf[:len(magic)]) != magic {
+		return leaderID, 0, fmt.Errorf("%w: bad magic", consts.ErrorReplicationProtocol)
+	}
+	if v := buf[len(magic)]; v != protocolVersion {
+		return leaderID, 0, fmt.Errorf("%w: unsupported version %d", consts.ErrorReplicationProtocol, v)
+	}
+	rest := buf[len(magic)+1:]
+	copy(leaderID[:], rest[:16])
+	return leaderID, int64(binary.BigEndian.Uint64(rest[16:])), nil
+}
+
+func writeFrame(w *bufio.Writer, kind byte, payload []byte) error {
+	var header [5]byte
+	header[0] = kind
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func readFrame(r *bufio.Reader) (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(header[1:])
+	if int64(n) > maxFrame {
+		return 0, nil, fmt.Errorf("%w: frame of %d bytes", consts.ErrorReplicationProtocol, n)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+func encodeRecords(records []item.DiskKV) []byte {
+	var payload []byte
+	for _, kv := range records {
+		payload = append(payload, kv.Encode()...)
+	}
+	return payload
+}
+
+func decodeRecords(payload []byte) ([]item.DiskKV, error) {
+	var records []item.DiskKV
+	for len(payload) > 0 {
+		var kv item.DiskKV
+		if !kv.DecodeHeader(payload) || kv.KeySize < 0 || kv.ValueSize < 0 ||
+			kv.KeySize > int64(len(payload)) || kv.ValueSize > int64(len(payload)) ||
+			kv.EncodedSize() > int64(len(payload)) {
+			return nil, fmt.Errorf("%w: truncated record", consts.ErrorReplicationProtocol)
+		}
+		size := kv.EncodedSize()
+		kv.Decode(payload[:size])
+		records = append(records, kv)
+		payload = payload[size:]
+	}
+	return records, nil
+}
@@ -0,0 +1,145 @@
+package replication
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sayuyere/bcask/internal/consts"
+	"github.com/sayuyere/bcask/internal/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const heartbeat = 50 * time.Millisecond
+
+func contents(b *db.Bcask) map[string]string {
+	return b.Fold(func(key, value string, acc interface{}) interface{} {
+		acc.(map[string]string)[key] = value
+		return acc
+	}, map[string]string{}).(map[string]string)
+}
+
+// lead serves b's log on addr until the returned function is called.
+func lead(t *testing.T, b *db.Bcask, addr string) (string, func()) {
+	ln, err := net.Listen("tcp", addr)
+	require.NoError(t, err)
+	l := NewLeader(b)
+	l.Heartbeat = heartbeat
+	done := make(chan struct{})
+	go func() {
+		assert.ErrorIs(t, l.Serve(ln), consts.ErrorServerClosed)
+		close(done)
+	}()
+	stop := func() {
+		l.Close()
+		<-done
+	}
+	return ln.Addr().String(), stop
+}
+
+// follow runs a follower of addr for b until the returned function is
+// called, and waits until it has caught up.
+func follow(t *testing.T, b *db.Bcask, addr string) (*Follower, func()) {
+	f := NewFollower(b, "tcp", addr)
+	f.Heartbeat = heartbeat
+	f.RetryBackoff, f.MaxBackoff = 10*time.Millisecond, 50*time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		assert.ErrorIs(t, f.Run(ctx), context.Canceled)
+		close(done)
+	}()
+	waitCtx, waitCancel := context.WithTimeout(ctx, 10*time.Second)
+	defer waitCancel()
+	require.NoError(t, f.WaitSynced(waitCtx))
+	return f, func() {
+		cancel()
+		<-done
+	}
+}
+
+func caughtUp(t *testing.T, leader, follower *db.Bcask) {
+	t.Helper()
+	require.Eventually(t, func() bool { return follower.Sequence() == leader.Sequence() }, 10*time.Second, time.Millisecond)
+	assert.Equal(t, contents(leader), contents(follower))
+}
+
+func TestReplication(t *testing.T) {
+	leader, err := db.Open(t.TempDir(), "leader")
+	require.NoError(t, err)
+	defer leader.Close()
+	followerDir := t.TempDir()
+	follower, err := db.Open(followerDir, "follower")
+	require.NoError(t, err)
+
+	// Enough data for the catch-up to cross segments.
+	big := strings.Repeat("v", 1<<20)
+	for _, key := range []string{"a", "b", "c", "d", "e", "a"} {
+		require.NoError(t, leader.Put(key, big))
+	}
+	require.NoError(t, leader.Delete("b"))
+	require.NoError(t, leader.PutWithTTL("ttl", "x", time.Hour))
+	require.Greater(t, len(leader.DBSegments), 1)
+
+	addr, stopLeader := lead(t, leader, "127.0.0.1:0")
+	_, stopFollower := follow(t, follower, addr)
+	caughtUp(t, leader, follower)
+	ttl, err := follower.TTL("ttl")
+	require.NoError(t, err)
+	assert.Greater(t, ttl, 59*time.Minute)
+	assert.ErrorIs(t, follower.Put("local", "write"), consts.ErrorReadOnly)
+
+	t.Run("Tail", func(t *testing.T) {
+		require.NoError(t, leader.Put("live", "1"))
+		require.NoError(t, leader.Delete("c"))
+		caughtUp(t, leader, follower)
+		_, err := follower.Get("c")
+		assert.ErrorIs(t, err, consts.ErrorKeyNotFound)
+	})
+
+	t.Run("LeaderRestart", func(t *testing.T) {
+		puts := follower.Stats().Puts
+		stopLeader()
+		require.NoError(t, leader.Put("while-down", "1"))
+		addr, stopLeader = lead(t, leader, addr)
+		caughtUp(t, leader, follower)
+		assert.Equal(t, puts+1, follower.Stats().Puts, "the follower should resume, not start over")
+	})
+
+	t.Run("FollowerRestart", func(t *testing.T) {
+		stopFollower()
+		require.NoError(t, follower.Close())
+		require.NoError(t, leader.Put("follower-down", "1"))
+		follower, err = db.Open(followerDir, "follower")
+		require.NoError(t, err)
+		_, stopFollower = follow(t, follower, addr)
+		caughtUp(t, leader, follower)
+		assert.Equal(t, uint64(1), follower.Stats().Puts, "only the missed record should be shipped")
+	})
+
+	t.Run("Reset", func(t *testing.T) {
+		stopFollower()
+		// Dropping the tombstone of "d" leaves nothing in the log that
+		// tells the follower to delete it, so it has to start over.
+		require.NoError(t, leader.Delete("d"))
+		leader.Lock.Lock()
+		require.NoError(t, leader.AddNewSegment())
+		leader.Lock.Unlock()
+		require.NoError(t, leader.Merge())
+		require.NoError(t, leader.Put("after-merge", "1"))
+
+		_, stopFollower = follow(t, follower, addr)
+		caughtUp(t, leader, follower)
+		_, err := follower.Get("d")
+		assert.ErrorIs(t, err, consts.ErrorKeyNotFound)
+	})
+
+	stopFollower()
+	stopLeader()
+	follower.SetReplica(false)
+	assert.NoError(t, follower.Put("promoted", "1"))
+	require.NoError(t, follower.Close())
+}
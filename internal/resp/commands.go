@@ -0,0 +1,547 @@
+package resp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sayuyere/bcask/internal/consts"
+	"github.com/sayuyere/bcask/internal/db"
+)
+
+// command is one entry of the command table. arity counts the command name
+// like Redis does: positive is exact, negative is a minimum.
+type command struct {
+	arity int
+	run   func(c *conn, args []string) (quit bool)
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"ping":    {-1, (*conn).ping},
+		"echo":    {2, (*conn).echo},
+		"quit":    {1, (*conn).quit},
+		"hello":   {-1, (*conn).hello},
+		"select":  {2, (*conn).selectDB},
+		"client":  {-2, (*conn).client},
+		"command": {-1, (*conn).command},
+		"get":     {2, (*conn).get},
+		"set":     {-3, (*conn).set},
+		"del":     {-2, (*conn).del},
+		"exists":  {-2, (*conn).exists},
+		"keys":    {2, (*conn).keys},
+		"scan":    {-2, (*conn).scan},
+		"mget":    {-2, (*conn).mget},
+		"mset":    {-3, (*conn).mset},
+		"ttl":     {2, (*conn).ttl},
+		"pttl":    {2, (*conn).ttl},
+		"dbsize":  {1, (*conn).dbsize},
+		"info":    {-1, (*conn).info},
+		"save":    {1, (*conn).save},
+
+		"bcask.merge": {1, (*conn).merge},
+		"bcask.roll":  {1, (*conn).roll},
+	}
+}
+
+// maxCursors bounds the SCAN cursors one connection may leave unfinished.
+const maxCursors = 1024
+
+func (c *conn) exec(args []string) bool {
+	name := strings.ToLower(args[0])
+	cmd, ok := commands[name]
+	if !ok {
+		var quoted []string
+		for _, arg := range args[1:] {
+			quoted = append(quoted, "'"+arg+"'")
+		}
+		c.w.error(fmt.Sprintf("ERR unknown command '%s', with args beginning with: %s", args[0], strings.Join(quoted, " ")))
+		return false
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) || len(args) < -cmd.arity {
+		c.wrongArgs(name)
+		return false
+	}
+	return cmd.run(c, args)
+}
+
+func (c *conn) wrongArgs(name string) {
+	c.w.error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+}
+
+// dbError replies with err from the database.
+func (c *conn) dbError(err error) {
+	if errors.Is(err, consts.ErrorReadOnly) {
+		c.w.error("READONLY You can't write against a read only database.")
+		return
+	}
+	c.w.error("ERR " + err.Error())
+}
+
+func (c *conn) ping(args []string) bool {
+	switch len(args) {
+	case 1:
+		c.w.simple("PONG")
+	case 2:
+		c.w.bulk(args[1])
+	default:
+		c.wrongArgs("ping")
+	}
+	return false
+}
+
+func (c *conn) echo(args []string) bool {
+	c.w.bulk(args[1])
+	return false
+}
+
+func (c *conn) quit([]string) bool {
+	c.w.simple("OK")
+	return true
+}
+
+// hello negotiates the protocol version and replies with server details.
+func (c *conn) hello(args []string) bool {
+	proto := c.w.proto
+	if len(args) > 1 {
+		v, err := strconv.Atoi(args[1])
+		if err != nil {
+			c.w.error("ERR Protocol version is not an integer or out of range")
+			return false
+		}
+		if v != 2 && v != 3 {
+			c.w.error("NOPROTO unsupported protocol version")
+			return false
+		}
+		proto = v
+	}
+	name := c.name
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToLower(args[i]); {
+		case opt == "auth" && i+2 < len(args):
+			c.w.error("ERR AUTH called without any password configured")
+			return false
+		case opt == "setname" && i+1 < len(args):
+			name = args[i+1]
+			i++
+		default:
+			c.w.error("ERR syntax error")
+			return false
+		}
+	}
+	c.w.proto, c.name = proto, name
+	c.w.mapHeader(7)
+	c.w.bulk("server")
+	c.w.bulk("bcask")
+	c.w.bulk("version")
+	c.w.bulk(serverVersion)
+	c.w.bulk("proto")
+	c.w.integer(int64(proto))
+	c.w.bulk("id")
+	c.w.integer(c.id)
+	c.w.bulk("mode")
+	c.w.bulk("standalone")
+	c.w.bulk("role")
+	c.w.bulk("master")
+	c.w.bulk("modules")
+	c.w.array(0)
+	return false
+}
+
+// serverVersion is reported by HELLO and INFO. Clients use it to pick
+// features, so it names the Redis version whose commands are mirrored.
+const serverVersion = "7.0.0"
+
+// selectDB only accepts database 0; bcask has one keyspace.
+func (c *conn) selectDB(args []string) bool {
+	if args[1] != "0" {
+		c.w.error("ERR DB index is out of range")
+		return false
+	}
+	c.w.simple("OK")
+	return false
+}
+
+func (c *conn) client(args []string) bool {
+	switch sub := strings.ToLower(args[1]); {
+	case sub == "setname" && len(args) == 3:
+		c.name = args[2]
+		c.w.simple("OK")
+	case sub == "getname" && len(args) == 2:
+		if c.name == "" {
+			c.w.null()
+		} else {
+			c.w.bulk(c.name)
+		}
+	case sub == "id" && len(args) == 2:
+		c.w.integer(c.id)
+	case sub == "setinfo" && len(args) == 4:
+		c.w.simple("OK")
+	default:
+		c.w.error(fmt.Sprintf("ERR unknown subcommand or wrong number of arguments for '%s'", args[1]))
+	}
+	return false
+}
+
+// command answers COMMAND and COMMAND DOCS with empty replies, which tells
+// clients such as redis-cli to fall back to their built-in command tables.
+func (c *conn) command(args []string) bool {
+	switch {
+	case len(args) > 1 && strings.EqualFold(args[1], "count"):
+		c.w.integer(int64(len(commands)))
+	case len(args) > 1 && strings.EqualFold(args[1], "docs"):
+		c.w.mapHeader(0)
+	default:
+		c.w.array(0)
+	}
+	return false
+}
+
+func (c *conn) get(args []string) bool {
+	value, err := c.s.DB.GetContext(c.ctx, args[1])
+	switch {
+	case errors.Is(err, consts.ErrorKeyNotFound):
+		c.w.null()
+	case err != nil:
+		c.dbError(err)
+	default:
+		c.w.bulk(value)
+	}
+	return false
+}
+
+// set supports the EX, PX, NX and XX options. A write skipped because of
+// NX or XX is answered with a null reply.
+func (c *conn) set(args []string) bool {
+	var opts db.PutOptions
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); opt {
+		case "NX":
+			opts.IfAbsent = true
+		case "XX":
+			opts.IfPresent = true
+		case "EX", "PX":
+			if opts.TTL != 0 || i+1 == len(args) {
+				c.w.error("ERR syntax error")
+				return false
+			}
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				c.w.error("ERR value is not an integer or out of range")
+				return false
+			}
+			unit := time.Second
+			if opt == "PX" {
+				unit = time.Millisecond
+			}
+			if n <= 0 || n > int64(time.Duration(1<<62)/unit) {
+				c.w.error("ERR invalid expire time in 'set' command")
+				return false
+			}
+			opts.TTL = time.Duration(n) * unit
+			i++
+		default:
+			c.w.error("ERR syntax error")
+			return false
+		}
+	}
+	if opts.IfAbsent && opts.IfPresent {
+		c.w.error("ERR syntax error")
+		return false
+	}
+	version, err := c.s.DB.PutWithOptionsContext(c.ctx, args[1], args[2], opts)
+	switch {
+	case err != nil:
+		c.dbError(err)
+	case version == 0:
+		c.w.null()
+	default:
+		c.w.simple("OK")
+	}
+	return false
+}
+
+func (c *conn) del(args []string) bool {
+	var n int64
+	for _, key := range args[1:] {
+		err := c.s.DB.DeleteContext(c.ctx, key)
+		if errors.Is(err, consts.ErrorKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			c.dbError(err)
+			return false
+		}
+		n++
+	}
+	c.w.integer(n)
+	return false
+}
+
+func (c *conn) exists(args []string) bool {
+	var n int64
+	for _, key := range args[1:] {
+		if _, err := c.s.DB.TTL(key); err == nil {
+			n++
+		}
+	}
+	c.w.integer(n)
+	return false
+}
+
+// matching returns the keys matching pattern in ascending order.
+func (c *conn) matching(pattern string) ([]string, error) {
+	keys, err := c.s.DB.ListKeysWithPrefix(literalPrefix(pattern))
+	if err != nil {
+		return nil, err
+	}
+	matched := keys[:0]
+	for _, key := range keys {
+		if match(pattern, key) {
+			matched = append(matched, key)
+		}
+	}
+	return matched, nil
+}
+
+func (c *conn) keys(args []string) bool {
+	keys, err := c.matching(args[1])
+	if err != nil {
+		c.dbError(err)
+		return false
+	}
+	c.w.strings(keys)
+	return false
+}
+
+// scan walks the keys in order. A cursor stands for the last key returned,
+// so every key that exists for the whole iteration is returned exactly
+// once, whatever is written in between.
+func (c *conn) scan(args []string) bool {
+	cursor, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		c.w.error("ERR invalid cursor")
+		return false
+	}
+	pattern, count, typeOK := "*", 10, true
+	for i := 2; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			c.w.error("ERR syntax error")
+			return false
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			count, err = strconv.Atoi(args[i+1])
+			if err != nil || count < 1 {
+				c.w.error("ERR value is not an integer or out of range")
+				return false
+			}
+		case "TYPE":
+			typeOK = typeOK && isString(args[i+1])
+		default:
+			c.w.error("ERR syntax error")
+			return false
+		}
+	}
+
+	after, ok := "", cursor == 0
+	if !ok {
+		after, ok = c.cursors[cursor]
+		delete(c.cursors, cursor)
+	}
+	if !ok {
+		c.w.error("ERR invalid cursor")
+		return false
+	}
+	keys, err := c.s.DB.ListKeysWithPrefix(literalPrefix(pattern))
+	if err != nil {
+		c.dbError(err)
+		return false
+	}
+	start := 0
+	if cursor != 0 {
+		start = sort.Search(len(keys), func(i int) bool { return keys[i] > after })
+	}
+	end := min(start+count, len(keys))
+	var batch []string
+	for _, key := range keys[start:end] {
+		if typeOK && match(pattern, key) {
+			batch = append(batch, key)
+		}
+	}
+
+	next := uint64(0)
+	if end < len(keys) {
+		if len(c.cursors) >= maxCursors {
+			clear(c.cursors)
+		}
+		c.nextCursor++
+		next = c.nextCursor
+		c.cursors[next] = keys[end-1]
+	}
+	c.w.array(2)
+	c.w.bulk(strconv.FormatUint(next, 10))
+	c.w.strings(batch)
+	return false
+}
+
+// isString reports whether a SCAN TYPE names strings, the only type stored.
+func isString(typ string) bool {
+	return strings.EqualFold(typ, "string")
+}
+
+func (c *conn) mget(args []string) bool {
+	c.w.array(len(args) - 1)
+	for _, key := range args[1:] {
+		value, err := c.s.DB.GetContext(c.ctx, key)
+		if err != nil {
+			c.w.null()
+			continue
+		}
+		c.w.bulk(value)
+	}
+	return false
+}
+
+// mset writes all pairs as one batch.
+func (c *conn) mset(args []string) bool {
+	if len(args)%2 != 1 {
+		c.wrongArgs("mset")
+		return false
+	}
+	var batch db.Batch
+	for i := 1; i < len(args); i += 2 {
+		batch.Put(args[i], args[i+1])
+	}
+	if err := c.s.DB.ApplyContext(c.ctx, &batch); err != nil {
+		c.dbError(err)
+		return false
+	}
+	c.w.simple("OK")
+	return false
+}
+
+// ttl answers TTL and PTTL: -2 for a missing key, -1 for one that does not
+// expire.
+func (c *conn) ttl(args []string) bool {
+	ttl, err := c.s.DB.TTL(args[1])
+	switch {
+	case errors.Is(err, consts.ErrorKeyNotFound):
+		c.w.integer(-2)
+	case err != nil:
+		c.dbError(err)
+	case ttl == db.NoExpiry:
+		c.w.integer(-1)
+	case strings.EqualFold(args[0], "pttl"):
+		c.w.integer(max(ttl.Milliseconds(), 0))
+	default:
+		c.w.integer(max((ttl.Milliseconds()+500)/1000, 0))
+	}
+	return false
+}
+
+func (c *conn) dbsize([]string) bool {
+	keys, err := c.s.DB.ListKeys()
+	if err != nil {
+		c.dbError(err)
+		return false
+	}
+	c.w.integer(int64(len(keys)))
+	return false
+}
+
+// info reports server, client, statistics and keyspace sections in the
+// Redis INFO layout, plus a bcask section on segments and merges.
+func (c *conn) info(args []string) bool {
+	sections := make(map[string]bool)
+	for _, arg := range args[1:] {
+		sections[strings.ToLower(arg)] = true
+	}
+	all := len(sections) == 0 || sections["all"] || sections["everything"] || sections["default"]
+	stats := c.s.DB.Stats()
+
+	var b strings.Builder
+	section := func(name string, lines ...string) {
+		if !all && !sections[name] {
+			return
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString("# " + strings.ToUpper(name[:1]) + name[1:] + "\r\n")
+		for _, line := range lines {
+			b.WriteString(line + "\r\n")
+		}
+	}
+	section("server",
+		"redis_version:"+serverVersion,
+		"server_name:bcask",
+		"redis_mode:standalone",
+		fmt.Sprintf("process_id:%d", os.Getpid()),
+		fmt.Sprintf("uptime_in_seconds:%d", int64(time.Since(c.s.started).Seconds())),
+	)
+	section("clients",
+		fmt.Sprintf("connected_clients:%d", c.s.clients()),
+	)
+	section("stats",
+		fmt.Sprintf("total_connections_received:%d", c.s.connections.Load()),
+		fmt.Sprintf("total_commands_processed:%d", c.s.commands.Load()),
+		fmt.Sprintf("keyspace_hits:%d", stats.Gets-stats.Misses),
+		fmt.Sprintf("keyspace_misses:%d", stats.Misses),
+	)
+	section("bcask",
+		"db_name:"+c.s.DB.DBName,
+		fmt.Sprintf("segments:%d", len(stats.Segments)),
+		fmt.Sprintf("bytes_written:%d", stats.BytesWritten),
+		fmt.Sprintf("live_bytes:%d", stats.LiveBytes),
+		fmt.Sprintf("dead_bytes:%d", stats.DeadBytes),
+		fmt.Sprintf("dead_ratio:%.4f", stats.DeadRatio()),
+		fmt.Sprintf("merges:%d", len(stats.Merges)),
+		fmt.Sprintf("index_memory_bytes:%d", stats.IndexMemoryBytes),
+	)
+	section("keyspace",
+		fmt.Sprintf("db0:keys=%d", stats.Keys),
+	)
+	c.w.verbatim(b.String())
+	return false
+}
+
+// save syncs the database to disk, which is what SAVE guarantees in Redis.
+func (c *conn) save([]string) bool {
+	if err := c.s.DB.SyncContext(c.ctx); err != nil {
+		c.dbError(err)
+		return false
+	}
+	c.w.simple("OK")
+	return false
+}
+
+// merge runs a full merge of the immutable segments. BCASK.MERGE and
+// BCASK.ROLL have no Redis counterpart; they let remote clients offer every
+// db.DB method.
+func (c *conn) merge([]string) bool {
+	if err := c.s.DB.MergeContext(c.ctx); err != nil {
+		c.dbError(err)
+		return false
+	}
+	c.w.simple("OK")
+	return false
+}
+
+// roll starts a new active segment.
+func (c *conn) roll([]string) bool {
+	if err := c.s.DB.RollContext(c.ctx); err != nil {
+		c.dbError(err)
+		return false
+	}
+	c.w.simple("OK")
+	return false
+}
@@ -0,0 +1,196 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/sayuyere/bcask/internal/consts"
+)
+
+// Limits on a single request, so a bad client cannot make the server
+// allocate without bound.
+const (
+	maxArgs    = 1 << 20
+	maxBulkLen = consts.SegmentMaxSize
+	maxInline  = 64 * 1024
+)
+
+// protocolError is answered with an error reply, after which the
+// connection is closed because the request stream can no longer be framed.
+type protocolError string
+
+func (e protocolError) Error() string { return "Protocol error: " + string(e) }
+
+// ReadCommand reads one request: a RESP array of bulk strings, or an inline
+// command of space-separated words as typed into telnet. It also reads the
+// commands of a Redis append-only file, which are stored the same way.
+func ReadCommand(r *bufio.Reader) ([]string, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if b != '*' {
+		if err := r.UnreadByte(); err != nil {
+			return nil, err
+		}
+		line, err := readLine(r, maxInline)
+		if err != nil {
+			return nil, err
+		}
+		return strings.Fields(line), nil
+	}
+	n, err := readLength(r, maxArgs, "multibulk length")
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, 0, min(n, 64))
+	for i := 0; i < n; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if b != '$' {
+			return nil, protocolError(fmt.Sprintf("expected '$', got '%c'", b))
+		}
+		size, err := readLength(r, int(maxBulkLen), "bulk length")
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if buf[size] != '\r' || buf[size+1] != '\n' {
+			return nil, protocolError("bulk string not terminated by CRLF")
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+// readLength reads the decimal length that follows a '*' or '$'.
+func readLength(r *bufio.Reader, limit int, what string) (int, error) {
+	line, err := readLine(r, 32)
+	if err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	n, err := strconv.Atoi(line)
+	if err != nil || n < 0 || n > limit {
+		return 0, protocolError("invalid " + what)
+	}
+	return n, nil
+}
+
+// readLine reads up to a CRLF, or a bare LF as inline clients may send.
+func readLine(r *bufio.Reader, limit int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > limit {
+			return "", protocolError("too big request")
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		line = line[:len(line)-1]
+		if n := len(line); n > 0 && line[n-1] == '\r' {
+			line = line[:n-1]
+		}
+		return string(line), nil
+	}
+}
+
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// writer encodes replies for the protocol version negotiated with HELLO.
+// RESP2 clients get maps as flat arrays and a single null bulk string.
+type writer struct {
+	*bufio.Writer
+	proto int
+}
+
+func (w *writer) simple(s string) {
+	w.WriteByte('+')
+	w.WriteString(s)
+	w.WriteString("\r\n")
+}
+
+// error writes an error reply. msg starts with an error code such as ERR.
+func (w *writer) error(msg string) {
+	w.WriteByte('-')
+	w.WriteString(strings.NewReplacer("\r", " ", "\n", " ").Replace(msg))
+	w.WriteString("\r\n")
+}
+
+func (w *writer) integer(n int64) {
+	w.WriteByte(':')
+	w.WriteString(strconv.FormatInt(n, 10))
+	w.WriteString("\r\n")
+}
+
+func (w *writer) bulk(s string) {
+	w.WriteByte('$')
+	w.WriteString(strconv.Itoa(len(s)))
+	w.WriteString("\r\n")
+	w.WriteString(s)
+	w.WriteString("\r\n")
+}
+
+func (w *writer) null() {
+	if w.proto >= 3 {
+		w.WriteString("_\r\n")
+		return
+	}
+	w.WriteString("$-1\r\n")
+}
+
+func (w *writer) array(n int) {
+	w.WriteByte('*')
+	w.WriteString(strconv.Itoa(n))
+	w.WriteString("\r\n")
+}
+
+// mapHeader starts a map of n pairs; the caller writes 2n values.
+func (w *writer) mapHeader(n int) {
+	if w.proto >= 3 {
+		w.WriteByte('%')
+		w.WriteString(strconv.Itoa(n))
+		w.WriteString("\r\n")
+		return
+	}
+	w.array(2 * n)
+}
+
+// verbatim writes text such as the INFO reply, as a verbatim string for
+// RESP3 clients.
+func (w *writer) verbatim(s string) {
+	if w.proto < 3 {
+		w.bulk(s)
+		return
+	}
+	w.WriteByte('=')
+	w.WriteString(strconv.Itoa(len(s) + 4))
+	w.WriteString("\r\ntxt:")
+	w.WriteString(s)
+	w.WriteString("\r\n")
+}
+
+func (w *writer) strings(values []string) {
+	w.array(len(values))
+	for _, v := range values {
+		w.bulk(v)
+	}
+}
@@ -0,0 +1,336 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sayuyere/bcask/internal/consts"
+	"github.com/sayuyere/bcask/internal/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// client speaks just enough RESP to test the server.
+type client struct {
+	t  *testing.T
+	nc net.Conn
+	r  *bufio.Reader
+}
+
+type replyError string
+
+func (e replyError) Error() string { return string(e) }
+
+func dial(t *testing.T, addr string) *client {
+	nc, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { nc.Close() })
+	return &client{t: t, nc: nc, r: bufio.NewReader(nc)}
+}
+
+func encode(args ...string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return b.String()
+}
+
+func (c *client) send(raw string) {
+	_, err := io.WriteString(c.nc, raw)
+	require.NoError(c.t, err)
+}
+
+func (c *client) do(args ...string) any {
+	c.send(encode(args...))
+	return c.reply()
+}
+
+// reply reads one reply: strings, int64, replyError, nil, []any or, for
+// RESP3 maps, map[string]any.
+func (c *client) reply() any {
+	c.t.Helper()
+	require.NoError(c.t, c.nc.SetReadDeadline(time.Now().Add(5*time.Second)))
+	line, err := c.r.ReadString('\n')
+	require.NoError(c.t, err)
+	line = strings.TrimSuffix(line, "\r\n")
+	kind, rest := line[0], line[1:]
+	switch kind {
+	case '+':
+		return rest
+	case '-':
+		return replyError(rest)
+	case ':':
+		n, err := strconv.ParseInt(rest, 10, 64)
+		require.NoError(c.t, err)
+		return n
+	case '_':
+		return nil
+	case '$', '=':
+		n, err := strconv.Atoi(rest)
+		require.NoError(c.t, err)
+		if n < 0 {
+			return nil
+		}
+		buf := make([]byte, n+2)
+		_, err = io.ReadFull(c.r, buf)
+		require.NoError(c.t, err)
+		if kind == '=' {
+			return string(buf[4:n])
+		}
+		return string(buf[:n])
+	case '*':
+		n, err := strconv.Atoi(rest)
+		require.NoError(c.t, err)
+		values := make([]any, n)
+		for i := range values {
+			values[i] = c.reply()
+		}
+		return values
+	case '%':
+		n, err := strconv.Atoi(rest)
+		require.NoError(c.t, err)
+		values := make(map[string]any, n)
+		for i := 0; i < n; i++ {
+			key := c.reply().(string)
+			values[key] = c.reply()
+		}
+		return values
+	}
+	c.t.Fatalf("unexpected reply %q", line)
+	return nil
+}
+
+func startServer(t *testing.T, opts ...db.Option) (*Server, *db.Bcask, string) {
+	b, err := db.Open(t.TempDir(), "resp_db", opts...)
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := NewServer(b)
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(l) }()
+	t.Cleanup(func() {
+		require.NoError(t, s.Close())
+		assert.ErrorIs(t, <-done, consts.ErrorServerClosed)
+		require.NoError(t, b.Close())
+	})
+	return s, b, l.Addr().String()
+}
+
+func strs(values ...string) []any {
+	out := make([]any, len(values))
+	for i, v := range values {
+		out[i] = v
+	}
+	return out
+}
+
+func TestServer(t *testing.T) {
+	_, b, addr := startServer(t)
+	c := dial(t, addr)
+
+	t.Run("Basics", func(t *testing.T) {
+		assert.Equal(t, "PONG", c.do("PING"))
+		assert.Equal(t, "hi", c.do("ping", "hi"))
+		assert.Equal(t, "a b", c.do("ECHO", "a b"))
+		assert.Equal(t, "OK", c.do("SELECT", "0"))
+		assert.Equal(t, replyError("ERR DB index is out of range"), c.do("SELECT", "1"))
+		assert.Equal(t, replyError("ERR unknown command 'NOPE', with args beginning with: 'x'"), c.do("NOPE", "x"))
+		assert.Equal(t, replyError("ERR wrong number of arguments for 'get' command"), c.do("GET"))
+		assert.Equal(t, []any{}, c.do("COMMAND"))
+	})
+
+	t.Run("StringCommands", func(t *testing.T) {
+		assert.Equal(t, nil, c.do("GET", "k"))
+		assert.Equal(t, "OK", c.do("SET", "k", "v\r\nwith binary \x00"))
+		assert.Equal(t, "v\r\nwith binary \x00", c.do("GET", "k"))
+		assert.Equal(t, nil, c.do("SET", "k", "other", "NX"))
+		assert.Equal(t, nil, c.do("SET", "missing", "x", "XX"))
+		assert.Equal(t, "OK", c.do("SET", "k", "v2", "xx"))
+		assert.Equal(t, replyError("ERR syntax error"), c.do("SET", "k", "v", "NX", "XX"))
+		assert.Equal(t, replyError("ERR syntax error"), c.do("SET", "k", "v", "KEEPTTL"))
+		assert.Equal(t, replyError("ERR invalid expire time in 'set' command"), c.do("SET", "k", "v", "EX", "0"))
+
+		assert.Equal(t, int64(-1), c.do("TTL", "k"))
+		assert.Equal(t, int64(-2), c.do("TTL", "missing"))
+		assert.Equal(t, "OK", c.do("SET", "t", "v", "EX", "100"))
+		assert.Equal(t, int64(100), c.do("TTL", "t"))
+		assert.Equal(t, "OK", c.do("SET", "p", "v", "PX", "30"))
+		ms := c.do("PTTL", "p").(int64)
+		assert.True(t, ms > 0 && ms <= 30, "PTTL = %d", ms)
+		time.Sleep(40 * time.Millisecond)
+		assert.Equal(t, nil, c.do("GET", "p"))
+		assert.Equal(t, "OK", c.do("SET", "p", "v", "NX"))
+
+		assert.Equal(t, "OK", c.do("MSET", "m1", "1", "m2", "2"))
+		assert.Equal(t, replyError("ERR wrong number of arguments for 'mset' command"), c.do("MSET", "m1", "1", "m2"))
+		assert.Equal(t, []any{"1", nil, "2"}, c.do("MGET", "m1", "nope", "m2"))
+		assert.Equal(t, int64(2), c.do("EXISTS", "m1", "m2", "nope"))
+		assert.Equal(t, int64(2), c.do("DEL", "m1", "m2", "nope"))
+		assert.Equal(t, int64(0), c.do("EXISTS", "m1"))
+
+		v, err := b.Get("t")
+		require.NoError(t, err)
+		assert.Equal(t, "v", v)
+	})
+
+	t.Run("KeysAndScan", func(t *testing.T) {
+		c.do("DEL", "k", "t", "p")
+		var pairs []string
+		for i := 0; i < 25; i++ {
+			pairs = append(pairs, fmt.Sprintf("user:%02d", i), "x")
+		}
+		pairs = append(pairs, "order:1", "x", "user*", "x")
+		assert.Equal(t, "OK", c.do(append([]string{"MSET"}, pairs...)...))
+		assert.Equal(t, int64(27), c.do("DBSIZE"))
+
+		assert.Equal(t, strs("user:10", "user:11", "user:12"), c.do("KEYS", "user:1[0-2]"))
+		assert.Equal(t, strs("order:1"), c.do("KEYS", "*der:?"))
+		assert.Equal(t, strs("user*"), c.do("KEYS", `user\*`))
+
+		var seen []string
+		cursor := "0"
+		for i := 0; ; i++ {
+			require.Less(t, i, 10)
+			reply := c.do("SCAN", cursor, "MATCH", "user:*", "COUNT", "4").([]any)
+			cursor = reply[0].(string)
+			for _, key := range reply[1].([]any) {
+				seen = append(seen, key.(string))
+			}
+			if cursor == "0" {
+				break
+			}
+			if i == 1 {
+				c.do("DEL", "user:09") // not reached yet
+				c.do("SET", "user:20", "y")
+			}
+		}
+		assert.Len(t, seen, 24)
+		assert.NotContains(t, seen, "user:09")
+		assert.Equal(t, "user:24", seen[len(seen)-1])
+		assert.Equal(t, replyError("ERR invalid cursor"), c.do("SCAN", "12345"))
+		reply := c.do("SCAN", "0", "TYPE", "hash").([]any)
+		assert.Empty(t, reply[1])
+	})
+
+	t.Run("Pipelining", func(t *testing.T) {
+		c.send(encode("SET", "pipe", "1") + encode("GET", "pipe") + "PING inline\r\n" + "GET pipe\n")
+		assert.Equal(t, "OK", c.reply())
+		assert.Equal(t, "1", c.reply())
+		assert.Equal(t, "inline", c.reply())
+		assert.Equal(t, "1", c.reply())
+	})
+
+	t.Run("Hello3", func(t *testing.T) {
+		c := dial(t, addr)
+		hello := c.do("HELLO", "3", "SETNAME", "tester").(map[string]any)
+		assert.Equal(t, "bcask", hello["server"])
+		assert.Equal(t, int64(3), hello["proto"])
+		assert.Equal(t, "tester", c.do("CLIENT", "GETNAME"))
+		assert.Equal(t, nil, c.do("GET", "nope"))
+		assert.Equal(t, replyError("NOPROTO unsupported protocol version"), c.do("HELLO", "4"))
+
+		info := c.do("INFO").(string)
+		assert.Contains(t, info, "# Server\r\nredis_version:")
+		assert.Contains(t, info, "connected_clients:2\r\n")
+		assert.Contains(t, info, "db_name:resp_db\r\n")
+		assert.Contains(t, info, "# Keyspace\r\ndb0:keys=")
+		only := c.do("INFO", "keyspace").(string)
+		assert.True(t, strings.HasPrefix(only, "# Keyspace\r\n"), only)
+		assert.NotContains(t, only, "# Server")
+	})
+
+	t.Run("ProtocolError", func(t *testing.T) {
+		c := dial(t, addr)
+		c.send("*1\r\n+PING\r\n")
+		assert.Equal(t, replyError("ERR Protocol error: expected '$', got '+'"), c.reply())
+		_, err := c.r.ReadByte()
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("Quit", func(t *testing.T) {
+		c := dial(t, addr)
+		assert.Equal(t, "OK", c.do("QUIT"))
+		_, err := c.r.ReadByte()
+		assert.ErrorIs(t, err, io.EOF)
+	})
+}
+
+func TestServerReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	b, err := db.Open(dir, "ro")
+	require.NoError(t, err)
+	require.NoError(t, b.Put("k", "v"))
+	require.NoError(t, b.Close())
+	b, err = db.Open(dir, "ro", db.WithReadOnly())
+	require.NoError(t, err)
+	defer b.Close()
+
+	s := NewServer(b)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(l)
+	defer s.Close()
+
+	c := dial(t, l.Addr().String())
+	assert.Equal(t, "v", c.do("GET", "k"))
+	reply := c.do("SET", "k", "x")
+	require.IsType(t, replyError(""), reply)
+	assert.True(t, strings.HasPrefix(string(reply.(replyError)), "READONLY"))
+}
+
+func TestServerClose(t *testing.T) {
+	s, _, addr := startServer(t)
+	c := dial(t, addr)
+	assert.Equal(t, "PONG", c.do("PING"))
+	require.NoError(t, s.Close())
+	_, err := c.r.ReadByte()
+	assert.Error(t, err)
+	_, err = net.Dial("tcp", addr)
+	assert.Error(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	assert.True(t, errors.Is(s.Serve(l), consts.ErrorServerClosed))
+}
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"a*c", "abbbc", true},
+		{"a*c", "abbbd", false},
+		{"a**c", "ac", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[c-a]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{`h[\]]llo`, "h]llo", true},
+		{"abc", "abcd", false},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.want, match(c.pattern, c.s), "match(%q, %q)", c.pattern, c.s)
+	}
+
+	assert.Equal(t, "user:", literalPrefix("user:*"))
+	assert.Equal(t, "a*b", literalPrefix(`a\*b?`))
+	assert.Equal(t, "", literalPrefix("[ab]c"))
+	assert.Equal(t, "exact", literalPrefix("exact"))
+}
@@ -0,0 +1,210 @@
+// Package resp serves a bcask database over the Redis serialization
+// protocol (RESP2, and RESP3 after HELLO 3), so redis-cli and existing Redis
+// clients can use the store. Only the string commands that map onto bcask
+// are implemented.
+package resp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sayuyere/bcask/internal/consts"
+	"github.com/sayuyere/bcask/internal/db"
+	"github.com/sayuyere/bcask/internal/logging"
+)
+
+// Server accepts RESP connections for one database.
+type Server struct {
+	DB     *db.Bcask
+	Logger *slog.Logger
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[*conn]struct{}
+	closed    bool
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+
+	started     time.Time
+	nextID      atomic.Int64
+	connections atomic.Int64
+	commands    atomic.Int64
+}
+
+// NewServer returns a server for b that logs nothing.
+func NewServer(b *db.Bcask) *Server {
+	return &Server{DB: b}
+}
+
+func (s *Server) init() {
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+		s.conns = make(map[*conn]struct{})
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+		s.started = time.Now()
+	}
+}
+
+// Serve accepts connections on l until Close is called, then returns
+// consts.ErrorServerClosed. Serve may be called for several listeners.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	s.init()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return consts.ErrorServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	logger := logging.OrDiscard(s.Logger)
+	var backoff time.Duration
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return consts.ErrorServerClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				backoff = min(max(2*backoff, 5*time.Millisecond), time.Second)
+				logger.Warn("resp accept failed", "error", err, "retry_in", backoff)
+				time.Sleep(backoff)
+				continue
+			}
+			return err
+		}
+		backoff = 0
+		c := s.newConn(nc)
+		if c == nil {
+			nc.Close()
+			return consts.ErrorServerClosed
+		}
+		go c.serve()
+	}
+}
+
+func (s *Server) newConn(nc net.Conn) *conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	c := &conn{
+		s:       s,
+		nc:      nc,
+		id:      s.nextID.Add(1),
+		ctx:     s.ctx,
+		r:       bufio.NewReader(nc),
+		w:       &writer{Writer: bufio.NewWriter(nc), proto: 2},
+		cursors: make(map[uint64]string),
+	}
+	s.conns[c] = struct{}{}
+	s.wg.Add(1)
+	s.connections.Add(1)
+	return c
+}
+
+// Close stops all listeners, closes every connection and waits for the
+// commands in progress to finish. It does not close the database.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.init()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.cancel()
+	var err error
+	for l := range s.listeners {
+		if closeErr := l.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	for c := range s.conns {
+		c.nc.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// clients returns the number of open connections.
+func (s *Server) clients() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// conn is one client connection. Commands run one at a time in the order
+// they arrive; replies are buffered until no pipelined request is pending.
+type conn struct {
+	s   *Server
+	nc  net.Conn
+	id  int64
+	ctx context.Context
+	r   *bufio.Reader
+	w   *writer
+
+	name string
+	// cursors maps SCAN cursors handed out on this connection to the last
+	// key they returned.
+	cursors    map[uint64]string
+	nextCursor uint64
+}
+
+func (c *conn) serve() {
+	defer func() {
+		c.nc.Close()
+		c.s.mu.Lock()
+		delete(c.s.conns, c)
+		c.s.mu.Unlock()
+		c.s.wg.Done()
+	}()
+	logger := logging.OrDiscard(c.s.Logger)
+	for {
+		args, err := ReadCommand(c.r)
+		if err != nil {
+			var perr protocolError
+			if errors.As(err, &perr) {
+				logger.Warn("resp protocol error", "client", c.nc.RemoteAddr(), "error", err)
+				c.w.error("ERR " + perr.Error())
+				c.w.Flush()
+			} else if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				logger.Debug("resp connection closed", "client", c.nc.RemoteAddr(), "error", err)
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		c.s.commands.Add(1)
+		quit := c.exec(args)
+		if quit || c.r.Buffered() == 0 {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
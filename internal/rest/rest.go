@@ -0,0 +1,423 @@
+// Package rest serves a bcask database as an HTTP/JSON API:
+//
+//	GET    /keys/{key}      value as the raw body, with an ETag
+//	PUT    /keys/{key}      store the request body, ?ttl=30s to expire it
+//	DELETE /keys/{key}
+//	GET    /keys            ?prefix=&limit=&cursor=&values=false, paginated
+//	POST   /batch           {"ops": [{"op": "put", "key": ..., "value": ...}]}
+//	POST   /admin/merge     {"segments": [ids]} to merge only those
+//	POST   /admin/sync
+//	GET    /stats
+//
+// ETags are the version of the key (see db.Bcask.GetVersion), so
+// If-None-Match, If-Match and If-None-Match: * on PUT make reads cacheable
+// and writes conditional.
+package rest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sayuyere/bcask/internal/consts"
+	"github.com/sayuyere/bcask/internal/db"
+)
+
+const (
+	// DefaultLimit and MaxLimit bound the entries of one /keys page.
+	DefaultLimit = 100
+	MaxLimit     = 1000
+	// maxBatchBody bounds a /batch request; a batch is applied in memory.
+	maxBatchBody = 4 * consts.SegmentMaxSize
+)
+
+// Handler routes the API for one database.
+type Handler struct {
+	DB  *db.Bcask
+	mux *http.ServeMux
+}
+
+// NewHandler returns the API handler for b.
+func NewHandler(b *db.Bcask) *Handler {
+	h := &Handler{DB: b, mux: http.NewServeMux()}
+	h.mux.HandleFunc("GET /keys/{key...}", h.getKey)
+	h.mux.HandleFunc("PUT /keys/{key...}", h.putKey)
+	h.mux.HandleFunc("DELETE /keys/{key...}", h.deleteKey)
+	h.mux.HandleFunc("GET /keys", h.listKeys)
+	h.mux.HandleFunc("POST /batch", h.batch)
+	h.mux.HandleFunc("POST /admin/merge", h.merge)
+	h.mux.HandleFunc("POST /admin/sync", h.sync)
+	h.mux.HandleFunc("GET /stats", h.stats)
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// Error is the body of every error response.
+type Error struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, Error{Error: err.Error()})
+}
+
+// dbError maps an error from the database to a status code.
+func dbError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var maxBytes *http.MaxBytesError
+	switch {
+	case errors.Is(err, consts.ErrorKeyNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, consts.ErrorVersionMismatch):
+		status = http.StatusPreconditionFailed
+	case errors.Is(err, consts.ErrorReadOnly):
+		status = http.StatusForbidden
+	case errors.Is(err, consts.ErrorDiskKeyValueBigEntry), errors.As(err, &maxBytes):
+		status = http.StatusRequestEntityTooLarge
+	case errors.Is(err, consts.ErrorSegmentNotFound), errors.Is(err, consts.ErrorMergeActiveSegment):
+		status = http.StatusBadRequest
+	}
+	writeError(w, status, err)
+}
+
+func etag(version int64) string {
+	return `"` + strconv.FormatInt(version, 36) + `"`
+}
+
+// parseETag returns the version in a strong ETag, or 0.
+func parseETag(tag string) int64 {
+	tag = strings.TrimSpace(tag)
+	if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+		return 0
+	}
+	version, err := strconv.ParseInt(tag[1:len(tag)-1], 36, 64)
+	if err != nil || version <= 0 {
+		return 0
+	}
+	return version
+}
+
+// matchesETag reports whether an If-Match or If-None-Match list names tag.
+func matchesETag(list, tag string) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Handler) getKey(w http.ResponseWriter, r *http.Request) {
+	value, version, err := h.DB.GetVersionContext(r.Context(), r.PathValue("key"))
+	if err != nil {
+		dbError(w, err)
+		return
+	}
+	tag := etag(version)
+	w.Header().Set("ETag", tag)
+	if inm := r.Header.Get("If-None-Match"); inm != "" && matchesETag(inm, tag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if im := r.Header.Get("If-Match"); im != "" && !matchesETag(im, tag) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(value)))
+	io.WriteString(w, value)
+}
+
+// putKey stores the body. If-Match makes the write conditional on the
+// current version (or, for *, on the key existing); If-None-Match: * on the
+// key not existing.
+func (h *Handler) putKey(w http.ResponseWriter, r *http.Request) {
+	var opts db.PutOptions
+	if ttl := r.URL.Query().Get("ttl"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid ttl %q", ttl))
+			return
+		}
+		opts.TTL = d
+	}
+	if im := strings.TrimSpace(r.Header.Get("If-Match")); im == "*" {
+		opts.IfPresent = true
+	} else if im != "" {
+		if opts.IfVersion = parseETag(im); opts.IfVersion == 0 {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+	}
+	if inm := strings.TrimSpace(r.Header.Get("If-None-Match")); inm == "*" {
+		opts.IfAbsent = true
+	} else if inm != "" {
+		writeError(w, http.StatusBadRequest, errors.New("If-None-Match on PUT only supports *"))
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, consts.SegmentMaxSize))
+	if err != nil {
+		dbError(w, err)
+		return
+	}
+	version, err := h.DB.PutWithOptionsContext(r.Context(), r.PathValue("key"), string(body), opts)
+	if err != nil {
+		dbError(w, err)
+		return
+	}
+	if version == 0 {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	w.Header().Set("ETag", etag(version))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) deleteKey(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	var err error
+	switch im := strings.TrimSpace(r.Header.Get("If-Match")); im {
+	case "", "*":
+		err = h.DB.DeleteContext(r.Context(), key)
+	default:
+		version := parseETag(im)
+		if version == 0 {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		err = h.DB.DeleteVersionContext(r.Context(), key, version)
+	}
+	if err != nil {
+		dbError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Entry is one key in a /keys page. Keys and values that are not valid
+// UTF-8 are sent base64-encoded in the _base64 fields instead.
+type Entry struct {
+	Key         string  `json:"key,omitempty"`
+	KeyBase64   string  `json:"key_base64,omitempty"`
+	Value       *string `json:"value,omitempty"`
+	ValueBase64 string  `json:"value_base64,omitempty"`
+}
+
+// Page is the response to GET /keys. NextCursor is empty on the last page.
+type Page struct {
+	Entries    []Entry `json:"entries"`
+	NextCursor string  `json:"next_cursor,omitempty"`
+}
+
+func newEntry(key string) Entry {
+	if utf8.ValidString(key) {
+		return Entry{Key: key}
+	}
+	return Entry{KeyBase64: base64.StdEncoding.EncodeToString([]byte(key))}
+}
+
+func (e *Entry) setValue(value string) {
+	if utf8.ValidString(value) {
+		e.Value = &value
+		return
+	}
+	e.ValueBase64 = base64.StdEncoding.EncodeToString([]byte(value))
+}
+
+// listKeys returns a page of keys in ascending order. The cursor is the
+// last key of the previous page, so pages stay consistent while keys are
+// written in between.
+func (h *Handler) listKeys(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := DefaultLimit
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > MaxLimit {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("limit must be between 1 and %d", MaxLimit))
+			return
+		}
+		limit = n
+	}
+	var after string
+	if cursor := q.Get("cursor"); cursor != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errors.New("invalid cursor"))
+			return
+		}
+		after = string(raw)
+	}
+	values := q.Get("values") != "false"
+
+	keys, err := h.DB.ListKeysWithPrefix(q.Get("prefix"))
+	if err != nil {
+		dbError(w, err)
+		return
+	}
+	page := Page{Entries: []Entry{}}
+	for _, key := range keys {
+		if after != "" && key <= after {
+			continue
+		}
+		if len(page.Entries) == limit {
+			last := page.Entries[len(page.Entries)-1]
+			page.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(entryKey(last)))
+			break
+		}
+		entry := newEntry(key)
+		if values {
+			value, err := h.DB.GetContext(r.Context(), key)
+			if errors.Is(err, consts.ErrorKeyNotFound) {
+				continue // deleted since the keys were listed
+			}
+			if err != nil {
+				dbError(w, err)
+				return
+			}
+			entry.setValue(value)
+		}
+		page.Entries = append(page.Entries, entry)
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+func entryKey(e Entry) string {
+	if e.KeyBase64 == "" {
+		return e.Key
+	}
+	raw, _ := base64.StdEncoding.DecodeString(e.KeyBase64)
+	return string(raw)
+}
+
+// BatchOp is one operation of a POST /batch request. Value and ValueBase64
+// are alternatives.
+type BatchOp struct {
+	Op          string  `json:"op"`
+	Key         string  `json:"key"`
+	Value       *string `json:"value,omitempty"`
+	ValueBase64 string  `json:"value_base64,omitempty"`
+}
+
+type BatchRequest struct {
+	Ops []BatchOp `json:"ops"`
+}
+
+type BatchResponse struct {
+	Applied int `json:"applied"`
+}
+
+// batch applies all operations atomically, or none of them.
+func (h *Handler) batch(w http.ResponseWriter, r *http.Request) {
+	var req BatchRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		var maxBytes *http.MaxBytesError
+		if errors.As(err, &maxBytes) {
+			dbError(w, err)
+			return
+		}
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid batch: %w", err))
+		return
+	}
+	var batch db.Batch
+	for i, op := range req.Ops {
+		switch op.Op {
+		case "put":
+			value := ""
+			switch {
+			case op.Value != nil && op.ValueBase64 != "":
+				writeError(w, http.StatusBadRequest, fmt.Errorf("op %d: both value and value_base64 set", i))
+				return
+			case op.Value != nil:
+				value = *op.Value
+			default:
+				raw, err := base64.StdEncoding.DecodeString(op.ValueBase64)
+				if err != nil {
+					writeError(w, http.StatusBadRequest, fmt.Errorf("op %d: %w", i, err))
+					return
+				}
+				value = string(raw)
+			}
+			batch.Put(op.Key, value)
+		case "delete":
+			batch.Delete(op.Key)
+		default:
+			writeError(w, http.StatusBadRequest, fmt.Errorf("op %d: unknown op %q", i, op.Op))
+			return
+		}
+	}
+	if err := h.DB.ApplyContext(r.Context(), &batch); err != nil {
+		dbError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, BatchResponse{Applied: batch.Len()})
+}
+
+type MergeRequest struct {
+	Segments []int64 `json:"segments"`
+}
+
+// merge runs a full merge, or merges the listed segments, and responds
+// with the merge record.
+func (h *Handler) merge(w http.ResponseWriter, r *http.Request) {
+	var req MergeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid merge request: %w", err))
+		return
+	}
+	before := lastMerge(h.DB.Stats())
+	var err error
+	if len(req.Segments) > 0 {
+		err = h.DB.MergeSegments(req.Segments)
+	} else {
+		err = h.DB.MergeContext(r.Context())
+	}
+	if err != nil {
+		dbError(w, err)
+		return
+	}
+	after := lastMerge(h.DB.Stats())
+	if !after.StartedAt.After(before.StartedAt) {
+		w.WriteHeader(http.StatusNoContent) // nothing to merge
+		return
+	}
+	writeJSON(w, http.StatusOK, after)
+}
+
+func lastMerge(s db.Stats) db.MergeRecord {
+	if len(s.Merges) == 0 {
+		return db.MergeRecord{}
+	}
+	return s.Merges[len(s.Merges)-1]
+}
+
+func (h *Handler) sync(w http.ResponseWriter, r *http.Request) {
+	if err := h.DB.SyncContext(r.Context()); err != nil {
+		dbError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) stats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.DB.Stats())
+}
@@ -0,0 +1,160 @@
+package rest
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/sayuyere/bcask/internal/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func do(t *testing.T, h http.Handler, method, target, body string, header ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func decode[T any](t *testing.T, w *httptest.ResponseRecorder) T {
+	t.Helper()
+	var v T
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &v), w.Body.String())
+	return v
+}
+
+func TestHandler(t *testing.T) {
+	b, err := db.Open(t.TempDir(), "rest_db")
+	require.NoError(t, err)
+	defer b.Close()
+	h := NewHandler(b)
+
+	t.Run("Keys", func(t *testing.T) {
+		w := do(t, h, "GET", "/keys/a/b", "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.Equal(t, "key not found", decode[Error](t, w).Error)
+
+		w = do(t, h, "PUT", "/keys/a/b", "value one")
+		require.Equal(t, http.StatusNoContent, w.Code)
+		tag := w.Header().Get("ETag")
+		require.NotEmpty(t, tag)
+
+		w = do(t, h, "GET", "/keys/a/b", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "value one", w.Body.String())
+		assert.Equal(t, tag, w.Header().Get("ETag"))
+		assert.Equal(t, http.StatusNotModified, do(t, h, "GET", "/keys/a/b", "", "If-None-Match", tag).Code)
+
+		assert.Equal(t, http.StatusPreconditionFailed, do(t, h, "PUT", "/keys/a/b", "x", "If-None-Match", "*").Code)
+		assert.Equal(t, http.StatusPreconditionFailed, do(t, h, "PUT", "/keys/new", "x", "If-Match", "*").Code)
+		w = do(t, h, "PUT", "/keys/a/b", "value two", "If-Match", tag)
+		require.Equal(t, http.StatusNoContent, w.Code)
+		newTag := w.Header().Get("ETag")
+		assert.NotEqual(t, tag, newTag)
+		assert.Equal(t, http.StatusPreconditionFailed, do(t, h, "PUT", "/keys/a/b", "lost update", "If-Match", tag).Code)
+		assert.Equal(t, http.StatusOK, do(t, h, "GET", "/keys/a/b", "", "If-None-Match", tag).Code)
+
+		assert.Equal(t, http.StatusPreconditionFailed, do(t, h, "DELETE", "/keys/a/b", "", "If-Match", tag).Code)
+		assert.Equal(t, http.StatusNoContent, do(t, h, "DELETE", "/keys/a/b", "", "If-Match", newTag).Code)
+		assert.Equal(t, http.StatusNotFound, do(t, h, "DELETE", "/keys/a/b", "").Code)
+
+		assert.Equal(t, http.StatusBadRequest, do(t, h, "PUT", "/keys/t?ttl=never", "x").Code)
+		require.Equal(t, http.StatusNoContent, do(t, h, "PUT", "/keys/t?ttl=1h", "x").Code)
+		ttl, err := b.TTL("t")
+		require.NoError(t, err)
+		assert.Greater(t, ttl.Minutes(), 59.0)
+
+		assert.Equal(t, http.StatusMethodNotAllowed, do(t, h, "POST", "/keys/a", "").Code)
+	})
+
+	t.Run("Batch", func(t *testing.T) {
+		w := do(t, h, "POST", "/batch", `{"ops": [
+			{"op": "put", "key": "user/1", "value": "alice"},
+			{"op": "put", "key": "user/2", "value_base64": "/w=="},
+			{"op": "put", "key": "user/3", "value": "carol"},
+			{"op": "delete", "key": "t"}
+		]}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, 4, decode[BatchResponse](t, w).Applied)
+		v, err := b.Get("user/2")
+		require.NoError(t, err)
+		assert.Equal(t, "\xff", v)
+
+		w = do(t, h, "POST", "/batch", `{"ops": [{"op": "put", "key": "x", "value": "1"}, {"op": "delete", "key": "missing"}]}`)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		_, err = b.Get("x")
+		assert.Error(t, err, "a failed batch must not be applied in part")
+		assert.Equal(t, http.StatusBadRequest, do(t, h, "POST", "/batch", `{"ops": [{"op": "incr", "key": "x"}]}`).Code)
+		assert.Equal(t, http.StatusBadRequest, do(t, h, "POST", "/batch", `{"ops": `).Code)
+	})
+
+	t.Run("List", func(t *testing.T) {
+		w := do(t, h, "GET", "/keys?prefix=user/&limit=2", "")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		page := decode[Page](t, w)
+		require.Len(t, page.Entries, 2)
+		assert.Equal(t, "user/1", page.Entries[0].Key)
+		assert.Equal(t, "alice", *page.Entries[0].Value)
+		assert.Nil(t, page.Entries[1].Value)
+		assert.Equal(t, "/w==", page.Entries[1].ValueBase64)
+		require.NotEmpty(t, page.NextCursor)
+
+		require.NoError(t, b.Put("user/2a", "inserted between pages"))
+		w = do(t, h, "GET", "/keys?prefix=user/&limit=2&values=false&cursor="+url.QueryEscape(page.NextCursor), "")
+		page = decode[Page](t, w)
+		require.Len(t, page.Entries, 2)
+		assert.Equal(t, "user/2a", page.Entries[0].Key)
+		assert.Equal(t, "user/3", page.Entries[1].Key)
+		assert.Nil(t, page.Entries[1].Value)
+		assert.Empty(t, page.NextCursor)
+
+		assert.Equal(t, http.StatusBadRequest, do(t, h, "GET", "/keys?limit=0", "").Code)
+		assert.Equal(t, http.StatusBadRequest, do(t, h, "GET", "/keys?cursor=***", "").Code)
+	})
+
+	t.Run("Admin", func(t *testing.T) {
+		assert.Equal(t, http.StatusNoContent, do(t, h, "POST", "/admin/sync", "").Code)
+		// Only the active segment exists, so there is nothing to merge.
+		assert.Equal(t, http.StatusNoContent, do(t, h, "POST", "/admin/merge", "").Code)
+		w := do(t, h, "POST", "/admin/merge", `{"segments": [0]}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w = do(t, h, "GET", "/stats", "")
+		require.Equal(t, http.StatusOK, w.Code)
+		stats := decode[db.Stats](t, w)
+		assert.Equal(t, 4, stats.Keys)
+		assert.NotZero(t, stats.Puts)
+	})
+}
+
+func TestHandlerMerge(t *testing.T) {
+	b, err := db.Open(t.TempDir(), "rest_merge_db")
+	require.NoError(t, err)
+	defer b.Close()
+	h := NewHandler(b)
+	big := strings.Repeat("x", 1024*1024)
+	for _, key := range []string{"a", "b", "c", "a"} {
+		require.NoError(t, b.Put(key, big))
+	}
+
+	w := do(t, h, "POST", "/admin/merge", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	record := decode[db.MergeRecord](t, w)
+	assert.Equal(t, []int64{0}, record.SegmentsIn)
+	assert.Equal(t, 2, record.RecordsMoved)
+
+	r := httptest.NewRequest("GET", "/keys/a", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	body, _ := io.ReadAll(rec.Body)
+	assert.Equal(t, big, string(body))
+}
@@ -0,0 +1,163 @@
+package segment
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/sayuyere/bcask/internal/consts"
+	"github.com/sayuyere/bcask/internal/item"
+	"github.com/sayuyere/bcask/internal/uuid"
+)
+
+// Segment header layout, SegmentHeaderSize bytes at the start of every
+// segment file, records follow directly after it:
+//
+//	| magic "BCSG" | version u16 | flags u16 | database uuid [16] | segment id i64 | created at i64 | segment size i64 | reserved [12] | crc u32 |
+//
+// Segments written before the header existed have records from offset 0.
+// They are read as format version 0, with no database ID or creation time.
+var segmentMagic = [4]byte{'B', 'C', 'S', 'G'}
+
+// checksumVersion is the first format version in which every record carries
+// a checksum.
+const checksumVersion = 2
+
+type Header struct {
+	Version    uint16
+	Flags      uint16
+	DatabaseID uuid.UUID
+	SegmentID  int64
+	// CreatedAt is the creation time in unix nanoseconds. A segment that is
+	// rewritten by a merge gets a new CreatedAt while keeping its ID.
+	CreatedAt   int64
+	SegmentSize int64
+}
+
+func (h Header) Encode() []byte {
+	buf := make([]byte, consts.SegmentHeaderSize)
+	copy(buf[0:4], segmentMagic[:])
+	binary.BigEndian.PutUint16(buf[4:6], h.Version)
+	binary.BigEndian.PutUint16(buf[6:8], h.Flags)
+	copy(buf[8:24], h.DatabaseID[:])
+	binary.BigEndian.PutUint64(buf[24:32], uint64(h.SegmentID))
+	binary.BigEndian.PutUint64(buf[32:40], uint64(h.CreatedAt))
+	binary.BigEndian.PutUint64(buf[40:48], uint64(h.SegmentSize))
+	binary.BigEndian.PutUint32(buf[60:64], crc32.ChecksumIEEE(buf[:60]))
+	return buf
+}
+
+func DecodeHeader(buf []byte) (Header, error) {
+	if len(buf) < int(consts.SegmentHeaderSize) || [4]byte(buf[0:4]) != segmentMagic {
+		return Header{}, consts.ErrorSegmentBadMagic
+	}
+	if binary.BigEndian.Uint32(buf[60:64]) != crc32.ChecksumIEEE(buf[:60]) {
+		return Header{}, consts.ErrorSegmentHeaderChecksum
+	}
+	h := Header{
+		Version:     binary.BigEndian.Uint16(buf[4:6]),
+		Flags:       binary.BigEndian.Uint16(buf[6:8]),
+		DatabaseID:  uuid.UUID(buf[8:24]),
+		SegmentID:   int64(binary.BigEndian.Uint64(buf[24:32])),
+		CreatedAt:   int64(binary.BigEndian.Uint64(buf[32:40])),
+		SegmentSize: int64(binary.BigEndian.Uint64(buf[40:48])),
+	}
+	if h.Version == 0 || h.Version > consts.SegmentFormatVersion {
+		return Header{}, fmt.Errorf("%w: %d", consts.ErrorSegmentVersion, h.Version)
+	}
+	return h, nil
+}
+
+// DataStart returns the offset of the first record in the segment.
+func (h Header) DataStart() int64 {
+	if h.Version == 0 {
+		return 0
+	}
+	return consts.SegmentHeaderSize
+}
+
+// Checksummed reports whether every record in the segment carries a checksum.
+func (h Header) Checksummed() bool {
+	return h.Version >= checksumVersion
+}
+
+// DecodeFileHeader is DecodeHeader for buf read from the start of segment
+// file fileID of size bytes. A file without the magic is accepted as a
+// version 0 segment if it starts with an empty slot or a plausible record.
+func DecodeFileHeader(buf []byte, size, fileID int64) (Header, error) {
+	h, err := DecodeHeader(buf)
+	if err != consts.ErrorSegmentBadMagic || !isLegacy(buf, size) {
+		return h, err
+	}
+	return Header{SegmentID: fileID, SegmentSize: consts.SegmentMaxSize}, nil
+}
+
+func isLegacy(buf []byte, size int64) bool {
+	if size < item.DiskKVHeaderSize || size > consts.SegmentMaxSize || int64(len(buf)) < item.DiskKVHeaderSize {
+		return false
+	}
+	if len(buf) >= int(consts.SegmentHeaderSize) {
+		// A header whose magic alone was damaged still has a valid crc.
+		fixed := append(segmentMagic[:], buf[4:60]...)
+		if binary.BigEndian.Uint32(buf[60:64]) == crc32.ChecksumIEEE(fixed) {
+			return false
+		}
+	}
+	// Records of that time carry no flags in their key size.
+	timestamp := int64(binary.BigEndian.Uint64(buf[0:8]))
+	keySize := int64(binary.BigEndian.Uint64(buf[8:16]))
+	valueSize := int64(binary.BigEndian.Uint64(buf[16:24]))
+	return timestamp >= 0 && keySize >= 0 && valueSize >= 0 &&
+		keySize <= size && valueSize <= size && item.DiskKVHeaderSize+keySize+valueSize <= size
+}
+
+// ReadHeader reads and validates the header of the segment file at path
+// without mapping it.
+func ReadHeader(path string) (Header, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Header{}, err
+	}
+	defer f.Close()
+	return readHeader(f)
+}
+
+func readHeader(r io.ReaderAt) (Header, error) {
+	buf := make([]byte, consts.SegmentHeaderSize)
+	if _, err := r.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return Header{}, err
+	}
+	return DecodeHeader(buf)
+}
+
+// readFileHeader is readHeader for segment fileID, accepting version 0.
+func readFileHeader(f *os.File, fileID int64) (Header, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return Header{}, err
+	}
+	buf := make([]byte, consts.SegmentHeaderSize)
+	n, err := f.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return Header{}, err
+	}
+	return DecodeFileHeader(buf[:n], info.Size(), fileID)
+}
+
+// validate checks that a header belongs to the expected segment of the
+// expected database. A nil dbID accepts any database, and so does a
+// version 0 segment, which does not record one.
+func (h Header) validate(fileID int64, dbID uuid.UUID) error {
+	if h.SegmentID != fileID {
+		return fmt.Errorf("%w: file is segment %d, header says %d", consts.ErrorSegmentIDMismatch, fileID, h.SegmentID)
+	}
+	if !dbID.IsNil() && h.Version != 0 && h.DatabaseID != dbID {
+		return fmt.Errorf("%w: expected %s, found %s", consts.ErrorSegmentForeignDatabase, dbID, h.DatabaseID)
+	}
+	if h.SegmentSize != consts.SegmentMaxSize {
+		return fmt.Errorf("segment %d was created with size %d, expected %d", fileID, h.SegmentSize, consts.SegmentMaxSize)
+	}
+	return nil
+}
@@ -2,14 +2,19 @@ package segment
 
 import (
 	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	mmap "github.com/edsrzf/mmap-go"
 	"github.com/sayuyere/bcask/internal/consts"
 	"github.com/sayuyere/bcask/internal/item"
+	"github.com/sayuyere/bcask/internal/logging"
+	"github.com/sayuyere/bcask/internal/uuid"
 )
 
 type Segment interface {
@@ -28,11 +33,69 @@ type FileSegment struct {
 	Path string
 	// FileID is the identifier for the segment file.
 	FileID int64
+	Header Header
 	// Segment is the segment associated with the file.
 	File   *mmap.MMap
 	Offset int64
 	OSFile *os.File
 	Lock   sync.RWMutex
+	// ReadOnly segments are mapped with mmap.RDONLY and refuse writes.
+	ReadOnly bool
+	// Logger receives segment events; nil is silent.
+	Logger *slog.Logger
+
+	reads        atomic.Uint64
+	writes       atomic.Uint64
+	bytesWritten atomic.Int64
+	// Space accounting, maintained by the database as records are written,
+	// overwritten and deleted.
+	liveBytes atomic.Int64
+	deadBytes atomic.Int64
+}
+
+// Reads returns the number of records read since the segment was opened.
+func (f *FileSegment) Reads() uint64 { return f.reads.Load() }
+
+// Writes returns the number of records appended since the segment was opened.
+func (f *FileSegment) Writes() uint64 { return f.writes.Load() }
+
+// BytesWritten returns the number of bytes appended since the segment was opened.
+func (f *FileSegment) BytesWritten() int64 { return f.bytesWritten.Load() }
+
+// LiveBytes returns the bytes of records the index still points at.
+func (f *FileSegment) LiveBytes() int64 { return f.liveBytes.Load() }
+
+// DeadBytes returns the bytes of overwritten or deleted records.
+func (f *FileSegment) DeadBytes() int64 { return f.deadBytes.Load() }
+
+// DataStart returns the offset of the first record.
+func (f *FileSegment) DataStart() int64 { return f.Header.DataStart() }
+
+// AddLive accounts for a newly written record.
+func (f *FileSegment) AddLive(n int64) { f.liveBytes.Add(n) }
+
+// MarkDead moves n bytes from live to dead.
+func (f *FileSegment) MarkDead(n int64) {
+	f.liveBytes.Add(-n)
+	f.deadBytes.Add(n)
+}
+
+// SetAccounting overwrites the live/dead byte counts, e.g. after recovery.
+func (f *FileSegment) SetAccounting(live, dead int64) {
+	f.liveBytes.Store(live)
+	f.deadBytes.Store(dead)
+}
+
+// Options controls how a segment file is opened or created.
+type Options struct {
+	// ReadOnly maps the file read-only at its current size instead of
+	// growing it to consts.SegmentMaxSize.
+	ReadOnly bool
+	Logger   *slog.Logger
+}
+
+func (f *FileSegment) log() *slog.Logger {
+	return logging.OrDiscard(f.Logger)
 }
 
 func (f *FileSegment) Get(offset int64) (item.DiskKV, error) {
@@ -41,11 +104,15 @@ func (f *FileSegment) Get(offset int64) (item.DiskKV, error) {
 	defer f.Lock.RUnlock()
 	res := item.DiskKV{}
 	res.DecodeFromMMapedFile(f.File, offset)
+	f.reads.Add(1)
 	return res, nil
 }
 func (f *FileSegment) Write(val item.DiskKV) error {
 	f.Lock.Lock()
 	defer f.Lock.Unlock()
+	if f.ReadOnly {
+		return consts.ErrorReadOnly
+	}
 	data := val.Encode()
 	mm := *f.File
 
@@ -58,12 +125,47 @@ func (f *FileSegment) Write(val item.DiskKV) error {
 		return consts.ErrorMMapIncompleteWrite
 	}
 	f.Offset += int64(len(data))
+	f.writes.Add(1)
+	f.bytesWritten.Add(int64(len(data)))
 	return nil
 }
 
+// WriteBatch appends as many of vals as fit with a single copy and returns
+// how many it wrote. It fails with consts.ErrorSegmentCapacityFull when not
+// even the first one fits.
+func (f *FileSegment) WriteBatch(vals []item.DiskKV) (int, error) {
+	f.Lock.Lock()
+	defer f.Lock.Unlock()
+	if f.ReadOnly {
+		return 0, consts.ErrorReadOnly
+	}
+	mm := *f.File
+	free := int64(len(mm)) - f.Offset
+	var data []byte
+	n := 0
+	for _, val := range vals {
+		if int64(len(data))+val.EncodedSize() > free {
+			break
+		}
+		data = append(data, val.Encode()...)
+		n++
+	}
+	if n == 0 && len(vals) > 0 {
+		return 0, consts.ErrorSegmentCapacityFull
+	}
+	copy(mm[f.Offset:], data)
+	f.Offset += int64(len(data))
+	f.writes.Add(uint64(n))
+	f.bytesWritten.Add(int64(len(data)))
+	return n, nil
+}
+
 func (f *FileSegment) WriteAt(val item.DiskKV, offset int) error {
 	f.Lock.Lock()
 	defer f.Lock.Unlock()
+	if f.ReadOnly {
+		return consts.ErrorReadOnly
+	}
 	data := val.Encode()
 	m := *f.File
 	if offset < 0 {
@@ -99,6 +201,9 @@ func (f *FileSegment) Delete(val item.MemoryItem) error {
 func (f *FileSegment) Sync() error {
 	f.Lock.RLock()
 	defer f.Lock.RUnlock()
+	if f.ReadOnly {
+		return nil
+	}
 
 	if err := f.File.Flush(); err != nil {
 		return fmt.Errorf("failed to sync segment file: %v", err)
@@ -110,65 +215,179 @@ func (f *FileSegment) GetOffset() int64 {
 	defer f.Lock.RUnlock()
 	return f.Offset
 }
-func (f *FileSegment) Close() error {
 
-	err := f.Sync()
-	if err != nil {
-		fmt.Println(err)
-	}
+// Close flushes and unmaps the segment. The mapping is released even when
+// the flush fails; the flush error is returned in that case.
+func (f *FileSegment) Close() error {
+	syncErr := f.Sync()
 	f.Lock.Lock()
 	defer f.Lock.Unlock()
 	if err := f.File.Unmap(); err != nil {
 		return fmt.Errorf("failed to close segment file: %v", err)
 	}
+	return syncErr
+}
+
+// Scan walks the records stored from offset `from` until the first empty or
+// truncated slot and calls fn for each one. It returns the offset just past
+// the last complete record. A record failing its checksum is taken for a
+// torn write when only zeroes follow it; anywhere else Scan fails with
+// consts.ErrorRecordChecksum.
+func (f *FileSegment) Scan(from int64, fn func(offset int64, kv item.DiskKV) error) (int64, error) {
+	f.Lock.RLock()
+	defer f.Lock.RUnlock()
+	mm := *f.File
+	offset := from
+	for offset+item.DiskKVHeaderSize <= int64(len(mm)) {
+		kv := item.DiskKV{}
+		kv.DecodeFromMMapedFile(f.File, offset)
+		if kv.Timestamp == 0 && kv.KeySize == 0 && kv.ValueSize == 0 {
+			break // zeroed tail of the segment
+		}
+		size := kv.EncodedSize()
+		if kv.KeySize < 0 || kv.ValueSize < 0 || offset+size > int64(len(mm)) {
+			f.log().Warn("segment scan stopped at corrupt record",
+				"segment_id", f.FileID, "offset", offset, "key_size", kv.KeySize, "value_size", kv.ValueSize)
+			break // torn or garbage record
+		}
+		if f.Header.Checksummed() && !item.ChecksumMatches(mm[offset:offset+size]) {
+			if !allZero(mm[offset+size:]) {
+				return offset, fmt.Errorf("%w: segment %d offset %d", consts.ErrorRecordChecksum, f.FileID, offset)
+			}
+			f.log().Warn("segment scan stopped at torn record",
+				"segment_id", f.FileID, "offset", offset, "key_size", kv.KeySize, "value_size", kv.ValueSize)
+			break
+		}
+		if fn != nil {
+			if err := fn(offset, kv); err != nil {
+				return offset, err
+			}
+		}
+		offset += size
+	}
+	return offset, nil
+}
+
+func allZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// SegmentPath returns the location of segment fileID inside dir.
+func SegmentPath(dir string, fileID int64) string {
+	return filepath.Join(dir, consts.SegmentPrefix+strconv.Itoa(int(fileID)))
+}
+
+// Rename moves the segment file to path. The mapping stays valid.
+func (f *FileSegment) Rename(path string) error {
+	f.Lock.Lock()
+	defer f.Lock.Unlock()
+	if err := os.Rename(f.Path, path); err != nil {
+		return err
+	}
+	f.Path = path
 	return nil
 }
 
-func OpenFileSegment(filepath_ string, fileID int64, offset int64) *FileSegment {
-	segmentLocation := filepath.Join(filepath_, consts.SegmentPrefix+strconv.Itoa(int(fileID)))
-	f, err := os.OpenFile(segmentLocation, os.O_RDWR, 0666)
+// OpenFileSegment maps an existing segment file after validating its header
+// against fileID and dbID (a nil dbID accepts any database). The write
+// offset is recovered by scanning the records, which fails on a record with
+// a bad checksum. Segments that predate the header are opened as version 0.
+func OpenFileSegment(dir string, fileID int64, dbID uuid.UUID, opts Options) (*FileSegment, error) {
+	segmentLocation := SegmentPath(dir, fileID)
+	flag, prot := os.O_RDWR, mmap.RDWR
+	if opts.ReadOnly {
+		flag, prot = os.O_RDONLY, mmap.RDONLY
+	}
+	f, err := os.OpenFile(segmentLocation, flag, 0666)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	header, err := readFileHeader(f, fileID)
+	if err == nil {
+		err = header.validate(fileID, dbID)
 	}
-	err = f.Truncate(consts.SegmentMaxSize)
 	if err != nil {
-		panic(err)
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", segmentLocation, err)
 	}
-	m, err := mmap.Map(f, os.O_RDWR, 0666)
+	if !opts.ReadOnly {
+		err = f.Truncate(consts.SegmentMaxSize)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	m, err := mmap.Map(f, prot, 0)
 	if err != nil {
-		panic(err)
+		f.Close()
+		return nil, err
 	}
-	return &FileSegment{
-		Path:   segmentLocation,
-		FileID: fileID,
-		File:   &m,
-		Offset: offset,
-		OSFile: f,
-		Lock:   sync.RWMutex{},
+	seg := &FileSegment{
+		Path:     segmentLocation,
+		FileID:   fileID,
+		Header:   header,
+		File:     &m,
+		OSFile:   f,
+		Lock:     sync.RWMutex{},
+		ReadOnly: opts.ReadOnly,
+		Logger:   opts.Logger,
+	}
+	if seg.Offset, err = seg.Scan(header.DataStart(), nil); err != nil {
+		m.Unmap()
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", segmentLocation, err)
 	}
+	seg.log().Debug("segment opened", "segment_id", fileID, "path", segmentLocation, "offset", seg.Offset, "read_only", opts.ReadOnly)
+	return seg, nil
+}
 
+// NewFileSegment creates (or truncates) a segment file and writes its header.
+func NewFileSegment(dir string, fileID int64, dbID uuid.UUID, opts Options) (*FileSegment, error) {
+	return NewFileSegmentAt(SegmentPath(dir, fileID), fileID, dbID, opts)
 }
 
-func NewFileSegment(filepath_ string, fileID int64, offset int64) *FileSegment {
-	segmentLocation := filepath.Join(filepath_, consts.SegmentPrefix+strconv.Itoa(int(fileID)))
-	fmt.Println(segmentLocation)
+// NewFileSegmentAt is NewFileSegment for an explicit file location, used to
+// build merge output next to the segment it will replace.
+func NewFileSegmentAt(segmentLocation string, fileID int64, dbID uuid.UUID, opts Options) (*FileSegment, error) {
+	if opts.ReadOnly {
+		return nil, consts.ErrorReadOnly
+	}
 	f, err := os.Create(segmentLocation)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	f.Truncate(consts.SegmentMaxSize)
+	if err := f.Truncate(consts.SegmentMaxSize); err != nil {
+		f.Close()
+		return nil, err
+	}
 	m, err := mmap.Map(f, os.O_RDWR, 0666)
 	if err != nil {
-		panic(err)
+		f.Close()
+		return nil, err
+	}
+	header := Header{
+		Version:     consts.SegmentFormatVersion,
+		DatabaseID:  dbID,
+		SegmentID:   fileID,
+		CreatedAt:   time.Now().UnixNano(),
+		SegmentSize: consts.SegmentMaxSize,
 	}
+	copy(m, header.Encode())
+	logging.OrDiscard(opts.Logger).Debug("segment created", "segment_id", fileID, "path", segmentLocation)
 	return &FileSegment{
 		Path:   segmentLocation,
 		FileID: fileID,
+		Header: header,
 		File:   &m,
-		Offset: offset,
+		Offset: consts.SegmentHeaderSize,
 		OSFile: f,
 		Lock:   sync.RWMutex{},
-	}
-
+		Logger: opts.Logger,
+	}, nil
 }
@@ -1,13 +1,17 @@
 package segment
 
 import (
+	"encoding/binary"
 	"os"
+	"path/filepath"
 	"testing"
 
 	mmap "github.com/edsrzf/mmap-go"
 	"github.com/sayuyere/bcask/internal/consts"
 	"github.com/sayuyere/bcask/internal/item"
+	"github.com/sayuyere/bcask/internal/uuid"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestFileSegment(t *testing.T) {
@@ -69,3 +73,178 @@ func TestFileSegment(t *testing.T) {
 		assert.NoError(t, err)
 	})
 }
+
+func TestFileSegmentHeader(t *testing.T) {
+	dir := t.TempDir()
+	dbID, err := uuid.New()
+	require.NoError(t, err)
+
+	seg, err := NewFileSegment(dir, 3, dbID, Options{})
+	require.NoError(t, err)
+	assert.Equal(t, consts.SegmentHeaderSize, seg.GetOffset())
+
+	records := []item.DiskKV{
+		{Key: "a", Value: "one", KeySize: 1, ValueSize: 3, Timestamp: 1},
+		{Key: "bb", Value: "two", KeySize: 2, ValueSize: 3, Timestamp: 2},
+	}
+	for _, r := range records {
+		require.NoError(t, seg.Write(r))
+	}
+	end := seg.GetOffset()
+	require.NoError(t, seg.Close())
+	require.NoError(t, seg.OSFile.Close())
+
+	t.Run("OpenRecoversHeaderAndOffset", func(t *testing.T) {
+		reopened, err := OpenFileSegment(dir, 3, dbID, Options{})
+		require.NoError(t, err)
+		defer reopened.OSFile.Close()
+		assert.Equal(t, seg.Header, reopened.Header)
+		assert.Equal(t, end, reopened.GetOffset())
+
+		var keys []string
+		_, err = reopened.Scan(consts.SegmentHeaderSize, func(offset int64, kv item.DiskKV) error {
+			keys = append(keys, kv.Key)
+			return nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"a", "bb"}, keys)
+		require.NoError(t, reopened.Close())
+	})
+
+	t.Run("RejectsForeignDatabase", func(t *testing.T) {
+		other, err := uuid.New()
+		require.NoError(t, err)
+		_, err = OpenFileSegment(dir, 3, other, Options{})
+		assert.ErrorIs(t, err, consts.ErrorSegmentForeignDatabase)
+	})
+
+	t.Run("RejectsMisnamedSegment", func(t *testing.T) {
+		require.NoError(t, os.Link(filepath.Join(dir, consts.SegmentPrefix+"3"), filepath.Join(dir, consts.SegmentPrefix+"4")))
+		_, err := OpenFileSegment(dir, 4, dbID, Options{})
+		assert.ErrorIs(t, err, consts.ErrorSegmentIDMismatch)
+	})
+
+	t.Run("RejectsGarbage", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, consts.SegmentPrefix+"5"), []byte("definitely not a segment"), 0666))
+		_, err := OpenFileSegment(dir, 5, dbID, Options{})
+		assert.ErrorIs(t, err, consts.ErrorSegmentBadMagic)
+
+		_, err = ReadHeader(filepath.Join(dir, consts.SegmentPrefix+"5"))
+		assert.ErrorIs(t, err, consts.ErrorSegmentBadMagic)
+	})
+
+	t.Run("RejectsCorruptHeader", func(t *testing.T) {
+		path := filepath.Join(dir, consts.SegmentPrefix+"6")
+		header := seg.Header
+		header.SegmentID = 6
+		data := header.Encode()
+		data[30] ^= 0xff
+		require.NoError(t, os.WriteFile(path, data, 0666))
+		_, err := OpenFileSegment(dir, 6, dbID, Options{})
+		assert.ErrorIs(t, err, consts.ErrorSegmentHeaderChecksum)
+	})
+
+	t.Run("RejectsDamagedMagic", func(t *testing.T) {
+		header := seg.Header
+		header.SegmentID = 8
+		data := make([]byte, consts.SegmentMaxSize)
+		copy(data, header.Encode())
+		data[0] = 'X'
+		require.NoError(t, os.WriteFile(filepath.Join(dir, consts.SegmentPrefix+"8"), data, 0666))
+		_, err := OpenFileSegment(dir, 8, dbID, Options{})
+		assert.ErrorIs(t, err, consts.ErrorSegmentBadMagic)
+	})
+
+	t.Run("OpensHeaderlessSegment", func(t *testing.T) {
+		kv := item.DiskKV{Key: "old", Value: "record", KeySize: 3, ValueSize: 6, Timestamp: 1700000000}
+		data := make([]byte, consts.SegmentMaxSize)
+		// Records of that time had neither flags nor a checksum.
+		binary.BigEndian.PutUint64(data[0:8], uint64(kv.Timestamp))
+		binary.BigEndian.PutUint64(data[8:16], uint64(kv.KeySize))
+		binary.BigEndian.PutUint64(data[16:24], uint64(kv.ValueSize))
+		copy(data[24:], kv.Key+kv.Value)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, consts.SegmentPrefix+"7"), data, 0666))
+
+		legacy, err := OpenFileSegment(dir, 7, dbID, Options{})
+		require.NoError(t, err)
+		defer legacy.OSFile.Close()
+		defer legacy.Close()
+		assert.Equal(t, uint16(0), legacy.Header.Version)
+		assert.Equal(t, int64(0), legacy.DataStart())
+		assert.Equal(t, kv.EncodedSize(), legacy.GetOffset())
+		got, err := legacy.Get(0)
+		require.NoError(t, err)
+		assert.Equal(t, kv, got)
+	})
+}
+
+func TestFileSegmentWriteBatch(t *testing.T) {
+	seg, err := NewFileSegment(t.TempDir(), 0, uuid.Nil, Options{})
+	require.NoError(t, err)
+	defer seg.OSFile.Close()
+	defer seg.Close()
+
+	big := string(make([]byte, consts.SegmentMaxSize/3))
+	records := []item.DiskKV{
+		{Key: "a", Value: big, KeySize: 1, ValueSize: int64(len(big)), Timestamp: 1},
+		{Key: "b", Value: big, KeySize: 1, ValueSize: int64(len(big)), Timestamp: 2},
+		{Key: "c", Value: big, KeySize: 1, ValueSize: int64(len(big)), Timestamp: 3},
+	}
+	n, err := seg.WriteBatch(records)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n, "the third record does not fit next to the header")
+	assert.Equal(t, consts.SegmentHeaderSize+2*records[0].EncodedSize(), seg.GetOffset())
+
+	got, err := seg.Get(consts.SegmentHeaderSize + records[0].EncodedSize())
+	require.NoError(t, err)
+	assert.Equal(t, records[1], got)
+
+	_, err = seg.WriteBatch(records[2:])
+	assert.ErrorIs(t, err, consts.ErrorSegmentCapacityFull)
+}
+
+func TestFileSegmentChecksum(t *testing.T) {
+	dir := t.TempDir()
+	dbID, err := uuid.New()
+	require.NoError(t, err)
+	seg, err := NewFileSegment(dir, 0, dbID, Options{})
+	require.NoError(t, err)
+	records := []item.DiskKV{
+		{Key: "a", Value: "first", KeySize: 1, ValueSize: 5, Timestamp: 1},
+		{Key: "b", Value: "second", KeySize: 1, ValueSize: 6, Timestamp: 2},
+	}
+	_, err = seg.WriteBatch(records)
+	require.NoError(t, err)
+	assert.True(t, seg.Header.Checksummed())
+	require.NoError(t, seg.Close())
+	require.NoError(t, seg.OSFile.Close())
+
+	flip := func(offset int64) {
+		f, err := os.OpenFile(SegmentPath(dir, 0), os.O_RDWR, 0)
+		require.NoError(t, err)
+		defer f.Close()
+		b := make([]byte, 1)
+		_, err = f.ReadAt(b, offset)
+		require.NoError(t, err)
+		b[0] ^= 0x01
+		_, err = f.WriteAt(b, offset)
+		require.NoError(t, err)
+	}
+	second := consts.SegmentHeaderSize + records[0].EncodedSize()
+
+	t.Run("TornLastRecordEndsTheScan", func(t *testing.T) {
+		flip(second + records[1].EncodedSize() - 1)
+		defer flip(second + records[1].EncodedSize() - 1)
+		reopened, err := OpenFileSegment(dir, 0, dbID, Options{ReadOnly: true})
+		require.NoError(t, err)
+		defer reopened.OSFile.Close()
+		defer reopened.Close()
+		assert.Equal(t, second, reopened.GetOffset())
+	})
+
+	t.Run("CorruptRecordFailsTheOpen", func(t *testing.T) {
+		flip(second - 1)
+		_, err := OpenFileSegment(dir, 0, dbID, Options{ReadOnly: true})
+		assert.ErrorIs(t, err, consts.ErrorRecordChecksum)
+	})
+}
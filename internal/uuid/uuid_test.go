@@ -0,0 +1,31 @@
+package uuid
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUUID(t *testing.T) {
+	t.Run("New", func(t *testing.T) {
+		a, err := New()
+		require.NoError(t, err)
+		b, err := New()
+		require.NoError(t, err)
+		assert.False(t, a.IsNil())
+		assert.NotEqual(t, a, b)
+		assert.Equal(t, byte(0x40), a[6]&0xf0)
+	})
+
+	t.Run("StringParseRoundTrip", func(t *testing.T) {
+		a, err := New()
+		require.NoError(t, err)
+		parsed, err := Parse(a.String())
+		require.NoError(t, err)
+		assert.Equal(t, a, parsed)
+
+		_, err = Parse("not-a-uuid")
+		assert.Error(t, err)
+	})
+}